@@ -0,0 +1,289 @@
+package autoconfig
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strings"
+	"text/template"
+
+	"github.com/funnydog/mailadmin/core/config"
+)
+
+// socket types of the servers, named after the Mozilla format
+const (
+	SSL      = "SSL"
+	STARTTLS = "STARTTLS"
+)
+
+// default ports of the servers when the configuration doesn't set one
+const (
+	DefaultIMAPPort = 993
+	DefaultSMTPPort = 587
+)
+
+// Settings are the IMAP and SMTP servers the mail clients connect to,
+// the users sign in with their email address.
+type Settings struct {
+	IMAPHost   string
+	IMAPPort   int
+	IMAPSocket string
+	SMTPHost   string
+	SMTPPort   int
+	SMTPSocket string
+}
+
+type ErrSocketNotSupported string
+
+func (sn ErrSocketNotSupported) Error() string {
+	return fmt.Sprintf("The socket type '%s' is not supported, use SSL or STARTTLS", string(sn))
+}
+
+// New returns the settings of the configuration or nil if the IMAP
+// host is not set, in which case the autoconfiguration is disabled.
+func New(conf *config.Configuration) (*Settings, error) {
+	if conf.IMAPHost == "" {
+		return nil, nil
+	}
+
+	s := Settings{
+		IMAPHost:   conf.IMAPHost,
+		IMAPPort:   conf.IMAPPort,
+		IMAPSocket: strings.ToUpper(conf.IMAPSocket),
+		SMTPHost:   conf.SMTPHost,
+		SMTPPort:   conf.SMTPPort,
+		SMTPSocket: strings.ToUpper(conf.SMTPSocket),
+	}
+	if s.IMAPPort == 0 {
+		s.IMAPPort = DefaultIMAPPort
+	}
+	if s.IMAPSocket == "" {
+		s.IMAPSocket = SSL
+	}
+	if s.SMTPHost == "" {
+		s.SMTPHost = s.IMAPHost
+	}
+	if s.SMTPPort == 0 {
+		s.SMTPPort = DefaultSMTPPort
+	}
+	if s.SMTPSocket == "" {
+		s.SMTPSocket = STARTTLS
+	}
+
+	for _, socket := range []string{s.IMAPSocket, s.SMTPSocket} {
+		if socket != SSL && socket != STARTTLS {
+			return nil, ErrSocketNotSupported(socket)
+		}
+	}
+	return &s, nil
+}
+
+// Domain returns the domain part of the address, empty if it isn't an
+// address.
+func Domain(email string) string {
+	if i := strings.LastIndex(email, "@"); i > 0 {
+		return strings.ToLower(email[i+1:])
+	}
+	return ""
+}
+
+func render(tmpl *template.Template, data interface{}) ([]byte, error) {
+	var b bytes.Buffer
+	b.WriteString(xml.Header)
+	if err := tmpl.Execute(&b, data); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+func escape(s string) string {
+	var b strings.Builder
+	_ = xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
+
+var funcs = template.FuncMap{"xml": escape}
+
+var mozillaTemplate = template.Must(template.New("mozilla").Funcs(funcs).Parse(
+	`<clientConfig version="1.1">
+  <emailProvider id="{{ xml .Domain }}">
+    <domain>{{ xml .Domain }}</domain>
+    <displayName>{{ xml .Domain }}</displayName>
+    <displayShortName>{{ xml .Domain }}</displayShortName>
+    <incomingServer type="imap">
+      <hostname>{{ xml .IMAPHost }}</hostname>
+      <port>{{ .IMAPPort }}</port>
+      <socketType>{{ .IMAPSocket }}</socketType>
+      <authentication>password-cleartext</authentication>
+      <username>%EMAILADDRESS%</username>
+    </incomingServer>
+    <outgoingServer type="smtp">
+      <hostname>{{ xml .SMTPHost }}</hostname>
+      <port>{{ .SMTPPort }}</port>
+      <socketType>{{ .SMTPSocket }}</socketType>
+      <authentication>password-cleartext</authentication>
+      <username>%EMAILADDRESS%</username>
+    </outgoingServer>
+  </emailProvider>
+</clientConfig>
+`))
+
+// Mozilla returns the config-v1.1.xml of the domain read by Thunderbird
+// and the clients following its autoconfiguration.
+func (s *Settings) Mozilla(domain string) ([]byte, error) {
+	return render(mozillaTemplate, struct {
+		*Settings
+		Domain string
+	}{s, domain})
+}
+
+var outlookTemplate = template.Must(template.New("outlook").Funcs(funcs).Parse(
+	`<Autodiscover xmlns="http://schemas.microsoft.com/exchange/autodiscover/responseschema/2006">
+  <Response xmlns="http://schemas.microsoft.com/exchange/autodiscover/outlook/responseschema/2006a">
+    <Account>
+      <AccountType>email</AccountType>
+      <Action>settings</Action>
+      <Protocol>
+        <Type>IMAP</Type>
+        <Server>{{ xml .IMAPHost }}</Server>
+        <Port>{{ .IMAPPort }}</Port>
+        <DomainRequired>off</DomainRequired>
+        <LoginName>{{ xml .Email }}</LoginName>
+        <SPA>off</SPA>
+        <SSL>on</SSL>{{ if eq .IMAPSocket "STARTTLS" }}
+        <Encryption>TLS</Encryption>{{ end }}
+        <AuthRequired>on</AuthRequired>
+      </Protocol>
+      <Protocol>
+        <Type>SMTP</Type>
+        <Server>{{ xml .SMTPHost }}</Server>
+        <Port>{{ .SMTPPort }}</Port>
+        <DomainRequired>off</DomainRequired>
+        <LoginName>{{ xml .Email }}</LoginName>
+        <SPA>off</SPA>
+        <SSL>on</SSL>{{ if eq .SMTPSocket "STARTTLS" }}
+        <Encryption>TLS</Encryption>{{ end }}
+        <AuthRequired>on</AuthRequired>
+        <UsePOPAuth>on</UsePOPAuth>
+      </Protocol>
+    </Account>
+  </Response>
+</Autodiscover>
+`))
+
+// Outlook returns the autodiscover.xml of the address.
+func (s *Settings) Outlook(email string) ([]byte, error) {
+	return render(outlookTemplate, struct {
+		*Settings
+		Email string
+	}{s, email})
+}
+
+// ReadOutlookRequest returns the address of the autodiscover request
+// posted by Outlook.
+func ReadOutlookRequest(r io.Reader) (string, error) {
+	request := struct {
+		EMailAddress string `xml:"Request>EMailAddress"`
+	}{}
+	if err := xml.NewDecoder(io.LimitReader(r, 1<<16)).Decode(&request); err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(request.EMailAddress), nil
+}
+
+var appleTemplate = template.Must(template.New("apple").Funcs(funcs).Parse(
+	`<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+<plist version="1.0">
+<dict>
+  <key>PayloadContent</key>
+  <array>
+    <dict>
+      <key>EmailAccountDescription</key>
+      <string>{{ xml .Email }}</string>
+      <key>EmailAccountName</key>
+      <string>{{ xml .Email }}</string>
+      <key>EmailAccountType</key>
+      <string>EmailTypeIMAP</string>
+      <key>EmailAddress</key>
+      <string>{{ xml .Email }}</string>
+      <key>IncomingMailServerAuthentication</key>
+      <string>EmailAuthPassword</string>
+      <key>IncomingMailServerHostName</key>
+      <string>{{ xml .IMAPHost }}</string>
+      <key>IncomingMailServerPortNumber</key>
+      <integer>{{ .IMAPPort }}</integer>
+      <key>IncomingMailServerUseSSL</key>
+      <true/>
+      <key>IncomingMailServerUsername</key>
+      <string>{{ xml .Email }}</string>
+      <key>OutgoingMailServerAuthentication</key>
+      <string>EmailAuthPassword</string>
+      <key>OutgoingMailServerHostName</key>
+      <string>{{ xml .SMTPHost }}</string>
+      <key>OutgoingMailServerPortNumber</key>
+      <integer>{{ .SMTPPort }}</integer>
+      <key>OutgoingMailServerUseSSL</key>
+      <true/>
+      <key>OutgoingMailServerUsername</key>
+      <string>{{ xml .Email }}</string>
+      <key>OutgoingPasswordSameAsIncomingPassword</key>
+      <true/>
+      <key>PayloadDisplayName</key>
+      <string>{{ xml .Email }}</string>
+      <key>PayloadIdentifier</key>
+      <string>{{ xml .Identifier }}.account</string>
+      <key>PayloadType</key>
+      <string>com.apple.mail.managed</string>
+      <key>PayloadUUID</key>
+      <string>{{ .AccountUUID }}</string>
+      <key>PayloadVersion</key>
+      <integer>1</integer>
+    </dict>
+  </array>
+  <key>PayloadDisplayName</key>
+  <string>Mail account {{ xml .Email }}</string>
+  <key>PayloadIdentifier</key>
+  <string>{{ xml .Identifier }}</string>
+  <key>PayloadType</key>
+  <string>Configuration</string>
+  <key>PayloadUUID</key>
+  <string>{{ .UUID }}</string>
+  <key>PayloadVersion</key>
+  <integer>1</integer>
+</dict>
+</plist>
+`))
+
+// uuid returns a name based UUID, the profile of an address keeps the
+// same identifiers and replaces the one installed before.
+func uuid(name string) string {
+	sum := sha1.Sum([]byte(name))
+	sum[6] = sum[6]&0x0f | 0x50
+	sum[8] = sum[8]&0x3f | 0x80
+	return fmt.Sprintf("%X-%X-%X-%X-%X", sum[0:4], sum[4:6], sum[6:8], sum[8:10], sum[10:16])
+}
+
+// Apple returns the .mobileconfig profile of the address for iOS and
+// macOS, the password is asked during the installation.
+func (s *Settings) Apple(email string) ([]byte, error) {
+	// the identifier is in reverse DNS notation
+	labels := strings.Split(Domain(email), ".")
+	for i, j := 0, len(labels)-1; i < j; i, j = i+1, j-1 {
+		labels[i], labels[j] = labels[j], labels[i]
+	}
+	local := email
+	if i := strings.LastIndex(email, "@"); i >= 0 {
+		local = email[:i]
+	}
+	identifier := strings.Join(labels, ".") + ".mail." + local
+
+	return render(appleTemplate, struct {
+		*Settings
+		Email       string
+		Identifier  string
+		UUID        string
+		AccountUUID string
+	}{s, email, identifier, uuid(identifier), uuid(identifier + ".account")})
+}
@@ -0,0 +1,121 @@
+package autoconfig
+
+import (
+	"encoding/xml"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/funnydog/mailadmin/core/config"
+)
+
+func testingSettings(t *testing.T) *Settings {
+	s, err := New(&config.Configuration{IMAPHost: "mail.example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestNew(t *testing.T) {
+	if s, err := New(&config.Configuration{}); s != nil || err != nil {
+		t.Errorf("Unexpected settings %v, %v", s, err)
+	}
+
+	s := testingSettings(t)
+	if s.SMTPHost != "mail.example.com" || s.IMAPPort != DefaultIMAPPort || s.SMTPPort != DefaultSMTPPort ||
+		s.IMAPSocket != SSL || s.SMTPSocket != STARTTLS {
+		t.Errorf("Unexpected settings %+v", s)
+	}
+
+	if _, err := New(&config.Configuration{IMAPHost: "mail.example.com", SMTPSocket: "plain"}); err == nil {
+		t.Error("The plain socket has been accepted")
+	}
+}
+
+func TestMozilla(t *testing.T) {
+	content, err := testingSettings(t).Mozilla("example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parsed := struct {
+		Domain   string `xml:"emailProvider>domain"`
+		Incoming struct {
+			Hostname string `xml:"hostname"`
+			Port     int    `xml:"port"`
+			Socket   string `xml:"socketType"`
+		} `xml:"emailProvider>incomingServer"`
+		Outgoing struct {
+			Port   int    `xml:"port"`
+			Socket string `xml:"socketType"`
+		} `xml:"emailProvider>outgoingServer"`
+	}{}
+	if err = xml.Unmarshal(content, &parsed); err != nil {
+		t.Fatal(err)
+	}
+	if parsed.Domain != "example.com" || parsed.Incoming.Hostname != "mail.example.com" ||
+		parsed.Incoming.Port != 993 || parsed.Incoming.Socket != SSL ||
+		parsed.Outgoing.Port != 587 || parsed.Outgoing.Socket != STARTTLS {
+		t.Errorf("Unexpected configuration %+v", parsed)
+	}
+}
+
+func TestOutlook(t *testing.T) {
+	email, err := ReadOutlookRequest(strings.NewReader(`<?xml version="1.0" encoding="utf-8"?>
+<Autodiscover xmlns="http://schemas.microsoft.com/exchange/autodiscover/outlook/requestschema/2006">
+  <Request>
+    <EMailAddress>test@example.com</EMailAddress>
+    <AcceptableResponseSchema>http://schemas.microsoft.com/exchange/autodiscover/outlook/responseschema/2006a</AcceptableResponseSchema>
+  </Request>
+</Autodiscover>`))
+	if err != nil {
+		t.Fatal(err)
+	} else if email != "test@example.com" {
+		t.Fatalf("Unexpected address %s", email)
+	}
+
+	content, err := testingSettings(t).Outlook("a&b@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed := struct {
+		Protocols []struct {
+			Type      string
+			Port      int
+			LoginName string
+		} `xml:"Response>Account>Protocol"`
+	}{}
+	if err = xml.Unmarshal(content, &parsed); err != nil {
+		t.Fatal(err)
+	}
+	if len(parsed.Protocols) != 2 || parsed.Protocols[0].Type != "IMAP" ||
+		parsed.Protocols[1].Port != 587 || parsed.Protocols[1].LoginName != "a&b@example.com" {
+		t.Errorf("Unexpected response %+v", parsed)
+	}
+}
+
+func TestApple(t *testing.T) {
+	s := testingSettings(t)
+	content, err := s.Apple("test@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the profile is well formed and stable
+	decoder := xml.NewDecoder(strings.NewReader(string(content)))
+	for {
+		if _, err = decoder.Token(); err != nil {
+			break
+		}
+	}
+	if err != io.EOF {
+		t.Fatal(err)
+	}
+	if again, _ := s.Apple("test@example.com"); string(again) != string(content) {
+		t.Error("The profile changes at every download")
+	}
+	if !strings.Contains(string(content), "<string>com.example.mail.test</string>") {
+		t.Error("The profile has an unexpected identifier")
+	}
+}
@@ -0,0 +1,712 @@
+package backup
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/funnydog/mailadmin/core/db"
+	"github.com/funnydog/mailadmin/core/form"
+	"github.com/funnydog/mailadmin/dkim"
+	"github.com/funnydog/mailadmin/mtasts"
+	"github.com/funnydog/mailadmin/types"
+)
+
+// Version of the document written by Export, bump it whenever the
+// format changes: the older versions refuse the fields they don't know.
+//
+//	1 domains, mailboxes and aliases
+//	2 transport of the domains
+//	3 expiry of the aliases
+//	4 recovery address of the mailboxes
+//	5 DKIM keys of the domains
+//	6 MTA-STS policies of the domains
+//	7 send-as grants of the mailboxes
+//	8 BCC rules of the domains and mailboxes
+//	9 access rules of the domains
+const Version = 9
+
+var (
+	errDryRun  = errors.New("dry run")
+	emailField = form.EmailField{Required: true}
+)
+
+type ErrVersionNotSupported int
+
+func (vn ErrVersionNotSupported) Error() string {
+	return fmt.Sprintf("Document version %d is not supported", int(vn))
+}
+
+type Mailbox struct {
+	Email    string    `json:"email"`
+	Password string    `json:"password"`
+	Recovery string    `json:"recovery,omitempty"`
+	SendAs   []string  `json:"send_as,omitempty"`
+	Active   bool      `json:"active"`
+	Created  time.Time `json:"created"`
+	Modified time.Time `json:"modified"`
+}
+
+type Alias struct {
+	Destination string     `json:"destination"`
+	RedirectTo  string     `json:"redirect_to"`
+	Active      bool       `json:"active"`
+	Expires     *time.Time `json:"expires,omitempty"`
+	Created     time.Time  `json:"created"`
+	Modified    time.Time  `json:"modified"`
+}
+
+type DKIMKey struct {
+	Selector   string    `json:"selector"`
+	Algorithm  string    `json:"algorithm"`
+	PrivateKey string    `json:"private_key"`
+	PublicKey  string    `json:"public_key"`
+	Active     bool      `json:"active"`
+	Signing    bool      `json:"signing"`
+	Created    time.Time `json:"created"`
+}
+
+type MTASTS struct {
+	Mode      string    `json:"mode"`
+	MX        []string  `json:"mx"`
+	MaxAge    int64     `json:"max_age"`
+	ReportURI string    `json:"report_uri"`
+	Modified  time.Time `json:"modified"`
+}
+
+// BCC is a rule of the domain, or of its mailbox when Mailbox is set.
+type BCC struct {
+	Mailbox string `json:"mailbox,omitempty"`
+	Kind    string `json:"kind"`
+	Address string `json:"address"`
+}
+
+type AccessRule struct {
+	Kind    string `json:"kind"`
+	Pattern string `json:"pattern"`
+	Action  string `json:"action"`
+	Message string `json:"message,omitempty"`
+}
+
+type Domain struct {
+	Name        string       `json:"name"`
+	Description string       `json:"description"`
+	BackupMX    bool         `json:"backupmx"`
+	Transport   string       `json:"transport,omitempty"`
+	Active      bool         `json:"active"`
+	Created     time.Time    `json:"created"`
+	Modified    time.Time    `json:"modified"`
+	Mailboxes   []Mailbox    `json:"mailboxes"`
+	Aliases     []Alias      `json:"aliases"`
+	DKIMKeys    []DKIMKey    `json:"dkim_keys,omitempty"`
+	MTASTS      *MTASTS      `json:"mta_sts,omitempty"`
+	BCC         []BCC        `json:"bcc,omitempty"`
+	AccessRules []AccessRule `json:"access_rules,omitempty"`
+}
+
+// Document is the JSON representation of one or more domains with
+// their mailboxes, aliases, password hashes and private DKIM keys.
+type Document struct {
+	Version  int       `json:"version"`
+	Exported time.Time `json:"exported"`
+	Domains  []Domain  `json:"domains"`
+}
+
+// Stats counts the records changed by Import.
+type Stats struct {
+	Created   int
+	Updated   int
+	Unchanged int
+
+	// the mailboxes created, to make their Maildirs
+	Mailboxes []types.Mailbox
+}
+
+func (s Stats) String() string {
+	return fmt.Sprintf("%d created, %d updated, %d unchanged", s.Created, s.Updated, s.Unchanged)
+}
+
+func (s *Stats) count(created, changed bool) {
+	if created {
+		s.Created++
+	} else if changed {
+		s.Updated++
+	} else {
+		s.Unchanged++
+	}
+}
+
+// Export builds the document of the given domains.
+func Export(db db.Querier, domains []types.Domain) (Document, error) {
+	doc := Document{
+		Version:  Version,
+		Exported: time.Now(),
+		Domains:  []Domain{},
+	}
+
+	for _, d := range domains {
+		domain := Domain{
+			Name:        d.Name,
+			Description: d.Description,
+			BackupMX:    d.BackupMX,
+			Transport:   d.Transport,
+			Active:      d.Active,
+			Created:     d.Created,
+			Modified:    d.Modified,
+			Mailboxes:   []Mailbox{},
+			Aliases:     []Alias{},
+		}
+
+		mailboxes, err := types.GetMailboxList(db, d.Id.Int64)
+		if err != nil {
+			return doc, err
+		}
+		for _, m := range mailboxes {
+			sendAs, err := types.GetSendAs(db, m.Id.Int64)
+			if err != nil {
+				return doc, err
+			}
+			domain.Mailboxes = append(domain.Mailboxes, Mailbox{
+				Email:    m.Email,
+				Password: m.Password,
+				Recovery: m.Recovery,
+				SendAs:   sendAs,
+				Active:   m.Active,
+				Created:  m.Created,
+				Modified: m.Modified,
+			})
+		}
+
+		aliases, err := types.GetAliasList(db, d.Id.Int64)
+		if err != nil {
+			return doc, err
+		}
+		for _, a := range aliases {
+			alias := Alias{
+				Destination: a.Destination,
+				RedirectTo:  a.RedirectTo,
+				Active:      a.Active,
+				Created:     a.Created,
+				Modified:    a.Modified,
+			}
+			if a.Expires.Valid {
+				expires := a.Expires.Time
+				alias.Expires = &expires
+			}
+			domain.Aliases = append(domain.Aliases, alias)
+		}
+
+		keys, err := types.GetDKIMKeys(db, d.Id.Int64)
+		if err != nil {
+			return doc, err
+		}
+		for _, k := range keys {
+			domain.DKIMKeys = append(domain.DKIMKeys, DKIMKey{
+				Selector:   k.Selector,
+				Algorithm:  k.Algorithm,
+				PrivateKey: k.PrivateKey,
+				PublicKey:  k.PublicKey,
+				Active:     k.Active,
+				Signing:    k.Signing,
+				Created:    k.Created,
+			})
+		}
+
+		policy, err := types.GetMTASTS(db, d.Id.Int64)
+		if err == nil {
+			domain.MTASTS = &MTASTS{
+				Mode:      policy.Mode,
+				MX:        policy.MX,
+				MaxAge:    policy.MaxAge,
+				ReportURI: policy.ReportURI,
+				Modified:  policy.Modified,
+			}
+		} else if err != sql.ErrNoRows {
+			return doc, err
+		}
+
+		rules, err := types.GetBCCs(db, d.Id.Int64)
+		if err != nil {
+			return doc, err
+		}
+		for _, b := range rules {
+			domain.BCC = append(domain.BCC, BCC{
+				Mailbox: b.Email,
+				Kind:    b.Kind,
+				Address: b.Address,
+			})
+		}
+
+		access, err := types.GetAccessRules(db, d.Id.Int64)
+		if err != nil {
+			return doc, err
+		}
+		for _, r := range access {
+			domain.AccessRules = append(domain.AccessRules, AccessRule{
+				Kind:    r.Kind,
+				Pattern: r.Pattern,
+				Action:  r.Action,
+				Message: r.Message,
+			})
+		}
+
+		doc.Domains = append(doc.Domains, domain)
+	}
+
+	return doc, nil
+}
+
+// ExportAll builds the document of every domain.
+func ExportAll(db db.Querier) (Document, error) {
+	domains, err := types.GetDomainList(db)
+	if err != nil {
+		return Document{}, err
+	}
+	return Export(db, domains)
+}
+
+func (doc *Document) Write(out io.Writer) error {
+	encoder := json.NewEncoder(out)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(doc)
+}
+
+// Read decodes a document checking its version.
+func Read(in io.Reader) (Document, error) {
+	doc := Document{}
+
+	data, err := io.ReadAll(in)
+	if err != nil {
+		return doc, err
+	}
+
+	// the version first, a newer document has unknown fields
+	header := struct {
+		Version int `json:"version"`
+	}{}
+	if err = json.Unmarshal(data, &header); err != nil {
+		return doc, err
+	}
+	if header.Version < 1 || header.Version > Version {
+		return doc, ErrVersionNotSupported(header.Version)
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	err = decoder.Decode(&doc)
+	return doc, err
+}
+
+// Import recreates the domains of the document in a single
+// transaction. The records already present are matched by domain name,
+// mailbox email and alias addresses and updated only if they differ,
+// so that importing the same document twice changes nothing. With
+// dryRun the transaction is always rolled back.
+func Import(database *db.Database, doc Document, dryRun bool) (Stats, error) {
+	stats := Stats{}
+
+	err := database.WithTx(func(tx *db.Tx) error {
+		for _, d := range doc.Domains {
+			if err := importDomain(tx, d, &stats); err != nil {
+				return fmt.Errorf("Domain %s: %w", d.Name, err)
+			}
+		}
+
+		// the grants last, they may name the domains imported after theirs
+		for _, d := range doc.Domains {
+			for _, m := range d.Mailboxes {
+				if err := importSendAs(tx, m, &stats); err != nil {
+					return fmt.Errorf("Mailbox %s: %w", m.Email, err)
+				}
+			}
+		}
+
+		if dryRun {
+			return errDryRun
+		}
+		return nil
+	})
+
+	if err == errDryRun {
+		err = nil
+		stats.Mailboxes = nil
+	}
+	return stats, err
+}
+
+func importDomain(tx *db.Tx, d Domain, stats *Stats) error {
+	if d.Name == "" {
+		return errors.New("The domain name cannot be empty")
+	}
+
+	domain, err := types.GetDomainByName(tx, d.Name)
+	created := err == sql.ErrNoRows
+	if err != nil && !created {
+		return err
+	}
+
+	changed := domain.Description != d.Description ||
+		domain.BackupMX != d.BackupMX ||
+		domain.Transport != d.Transport ||
+		domain.Active != d.Active
+	domain.Name = d.Name
+	domain.Description = d.Description
+	domain.BackupMX = d.BackupMX
+	domain.Transport = d.Transport
+	domain.Active = d.Active
+
+	if created {
+		err = domain.Create(tx)
+	} else if changed {
+		err = domain.Update(tx)
+	}
+	if err != nil {
+		return err
+	}
+	stats.count(created, changed)
+
+	for _, m := range d.Mailboxes {
+		if err := importMailbox(tx, domain, m, stats); err != nil {
+			return fmt.Errorf("Mailbox %s: %w", m.Email, err)
+		}
+	}
+
+	for _, a := range d.Aliases {
+		if err := importAlias(tx, domain, a, stats); err != nil {
+			return fmt.Errorf("Alias %s: %w", a.Destination, err)
+		}
+	}
+
+	// oldest first, the keys are created in their order
+	for i := len(d.DKIMKeys) - 1; i >= 0; i-- {
+		k := d.DKIMKeys[i]
+		if err := importDKIMKey(tx, domain, k, stats); err != nil {
+			return fmt.Errorf("DKIM key %s: %w", k.Selector, err)
+		}
+	}
+
+	if d.MTASTS != nil {
+		if err := importMTASTS(tx, domain, *d.MTASTS, stats); err != nil {
+			return fmt.Errorf("MTA-STS policy: %w", err)
+		}
+	}
+
+	for _, b := range d.BCC {
+		if err := importBCC(tx, domain, b, stats); err != nil {
+			return fmt.Errorf("BCC rule %s: %w", b.Address, err)
+		}
+	}
+
+	for _, r := range d.AccessRules {
+		if err := importAccessRule(tx, domain, r, stats); err != nil {
+			return fmt.Errorf("Access rule %s: %w", r.Pattern, err)
+		}
+	}
+	return nil
+}
+
+func importMailbox(tx *db.Tx, domain types.Domain, m Mailbox, stats *Stats) error {
+	if !domain.Contains(m.Email) {
+		return fmt.Errorf("The address doesn't end with @%s", domain.Name)
+	} else if m.Password == "" {
+		return errors.New("The password hash cannot be empty")
+	}
+
+	mailbox, err := types.GetMailboxByEmail(tx, m.Email)
+	created := err == sql.ErrNoRows
+	if err != nil && !created {
+		return err
+	}
+
+	changed := mailbox.Domain != domain.Id ||
+		mailbox.Password != m.Password ||
+		mailbox.Recovery != m.Recovery ||
+		mailbox.Active != m.Active
+	mailbox.Domain = domain.Id
+	mailbox.Email = m.Email
+	mailbox.Password = m.Password
+	mailbox.Recovery = m.Recovery
+	mailbox.Active = m.Active
+
+	if created {
+		err = mailbox.Create(tx)
+		stats.Mailboxes = append(stats.Mailboxes, mailbox)
+	} else if changed {
+		err = mailbox.Update(tx)
+	}
+	if err != nil {
+		return err
+	}
+	stats.count(created, changed)
+	return nil
+}
+
+// importSendAs adds the grants missing from the mailbox, each grant
+// is counted as a record.
+func importSendAs(tx *db.Tx, m Mailbox, stats *Stats) error {
+	if len(m.SendAs) == 0 {
+		return nil
+	}
+
+	mailbox, err := types.GetMailboxByEmail(tx, m.Email)
+	if err != nil {
+		return err
+	}
+	addresses, err := types.GetSendAs(tx, mailbox.Id.Int64)
+	if err != nil {
+		return err
+	}
+	granted := map[string]bool{}
+	for _, address := range addresses {
+		granted[address] = true
+	}
+
+	n := len(addresses)
+	for _, address := range m.SendAs {
+		if err = types.ValidSendAs(tx, address); err != nil {
+			return err
+		}
+		created := !granted[address]
+		if created {
+			granted[address] = true
+			addresses = append(addresses, address)
+		}
+		stats.count(created, false)
+	}
+
+	if len(addresses) > n {
+		return types.SetSendAs(tx, mailbox.Id.Int64, addresses)
+	}
+	return nil
+}
+
+func importAlias(tx *db.Tx, domain types.Domain, a Alias, stats *Stats) error {
+	if !domain.Contains(a.Destination) {
+		return fmt.Errorf("The address doesn't end with @%s", domain.Name)
+	} else if a.RedirectTo == "" {
+		return errors.New("The redirect_to address cannot be empty")
+	}
+
+	alias, err := types.GetAliasByAddress(tx, domain.Id.Int64, a.Destination, a.RedirectTo)
+	created := err == sql.ErrNoRows
+	if err != nil && !created {
+		return err
+	}
+
+	expires := sql.NullTime{}
+	if a.Expires != nil {
+		expires = sql.NullTime{Time: *a.Expires, Valid: true}
+	}
+
+	changed := alias.Active != a.Active || alias.Expires.Valid != expires.Valid ||
+		(expires.Valid && !alias.Expires.Time.Equal(expires.Time))
+	alias.Domain = domain.Id
+	alias.Destination = a.Destination
+	alias.RedirectTo = a.RedirectTo
+	alias.Active = a.Active
+	alias.Expires = expires
+
+	if created {
+		err = alias.Create(tx)
+	} else if changed {
+		err = alias.Update(tx)
+	}
+	if err != nil {
+		return err
+	}
+	stats.count(created, changed)
+	return nil
+}
+
+// importDKIMKey creates the key missing from the domain, the key of a
+// selector already there must be the same: once published it cannot
+// change without breaking the signatures in transit.
+func importDKIMKey(tx *db.Tx, domain types.Domain, k DKIMKey, stats *Stats) error {
+	if err := dkim.ValidSelector(k.Selector); err != nil {
+		return err
+	} else if k.PrivateKey == "" || k.PublicKey == "" {
+		return errors.New("The keys cannot be empty")
+	}
+
+	keys, err := types.GetDKIMKeys(tx, domain.Id.Int64)
+	if err != nil {
+		return err
+	}
+	key := types.DKIMKey{Domain: domain.Id}
+	created := true
+	for _, other := range keys {
+		if other.Selector == k.Selector {
+			key, created = other, false
+			break
+		}
+	}
+
+	if created {
+		key.Selector = k.Selector
+		key.Algorithm = k.Algorithm
+		key.PrivateKey = k.PrivateKey
+		key.PublicKey = k.PublicKey
+		key.Active = k.Active
+		err = key.Create(tx)
+	} else if key.PrivateKey != k.PrivateKey || key.Algorithm != k.Algorithm {
+		return errors.New("The selector has another key already")
+	}
+	if err != nil {
+		return err
+	}
+
+	changed := key.Active != k.Active || (k.Signing && !key.Signing)
+	if key.Active != k.Active {
+		if err = key.SetActive(tx, k.Active); err != nil {
+			return err
+		}
+	}
+	if k.Signing && !key.Signing {
+		err = key.Promote(tx)
+	}
+	if err != nil {
+		return err
+	}
+	stats.count(created, changed)
+	return nil
+}
+
+// importMTASTS restores the policy with its modification time, the id
+// of the record published in the DNS.
+func importMTASTS(tx *db.Tx, domain types.Domain, p MTASTS, stats *Stats) error {
+	if p.Mode != mtasts.Enforce && p.Mode != mtasts.Testing && p.Mode != mtasts.None {
+		return fmt.Errorf("Unknown mode '%s'", p.Mode)
+	} else if p.MaxAge < mtasts.MinMaxAge || p.MaxAge > mtasts.MaxMaxAge {
+		return fmt.Errorf("The max age must be between %d and %d seconds", mtasts.MinMaxAge, mtasts.MaxMaxAge)
+	} else if err := mtasts.ValidReportURI(p.ReportURI); err != nil {
+		return err
+	}
+	mx, err := mtasts.ParseMX(strings.Join(p.MX, " "))
+	if err != nil {
+		return err
+	}
+
+	policy, err := types.GetMTASTS(tx, domain.Id.Int64)
+	created := err == sql.ErrNoRows
+	if err != nil && !created {
+		return err
+	}
+
+	changed := policy.Mode != p.Mode ||
+		strings.Join(policy.MX, " ") != strings.Join(mx, " ") ||
+		policy.MaxAge != p.MaxAge ||
+		policy.ReportURI != p.ReportURI ||
+		!policy.Modified.Equal(p.Modified)
+	policy.Domain = domain.Id
+	policy.Mode = p.Mode
+	policy.MX = mx
+	policy.MaxAge = p.MaxAge
+	policy.ReportURI = p.ReportURI
+	policy.Modified = p.Modified
+
+	if created || changed {
+		if err = policy.Restore(tx); err != nil {
+			return err
+		}
+	}
+	stats.count(created, changed)
+	return nil
+}
+
+// importBCC matches the rule by kind and mailbox, postfix allows one
+// for each of them: a rule with another address is replaced.
+func importBCC(tx *db.Tx, domain types.Domain, b BCC, stats *Stats) error {
+	if b.Kind != types.BCCSender && b.Kind != types.BCCRecipient {
+		return fmt.Errorf("Unknown kind '%s'", b.Kind)
+	} else if _, err := emailField.Clean(b.Address); err != nil {
+		return err
+	}
+
+	bcc := types.BCC{Domain: domain.Id, Kind: b.Kind, Address: b.Address}
+	if b.Mailbox != "" {
+		if !domain.Contains(b.Mailbox) {
+			return fmt.Errorf("The address doesn't end with @%s", domain.Name)
+		}
+		mailbox, err := types.GetMailboxByEmail(tx, b.Mailbox)
+		if err != nil {
+			return err
+		}
+		bcc.Mailbox = mailbox.Id
+	}
+
+	rules, err := types.GetBCCs(tx, domain.Id.Int64)
+	if err != nil {
+		return err
+	}
+	created, changed := true, false
+	for _, other := range rules {
+		if other.Kind == b.Kind && other.Email == b.Mailbox {
+			created, changed = false, other.Address != b.Address
+			if changed {
+				err = other.Delete(tx)
+			}
+			break
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	if created || changed {
+		if err = bcc.Create(tx); err != nil {
+			return err
+		}
+	}
+	stats.count(created, changed)
+	return nil
+}
+
+// importAccessRule matches the rule by kind and pattern, a rule with
+// another action or message is replaced.
+func importAccessRule(tx *db.Tx, domain types.Domain, r AccessRule, stats *Stats) error {
+	if err := types.ValidAccessPattern(domain, r.Kind, r.Pattern); err != nil {
+		return err
+	} else if r.Action != types.AccessOK && r.Action != types.AccessReject && r.Action != types.AccessDiscard {
+		return fmt.Errorf("Unknown action '%s'", r.Action)
+	} else if strings.ContainsAny(r.Message, "\r\n") {
+		return errors.New("The message must be a single line")
+	}
+
+	rules, err := types.GetAccessRulesByKind(tx, domain.Id.Int64, r.Kind)
+	if err != nil {
+		return err
+	}
+	created, changed := true, false
+	for _, other := range rules {
+		if other.Pattern == r.Pattern {
+			created, changed = false, other.Action != r.Action || other.Message != r.Message
+			if changed {
+				err = other.Delete(tx)
+			}
+			break
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	if created || changed {
+		rule := types.AccessRule{
+			Domain:  domain.Id,
+			Kind:    r.Kind,
+			Pattern: r.Pattern,
+			Action:  r.Action,
+			Message: r.Message,
+		}
+		if err = rule.Create(tx); err != nil {
+			return err
+		}
+	}
+	stats.count(created, changed)
+	return nil
+}
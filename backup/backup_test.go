@@ -0,0 +1,456 @@
+package backup
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/funnydog/mailadmin/core/db"
+	"github.com/funnydog/mailadmin/mtasts"
+	"github.com/funnydog/mailadmin/testutils"
+	"github.com/funnydog/mailadmin/types"
+)
+
+const databasePath = "/tmp/test-backup.db"
+
+func createTestingDatabase(t *testing.T) *db.Database {
+	database, domain := testutils.CreateTestingDatabase(t, databasePath)
+
+	mailbox := types.Mailbox{Domain: domain.Id, Email: "test@example.com", Password: "hash", Active: true}
+	if err := mailbox.Create(database); err != nil {
+		t.Fatal(err)
+	}
+
+	alias := types.Alias{Domain: domain.Id, Destination: "info@example.com", RedirectTo: "test@example.com"}
+	if err := alias.Create(database); err != nil {
+		t.Fatal(err)
+	}
+	return database
+}
+
+// exportAndDelete exports the domains and deletes example.com with
+// the records depending on it, returning the document read back.
+func exportAndDelete(t *testing.T, database *db.Database) Document {
+	doc, err := ExportAll(database)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err = doc.Write(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	domain, err := types.GetDomainByName(database, "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = domain.Delete(database); err != nil {
+		t.Fatal(err)
+	}
+
+	doc, err = Read(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return doc
+}
+
+func TestExportImport(t *testing.T) {
+	database := createTestingDatabase(t)
+
+	// delete the domain, the mailboxes and aliases follow
+	doc := exportAndDelete(t, database)
+
+	// the dry run changes nothing
+	stats, err := Import(database, doc, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Created != 3 {
+		t.Errorf("Dry run: expected 3 created records, got %s", stats)
+	}
+	if _, err = types.GetDomainByName(database, "example.com"); err == nil {
+		t.Error("The dry run restored the domain")
+	}
+
+	stats, err = Import(database, doc, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Created != 3 {
+		t.Errorf("Expected 3 created records, got %s", stats)
+	}
+
+	mailbox, err := types.GetMailboxByEmail(database, "test@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mailbox.Password != "hash" {
+		t.Error("The password hash hasn't been restored")
+	}
+
+	// importing twice changes nothing
+	stats, err = Import(database, doc, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Created != 0 || stats.Updated != 0 || stats.Unchanged != 3 {
+		t.Errorf("Expected 3 unchanged records, got %s", stats)
+	}
+
+	// changed records are updated
+	doc.Domains[0].Aliases[0].Active = true
+	stats, err = Import(database, doc, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Updated != 1 {
+		t.Errorf("Expected 1 updated record, got %s", stats)
+	}
+}
+
+func TestExportImportDKIM(t *testing.T) {
+	database := createTestingDatabase(t)
+
+	domain, err := types.GetDomainByName(database, "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, selector := range []string{"old", "new", "retired"} {
+		key := types.DKIMKey{
+			Domain:     domain.Id,
+			Selector:   selector,
+			Algorithm:  "ed25519",
+			PrivateKey: "private " + selector,
+			PublicKey:  "public " + selector,
+			Active:     selector != "retired",
+		}
+		if err = key.Create(database); err != nil {
+			t.Fatal(err)
+		}
+		if selector == "new" {
+			if err = key.Promote(database); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	doc := exportAndDelete(t, database)
+	stats, err := Import(database, doc, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Created != 6 {
+		t.Errorf("Expected 6 created records, got %s", stats)
+	}
+
+	domain, err = types.GetDomainByName(database, "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, err := types.GetDKIMKeys(database, domain.Id.Int64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored := map[string]types.DKIMKey{}
+	for _, k := range keys {
+		restored[k.Selector] = k
+	}
+	if len(restored) != 3 || restored["new"].PrivateKey != "private new" {
+		t.Fatalf("The DKIM keys haven't been restored: %v", keys)
+	}
+	if !restored["new"].Signing || restored["old"].Signing || !restored["old"].Active || restored["retired"].Active {
+		t.Error("The active and signing keys haven't been restored")
+	}
+
+	// importing twice changes nothing
+	stats, err = Import(database, doc, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Created != 0 || stats.Updated != 0 {
+		t.Errorf("Expected no changes, got %s", stats)
+	}
+
+	// a selector cannot get another key
+	doc.Domains[0].DKIMKeys[0].PrivateKey = "other"
+	if _, err = Import(database, doc, false); err == nil {
+		t.Error("Expected error but got no error instead")
+	}
+}
+
+func TestExportImportMTASTS(t *testing.T) {
+	database := createTestingDatabase(t)
+
+	domain, err := types.GetDomainByName(database, "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	policy := types.MTASTS{
+		Domain:    domain.Id,
+		Mode:      mtasts.Enforce,
+		MX:        []string{"mx1.example.com", "*.example.net"},
+		MaxAge:    mtasts.DefaultMaxAge,
+		ReportURI: "mailto:tlsrpt@example.com",
+	}
+	if err = policy.Save(database); err != nil {
+		t.Fatal(err)
+	}
+
+	doc := exportAndDelete(t, database)
+	stats, err := Import(database, doc, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Created != 4 {
+		t.Errorf("Expected 4 created records, got %s", stats)
+	}
+
+	domain, err = types.GetDomainByName(database, "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored, err := types.GetMTASTS(database, domain.Id.Int64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if restored.Mode != policy.Mode || strings.Join(restored.MX, " ") != strings.Join(policy.MX, " ") ||
+		restored.ReportURI != policy.ReportURI {
+		t.Errorf("The policy hasn't been restored: %v", restored)
+	}
+
+	// the record published in the DNS keeps working
+	if mtasts.PolicyID(restored) != mtasts.PolicyID(policy) {
+		t.Errorf("The policy id changed from %s to %s", mtasts.PolicyID(policy), mtasts.PolicyID(restored))
+	}
+
+	// importing twice changes nothing
+	stats, err = Import(database, doc, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Created != 0 || stats.Updated != 0 {
+		t.Errorf("Expected no changes, got %s", stats)
+	}
+
+	doc.Domains[0].MTASTS.Mode = "strict"
+	if _, err = Import(database, doc, false); err == nil {
+		t.Error("Expected error but got no error instead")
+	}
+}
+
+func TestExportImportSendAs(t *testing.T) {
+	database := createTestingDatabase(t)
+
+	// the grant names a domain which comes after in the document
+	other := types.Domain{Name: "other.org", Active: true}
+	if err := other.Create(database); err != nil {
+		t.Fatal(err)
+	}
+	mailbox, err := types.GetMailboxByEmail(database, "test@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = types.SetSendAs(database, mailbox.Id.Int64, []string{"@other.org", "info@example.com"}); err != nil {
+		t.Fatal(err)
+	}
+
+	doc := exportAndDelete(t, database)
+	if err = other.Delete(database); err != nil {
+		t.Fatal(err)
+	}
+	stats, err := Import(database, doc, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Created != 6 {
+		t.Errorf("Expected 6 created records, got %s", stats)
+	}
+
+	mailbox, err = types.GetMailboxByEmail(database, "test@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addresses, err := types.GetSendAs(database, mailbox.Id.Int64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(addresses, " ") != "@other.org info@example.com" {
+		t.Errorf("The send-as grants haven't been restored: %v", addresses)
+	}
+
+	// importing twice changes nothing
+	stats, err = Import(database, doc, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Created != 0 || stats.Updated != 0 {
+		t.Errorf("Expected no changes, got %s", stats)
+	}
+
+	doc.Domains[0].Mailboxes[0].SendAs = []string{"@unknown.net"}
+	if _, err = Import(database, doc, false); err == nil {
+		t.Error("Expected error but got no error instead")
+	}
+}
+
+func TestExportImportBCC(t *testing.T) {
+	database := createTestingDatabase(t)
+
+	mailbox, err := types.GetMailboxByEmail(database, "test@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rules := []types.BCC{
+		{Domain: mailbox.Domain, Kind: types.BCCRecipient, Address: "archive@example.net"},
+		{Domain: mailbox.Domain, Mailbox: mailbox.Id, Kind: types.BCCSender, Address: "boss@example.net"},
+	}
+	for _, rule := range rules {
+		if err = rule.Create(database); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	doc := exportAndDelete(t, database)
+	stats, err := Import(database, doc, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Created != 5 {
+		t.Errorf("Expected 5 created records, got %s", stats)
+	}
+
+	mailbox, err = types.GetMailboxByEmail(database, "test@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored, err := types.GetBCCs(database, mailbox.Domain.Int64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := map[string]string{}
+	for _, b := range restored {
+		found[b.Kind+" "+b.Email] = b.Address
+	}
+	if len(found) != 2 || found["recipient "] != "archive@example.net" || found["sender test@example.com"] != "boss@example.net" {
+		t.Errorf("The BCC rules haven't been restored: %v", found)
+	}
+
+	// importing twice changes nothing
+	stats, err = Import(database, doc, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Created != 0 || stats.Updated != 0 {
+		t.Errorf("Expected no changes, got %s", stats)
+	}
+
+	// the rule of the same kind and mailbox is replaced
+	doc.Domains[0].BCC[0].Address = "other@example.net"
+	stats, err = Import(database, doc, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Updated != 1 {
+		t.Errorf("Expected 1 updated record, got %s", stats)
+	}
+}
+
+func TestExportImportAccessRules(t *testing.T) {
+	database := createTestingDatabase(t)
+
+	domain, err := types.GetDomainByName(database, "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rules := []types.AccessRule{
+		{Domain: domain.Id, Kind: types.AccessSender, Pattern: "spam.net", Action: types.AccessReject, Message: "No spam"},
+		{Domain: domain.Id, Kind: types.AccessRecipient, Pattern: "info@example.com", Action: types.AccessDiscard},
+	}
+	for _, rule := range rules {
+		if err = rule.Create(database); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	doc := exportAndDelete(t, database)
+	stats, err := Import(database, doc, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Created != 5 {
+		t.Errorf("Expected 5 created records, got %s", stats)
+	}
+
+	domain, err = types.GetDomainByName(database, "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored, err := types.GetAccessRules(database, domain.Id.Int64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := map[string]string{}
+	for _, r := range restored {
+		found[r.Kind+" "+r.Pattern] = r.Result()
+	}
+	if len(found) != 2 || found["sender spam.net"] != "REJECT No spam" || found["recipient info@example.com"] != "DISCARD" {
+		t.Errorf("The access rules haven't been restored: %v", found)
+	}
+
+	// importing twice changes nothing
+	stats, err = Import(database, doc, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Created != 0 || stats.Updated != 0 {
+		t.Errorf("Expected no changes, got %s", stats)
+	}
+
+	// the rule of the same pattern is replaced
+	doc.Domains[0].AccessRules[1].Action = types.AccessOK
+	stats, err = Import(database, doc, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Updated != 1 {
+		t.Errorf("Expected 1 updated record, got %s", stats)
+	}
+
+	doc.Domains[0].AccessRules[0].Pattern = "info@other.org"
+	if _, err = Import(database, doc, false); err == nil {
+		t.Error("Expected error but got no error instead")
+	}
+}
+
+func TestImportErrors(t *testing.T) {
+	database := createTestingDatabase(t)
+
+	_, err := Read(strings.NewReader(`{"version": 99, "domains": []}`))
+	if _, ok := err.(ErrVersionNotSupported); !ok {
+		t.Errorf("Expected ErrVersionNotSupported, got %v", err)
+	}
+
+	// the version is checked before the fields of a newer format
+	_, err = Read(strings.NewReader(`{"version": 99, "domains": [{"name": "example.org", "future": true}]}`))
+	if _, ok := err.(ErrVersionNotSupported); !ok {
+		t.Errorf("Expected ErrVersionNotSupported, got %v", err)
+	}
+
+	doc, err := Read(strings.NewReader(`{"version": 1, "domains": [
+{"name": "other.org", "mailboxes": [{"email": "a@other.org", "password": "x"}]},
+{"name": "bad.org", "mailboxes": [{"email": "a@example.com", "password": "x"}]}
+]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the whole document is rolled back
+	if _, err = Import(database, doc, false); err == nil {
+		t.Error("Expected error but got no error instead")
+	}
+	if _, err = types.GetDomainByName(database, "other.org"); err == nil {
+		t.Error("The import hasn't been rolled back")
+	}
+}
@@ -31,6 +31,64 @@ type Configuration struct {
 	CookieKey    string   `json:"cookiekey"`
 	Debug        bool     `json:"debug"`
 	AllowedURLs  []string `json:"allowed_urls"`
+
+	// postfix lookup tables for the hosts without a database
+	PostfixMapDir string `json:"postfixmapdir"`
+	PostfixReload string `json:"postfixreload"`
+
+	// OpenDKIM tables and keys
+	DKIMDir    string `json:"dkimdir"`
+	DKIMReload string `json:"dkimreload"`
+
+	// DNS health check, the resolver is host:port
+	DNSResolver string   `json:"dnsresolver"`
+	MXHosts     []string `json:"mxhosts"`
+
+	// Maildir of the mailboxes, see the storage package
+	MailRoot    string `json:"mailroot"`
+	MailLayout  string `json:"maillayout"`
+	MailArchive string `json:"mailarchive"`
+	MailUID     int    `json:"mailuid"`
+	MailGID     int    `json:"mailgid"`
+
+	// servers given to the mail clients, see the autoconfig package
+	IMAPHost   string `json:"imaphost"`
+	IMAPPort   int    `json:"imapport"`
+	IMAPSocket string `json:"imapsocket"`
+	SMTPHost   string `json:"smtphost"`
+	SMTPPort   int    `json:"smtpport"`
+	SMTPSocket string `json:"smtpsocket"`
+
+	// postfix policy service, the quotas are recipients per mailbox
+	PolicyAddress string `json:"policyaddress"`
+	PolicyHourly  int64  `json:"policyhourly"`
+	PolicyDaily   int64  `json:"policydaily"`
+
+	// days after which the deleted records are purged, 0 keeps them
+	TrashPurgeDays int `json:"trashpurgedays"`
+
+	// schedules of the jobs replacing the default ones, by job name
+	JobSchedules map[string]string `json:"jobschedules"`
+
+	// SMTP server sending the notifications, no host disables them
+	MailerHost     string `json:"mailerhost"`
+	MailerPort     int    `json:"mailerport"`
+	MailerStartTLS bool   `json:"mailerstarttls"`
+	MailerUsername string `json:"mailerusername"`
+	MailerPassword string `json:"mailerpassword"`
+	MailerFrom     string `json:"mailerfrom"`
+
+	// address of the web interface in the links of the mails, like
+	// https://mail.example.com, no address disables the password reset
+	PublicURL string `json:"publicurl"`
+
+	// requirements of the new passwords, the zero values use the
+	// defaults and the negative ones disable the check, the list is a
+	// file of common or breached passwords, one per line
+	PasswordMinLength  int     `json:"passwordminlength"`
+	PasswordMinClasses int     `json:"passwordminclasses"`
+	PasswordMinEntropy float64 `json:"passwordminentropy"`
+	PasswordList       string  `json:"passwordlist"`
 }
 
 func Read(filename string) (Configuration, error) {
@@ -4,9 +4,13 @@ import (
 	"io/fs"
 	"log"
 	"net/http"
+	"os"
 
 	"github.com/funnydog/mailadmin/core/config"
 	"github.com/funnydog/mailadmin/core/db"
+	"github.com/funnydog/mailadmin/core/form"
+	"github.com/funnydog/mailadmin/core/mailer"
+	"github.com/funnydog/mailadmin/core/scheduler"
 	"github.com/funnydog/mailadmin/core/template"
 	"github.com/funnydog/mailadmin/core/urls"
 	"github.com/go-errors/errors"
@@ -20,6 +24,9 @@ type Middleware func(http.Handler) http.Handler
 type Context struct {
 	Config          *config.Configuration
 	Database        *db.Database
+	Scheduler       *scheduler.Scheduler
+	Mailer          *mailer.Mailer
+	Passwords       *form.PasswordPolicy
 	TemplateManager *template.Manager
 	URLManager      *urls.Manager
 	Router          *httprouter.Router
@@ -29,6 +36,7 @@ type Context struct {
 }
 
 func (c *Context) Close() {
+	c.Scheduler.Stop()
 	c.Database.Close()
 }
 
@@ -50,6 +58,18 @@ func (c *Context) AddRoute(name, method, prefix string, handler Handler) {
 	c.URLManager.Add(&route)
 }
 
+// AddRootRoute adds a route ignoring the BasePrefix, for the URLs that
+// must be at the root of the host like the well-known ones.
+func (c *Context) AddRootRoute(name, method, prefix string, handler Handler) {
+	route := urls.URL{
+		Prefix:      prefix,
+		Method:      method,
+		HandlerFunc: embedCtx(handler, c),
+		Name:        name,
+	}
+	c.URLManager.Add(&route)
+}
+
 func (c *Context) SetNotFoundTemplate(template string) {
 	if c.Config.Debug && template != "" {
 		c.Router.NotFound = http.HandlerFunc(
@@ -127,7 +147,11 @@ func (c *Context) IsURLAllowed(path string) bool {
 	return exists
 }
 
+// ListenAndServe starts the scheduler and serves the requests.
 func (c *Context) ListenAndServe() error {
+	c.Scheduler.Start()
+	defer c.Scheduler.Stop()
+
 	var router http.Handler = c.Router
 	for _, m := range c.Middleware {
 		router = m(router)
@@ -152,6 +176,23 @@ func (c *Context) AddMiddleware(mid Middleware) {
 	c.Middleware = append(c.Middleware, mid)
 }
 
+// passwordPolicy returns the policy of the configuration, the
+// passwordlist file adds to the built-in list of common passwords.
+func passwordPolicy(conf *config.Configuration) (*form.PasswordPolicy, error) {
+	policy := form.NewPasswordPolicy(conf.PasswordMinLength, conf.PasswordMinClasses, conf.PasswordMinEntropy)
+	if conf.PasswordList == "" {
+		return policy, nil
+	}
+
+	f, err := os.Open(conf.PasswordList)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return policy, form.ReadPasswordList(f, policy.Common)
+}
+
 func CreateContextFromConf(fsys fs.FS, static config.Static, conf *config.Configuration) (*Context, error) {
 	db, err := db.Connect(conf)
 	if err != nil {
@@ -192,6 +233,19 @@ func CreateContextFromConf(fsys fs.FS, static config.Static, conf *config.Config
 		return nil, err
 	}
 
+	// nil if the SMTP server isn't configured
+	mail, err := mailer.New(conf, db, &templates)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	passwords, err := passwordPolicy(conf)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
 	if conf.CookieKey == "" {
 		conf.CookieKey = "something-very-secret"
 	}
@@ -199,6 +253,9 @@ func CreateContextFromConf(fsys fs.FS, static config.Static, conf *config.Config
 	return &Context{
 		Config:          conf,
 		Database:        db,
+		Scheduler:       scheduler.New(db),
+		Mailer:          mail,
+		Passwords:       passwords,
 		TemplateManager: &templates,
 		URLManager:      &urlManager,
 		Store:           sessions.NewCookieStore([]byte(conf.CookieKey)),
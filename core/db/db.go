@@ -29,9 +29,31 @@ func (sn ErrStatementNotFound) Error() string {
 	return fmt.Sprintf("Statement '%s' not found in the map", string(sn))
 }
 
+// Querier is implemented by both Database and Tx so that the same
+// code can run either on its own or inside a transaction.
+type Querier interface {
+	FindStatement(key string) (*sql.Stmt, error)
+}
+
 type Database struct {
-	Db    *sql.DB
-	stmts map[string]*sql.Stmt
+	Db     *sql.DB
+	Driver string
+	stmts  map[string]*sql.Stmt
+}
+
+// Tx is a transaction started by Database.WithTx. The statements
+// returned by FindStatement are bound to the transaction.
+type Tx struct {
+	Tx *sql.Tx
+	db *Database
+}
+
+func (tx *Tx) FindStatement(key string) (*sql.Stmt, error) {
+	stmt, err := tx.db.FindStatement(key)
+	if err != nil {
+		return nil, err
+	}
+	return tx.Tx.Stmt(stmt), nil
 }
 
 func (db *Database) PrepareStatement(key, sql string) error {
@@ -57,6 +79,28 @@ func (db *Database) FindStatement(key string) (*sql.Stmt, error) {
 	return stmt, nil
 }
 
+// WithTx runs fn inside a transaction which is committed if fn returns
+// nil and rolled back if fn returns an error or panics.
+func (db *Database) WithTx(fn func(tx *Tx) error) error {
+	sqltx, err := db.Db.Begin()
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			sqltx.Rollback()
+			panic(r)
+		}
+	}()
+
+	if err = fn(&Tx{Tx: sqltx, db: db}); err != nil {
+		sqltx.Rollback()
+		return err
+	}
+	return sqltx.Commit()
+}
+
 func (db *Database) Close() {
 	for _, stmt := range db.stmts {
 		stmt.Close()
@@ -64,6 +108,15 @@ func (db *Database) Close() {
 	db.Db.Close()
 }
 
+// sqliteDSN adds the foreign keys option to the parameters the name may
+// already have.
+func sqliteDSN(name string) string {
+	if strings.Contains(name, "?") {
+		return name + "&_foreign_keys=on"
+	}
+	return name + "?_foreign_keys=on"
+}
+
 func Connect(conf *config.Configuration) (*Database, error) {
 	var (
 		db  *sql.DB
@@ -71,7 +124,9 @@ func Connect(conf *config.Configuration) (*Database, error) {
 	)
 	switch conf.DBType {
 	case "sqlite3":
-		db, err = sql.Open("sqlite3", conf.DBName)
+		// enable the foreign keys on every connection of the
+		// pool, transactions may not run on the first one
+		db, err = sql.Open("sqlite3", sqliteDSN(conf.DBName))
 		if err != nil {
 			return nil, err
 		}
@@ -117,7 +172,8 @@ func Connect(conf *config.Configuration) (*Database, error) {
 	}
 
 	return &Database{
-		Db:    db,
-		stmts: map[string]*sql.Stmt{},
+		Db:     db,
+		Driver: conf.DBType,
+		stmts:  map[string]*sql.Stmt{},
 	}, nil
 }
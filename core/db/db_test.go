@@ -33,6 +33,168 @@ func TestSQLite3(t *testing.T) {
 	_, _ = db.Db.Exec("DROP TABLE testusers")
 }
 
+func TestSQLiteDSN(t *testing.T) {
+	tests := map[string]string{
+		"/tmp/test.sqlite":             "/tmp/test.sqlite?_foreign_keys=on",
+		"file:test.db?cache=shared":    "file:test.db?cache=shared&_foreign_keys=on",
+		"file:test.db?mode=ro&_txlock": "file:test.db?mode=ro&_txlock&_foreign_keys=on",
+	}
+	for name, expected := range tests {
+		if dsn := sqliteDSN(name); dsn != expected {
+			t.Errorf("sqliteDSN(%q) = %q; Expected %q", name, dsn, expected)
+		}
+	}
+}
+
+func TestTransaction(t *testing.T) {
+	conf := config.Configuration{
+		DBType: "sqlite3",
+		DBName: "/tmp/test-tx.sqlite",
+	}
+	db, err := Connect(&conf)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer os.Remove(conf.DBName)
+	defer db.Close()
+
+	_, err = db.Db.Exec("CREATE TABLE testusers(id INTEGER PRIMARY KEY, name TEXT)")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = db.PrepareStatement("userCreate", "INSERT INTO testusers(name) VALUES ($1)")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	insert := func(q Querier, name string) error {
+		stmt, err := q.FindStatement("userCreate")
+		if err != nil {
+			return err
+		}
+		_, err = stmt.Exec(name)
+		return err
+	}
+
+	count := func() (n int) {
+		_ = db.Db.QueryRow("SELECT COUNT(*) FROM testusers").Scan(&n)
+		return n
+	}
+
+	// a successful transaction commits every row
+	err = db.WithTx(func(tx *Tx) error {
+		if err := insert(tx, "first"); err != nil {
+			return err
+		}
+		return insert(tx, "second")
+	})
+	if err != nil {
+		t.Error(err)
+	}
+	if n := count(); n != 2 {
+		t.Errorf("Expected 2 rows after commit, found %d", n)
+	}
+
+	// a failing transaction must leave no rows behind
+	err = db.WithTx(func(tx *Tx) error {
+		if err := insert(tx, "third"); err != nil {
+			return err
+		}
+		_, err := tx.FindStatement("notfound")
+		return err
+	})
+	if err == nil {
+		t.Error("Expected error but got no error instead")
+	}
+	if n := count(); n != 2 {
+		t.Errorf("Expected 2 rows after rollback, found %d", n)
+	}
+
+	// the database works outside of the transaction too
+	if err = insert(db, "fourth"); err != nil {
+		t.Error(err)
+	}
+	if n := count(); n != 3 {
+		t.Errorf("Expected 3 rows, found %d", n)
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	conf := config.Configuration{
+		DBType: "sqlite3",
+		DBName: "/tmp/test-migrate.sqlite",
+	}
+	db, err := Connect(&conf)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer os.Remove(conf.DBName)
+	defer db.Close()
+
+	_, err = db.Db.Exec(`
+CREATE TABLE testgroups(id INTEGER PRIMARY KEY, name TEXT, UNIQUE(name));
+CREATE TABLE testusers(id INTEGER PRIMARY KEY, group_id INTEGER NOT NULL REFERENCES testgroups(id) ON DELETE CASCADE);
+INSERT INTO testgroups(id, name) VALUES (1, 'staff');
+INSERT INTO testusers(group_id) VALUES (1);
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the rebuild of the table must not cascade on the users
+	migrations := []Migration{
+		{"groups without the constraint", []string{
+			`CREATE TABLE testgroups_new(id INTEGER PRIMARY KEY, name TEXT)`,
+			`INSERT INTO testgroups_new(id, name) SELECT id, name FROM testgroups`,
+			`DROP TABLE testgroups`,
+			`ALTER TABLE testgroups_new RENAME TO testgroups`,
+		}},
+		{"users with a name", []string{
+			`ALTER TABLE testusers ADD COLUMN name TEXT NOT NULL DEFAULT ''`,
+		}},
+	}
+	if n, err := db.Migrate("test", migrations); err != nil || n != 2 {
+		t.Fatalf("Migrate returned %d, %v", n, err)
+	}
+	if v, _ := db.SchemaVersion("test"); v != 2 {
+		t.Errorf("Version %d, Expected 2", v)
+	}
+	var n int
+	_ = db.Db.QueryRow("SELECT COUNT(*) FROM testusers").Scan(&n)
+	if n != 1 {
+		t.Errorf("Found %d users after the migration, Expected 1", n)
+	}
+	if _, err = db.Db.Exec("INSERT INTO testgroups(name) VALUES ('staff')"); err != nil {
+		t.Error("The constraint is still there")
+	}
+
+	// the migrations already run are skipped, a failing one is not
+	// recorded and stops the following ones
+	migrations = append(migrations,
+		Migration{"broken", []string{`ALTER TABLE missing ADD COLUMN name TEXT`}},
+		Migration{"never", []string{`CREATE TABLE never(id INTEGER)`}},
+	)
+	if n, err := db.Migrate("test", migrations); err == nil || n != 0 {
+		t.Errorf("Migrate returned %d, %v", n, err)
+	}
+	if v, _ := db.SchemaVersion("test"); v != 2 {
+		t.Errorf("Version %d, Expected 2", v)
+	}
+	if db.HasTable("never") || !db.HasTable("testusers") {
+		t.Error("Unexpected tables after the failed migration")
+	}
+
+	// the foreign keys are enabled again
+	if _, err = db.Db.Exec("INSERT INTO testusers(group_id) VALUES (42)"); err == nil {
+		t.Error("The foreign keys are disabled")
+	}
+}
+
 func TestPostgreSQL(t *testing.T) {
 	conf := config.Configuration{
 		DBType:    "postgres",
@@ -0,0 +1,138 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+)
+
+// Migration upgrades the schema of a component by one version running
+// its statements in a transaction.
+type Migration struct {
+	Description string
+	Statements  []string
+}
+
+type ErrForeignKeys string
+
+func (fk ErrForeignKeys) Error() string {
+	return fmt.Sprintf("The migration left rows of '%s' referring to missing records", string(fk))
+}
+
+// the version of each component of the schema, the migration i brings
+// a component from version i to version i+1
+const versionTable = `
+CREATE TABLE IF NOT EXISTS schema_version (
+	component VARCHAR(20) PRIMARY KEY,
+	version INTEGER NOT NULL
+);`
+
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+func setVersion(e execer, component string, version int) error {
+	res, err := e.Exec(`UPDATE schema_version SET version=$1 WHERE component=$2`, version, component)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil || n > 0 {
+		return err
+	}
+	_, err = e.Exec(`INSERT INTO schema_version(component, version) VALUES ($1, $2)`, component, version)
+	return err
+}
+
+// SetSchemaVersion records the version of the component, CreateModel
+// sets the last one.
+func (db *Database) SetSchemaVersion(component string, version int) error {
+	if _, err := db.Db.Exec(versionTable); err != nil {
+		return err
+	}
+	return setVersion(db.Db, component, version)
+}
+
+// SchemaVersion returns the version of the component, 0 if it has never
+// been recorded: the tables created before the versions are at 0.
+func (db *Database) SchemaVersion(component string) (int, error) {
+	if _, err := db.Db.Exec(versionTable); err != nil {
+		return 0, err
+	}
+
+	version := 0
+	err := db.Db.QueryRow(`SELECT version FROM schema_version WHERE component=$1`, component).Scan(&version)
+	if err == sql.ErrNoRows {
+		err = nil
+	}
+	return version, err
+}
+
+// HasTable reports if the table exists.
+func (db *Database) HasTable(name string) bool {
+	rows, err := db.Db.Query(`SELECT 1 FROM ` + name + ` WHERE 1=0`)
+	if err != nil {
+		return false
+	}
+	rows.Close()
+	return true
+}
+
+// Migrate runs the migrations of the component after its version and
+// returns how many have been run. Each migration is committed with its
+// version, so a failed one can be retried once fixed.
+//
+// SQLite rebuilds the tables to change their constraints, the foreign
+// keys are disabled meanwhile and checked at the end.
+func (db *Database) Migrate(component string, migrations []Migration) (int, error) {
+	version, err := db.SchemaVersion(component)
+	if err != nil || version >= len(migrations) {
+		return 0, err
+	}
+
+	ctx := context.Background()
+	conn, err := db.Db.Conn(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+
+	if db.Driver == "sqlite3" {
+		if _, err = conn.ExecContext(ctx, `PRAGMA foreign_keys = OFF`); err != nil {
+			return 0, err
+		}
+		defer conn.ExecContext(ctx, `PRAGMA foreign_keys = ON`)
+	}
+
+	run := 0
+	for i := version; i < len(migrations); i++ {
+		tx, err := conn.BeginTx(ctx, nil)
+		if err != nil {
+			return run, err
+		}
+		for _, stmt := range migrations[i].Statements {
+			if _, err = tx.Exec(stmt); err != nil {
+				tx.Rollback()
+				return run, fmt.Errorf("%s migration %d (%s): %w", component, i+1, migrations[i].Description, err)
+			}
+		}
+		if err = setVersion(tx, component, i+1); err != nil {
+			tx.Rollback()
+			return run, err
+		}
+		if err = tx.Commit(); err != nil {
+			return run, err
+		}
+		run++
+	}
+
+	if db.Driver == "sqlite3" {
+		var table string
+		err = conn.QueryRowContext(ctx, `PRAGMA foreign_key_check`).Scan(&table, new(interface{}), new(interface{}), new(interface{}))
+		if err == nil {
+			return run, ErrForeignKeys(table)
+		} else if err != sql.ErrNoRows {
+			return run, err
+		}
+	}
+	return run, nil
+}
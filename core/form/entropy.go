@@ -0,0 +1,198 @@
+package form
+
+import (
+	"math"
+	"strings"
+	"unicode"
+)
+
+// keyboard rows walked by the spatial sequences like qwerty or asdf
+var keyboardRows = []string{
+	"1234567890",
+	"qwertyuiop",
+	"asdfghjkl",
+	"zxcvbnm",
+	"qwertzuiop",
+	"yxcvbnm",
+	"azertyuiop",
+	"qsdfghjklm",
+	"wxcvbn",
+}
+
+// maxPattern is the longest run of characters matched against the
+// patterns, the longer ones are split: it bounds the cost of Entropy
+// to the length of the password times its square.
+const maxPattern = 24
+
+// undo the common substitutions of the letters
+var leet = strings.NewReplacer(
+	"4", "a", "@", "a", "8", "b", "(", "c", "3", "e", "6", "g",
+	"1", "i", "!", "i", "|", "l", "0", "o", "$", "s", "5", "s",
+	"7", "t", "+", "t", "2", "z",
+)
+
+// cardinality returns the size of the class of the character guessed
+// by brute force.
+func cardinality(r rune) float64 {
+	switch {
+	case unicode.IsDigit(r):
+		return 10
+	case r <= unicode.MaxASCII && unicode.IsLetter(r):
+		return 26
+	case r <= unicode.MaxASCII:
+		return 33
+	default:
+		return 100
+	}
+}
+
+// dictionaryGuesses returns the guesses of a word of the list along
+// with its uppercase letters and substitutions, 0 if not found.
+func dictionaryGuesses(word []rune, common map[string]int) float64 {
+	text := string(word)
+	lower := strings.ToLower(text)
+
+	guesses := 0.0
+	if rank, ok := common[lower]; ok {
+		guesses = float64(rank)
+	} else if rank, ok := common[leet.Replace(lower)]; ok {
+		// each substitution doubles the guesses
+		n := 0
+		for _, r := range lower {
+			if strings.ContainsRune("48@(3561!|0$7+2", r) {
+				n++
+			}
+		}
+		guesses = float64(rank) * math.Pow(2, float64(n))
+	} else {
+		return 0
+	}
+
+	// the capitalized and all uppercase words are tried first
+	upper := 0
+	for _, r := range word {
+		if unicode.IsUpper(r) {
+			upper++
+		}
+	}
+	if upper > 0 {
+		if upper == len(word) || (upper == 1 && unicode.IsUpper(word[0])) {
+			guesses *= 2
+		} else {
+			guesses *= math.Pow(2, float64(upper))
+		}
+	}
+	return guesses
+}
+
+// sequenceGuesses returns the guesses of a run like abcd, 9876 or
+// asdf, 0 if the characters are not a sequence.
+func sequenceGuesses(word []rune) float64 {
+	if len(word) < 3 {
+		return 0
+	}
+
+	step := word[1] - word[0]
+	if step == 1 || step == -1 {
+		ok := true
+		for i := 2; i < len(word) && ok; i++ {
+			ok = word[i]-word[i-1] == step
+		}
+		if ok {
+			base := 26.0
+			if unicode.IsDigit(word[0]) {
+				base = 10
+			}
+			if strings.ContainsRune("aAzZ019", word[0]) {
+				base = 4
+			}
+			if step < 0 {
+				base *= 2
+			}
+			return base * float64(len(word))
+		}
+	}
+
+	lower := strings.ToLower(string(word))
+	for _, row := range keyboardRows {
+		if strings.Contains(row, lower) {
+			return float64(len(keyboardRows)*len(row)) * float64(len(word))
+		}
+		if strings.Contains(row, reverse(lower)) {
+			return 2 * float64(len(keyboardRows)*len(row)) * float64(len(word))
+		}
+	}
+	return 0
+}
+
+func reverse(s string) string {
+	r := []rune(s)
+	for i, j := 0, len(r)-1; i < j; i, j = i+1, j-1 {
+		r[i], r[j] = r[j], r[i]
+	}
+	return string(r)
+}
+
+// repeatGuesses returns the guesses of a block repeated twice or more,
+// like aaaa or abcabc, 0 if the word is not a repetition.
+func repeatGuesses(word []rune, common map[string]int) float64 {
+	for size := 1; size <= len(word)/2; size++ {
+		if len(word)%size != 0 {
+			continue
+		}
+		block := string(word[:size])
+		if strings.Repeat(block, len(word)/size) == string(word) {
+			bits := Entropy(block, common)
+			return math.Pow(2, bits) * float64(len(word)/size)
+		}
+	}
+	return 0
+}
+
+// yearGuesses returns the guesses of a recent year, 0 otherwise.
+func yearGuesses(word []rune) float64 {
+	if len(word) != 4 {
+		return 0
+	}
+	s := string(word)
+	if s >= "1900" && s <= "2099" {
+		return 200
+	}
+	return 0
+}
+
+// Entropy estimates the bits of the password as the cheapest split in
+// the patterns an attacker tries first: the common passwords, even with
+// uppercase letters and substitutions, the sequences, the repeats and
+// the years. The remaining characters are guessed by brute force.
+func Entropy(password string, common map[string]int) float64 {
+	word := []rune(password)
+
+	// bits[j] is the minimum for the first j characters
+	bits := make([]float64, len(word)+1)
+	for j := 1; j <= len(word); j++ {
+		bits[j] = bits[j-1] + math.Log2(cardinality(word[j-1]))
+		start := 0
+		if j > maxPattern {
+			start = j - maxPattern
+		}
+		for i := start; i < j-1; i++ {
+			part := word[i:j]
+			guesses := math.Inf(1)
+			for _, g := range []float64{
+				dictionaryGuesses(part, common),
+				sequenceGuesses(part),
+				yearGuesses(part),
+				repeatGuesses(part, common),
+			} {
+				if g > 0 && g < guesses {
+					guesses = g
+				}
+			}
+			if b := bits[i] + math.Log2(guesses); b < bits[j] {
+				bits[j] = b
+			}
+		}
+	}
+	return bits[len(word)]
+}
@@ -0,0 +1,167 @@
+package form
+
+import (
+	"bufio"
+	_ "embed"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"unicode"
+
+	"github.com/funnydog/mailadmin/types"
+)
+
+// defaults of the password policy replacing the zero values
+const (
+	DefaultPasswordLength  = 10
+	DefaultPasswordClasses = 2
+	DefaultPasswordEntropy = 40
+)
+
+var (
+	ErrPasswordCommon = errors.New("This password is among the most common ones.")
+	ErrPasswordWeak   = errors.New("This password is too easy to guess, add another word or some symbols.")
+)
+
+type ErrPasswordShort int
+
+func (ps ErrPasswordShort) Error() string {
+	return fmt.Sprintf("The password must be at least %d characters long.", int(ps))
+}
+
+type ErrPasswordClasses int
+
+func (pc ErrPasswordClasses) Error() string {
+	return fmt.Sprintf("The password must mix at least %d of lowercase letters, uppercase letters, digits and symbols.", int(pc))
+}
+
+//go:embed common_passwords.txt
+var commonPasswords string
+
+// CommonPasswords returns the built-in list of the most common
+// passwords, lowercase and ranked from the most frequent.
+func CommonPasswords() map[string]int {
+	list := map[string]int{}
+	_ = ReadPasswordList(strings.NewReader(commonPasswords), list)
+	return list
+}
+
+// ReadPasswordList adds the passwords of the reader, one per line, to
+// the list ranking them after the ones already there.
+func ReadPasswordList(r io.Reader, list map[string]int) error {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		password := strings.ToLower(strings.TrimSpace(scanner.Text()))
+		if _, ok := list[password]; password != "" && !ok {
+			list[password] = len(list) + 1
+		}
+	}
+	return scanner.Err()
+}
+
+// PasswordPolicy holds the requirements of the new passwords, the
+// negative values disable the check.
+type PasswordPolicy struct {
+	MinLength  int
+	MinClasses int
+	MinEntropy float64
+	Common     map[string]int
+}
+
+// NewPasswordPolicy returns the policy with the defaults in place of
+// the zero values and the built-in list of common passwords.
+func NewPasswordPolicy(minLength, minClasses int, minEntropy float64) *PasswordPolicy {
+	p := PasswordPolicy{
+		MinLength:  minLength,
+		MinClasses: minClasses,
+		MinEntropy: minEntropy,
+		Common:     CommonPasswords(),
+	}
+	if p.MinLength == 0 {
+		p.MinLength = DefaultPasswordLength
+	}
+	if p.MinClasses == 0 {
+		p.MinClasses = DefaultPasswordClasses
+	}
+	if p.MinEntropy == 0 {
+		p.MinEntropy = DefaultPasswordEntropy
+	}
+	return &p
+}
+
+// classes returns how many of lowercase letters, uppercase letters,
+// digits and symbols the password contains.
+func classes(password string) int {
+	var lower, upper, digit, symbol int
+	for _, r := range password {
+		switch {
+		case unicode.IsLower(r):
+			lower = 1
+		case unicode.IsUpper(r):
+			upper = 1
+		case unicode.IsDigit(r):
+			digit = 1
+		default:
+			symbol = 1
+		}
+	}
+	return lower + upper + digit + symbol
+}
+
+// Check returns the first requirement the password doesn't satisfy,
+// the passwords bcrypt would truncate are refused before the costlier
+// checks.
+func (p *PasswordPolicy) Check(password string) error {
+	if len(password) > types.MaxPasswordLength {
+		return types.ErrPasswordTooLong
+	}
+	if n := len([]rune(password)); n < p.MinLength {
+		return ErrPasswordShort(p.MinLength)
+	}
+	if classes(password) < p.MinClasses {
+		return ErrPasswordClasses(p.MinClasses)
+	}
+	if _, ok := p.Common[strings.ToLower(password)]; ok {
+		return ErrPasswordCommon
+	}
+	if p.MinEntropy > 0 && Entropy(password, p.Common) < p.MinEntropy {
+		return ErrPasswordWeak
+	}
+	return nil
+}
+
+// PasswordField is a TextField checking the length and the policy, its
+// value is never shown back in the form.
+type PasswordField struct {
+	Required bool
+	Label    string
+	Policy   *PasswordPolicy
+}
+
+func (f *PasswordField) Clean(value string) (interface{}, error) {
+	if len(value) > types.MaxPasswordLength {
+		return nil, types.ErrPasswordTooLong
+	} else if value != "" {
+		if f.Policy != nil {
+			if err := f.Policy.Check(value); err != nil {
+				return nil, err
+			}
+		}
+		return value, nil
+	} else if f.Required {
+		return nil, ErrRequired
+	} else {
+		return value, nil
+	}
+}
+
+func (f *PasswordField) Update(name string, value interface{}, fv *FieldValue) {
+	if f.Label != "" {
+		fv.Label = f.Label
+	} else {
+		fv.Label = name
+	}
+	fv.Required = f.Required
+	fv.Value = ""
+}
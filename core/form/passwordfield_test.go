@@ -0,0 +1,119 @@
+package form
+
+import (
+	"strings"
+	"testing"
+
+	. "github.com/funnydog/mailadmin/testutils"
+	"github.com/funnydog/mailadmin/types"
+)
+
+func TestPasswordFieldClean(t *testing.T) {
+	field := PasswordField{Required: false, Label: "Label", Policy: NewPasswordPolicy(0, 0, 0)}
+
+	value, err := field.Clean("")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	AssertStringEqual(t, value.(string), "")
+
+	if _, err = field.Clean("1"); err != ErrPasswordShort(DefaultPasswordLength) {
+		t.Errorf("Unexpected error %v", err)
+	}
+
+	value, err = field.Clean("Tulip-Orbit-58-Quay")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	AssertStringEqual(t, value.(string), "Tulip-Orbit-58-Quay")
+
+	field.Required = true
+	if _, err = field.Clean(""); err != ErrRequired {
+		t.Errorf("Unexpected error %v", err)
+	}
+
+	// bcrypt would truncate the long passwords, even without a policy
+	field.Policy = nil
+	if _, err = field.Clean(strings.Repeat("a", types.MaxPasswordLength+1)); err != types.ErrPasswordTooLong {
+		t.Errorf("Unexpected error %v", err)
+	}
+}
+
+func TestPasswordFieldUpdate(t *testing.T) {
+	value := FieldValue{}
+	field := PasswordField{Required: true, Label: "label"}
+
+	field.Update("password", "secret", &value)
+
+	AssertStringEqual(t, value.Value, "")
+	AssertStringEqual(t, value.Label, field.Label)
+	AssertBoolEqual(t, value.Required, field.Required)
+}
+
+func TestPasswordPolicyCheck(t *testing.T) {
+	policy := NewPasswordPolicy(0, 0, 0)
+
+	tests := []struct {
+		password string
+		err      error
+	}{
+		{"short", ErrPasswordShort(DefaultPasswordLength)},
+		{"onlylowercase", ErrPasswordClasses(DefaultPasswordClasses)},
+		{"qwerty123456", ErrPasswordWeak},
+		{"Summer2024!", ErrPasswordWeak},
+		{"P@ssw0rd2024", ErrPasswordWeak},
+		{"abcABCabcABC", ErrPasswordWeak},
+		{"Xk9#mQ2vLp", nil},
+		{"correct horse battery staple", nil},
+	}
+	for _, test := range tests {
+		if err := policy.Check(test.password); err != test.err {
+			t.Errorf("Check(%q) = %v; Expected %v", test.password, err, test.err)
+		}
+	}
+
+	// the long passwords are refused before estimating their entropy
+	if err := policy.Check(strings.Repeat("Xk9#mQ2vLp", 100000)); err != types.ErrPasswordTooLong {
+		t.Errorf("Unexpected error %v", err)
+	}
+
+	// the list catches what the other rules let through
+	if err := ReadPasswordList(strings.NewReader("Xk9#mQ2vLp\n"), policy.Common); err != nil {
+		t.Fatal(err)
+	}
+	if err := policy.Check("xk9#mq2vlp"); err != ErrPasswordCommon {
+		t.Errorf("Unexpected error %v", err)
+	}
+
+	// the negative values disable the checks
+	policy = NewPasswordPolicy(-1, -1, -1)
+	if err := policy.Check("abcdefgh"); err != nil {
+		t.Errorf("Unexpected error %v", err)
+	}
+}
+
+func TestEntropy(t *testing.T) {
+	common := CommonPasswords()
+
+	// the patterns are far cheaper than the random characters
+	random := Entropy("k3#vQz9!", common)
+	if random < 30 {
+		t.Errorf("Entropy of random characters %.1f", random)
+	}
+	for _, password := range []string{"aaaaaaaa", "abcdefgh", "87654321", "Password", "P@ssw0rd", "asdfghjk", "19871987"} {
+		if bits := Entropy(password, common); bits > random/2 {
+			t.Errorf("Entropy(%q) = %.1f; Expected less than %.1f", password, bits, random/2)
+		}
+	}
+
+	// the patterns are bounded, a long password takes linear time
+	if bits := Entropy(strings.Repeat("k3#vQz9!", 100), common); bits < random {
+		t.Errorf("Entropy of the long password %.1f", bits)
+	}
+
+	if bits := Entropy("", common); bits != 0 {
+		t.Errorf("Entropy of the empty password %.1f", bits)
+	}
+}
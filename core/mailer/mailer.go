@@ -0,0 +1,448 @@
+package mailer
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"html"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/funnydog/mailadmin/core/config"
+	"github.com/funnydog/mailadmin/core/db"
+	"github.com/funnydog/mailadmin/core/template"
+)
+
+// DefaultPort is the submission port used when the configuration
+// doesn't set one.
+const DefaultPort = 587
+
+// MaxAttempts is how many times a mail is tried before giving up.
+const MaxAttempts = 5
+
+// HistoryDays is how long the sent and failed mails stay in the queue.
+const HistoryDays = 30
+
+// timeout of a connection to the SMTP server
+const timeout = time.Minute
+
+// Layout is the block of the extend templates wrapping the content of
+// the mails, the templates define the subject and content blocks.
+const Layout = "mail"
+
+var ErrNoSender = errors.New("The mailerfrom field must be set to send the mails")
+
+type ErrInvalidRecipient string
+
+func (ir ErrInvalidRecipient) Error() string {
+	return fmt.Sprintf("'%s' is not a valid recipient", string(ir))
+}
+
+// Message is a mail in the queue, Next is when it is tried again. The
+// body of the private messages is blanked once sent or given up.
+type Message struct {
+	Id       sql.NullInt64
+	To       string
+	Subject  string
+	Body     string
+	Private  bool
+	Attempts int
+	Next     time.Time
+	Error    string
+	Created  time.Time
+	Sent     sql.NullTime
+}
+
+func (msg *Message) scan(s interface{ Scan(...interface{}) error }) error {
+	return s.Scan(
+		&msg.Id,
+		&msg.To,
+		&msg.Subject,
+		&msg.Body,
+		&msg.Private,
+		&msg.Attempts,
+		&msg.Next,
+		&msg.Error,
+		&msg.Created,
+		&msg.Sent,
+	)
+}
+
+// Mailer renders the mails with the template manager, keeps them in a
+// queue in the database and sends them to the SMTP server, retrying
+// the failed ones later.
+type Mailer struct {
+	Host     string
+	Port     int
+	StartTLS bool
+	Username string
+	Password string
+	From     string
+
+	DB        *db.Database
+	Templates *template.Manager
+	Now       func() time.Time
+
+	// one flush of the queue at a time
+	mutex sync.Mutex
+}
+
+// New returns the mailer of the configuration or nil if the host is
+// not set, in which case no mail is sent.
+func New(conf *config.Configuration, database *db.Database, templates *template.Manager) (*Mailer, error) {
+	if conf.MailerHost == "" {
+		return nil, nil
+	}
+	if _, err := mail.ParseAddress(conf.MailerFrom); err != nil {
+		return nil, ErrNoSender
+	}
+
+	m := Mailer{
+		Host:      conf.MailerHost,
+		Port:      conf.MailerPort,
+		StartTLS:  conf.MailerStartTLS,
+		Username:  conf.MailerUsername,
+		Password:  conf.MailerPassword,
+		From:      conf.MailerFrom,
+		DB:        database,
+		Templates: templates,
+		Now:       time.Now,
+	}
+	if m.Port == 0 {
+		m.Port = DefaultPort
+	}
+	return &m, nil
+}
+
+// Render returns the subject and the HTML body of the mail template.
+func (m *Mailer) Render(name string, data interface{}) (string, string, error) {
+	var b bytes.Buffer
+	if err := m.Templates.Execute(&b, name, "subject", data); err != nil {
+		return "", "", err
+	}
+	// the subject is a header, not HTML
+	subject := strings.Join(strings.Fields(html.UnescapeString(b.String())), " ")
+
+	b.Reset()
+	if err := m.Templates.Execute(&b, name, Layout, data); err != nil {
+		return "", "", err
+	}
+	return subject, b.String(), nil
+}
+
+// Queue renders the template and adds the mail to the queue, the mail
+// is sent by the next Flush.
+func (m *Mailer) Queue(to, name string, data interface{}) error {
+	return m.queue(to, name, data, false)
+}
+
+// QueuePrivate is Queue for the mails carrying a secret, like a reset
+// link, their body is not kept in the queue after sending them.
+func (m *Mailer) QueuePrivate(to, name string, data interface{}) error {
+	return m.queue(to, name, data, true)
+}
+
+func (m *Mailer) queue(to, name string, data interface{}, private bool) error {
+	address, err := mail.ParseAddress(to)
+	if err != nil {
+		return ErrInvalidRecipient(to)
+	}
+
+	subject, body, err := m.Render(name, data)
+	if err != nil {
+		return err
+	}
+
+	stmt, err := m.DB.FindStatement("mailQueue")
+	if err != nil {
+		return err
+	}
+
+	now := m.Now().UTC()
+	_, err = stmt.Exec(address.Address, subject, body, private, now, now)
+	return err
+}
+
+// randomId returns the left part of the Message-ID.
+func randomId() string {
+	b := make([]byte, 12)
+	if _, err := rand.Read(b); err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 36)
+	}
+	return hex.EncodeToString(b)
+}
+
+// Compose returns the message sent to the server with the headers and
+// the body encoded as quoted-printable.
+func Compose(from string, msg Message, date time.Time) []byte {
+	domain := "localhost"
+	if i := strings.LastIndex(from, "@"); i >= 0 {
+		domain = strings.TrimSuffix(from[i+1:], ">")
+	}
+
+	var b bytes.Buffer
+	headers := [][2]string{
+		{"From", from},
+		{"To", msg.To},
+		{"Subject", mime.QEncoding.Encode("utf-8", msg.Subject)},
+		{"Date", date.Format(time.RFC1123Z)},
+		{"Message-ID", fmt.Sprintf("<%s@%s>", randomId(), domain)},
+		{"MIME-Version", "1.0"},
+		{"Content-Type", "text/html; charset=utf-8"},
+		{"Content-Transfer-Encoding", "quoted-printable"},
+	}
+	for _, h := range headers {
+		fmt.Fprintf(&b, "%s: %s\r\n", h[0], h[1])
+	}
+	b.WriteString("\r\n")
+
+	w := quotedprintable.NewWriter(&b)
+	_, _ = w.Write([]byte(msg.Body))
+	_ = w.Close()
+	return b.Bytes()
+}
+
+// Send delivers the message to the SMTP server at once.
+func (m *Mailer) Send(msg Message) error {
+	address := net.JoinHostPort(m.Host, strconv.Itoa(m.Port))
+	conn, err := net.DialTimeout("tcp", address, timeout)
+	if err != nil {
+		return err
+	}
+	_ = conn.SetDeadline(time.Now().Add(timeout))
+
+	c, err := smtp.NewClient(conn, m.Host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+
+	if m.StartTLS {
+		if err = c.StartTLS(&tls.Config{ServerName: m.Host}); err != nil {
+			return err
+		}
+	}
+	// PlainAuth refuses to send the password in clear to a remote host
+	if m.Username != "" {
+		if err = c.Auth(smtp.PlainAuth("", m.Username, m.Password, m.Host)); err != nil {
+			return err
+		}
+	}
+
+	from, err := mail.ParseAddress(m.From)
+	if err != nil {
+		return ErrNoSender
+	}
+	if err = c.Mail(from.Address); err != nil {
+		return err
+	}
+	if err = c.Rcpt(msg.To); err != nil {
+		return err
+	}
+
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err = w.Write(Compose(m.From, msg, m.Now())); err != nil {
+		return err
+	}
+	if err = w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+// backoff returns the wait before the next attempt: 1, 4, 16 and 64
+// minutes.
+func backoff(attempts int) time.Duration {
+	d := time.Minute
+	for i := 1; i < attempts; i++ {
+		d *= 4
+	}
+	return d
+}
+
+// Flush sends the mails whose time has come and returns how many have
+// been sent, the failed ones are tried again later up to MaxAttempts.
+func (m *Mailer) Flush() (int, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	now := m.Now().UTC()
+	messages, err := m.due(now)
+	if err != nil {
+		return 0, err
+	}
+
+	sent := 0
+	var last error
+	for _, msg := range messages {
+		msg.Attempts++
+		failed := m.Send(msg)
+		if failed != nil {
+			last = failed
+			err = m.update("mailFailed", msg.Attempts, now.Add(backoff(msg.Attempts)), failed.Error(), msg.Id)
+		} else {
+			sent++
+			err = m.update("mailSent", msg.Attempts, now, msg.Id)
+		}
+		if err == nil && msg.Private && (failed == nil || msg.Attempts >= MaxAttempts) {
+			err = m.update("mailForget", msg.Id)
+		}
+		if err != nil {
+			return sent, err
+		}
+	}
+
+	if err = m.update("mailPurge", now.AddDate(0, 0, -HistoryDays)); err != nil {
+		return sent, err
+	}
+	if last != nil {
+		return sent, fmt.Errorf("%d of %d mails not sent: %w", len(messages)-sent, len(messages), last)
+	}
+	return sent, nil
+}
+
+func (m *Mailer) due(now time.Time) ([]Message, error) {
+	messages := []Message{}
+
+	stmt, err := m.DB.FindStatement("mailDue")
+	if err != nil {
+		return messages, err
+	}
+
+	rows, err := stmt.Query(MaxAttempts, now)
+	if err != nil {
+		return messages, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		msg := Message{}
+		if err = msg.scan(rows); err != nil {
+			return messages, err
+		}
+		messages = append(messages, msg)
+	}
+	return messages, rows.Err()
+}
+
+func (m *Mailer) update(key string, args ...interface{}) error {
+	stmt, err := m.DB.FindStatement(key)
+	if err != nil {
+		return err
+	}
+
+	_, err = stmt.Exec(args...)
+	return err
+}
+
+// GetMessages returns the latest mails of the queue.
+func GetMessages(db db.Querier, limit int) ([]Message, error) {
+	messages := []Message{}
+
+	stmt, err := db.FindStatement("mailList")
+	if err != nil {
+		return messages, err
+	}
+
+	rows, err := stmt.Query(limit)
+	if err != nil {
+		return messages, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		msg := Message{}
+		if err = msg.scan(rows); err != nil {
+			return messages, err
+		}
+		messages = append(messages, msg)
+	}
+	return messages, rows.Err()
+}
+
+const messageColumns = `id, recipient, subject, body, private, attempts, next_attempt, error, created, sent`
+
+// PrepareStatements prepares the statements of the queue, the table
+// must exist.
+func PrepareStatements(database *db.Database) error {
+	stmts := map[string]string{
+		"mailQueue":  `INSERT INTO mail_queue(recipient, subject, body, private, next_attempt, created) VALUES ($1, $2, $3, $4, $5, $6)`,
+		"mailDue":    `SELECT ` + messageColumns + ` FROM mail_queue WHERE sent IS NULL AND attempts < $1 AND next_attempt <= $2 ORDER BY id LIMIT 100`,
+		"mailSent":   `UPDATE mail_queue SET attempts=$1, sent=$2, error='' WHERE id=$3`,
+		"mailFailed": `UPDATE mail_queue SET attempts=$1, next_attempt=$2, error=$3 WHERE id=$4`,
+		"mailForget": `UPDATE mail_queue SET body='' WHERE id=$1`,
+		"mailPurge":  `DELETE FROM mail_queue WHERE created < $1`,
+		"mailList":   `SELECT ` + messageColumns + ` FROM mail_queue ORDER BY id DESC LIMIT $1`,
+	}
+
+	for key, sql := range stmts {
+		if err := database.PrepareStatement(key, sql); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// migrations upgrade the databases created by the previous versions,
+// the first one by a version without the mailer.
+var migrations = []db.Migration{
+	{Description: "queue", Statements: []string{
+		`CREATE TABLE IF NOT EXISTS mail_queue (
+	id INTEGER PRIMARY KEY,
+	recipient VARCHAR(255) NOT NULL,
+	subject VARCHAR(255) NOT NULL,
+	body TEXT NOT NULL,
+	private TINYINT(1) NOT NULL DEFAULT '0',
+	attempts INTEGER NOT NULL DEFAULT '0',
+	next_attempt DATETIME NOT NULL,
+	error TEXT NOT NULL DEFAULT '',
+	created DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	sent DATETIME NULL DEFAULT NULL
+)`,
+		`CREATE INDEX IF NOT EXISTS mail_queue_due ON mail_queue(next_attempt) WHERE sent IS NULL`,
+	}},
+}
+
+// Migrate upgrades the table to the last schema.
+func Migrate(database *db.Database) (int, error) {
+	return database.Migrate("mailer", migrations)
+}
+
+// CreateModel creates the table of the queue.
+func CreateModel(database *db.Database) error {
+	_, err := database.Db.Exec(`
+CREATE TABLE mail_queue (
+	id INTEGER PRIMARY KEY,
+	recipient VARCHAR(255) NOT NULL,
+	subject VARCHAR(255) NOT NULL,
+	body TEXT NOT NULL,
+	private TINYINT(1) NOT NULL DEFAULT '0',
+	attempts INTEGER NOT NULL DEFAULT '0',
+	next_attempt DATETIME NOT NULL,
+	error TEXT NOT NULL DEFAULT '',
+	created DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	sent DATETIME NULL DEFAULT NULL
+);
+CREATE INDEX mail_queue_due ON mail_queue(next_attempt) WHERE sent IS NULL;
+`)
+	if err != nil {
+		return err
+	}
+
+	return database.SetSchemaVersion("mailer", len(migrations))
+}
@@ -0,0 +1,198 @@
+package mailer
+
+import (
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+
+	"github.com/funnydog/mailadmin/core/config"
+	"github.com/funnydog/mailadmin/core/template"
+	"github.com/funnydog/mailadmin/core/urls"
+	"github.com/funnydog/mailadmin/testutils"
+)
+
+const databasePath = "/tmp/test-mailer.db"
+
+var templates = fstest.MapFS{
+	"extend/mail.html": {Data: []byte(`{{ define "mail" }}<html><body>{{ template "content" . }}</body></html>{{ end }}`)},
+	"templates/mail_test.html": {Data: []byte(`{{ define "subject" }}Hello {{ .name }}{{ end }}
+{{ define "content" }}<p>Dear {{ .name }},</p>{{ end }}`)},
+}
+
+func createTestingMailer(t *testing.T, server *testutils.SMTPServer) *Mailer {
+	host, port, err := net.SplitHostPort(server.Address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf := config.Configuration{
+		MailerHost: host,
+		MailerFrom: "MailAdmin <admin@example.com>",
+	}
+	conf.MailerPort, _ = strconv.Atoi(port)
+
+	database := testutils.ConnectTestingDatabase(t, databasePath)
+	if err = CreateModel(database); err != nil {
+		t.Fatal(err)
+	}
+	if err = PrepareStatements(database); err != nil {
+		t.Fatal(err)
+	}
+
+	um := urls.CreateManager(&conf, httprouter.New())
+	tm, err := template.Create(templates, config.Static{TemplateDir: "templates", ExtendDir: "extend"}, &um)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := New(&conf, database, &tm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func TestNew(t *testing.T) {
+	conf := config.Configuration{}
+	if m, err := New(&conf, nil, nil); m != nil || err != nil {
+		t.Errorf("Unexpected mailer %v, %v", m, err)
+	}
+
+	conf.MailerHost = "smtp.example.com"
+	if _, err := New(&conf, nil, nil); err != ErrNoSender {
+		t.Errorf("Unexpected error %v", err)
+	}
+
+	conf.MailerFrom = "admin@example.com"
+	if m, err := New(&conf, nil, nil); err != nil || m.Port != DefaultPort {
+		t.Errorf("Unexpected mailer %v, %v", m, err)
+	}
+}
+
+func TestCompose(t *testing.T) {
+	msg := Message{
+		To:      "test@example.com",
+		Subject: "Città",
+		Body:    "<p>" + strings.Repeat("a", 100) + "</p>",
+	}
+	data := string(Compose("admin@example.com", msg, time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)))
+
+	for _, expected := range []string{
+		"To: test@example.com\r\n",
+		"Subject: =?utf-8?q?Citt=C3=A0?=\r\n",
+		"Date: Mon, 19 Oct 2026 12:00:00 +0000\r\n",
+		"@example.com>\r\n",
+		"Content-Transfer-Encoding: quoted-printable\r\n\r\n<p>aaa",
+	} {
+		if !strings.Contains(data, expected) {
+			t.Errorf("The message doesn't contain %q:\n%s", expected, data)
+		}
+	}
+	for _, line := range strings.Split(data, "\r\n") {
+		if len(line) > 76 {
+			t.Errorf("The line is too long: %s", line)
+		}
+	}
+}
+
+func TestQueue(t *testing.T) {
+	server := testutils.ServeSMTP(t)
+	m := createTestingMailer(t, server)
+
+	now := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+	m.Now = func() time.Time { return now }
+
+	if err := m.Queue("not an address", "mail_test.html", nil); err != ErrInvalidRecipient("not an address") {
+		t.Errorf("Unexpected error %v", err)
+	}
+	data := map[string]interface{}{"name": "Tom & Jerry"}
+	if err := m.Queue("Test <test@example.com>", "mail_test.html", data); err != nil {
+		t.Fatal(err)
+	}
+
+	// the server refuses the mail, it is tried again later
+	server.Reject(true)
+	if n, err := m.Flush(); n != 0 || err == nil {
+		t.Fatalf("Unexpected flush %d, %v", n, err)
+	}
+	messages, err := GetMessages(m.DB, 10)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(messages) != 1 || messages[0].Attempts != 1 || !strings.HasPrefix(messages[0].Error, "451") {
+		t.Fatalf("Unexpected queue %+v", messages)
+	}
+	if messages[0].Subject != "Hello Tom & Jerry" {
+		t.Errorf("Unexpected subject %q", messages[0].Subject)
+	}
+
+	server.Reject(false)
+	if n, err := m.Flush(); n != 0 || err != nil {
+		t.Errorf("The mail has been tried again too soon: %d, %v", n, err)
+	}
+
+	now = now.Add(backoff(1))
+	if n, err := m.Flush(); n != 1 || err != nil {
+		t.Fatalf("Unexpected flush %d, %v", n, err)
+	}
+
+	mails := server.Mails()
+	if len(mails) != 1 || mails[0].From != "admin@example.com" || mails[0].To[0] != "test@example.com" {
+		t.Fatalf("Unexpected mails %+v", mails)
+	}
+	if !strings.Contains(mails[0].Data, "<html><body><p>Dear Tom &amp; Jerry,</p></body></html>") {
+		t.Errorf("Unexpected body %s", mails[0].Data)
+	}
+
+	if messages, err = GetMessages(m.DB, 10); err != nil {
+		t.Fatal(err)
+	} else if !messages[0].Sent.Valid || messages[0].Error != "" {
+		t.Errorf("The mail isn't marked as sent %+v", messages[0])
+	}
+}
+
+func TestQueuePrivate(t *testing.T) {
+	server := testutils.ServeSMTP(t)
+	m := createTestingMailer(t, server)
+
+	data := map[string]interface{}{"name": "Jerry"}
+	if err := m.QueuePrivate("test@example.com", "mail_test.html", data); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Queue("test@example.com", "mail_test.html", data); err != nil {
+		t.Fatal(err)
+	}
+
+	if n, err := m.Flush(); n != 2 || err != nil {
+		t.Fatalf("Unexpected flush %d, %v", n, err)
+	}
+	if mails := server.Mails(); len(mails) != 2 || !strings.Contains(mails[0].Data, "Dear Jerry") {
+		t.Fatalf("Unexpected mails %+v", mails)
+	}
+
+	// the sent private mail keeps only the subject
+	messages, err := GetMessages(m.DB, 10)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(messages) != 2 {
+		t.Fatalf("Found %d messages, Expected 2", len(messages))
+	}
+	if public := messages[0]; public.Private || public.Body == "" {
+		t.Errorf("Unexpected public mail %+v", public)
+	}
+	if private := messages[1]; !private.Private || private.Body != "" || private.Subject != "Hello Jerry" {
+		t.Errorf("Unexpected private mail %+v", private)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	expected := []time.Duration{time.Minute, 4 * time.Minute, 16 * time.Minute, 64 * time.Minute}
+	for i, d := range expected {
+		if b := backoff(i + 1); b != d {
+			t.Errorf("backoff(%d) = %v; Expected %v", i+1, b, d)
+		}
+	}
+}
@@ -0,0 +1,185 @@
+package scheduler
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Schedule returns the next time a job runs after the given one.
+type Schedule interface {
+	Next(after time.Time) time.Time
+}
+
+type ErrInvalidSchedule string
+
+func (is ErrInvalidSchedule) Error() string {
+	return fmt.Sprintf("'%s' is not a valid schedule, use '@every 1h', '@daily' or the five fields of cron", string(is))
+}
+
+// interval runs a job at a fixed distance from the previous run.
+type interval time.Duration
+
+func (i interval) Next(after time.Time) time.Time {
+	return after.Add(time.Duration(i))
+}
+
+// Every returns the schedule of a job run every d, a minute at least.
+func Every(d time.Duration) Schedule {
+	if d < time.Minute {
+		d = time.Minute
+	}
+	return interval(d)
+}
+
+// cron holds a bit for each value matched by the fields.
+type cron struct {
+	minute, hour, dom, month, dow uint64
+
+	// the days match either field when both are restricted
+	anyDom, anyDow bool
+}
+
+// bounds of the fields of cron
+var fields = []struct {
+	min, max int
+}{
+	{0, 59}, // minute
+	{0, 23}, // hour
+	{1, 31}, // day of month
+	{1, 12}, // month
+	{0, 7},  // day of week, 0 and 7 are sunday
+}
+
+var descriptors = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+// parseField returns the bits of a field written as a comma separated
+// list of *, n or n-m, each optionally followed by /step.
+func parseField(field string, min, max int) (uint64, error) {
+	bits := uint64(0)
+	for _, item := range strings.Split(field, ",") {
+		step := 1
+		if i := strings.Index(item, "/"); i >= 0 {
+			n, err := strconv.Atoi(item[i+1:])
+			if err != nil || n <= 0 {
+				return 0, fmt.Errorf("invalid step in '%s'", item)
+			}
+			item, step = item[:i], n
+		}
+
+		start, end := min, max
+		if item != "*" {
+			bounds := strings.SplitN(item, "-", 2)
+			n, err := strconv.Atoi(bounds[0])
+			if err != nil {
+				return 0, fmt.Errorf("invalid value '%s'", item)
+			}
+			start, end = n, n
+			if len(bounds) == 2 {
+				if end, err = strconv.Atoi(bounds[1]); err != nil {
+					return 0, fmt.Errorf("invalid range '%s'", item)
+				}
+			} else if step > 1 {
+				// n/step runs from n to the end
+				end = max
+			}
+		}
+		if start < min || end > max || start > end {
+			return 0, fmt.Errorf("'%s' is out of the range %d-%d", item, min, max)
+		}
+
+		for v := start; v <= end; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+	return bits, nil
+}
+
+// Parse returns the schedule of spec, either "@every <duration>", one
+// of the descriptors like @hourly and @daily or the five fields of
+// cron: minute, hour, day of month, month and day of week. The times
+// of cron are in the local time zone.
+func Parse(spec string) (Schedule, error) {
+	spec = strings.TrimSpace(spec)
+	if strings.HasPrefix(spec, "@every ") {
+		d, err := time.ParseDuration(strings.TrimSpace(strings.TrimPrefix(spec, "@every ")))
+		if err != nil || d <= 0 {
+			return nil, ErrInvalidSchedule(spec)
+		}
+		return Every(d), nil
+	}
+	if expanded, ok := descriptors[spec]; ok {
+		spec = expanded
+	}
+
+	parts := strings.Fields(spec)
+	if len(parts) != len(fields) {
+		return nil, ErrInvalidSchedule(spec)
+	}
+
+	bits := make([]uint64, len(fields))
+	for i, part := range parts {
+		var err error
+		if bits[i], err = parseField(part, fields[i].min, fields[i].max); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidSchedule(spec), err)
+		}
+	}
+
+	// sunday is both 0 and 7
+	if bits[4]&(1<<7) != 0 {
+		bits[4] |= 1
+	}
+	return &cron{
+		minute: bits[0],
+		hour:   bits[1],
+		dom:    bits[2],
+		month:  bits[3],
+		dow:    bits[4],
+		anyDom: parts[2] == "*",
+		anyDow: parts[4] == "*",
+	}, nil
+}
+
+func (c *cron) matchDay(t time.Time) bool {
+	dom := c.dom&(1<<uint(t.Day())) != 0
+	dow := c.dow&(1<<uint(t.Weekday())) != 0
+	switch {
+	case c.anyDom:
+		return dow
+	case c.anyDow:
+		return dom
+	default:
+		return dom || dow
+	}
+}
+
+// Next returns the first minute after the given time matched by the
+// fields, the zero time if none does within five years.
+func (c *cron) Next(after time.Time) time.Time {
+	t := after.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		switch {
+		case c.month&(1<<uint(t.Month())) == 0:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+		case !c.matchDay(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+		case c.hour&(1<<uint(t.Hour())) == 0:
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+		case c.minute&(1<<uint(t.Minute())) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
@@ -0,0 +1,61 @@
+package scheduler
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParse(t *testing.T) {
+	for _, spec := range []string{"", "* * * *", "60 * * * *", "* 24 * * *", "* * 0 * *", "5-1 * * * *", "*/0 * * * *", "@every", "@every -1h", "@often"} {
+		if _, err := Parse(spec); err == nil {
+			t.Errorf("The schedule '%s' has been accepted", spec)
+		}
+	}
+
+	schedule, err := Parse("@every 90s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+	if next := schedule.Next(start); !next.Equal(start.Add(90 * time.Second)) {
+		t.Errorf("Unexpected next run %v", next)
+	}
+}
+
+func TestCronNext(t *testing.T) {
+	// monday 19 october 2026
+	start := time.Date(2026, 10, 19, 12, 30, 15, 0, time.UTC)
+	tests := []struct {
+		spec string
+		next time.Time
+	}{
+		{"* * * * *", time.Date(2026, 10, 19, 12, 31, 0, 0, time.UTC)},
+		{"@hourly", time.Date(2026, 10, 19, 13, 0, 0, 0, time.UTC)},
+		{"@daily", time.Date(2026, 10, 20, 0, 0, 0, 0, time.UTC)},
+		{"*/20 * * * *", time.Date(2026, 10, 19, 12, 40, 0, 0, time.UTC)},
+		{"15,45 9-17 * * *", time.Date(2026, 10, 19, 12, 45, 0, 0, time.UTC)},
+		{"0 3 * * 7", time.Date(2026, 10, 25, 3, 0, 0, 0, time.UTC)},
+		{"0 0 1 * *", time.Date(2026, 11, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 0 29 2 *", time.Date(2028, 2, 29, 0, 0, 0, 0, time.UTC)},
+		// either the day of the month or the day of the week
+		{"0 0 1 * 3", time.Date(2026, 10, 21, 0, 0, 0, 0, time.UTC)},
+	}
+	for _, test := range tests {
+		schedule, err := Parse(test.spec)
+		if err != nil {
+			t.Errorf("Parse(%s): %v", test.spec, err)
+			continue
+		}
+		if next := schedule.Next(start); !next.Equal(test.next) {
+			t.Errorf("Next of '%s' is %v; Expected %v", test.spec, next, test.next)
+		}
+	}
+
+	schedule, err := Parse("0 0 31 2 *")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next := schedule.Next(start); !next.IsZero() {
+		t.Errorf("The 31st of February is %v", next)
+	}
+}
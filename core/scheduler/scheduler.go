@@ -0,0 +1,491 @@
+package scheduler
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/funnydog/mailadmin/core/db"
+)
+
+// DefaultLockTimeout is how long a job holds its lock, an instance
+// which died while running it doesn't keep it forever.
+const DefaultLockTimeout = time.Hour
+
+// HistoryDays is how long the runs are kept in the history.
+const HistoryDays = 30
+
+var ErrJobRunning = errors.New("The job is already running")
+
+type ErrJobNotFound string
+
+func (jn ErrJobNotFound) Error() string {
+	return fmt.Sprintf("The job '%s' doesn't exist", string(jn))
+}
+
+type ErrJobExists string
+
+func (je ErrJobExists) Error() string {
+	return fmt.Sprintf("The job '%s' has already been added", string(je))
+}
+
+// Job is a task run periodically by the scheduler.
+type Job struct {
+	Name        string
+	Description string
+	Spec        string
+	Schedule    Schedule
+	Run         func() error
+
+	// zero until the scheduler starts
+	Next    time.Time
+	Running bool
+}
+
+// Run is an execution of a job kept in the history.
+type Run struct {
+	Id       sql.NullInt64
+	Job      string
+	Manual   bool
+	Started  time.Time
+	Finished sql.NullTime
+	Error    string
+}
+
+// Status returns running, failed or ok.
+func (run *Run) Status() string {
+	switch {
+	case !run.Finished.Valid:
+		return "running"
+	case run.Error != "":
+		return "failed"
+	default:
+		return "ok"
+	}
+}
+
+// Duration returns how long the run took, rounded to the millisecond.
+func (run *Run) Duration() time.Duration {
+	if !run.Finished.Valid {
+		return 0
+	}
+	return run.Finished.Time.Sub(run.Started).Round(time.Millisecond)
+}
+
+func (run *Run) scan(s interface{ Scan(...interface{}) error }) error {
+	return s.Scan(
+		&run.Id,
+		&run.Job,
+		&run.Manual,
+		&run.Started,
+		&run.Finished,
+		&run.Error,
+	)
+}
+
+// Scheduler runs the jobs of the web server. Every run takes a lock in
+// the database, so only one of the instances sharing it runs a job at
+// a time, and is written in the history.
+type Scheduler struct {
+	DB          *db.Database
+	Owner       string
+	LockTimeout time.Duration
+	Now         func() time.Time
+
+	mutex sync.Mutex
+	jobs  []*Job
+	stop  chan struct{}
+}
+
+// New returns a scheduler without jobs, the owner of the locks is the
+// host and the process id.
+func New(database *db.Database) *Scheduler {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "localhost"
+	}
+	return &Scheduler{
+		DB:          database,
+		Owner:       fmt.Sprintf("%s:%d", host, os.Getpid()),
+		LockTimeout: DefaultLockTimeout,
+		Now:         time.Now,
+	}
+}
+
+// Add adds the job name run on the schedule of spec, see Parse.
+func (s *Scheduler) Add(name, description, spec string, run func() error) error {
+	schedule, err := Parse(spec)
+	if err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, job := range s.jobs {
+		if job.Name == name {
+			return ErrJobExists(name)
+		}
+	}
+	s.jobs = append(s.jobs, &Job{
+		Name:        name,
+		Description: description,
+		Spec:        spec,
+		Schedule:    schedule,
+		Run:         run,
+	})
+	return nil
+}
+
+// Jobs returns a copy of the jobs in the order they were added.
+func (s *Scheduler) Jobs() []Job {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	jobs := make([]Job, len(s.jobs))
+	for i, job := range s.jobs {
+		jobs[i] = *job
+	}
+	return jobs
+}
+
+func (s *Scheduler) find(name string) (*Job, error) {
+	for _, job := range s.jobs {
+		if job.Name == name {
+			return job, nil
+		}
+	}
+	return nil, ErrJobNotFound(name)
+}
+
+// Start runs the jobs when they are due until Stop is called, the
+// first runs are the next times of the schedules.
+func (s *Scheduler) Start() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.stop != nil {
+		return
+	}
+
+	now := s.Now()
+	for _, job := range s.jobs {
+		job.Next = job.Schedule.Next(now)
+	}
+	s.stop = make(chan struct{})
+	go s.loop(s.stop)
+}
+
+// Stop stops the scheduler, the jobs running finish.
+func (s *Scheduler) Stop() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.stop != nil {
+		close(s.stop)
+		s.stop = nil
+	}
+}
+
+func (s *Scheduler) loop(stop chan struct{}) {
+	for {
+		// wake up at the next run, or after a minute in case the
+		// clock has been changed
+		s.mutex.Lock()
+		now := s.Now()
+		wait := time.Minute
+		for _, job := range s.jobs {
+			if job.Next.IsZero() {
+				continue
+			}
+			if !job.Next.After(now) {
+				job.Next = job.Schedule.Next(now)
+				go s.execute(job.Name, false)
+			}
+			if d := job.Next.Sub(now); d > 0 && d < wait {
+				wait = d
+			}
+		}
+		s.mutex.Unlock()
+
+		select {
+		case <-stop:
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+// Trigger runs the job at once in the background, the error is
+// logged and written in the history.
+func (s *Scheduler) Trigger(name string) error {
+	s.mutex.Lock()
+	job, err := s.find(name)
+	running := err == nil && job.Running
+	s.mutex.Unlock()
+	if err != nil {
+		return err
+	} else if running {
+		return ErrJobRunning
+	}
+
+	go s.execute(name, true)
+	return nil
+}
+
+func (s *Scheduler) execute(name string, manual bool) {
+	if _, err := s.RunJob(name, manual); err != nil && err != ErrJobRunning {
+		log.Printf("job %s: %v\n", name, err)
+	}
+}
+
+// RunJob runs the job and waits for it, the returned error is either
+// the one of the job or ErrJobRunning if the job is running here or in
+// another instance.
+func (s *Scheduler) RunJob(name string, manual bool) (Run, error) {
+	s.mutex.Lock()
+	job, err := s.find(name)
+	if err == nil && job.Running {
+		err = ErrJobRunning
+	} else if err == nil {
+		job.Running = true
+	}
+	s.mutex.Unlock()
+	if err != nil {
+		return Run{}, err
+	}
+
+	defer func() {
+		s.mutex.Lock()
+		job.Running = false
+		s.mutex.Unlock()
+	}()
+
+	locked, err := s.lock(name)
+	if err != nil {
+		return Run{}, err
+	} else if !locked {
+		return Run{}, ErrJobRunning
+	}
+	defer func() {
+		if err := s.unlock(name); err != nil {
+			log.Printf("job %s: %v\n", name, err)
+		}
+	}()
+
+	run := Run{Job: name, Manual: manual, Started: s.Now().UTC()}
+	if err = run.create(s.DB); err != nil {
+		return run, err
+	}
+
+	jobErr := runSafely(job.Run)
+	run.Finished = sql.NullTime{Time: s.Now().UTC(), Valid: true}
+	if jobErr != nil {
+		run.Error = jobErr.Error()
+	}
+	if err = run.finish(s.DB); err != nil {
+		return run, err
+	}
+	if err = purgeRuns(s.DB, s.Now().AddDate(0, 0, -HistoryDays)); err != nil {
+		return run, err
+	}
+	return run, jobErr
+}
+
+// runSafely turns the panics of the job in errors.
+func runSafely(fn func() error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return fn()
+}
+
+// lock takes the lock of the job unless another owner holds it and
+// it hasn't expired.
+func (s *Scheduler) lock(name string) (bool, error) {
+	stmt, err := s.DB.FindStatement("jobLock")
+	if err != nil {
+		return false, err
+	}
+
+	now := s.Now().UTC()
+	result, err := stmt.Exec(name, s.Owner, now.Add(s.LockTimeout), now)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+func (s *Scheduler) unlock(name string) error {
+	stmt, err := s.DB.FindStatement("jobUnlock")
+	if err != nil {
+		return err
+	}
+
+	_, err = stmt.Exec(name, s.Owner)
+	return err
+}
+
+func (run *Run) create(db db.Querier) error {
+	stmt, err := db.FindStatement("jobRunCreate")
+	if err != nil {
+		return err
+	}
+
+	res, err := stmt.Exec(run.Job, run.Manual, run.Started)
+	if err != nil {
+		return err
+	}
+
+	run.Id.Int64, err = res.LastInsertId()
+	if err != nil {
+		return err
+	}
+	run.Id.Valid = true
+	return nil
+}
+
+func (run *Run) finish(db db.Querier) error {
+	stmt, err := db.FindStatement("jobRunFinish")
+	if err != nil {
+		return err
+	}
+
+	_, err = stmt.Exec(run.Finished, run.Error, run.Id)
+	return err
+}
+
+func purgeRuns(db db.Querier, before time.Time) error {
+	stmt, err := db.FindStatement("jobRunPurge")
+	if err != nil {
+		return err
+	}
+
+	_, err = stmt.Exec(before.UTC())
+	return err
+}
+
+// GetRuns returns the latest runs of all the jobs.
+func GetRuns(db db.Querier, limit int) ([]Run, error) {
+	runs := []Run{}
+
+	stmt, err := db.FindStatement("jobRunList")
+	if err != nil {
+		return runs, err
+	}
+
+	rows, err := stmt.Query(limit)
+	if err != nil {
+		return runs, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		run := Run{}
+		if err = run.scan(rows); err != nil {
+			return runs, err
+		}
+		runs = append(runs, run)
+	}
+	return runs, rows.Err()
+}
+
+// GetLastRun returns the latest run of the job, sql.ErrNoRows if it
+// never ran.
+func GetLastRun(db db.Querier, name string) (Run, error) {
+	run := Run{}
+
+	stmt, err := db.FindStatement("jobRunLast")
+	if err != nil {
+		return run, err
+	}
+
+	err = run.scan(stmt.QueryRow(name))
+	return run, err
+}
+
+const runColumns = `id, name, manual, started, finished, error`
+
+// PrepareStatements prepares the statements of the scheduler, the
+// tables must exist.
+func PrepareStatements(database *db.Database) error {
+	stmts := map[string]string{
+		// the lock is taken if free or expired
+		"jobLock": `INSERT INTO job_lock(name, owner, expires) VALUES ($1, $2, $3)
+ON CONFLICT(name) DO UPDATE SET owner=excluded.owner, expires=excluded.expires WHERE job_lock.expires < $4`,
+		"jobUnlock": `DELETE FROM job_lock WHERE name=$1 AND owner=$2`,
+
+		"jobRunCreate": `INSERT INTO job_run(name, manual, started) VALUES ($1, $2, $3)`,
+		"jobRunFinish": `UPDATE job_run SET finished=$1, error=$2 WHERE id=$3`,
+		"jobRunPurge":  `DELETE FROM job_run WHERE started < $1`,
+		"jobRunList":   `SELECT ` + runColumns + ` FROM job_run ORDER BY id DESC LIMIT $1`,
+		"jobRunLast":   `SELECT ` + runColumns + ` FROM job_run WHERE name=$1 ORDER BY id DESC LIMIT 1`,
+	}
+
+	for key, sql := range stmts {
+		if err := database.PrepareStatement(key, sql); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// migrations upgrade the databases created by the previous versions,
+// the first one by a version without the scheduler.
+var migrations = []db.Migration{
+	{Description: "jobs", Statements: []string{
+		`CREATE TABLE IF NOT EXISTS job_lock (
+	name VARCHAR(50) PRIMARY KEY,
+	owner VARCHAR(255) NOT NULL,
+	expires DATETIME NOT NULL
+)`,
+		`CREATE TABLE IF NOT EXISTS job_run (
+	id INTEGER PRIMARY KEY,
+	name VARCHAR(50) NOT NULL,
+	manual TINYINT(1) NOT NULL DEFAULT '0',
+	started DATETIME NOT NULL,
+	finished DATETIME NULL DEFAULT NULL,
+	error TEXT NOT NULL DEFAULT ''
+)`,
+		`CREATE INDEX IF NOT EXISTS job_run_name ON job_run(name)`,
+	}},
+}
+
+// Migrate upgrades the tables to the last schema.
+func Migrate(database *db.Database) (int, error) {
+	return database.Migrate("scheduler", migrations)
+}
+
+// CreateModel creates the tables of the locks and of the history.
+func CreateModel(database *db.Database) error {
+	_, err := database.Db.Exec(`
+CREATE TABLE job_lock (
+	name VARCHAR(50) PRIMARY KEY,
+	owner VARCHAR(255) NOT NULL,
+	expires DATETIME NOT NULL
+);`)
+	if err != nil {
+		return err
+	}
+
+	_, err = database.Db.Exec(`
+CREATE TABLE job_run (
+	id INTEGER PRIMARY KEY,
+	name VARCHAR(50) NOT NULL,
+	manual TINYINT(1) NOT NULL DEFAULT '0',
+	started DATETIME NOT NULL,
+	finished DATETIME NULL DEFAULT NULL,
+	error TEXT NOT NULL DEFAULT ''
+);
+CREATE INDEX job_run_name ON job_run(name);
+`)
+	if err != nil {
+		return err
+	}
+
+	return database.SetSchemaVersion("scheduler", len(migrations))
+}
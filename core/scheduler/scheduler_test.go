@@ -0,0 +1,115 @@
+package scheduler
+
+import (
+	"database/sql"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/funnydog/mailadmin/core/db"
+	"github.com/funnydog/mailadmin/testutils"
+)
+
+const databasePath = "/tmp/test-scheduler.db"
+
+func createTestingDatabase(t *testing.T) *db.Database {
+	database := testutils.ConnectTestingDatabase(t, databasePath)
+	if err := CreateModel(database); err != nil {
+		t.Fatal(err)
+	}
+	if err := PrepareStatements(database); err != nil {
+		t.Fatal(err)
+	}
+	return database
+}
+
+func TestRunJob(t *testing.T) {
+	database := createTestingDatabase(t)
+
+	s := New(database)
+	count := 0
+	if err := s.Add("count", "Count the runs", "@every 1h", func() error {
+		count++
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Add("count", "Again", "@daily", nil); err != ErrJobExists("count") {
+		t.Errorf("Unexpected error %v", err)
+	}
+	if err := s.Add("fail", "Fail", "@daily", func() error {
+		panic("broken")
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := GetLastRun(database, "count"); err != sql.ErrNoRows {
+		t.Errorf("Unexpected error %v", err)
+	}
+
+	run, err := s.RunJob("count", true)
+	if err != nil {
+		t.Fatal(err)
+	} else if count != 1 || run.Status() != "ok" || !run.Manual {
+		t.Errorf("Unexpected run %+v, count %d", run, count)
+	}
+
+	if _, err = s.RunJob("fail", false); err == nil {
+		t.Error("The panic of the job has been ignored")
+	}
+	last, err := GetLastRun(database, "fail")
+	if err != nil {
+		t.Fatal(err)
+	} else if last.Status() != "failed" || last.Error != "panic: broken" {
+		t.Errorf("Unexpected run %+v", last)
+	}
+
+	if _, err = s.RunJob("missing", false); !errors.Is(err, ErrJobNotFound("missing")) {
+		t.Errorf("Unexpected error %v", err)
+	}
+
+	runs, err := GetRuns(database, 10)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(runs) != 2 || runs[0].Job != "fail" || runs[1].Job != "count" {
+		t.Errorf("Unexpected runs %v", runs)
+	}
+}
+
+func TestLock(t *testing.T) {
+	database := createTestingDatabase(t)
+
+	now := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+	first, second := New(database), New(database)
+	first.Owner, second.Owner = "first", "second"
+	first.Now = func() time.Time { return now }
+	second.Now = first.Now
+
+	if locked, err := first.lock("job"); err != nil || !locked {
+		t.Fatalf("The first instance didn't take the lock: %v", err)
+	}
+
+	// the other instance can't run the job until the lock expires
+	count := 0
+	if err := second.Add("job", "", "@hourly", func() error {
+		count++
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := second.RunJob("job", false); err != ErrJobRunning {
+		t.Errorf("Unexpected error %v", err)
+	}
+
+	now = now.Add(DefaultLockTimeout + time.Minute)
+	if _, err := second.RunJob("job", false); err != nil {
+		t.Fatal(err)
+	} else if count != 1 {
+		t.Errorf("The job ran %d times", count)
+	}
+
+	// the lock is released after the run
+	if locked, err := first.lock("job"); err != nil || !locked {
+		t.Errorf("The lock hasn't been released: %v", err)
+	}
+}
@@ -3,6 +3,7 @@ package template
 import (
 	"fmt"
 	"html/template"
+	"io"
 	"io/fs"
 	"net/http"
 	"path/filepath"
@@ -41,6 +42,16 @@ func (m *Manager) Render(w http.ResponseWriter, base, name string, data *map[str
 	return err
 }
 
+// Execute renders the block of the template into w, for the output
+// which isn't a page like the mails.
+func (m *Manager) Execute(w io.Writer, name, block string, data interface{}) error {
+	tmp, ok := m.templates[name]
+	if !ok {
+		return fmt.Errorf("Template %s not found", name)
+	}
+	return tmp.ExecuteTemplate(w, block, data)
+}
+
 func Create(fsys fs.FS, conf config.Static, um *urls.Manager) (Manager, error) {
 
 	// generic tags
@@ -0,0 +1,260 @@
+package dkim
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/funnydog/mailadmin/core/db"
+	"github.com/funnydog/mailadmin/types"
+)
+
+// algorithms of the keys, named after the k= tag of the DNS record
+const (
+	RSA     = "rsa"
+	Ed25519 = "ed25519"
+)
+
+// RSABits is the size of the RSA keys, the larger ones don't fit in a
+// TXT record of many DNS providers.
+const RSABits = 2048
+
+// names of the files written by WriteTables
+const (
+	KeyTable     = "KeyTable"
+	SigningTable = "SigningTable"
+	KeysDir      = "keys"
+)
+
+const header = "# Generated by mailadmin, do not edit.\n"
+
+var selectorRe = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?$`)
+
+type ErrAlgorithmNotSupported string
+
+func (an ErrAlgorithmNotSupported) Error() string {
+	return fmt.Sprintf("The DKIM algorithm '%s' is not supported", string(an))
+}
+
+type ErrInvalidSelector string
+
+func (is ErrInvalidSelector) Error() string {
+	return fmt.Sprintf("The selector '%s' must be made of lowercase letters, digits and dashes", string(is))
+}
+
+// ValidSelector checks that the selector can be used as a DNS label.
+func ValidSelector(selector string) error {
+	if !selectorRe.MatchString(selector) {
+		return ErrInvalidSelector(selector)
+	}
+	return nil
+}
+
+// DefaultSelector returns a selector based on the date, like the ones
+// suggested for opendkim-genkey.
+func DefaultSelector(now time.Time) string {
+	return now.Format("200601")
+}
+
+// Generate creates a new key of the domain with the given selector,
+// the key is not saved.
+func Generate(domain types.Domain, selector, algorithm string) (types.DKIMKey, error) {
+	key := types.DKIMKey{
+		Domain:    domain.Id,
+		Selector:  selector,
+		Algorithm: algorithm,
+		Active:    true,
+	}
+	if err := ValidSelector(selector); err != nil {
+		return key, err
+	}
+
+	var private interface{}
+	var public []byte
+	switch algorithm {
+	case RSA:
+		rsaKey, err := rsa.GenerateKey(rand.Reader, RSABits)
+		if err != nil {
+			return key, err
+		}
+		if public, err = x509.MarshalPKIXPublicKey(&rsaKey.PublicKey); err != nil {
+			return key, err
+		}
+		private = rsaKey
+
+	case Ed25519:
+		// RFC 8463 publishes the raw public key
+		edPublic, edKey, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return key, err
+		}
+		public = edPublic
+		private = edKey
+
+	default:
+		return key, ErrAlgorithmNotSupported(algorithm)
+	}
+
+	der, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		return key, err
+	}
+	key.PrivateKey = string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}))
+	key.PublicKey = base64.StdEncoding.EncodeToString(public)
+	return key, nil
+}
+
+// RecordName returns the name of the TXT record of the key.
+func RecordName(key types.DKIMKey, domain string) string {
+	return key.Selector + "._domainkey." + domain
+}
+
+// RecordValue returns the value of the TXT record of the key.
+func RecordValue(key types.DKIMKey) string {
+	return fmt.Sprintf("v=DKIM1; k=%s; p=%s", key.Algorithm, key.PublicKey)
+}
+
+// Record returns the TXT record in the zone file format, the value is
+// split in strings of 255 bytes at most as required by the DNS.
+func Record(key types.DKIMKey, domain string) string {
+	value := RecordValue(key)
+	parts := []string{}
+	for len(value) > 255 {
+		parts = append(parts, `"`+value[:255]+`"`)
+		value = value[255:]
+	}
+	parts = append(parts, `"`+value+`"`)
+
+	return fmt.Sprintf("%s. IN TXT ( %s )", RecordName(key, domain), strings.Join(parts, "\n\t"))
+}
+
+// keyPath returns the path of the private key relative to the
+// directory of the tables.
+func keyPath(key types.DKIMKey, domain string) string {
+	return filepath.Join(KeysDir, domain, key.Selector+".private")
+}
+
+// RemoveKey removes the private key written by WriteTables in dir, if
+// it exists.
+func RemoveKey(dir string, key types.DKIMKey, domain string) error {
+	err := os.Remove(filepath.Join(dir, keyPath(key, domain)))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// RenderTables returns the OpenDKIM KeyTable and SigningTable of the
+// active keys of the active domains, and the private keys, keyed by
+// the path relative to dir. Every active key is in the KeyTable, the
+// SigningTable uses the signing one of each domain.
+func RenderTables(db db.Querier, dir string) (map[string][]byte, error) {
+	domains, err := types.GetActiveDomains(db)
+	if err != nil {
+		return nil, err
+	}
+	names := map[int64]string{}
+	for _, d := range domains {
+		names[d.Id.Int64] = d.Name
+	}
+
+	keys, err := types.GetActiveDKIMKeys(db)
+	if err != nil {
+		return nil, err
+	}
+
+	var keyTable, signingTable bytes.Buffer
+	keyTable.WriteString(header)
+	signingTable.WriteString(header)
+
+	files := map[string][]byte{}
+	for _, key := range keys {
+		domain := names[key.Domain.Int64]
+		path := keyPath(key, domain)
+		files[path] = []byte(key.PrivateKey)
+
+		name := RecordName(key, domain)
+		fmt.Fprintf(&keyTable, "%s %s:%s:%s\n", name, domain, key.Selector, filepath.Join(dir, path))
+		if key.Signing {
+			fmt.Fprintf(&signingTable, "*@%s %s\n", domain, name)
+		}
+	}
+
+	files[KeyTable] = keyTable.Bytes()
+	files[SigningTable] = signingTable.Bytes()
+	return files, nil
+}
+
+// writeFile replaces the file atomically and reports if the content
+// changed, the private keys are readable only by the owner.
+func writeFile(path string, content []byte, mode os.FileMode) (bool, error) {
+	old, err := os.ReadFile(path)
+	if err == nil && bytes.Equal(old, content) {
+		return false, nil
+	}
+
+	if err = os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return false, err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return false, err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err = tmp.Write(content); err != nil {
+		tmp.Close()
+		return false, err
+	}
+	if err = tmp.Chmod(mode); err != nil {
+		tmp.Close()
+		return false, err
+	}
+	if err = tmp.Close(); err != nil {
+		return false, err
+	}
+	return true, os.Rename(tmp.Name(), path)
+}
+
+// WriteTables writes the tables and the private keys in dir and
+// reports if any of them changed. The KeyTable refers to the keys with
+// absolute paths if dir is absolute.
+func WriteTables(db db.Querier, dir string) (bool, error) {
+	files, err := RenderTables(db, dir)
+	if err != nil {
+		return false, err
+	}
+
+	paths := []string{}
+	for path := range files {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	changed := false
+	for _, path := range paths {
+		mode := os.FileMode(0644)
+		if strings.HasPrefix(path, KeysDir+string(filepath.Separator)) {
+			mode = 0600
+		}
+
+		c, err := writeFile(filepath.Join(dir, path), files[path], mode)
+		if err != nil {
+			return changed, err
+		}
+		changed = changed || c
+	}
+	return changed, nil
+}
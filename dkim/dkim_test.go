@@ -0,0 +1,166 @@
+package dkim
+
+import (
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/funnydog/mailadmin/testutils"
+	"github.com/funnydog/mailadmin/types"
+)
+
+const databasePath = "/tmp/test-dkim.db"
+
+func TestGenerate(t *testing.T) {
+	domain := types.Domain{Name: "example.com"}
+
+	key, err := Generate(domain, "202610", RSA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, _ := pem.Decode([]byte(key.PrivateKey))
+	private, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, _ := base64.StdEncoding.DecodeString(key.PublicKey)
+	public, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !private.(*rsa.PrivateKey).PublicKey.Equal(public) {
+		t.Error("The public key doesn't match the private one")
+	}
+
+	record := Record(key, domain.Name)
+	if !strings.HasPrefix(record, `202610._domainkey.example.com. IN TXT ( "v=DKIM1; k=rsa; p=`) {
+		t.Errorf("Unexpected record %s", record)
+	}
+	for _, part := range regexp.MustCompile(`"([^"]*)"`).FindAllStringSubmatch(record, -1) {
+		if len(part[1]) > 255 {
+			t.Errorf("The record string %s is too long", part[1])
+		}
+	}
+
+	key, err = Generate(domain, "ed", Ed25519)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if raw, _ := base64.StdEncoding.DecodeString(key.PublicKey); len(raw) != ed25519.PublicKeySize {
+		t.Errorf("The ed25519 public key is %d bytes long", len(raw))
+	}
+
+	if _, err = Generate(domain, "Bad_Selector", RSA); err == nil {
+		t.Error("Invalid selector accepted")
+	}
+	if _, err = Generate(domain, "x", "dsa"); err == nil {
+		t.Error("Invalid algorithm accepted")
+	}
+	if s := DefaultSelector(time.Date(2026, 10, 19, 0, 0, 0, 0, time.UTC)); s != "202610" {
+		t.Errorf("Default selector %s, Expected 202610", s)
+	}
+}
+
+func TestTables(t *testing.T) {
+	database, domain := testutils.CreateTestingDatabase(t, databasePath)
+
+	// rotation: both keys are published, the old one signs until the
+	// new one is promoted
+	keys := []types.DKIMKey{}
+	for _, selector := range []string{"old", "new"} {
+		key, err := Generate(domain, selector, Ed25519)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = key.Create(database); err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, key)
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !keys[0].Signing || keys[1].Signing {
+		t.Fatal("The new key signs before being promoted")
+	}
+
+	third, err := Generate(domain, "third", Ed25519)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = third.Create(database); err != types.ErrTooManyDKIMKeys {
+		t.Errorf("Create returned %v, Expected ErrTooManyDKIMKeys", err)
+	}
+
+	dir := t.TempDir()
+	changed, err := WriteTables(database, dir)
+	if err != nil {
+		t.Fatal(err)
+	} else if !changed {
+		t.Error("The tables have not been written")
+	}
+
+	keyTable, _ := os.ReadFile(filepath.Join(dir, KeyTable))
+	for _, selector := range []string{"old", "new"} {
+		line := selector + "._domainkey.example.com example.com:" + selector + ":" + filepath.Join(dir, "keys", "example.com", selector+".private")
+		if !strings.Contains(string(keyTable), line) {
+			t.Errorf("The KeyTable doesn't contain %s", line)
+		}
+	}
+
+	signingTable, _ := os.ReadFile(filepath.Join(dir, SigningTable))
+	if !strings.Contains(string(signingTable), "*@example.com old._domainkey.example.com\n") ||
+		strings.Contains(string(signingTable), "new.") {
+		t.Errorf("Unexpected SigningTable:\n%s", signingTable)
+	}
+
+	if err = keys[0].SetActive(database, false); err != types.ErrDKIMKeySigning {
+		t.Errorf("SetActive returned %v, Expected ErrDKIMKeySigning", err)
+	}
+	if err = keys[1].Promote(database); err != nil {
+		t.Fatal(err)
+	}
+	if changed, err = WriteTables(database, dir); err != nil {
+		t.Fatal(err)
+	} else if !changed {
+		t.Error("The promotion hasn't changed the tables")
+	}
+	signingTable, _ = os.ReadFile(filepath.Join(dir, SigningTable))
+	if !strings.Contains(string(signingTable), "*@example.com new._domainkey.example.com\n") ||
+		strings.Contains(string(signingTable), "old.") {
+		t.Errorf("Unexpected SigningTable:\n%s", signingTable)
+	}
+
+	info, err := os.Stat(filepath.Join(dir, "keys", "example.com", "new.private"))
+	if err != nil {
+		t.Fatal(err)
+	} else if info.Mode().Perm() != 0600 {
+		t.Errorf("The private key has mode %v, Expected 0600", info.Mode().Perm())
+	}
+
+	if changed, _ = WriteTables(database, dir); changed {
+		t.Error("The tables have been rewritten without changes")
+	}
+
+	old, err := types.GetDKIMKeyById(database, keys[0].Id.Int64)
+	if err != nil {
+		t.Fatal(err)
+	} else if err = old.SetActive(database, false); err != nil {
+		t.Fatal(err)
+	}
+	if err = RemoveKey(dir, keys[0], domain.Name); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(filepath.Join(dir, "keys", "example.com", "old.private")); !os.IsNotExist(err) {
+		t.Error("The private key hasn't been removed")
+	}
+	if err = RemoveKey(dir, keys[0], domain.Name); err != nil {
+		t.Errorf("Removing a missing key returned %v", err)
+	}
+}
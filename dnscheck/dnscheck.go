@@ -0,0 +1,287 @@
+package dnscheck
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/funnydog/mailadmin/dkim"
+	"github.com/funnydog/mailadmin/mtasts"
+	"github.com/funnydog/mailadmin/types"
+)
+
+// results of a check
+const (
+	Pass = "pass"
+	Warn = "warn"
+	Fail = "fail"
+)
+
+// DefaultTimeout bounds the time spent by all the checks of a domain.
+const DefaultTimeout = 10 * time.Second
+
+// Check is the result of the verification of a DNS record, Found lists
+// the values published and Expected what they should look like.
+type Check struct {
+	Name     string
+	Record   string
+	Status   string
+	Message  string
+	Found    []string
+	Expected string
+}
+
+// Checker resolves the records of the domains, MXHosts are the names
+// of the mail servers the MX records must point to, if set.
+type Checker struct {
+	Resolver *net.Resolver
+	MXHosts  []string
+	Timeout  time.Duration
+}
+
+// New returns a checker querying the DNS server at address, host:port,
+// or the resolver of the system if address is empty.
+func New(address string, mxHosts []string) *Checker {
+	c := Checker{
+		Resolver: net.DefaultResolver,
+		MXHosts:  mxHosts,
+		Timeout:  DefaultTimeout,
+	}
+	if address != "" {
+		c.Resolver = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, network, address)
+			},
+		}
+	}
+	return &c
+}
+
+func fqdn(name string) string {
+	return strings.TrimSuffix(strings.ToLower(name), ".") + "."
+}
+
+// notFound reports if the error means that the record doesn't exist,
+// as opposed to a failure of the resolver.
+func notFound(err error) bool {
+	var dnsErr *net.DNSError
+	return errors.As(err, &dnsErr) && dnsErr.IsNotFound
+}
+
+// lookupTXT returns the TXT records of name starting with prefix.
+func (c *Checker) lookupTXT(ctx context.Context, name, prefix string) ([]string, error) {
+	records, err := c.Resolver.LookupTXT(ctx, fqdn(name))
+	if notFound(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	found := []string{}
+	for _, r := range records {
+		if strings.HasPrefix(strings.ToLower(r), strings.ToLower(prefix)) {
+			found = append(found, r)
+		}
+	}
+	return found, nil
+}
+
+// tags parses the tag=value list of the SPF, DMARC, DKIM and MTA-STS
+// records.
+func tags(record string) map[string]string {
+	result := map[string]string{}
+	for _, part := range strings.Split(record, ";") {
+		if kv := strings.SplitN(strings.TrimSpace(part), "=", 2); len(kv) == 2 {
+			result[strings.ToLower(strings.TrimSpace(kv[0]))] = strings.TrimSpace(kv[1])
+		}
+	}
+	return result
+}
+
+func (c *Checker) checkMX(ctx context.Context, domain string) Check {
+	check := Check{Name: "MX", Record: domain, Expected: "at least one MX record"}
+	if len(c.MXHosts) > 0 {
+		check.Expected = "MX records pointing to " + strings.Join(c.MXHosts, ", ")
+	}
+
+	records, err := c.Resolver.LookupMX(ctx, fqdn(domain))
+	if err != nil && !notFound(err) {
+		check.Status, check.Message = Fail, err.Error()
+		return check
+	} else if len(records) == 0 {
+		check.Status, check.Message = Fail, "The domain has no MX records."
+		return check
+	}
+
+	expected := map[string]bool{}
+	for _, host := range c.MXHosts {
+		expected[fqdn(host)] = true
+	}
+
+	matches := 0
+	for _, mx := range records {
+		check.Found = append(check.Found, fmt.Sprintf("%d %s", mx.Pref, mx.Host))
+		if expected[fqdn(mx.Host)] {
+			matches++
+		}
+	}
+	sort.Strings(check.Found)
+
+	switch {
+	case len(expected) == 0 || matches == len(records):
+		check.Status = Pass
+	case matches > 0:
+		check.Status, check.Message = Warn, "Some MX records point to other servers."
+	default:
+		check.Status, check.Message = Fail, "The MX records point to other servers."
+	}
+	return check
+}
+
+func (c *Checker) checkSPF(ctx context.Context, domain string) Check {
+	check := Check{Name: "SPF", Record: domain, Expected: "v=spf1 mx -all"}
+
+	records, err := c.lookupTXT(ctx, domain, "v=spf1")
+	check.Found = records
+	switch {
+	case err != nil:
+		check.Status, check.Message = Fail, err.Error()
+	case len(records) == 0:
+		check.Status, check.Message = Fail, "The domain has no SPF record."
+	case len(records) > 1:
+		check.Status, check.Message = Fail, "The domain has more than one SPF record."
+	case strings.HasSuffix(records[0], "-all") || strings.HasSuffix(records[0], "~all"):
+		check.Status = Pass
+	case strings.Contains(records[0], "redirect="):
+		check.Status = Pass
+	default:
+		check.Status, check.Message = Warn, "The SPF record doesn't end with -all or ~all."
+	}
+	return check
+}
+
+func (c *Checker) checkDMARC(ctx context.Context, domain string) Check {
+	name := "_dmarc." + domain
+	check := Check{
+		Name:     "DMARC",
+		Record:   name,
+		Expected: "v=DMARC1; p=quarantine; rua=mailto:postmaster@" + domain,
+	}
+
+	records, err := c.lookupTXT(ctx, name, "v=DMARC1")
+	check.Found = records
+	switch {
+	case err != nil:
+		check.Status, check.Message = Fail, err.Error()
+	case len(records) == 0:
+		check.Status, check.Message = Fail, "The domain has no DMARC record."
+	case len(records) > 1:
+		check.Status, check.Message = Fail, "The domain has more than one DMARC record."
+	default:
+		switch strings.ToLower(tags(records[0])["p"]) {
+		case "quarantine", "reject":
+			check.Status = Pass
+		case "none":
+			check.Status, check.Message = Warn, "The DMARC policy is none, the failing mails are delivered."
+		default:
+			check.Status, check.Message = Fail, "The DMARC record has no valid policy."
+		}
+	}
+	return check
+}
+
+func (c *Checker) checkDKIM(ctx context.Context, domain string, key types.DKIMKey) Check {
+	name := key.Selector + "._domainkey." + domain
+	check := Check{
+		Name:     "DKIM " + key.Selector,
+		Record:   name,
+		Expected: dkim.RecordValue(key),
+	}
+
+	records, err := c.lookupTXT(ctx, name, "v=DKIM1")
+	check.Found = records
+	if err != nil {
+		check.Status, check.Message = Fail, err.Error()
+		return check
+	} else if len(records) == 0 {
+		check.Status, check.Message = Fail, "The DKIM record is not published."
+		return check
+	}
+
+	for _, r := range records {
+		if strings.ReplaceAll(tags(r)["p"], " ", "") == key.PublicKey {
+			check.Status = Pass
+			return check
+		}
+	}
+	check.Status, check.Message = Fail, "The published key differs from the one of the domain."
+	return check
+}
+
+// checkMTASTS compares the id of the record with the one of the policy,
+// nil if the domain has none: a stale id keeps the senders on the
+// policy they fetched before.
+func (c *Checker) checkMTASTS(ctx context.Context, domain string, policy *types.MTASTS) Check {
+	name := "_mta-sts." + domain
+	check := Check{Name: "MTA-STS", Record: name, Expected: "a policy on the MTA-STS page"}
+	id := ""
+	if policy != nil {
+		id = mtasts.PolicyID(*policy)
+		check.Expected = "v=STSv1; id=" + id
+	}
+
+	records, err := c.lookupTXT(ctx, name, "v=STSv1")
+	check.Found = records
+	switch {
+	case err != nil:
+		check.Status, check.Message = Fail, err.Error()
+	case len(records) == 0:
+		check.Status, check.Message = Warn, "MTA-STS is not enabled, the senders can't require TLS."
+	case len(records) > 1:
+		check.Status, check.Message = Fail, "The domain has more than one MTA-STS record."
+	case policy == nil:
+		check.Status, check.Message = Fail, "The MTA-STS record is published but the domain has no policy."
+	case tags(records[0])["id"] != id:
+		check.Status, check.Message = Fail, "The id of the MTA-STS record differs from the one of the policy, the senders won't fetch it again."
+	default:
+		check.Status = Pass
+	}
+	return check
+}
+
+// Run checks the records of the domain, keys are the DKIM keys which
+// must be published and policy the MTA-STS policy, nil if none.
+func (c *Checker) Run(ctx context.Context, domain string, keys []types.DKIMKey, policy *types.MTASTS) []Check {
+	ctx, cancel := context.WithTimeout(ctx, c.Timeout)
+	defer cancel()
+
+	checks := []Check{
+		c.checkMX(ctx, domain),
+		c.checkSPF(ctx, domain),
+		c.checkDMARC(ctx, domain),
+	}
+
+	published := 0
+	for _, key := range keys {
+		if key.Active {
+			checks = append(checks, c.checkDKIM(ctx, domain, key))
+			published++
+		}
+	}
+	if published == 0 {
+		checks = append(checks, Check{
+			Name:     "DKIM",
+			Status:   Warn,
+			Message:  "The domain has no active DKIM keys.",
+			Expected: "an active key on the DKIM page",
+		})
+	}
+
+	return append(checks, c.checkMTASTS(ctx, domain, policy))
+}
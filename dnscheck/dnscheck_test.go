@@ -0,0 +1,78 @@
+package dnscheck
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/funnydog/mailadmin/mtasts"
+	"github.com/funnydog/mailadmin/testutils"
+	"github.com/funnydog/mailadmin/types"
+)
+
+func statuses(checks []Check) map[string]string {
+	result := map[string]string{}
+	for _, c := range checks {
+		result[c.Name] = c.Status
+	}
+	return result
+}
+
+func TestRun(t *testing.T) {
+	key := types.DKIMKey{Selector: "mail", Algorithm: "rsa", PublicKey: strings.Repeat("A", 300), Active: true}
+	policy := types.MTASTS{Mode: mtasts.Enforce, Modified: time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)}
+	address := testutils.ServeDNS(t, testutils.DNSZone{
+		MX: map[string][]net.MX{
+			"good.com.":    {{Host: "mx.example.net.", Pref: 10}},
+			"partial.com.": {{Host: "mx.example.net.", Pref: 10}, {Host: "old.isp.com.", Pref: 20}},
+		},
+		TXT: map[string][]string{
+			"good.com.":                    {"v=spf1 mx -all", "google-site-verification=x"},
+			"_dmarc.good.com.":             {"v=DMARC1; p=reject"},
+			"mail._domainkey.good.com.":    {"v=DKIM1; k=rsa; p=" + key.PublicKey},
+			"_mta-sts.good.com.":           {"v=STSv1; id=" + mtasts.PolicyID(policy)},
+			"partial.com.":                 {"v=spf1 mx ?all"},
+			"_mta-sts.stale.com.":          {"v=STSv1; id=20250101000000"},
+			"_dmarc.partial.com.":          {"v=DMARC1; p=none"},
+			"mail._domainkey.partial.com.": {"v=DKIM1; k=rsa; p=OTHER"},
+		},
+	})
+	checker := New(address, []string{"mx.example.net"})
+
+	result := statuses(checker.Run(context.Background(), "good.com", []types.DKIMKey{key}, &policy))
+	for name, status := range result {
+		if status != Pass {
+			t.Errorf("good.com: %s is %s, Expected %s", name, status, Pass)
+		}
+	}
+
+	expected := map[string]string{
+		"MX": Warn, "SPF": Warn, "DMARC": Warn, "DKIM mail": Fail, "MTA-STS": Warn,
+	}
+	result = statuses(checker.Run(context.Background(), "partial.com", []types.DKIMKey{key}, &policy))
+	for name, status := range expected {
+		if result[name] != status {
+			t.Errorf("partial.com: %s is %s, Expected %s", name, result[name], status)
+		}
+	}
+
+	expected = map[string]string{
+		"MX": Fail, "SPF": Fail, "DMARC": Fail, "DKIM": Warn, "MTA-STS": Warn,
+	}
+	result = statuses(checker.Run(context.Background(), "missing.com", nil, nil))
+	for name, status := range expected {
+		if result[name] != status {
+			t.Errorf("missing.com: %s is %s, Expected %s", name, result[name], status)
+		}
+	}
+
+	// the id must be the one of the policy saved last
+	if status := statuses(checker.Run(context.Background(), "stale.com", nil, &policy))["MTA-STS"]; status != Fail {
+		t.Errorf("stale.com: MTA-STS is %s, Expected %s", status, Fail)
+	}
+	if status := statuses(checker.Run(context.Background(), "good.com", nil, nil))["MTA-STS"]; status != Fail {
+		t.Errorf("good.com without a policy: MTA-STS is %s, Expected %s", status, Fail)
+	}
+}
@@ -0,0 +1,227 @@
+package importer
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/funnydog/mailadmin/core/db"
+	"github.com/funnydog/mailadmin/core/form"
+	"github.com/funnydog/mailadmin/types"
+)
+
+const (
+	KindMailbox = "mailbox"
+	KindAlias   = "alias"
+)
+
+var (
+	ErrInvalidRows = errors.New("The file contains errors, nothing has been imported.")
+	emailField     = form.EmailField{Required: true}
+)
+
+// Row is a record of the CSV file along with the errors found while
+// validating it. The Target is the redirect_to address of the aliases.
+type Row struct {
+	Line     int
+	Kind     string
+	Address  string
+	Target   string
+	Active   bool
+	Errors   []string
+	password string
+}
+
+func (r *Row) Valid() bool {
+	return len(r.Errors) == 0
+}
+
+func (r *Row) addError(format string, args ...interface{}) {
+	r.Errors = append(r.Errors, fmt.Sprintf(format, args...))
+}
+
+// CSV holds the validated rows to import in a domain. Each row has the
+// form:
+//
+//	mailbox,<email>,<password>[,<active>]
+//	alias,<destination>,<redirect_to>[,<active>]
+//
+// an optional header starting with "type" and lines starting with #
+// are skipped.
+type CSV struct {
+	Domain types.Domain
+	Rows   []Row
+}
+
+func (c *CSV) Valid() bool {
+	for i := range c.Rows {
+		if !c.Rows[i].Valid() {
+			return false
+		}
+	}
+	return true
+}
+
+// Count returns the number of mailboxes and aliases in the file.
+func (c *CSV) Count() (mailboxes, aliases int) {
+	for _, row := range c.Rows {
+		if row.Kind == KindMailbox {
+			mailboxes++
+		} else if row.Kind == KindAlias {
+			aliases++
+		}
+	}
+	return mailboxes, aliases
+}
+
+func parseActive(value string) (bool, bool) {
+	switch strings.ToLower(value) {
+	case "", "1", "y", "yes", "true", "on", "active":
+		return true, true
+	case "0", "n", "no", "false", "off", "inactive":
+		return false, true
+	}
+	return false, false
+}
+
+// ReadCSV reads and validates the rows of in with the same rules of
+// the mailbox and alias forms, the passwords must satisfy the policy.
+// The returned error is not nil only if the file cannot be read, the
+// errors of the rows are stored in each row.
+func ReadCSV(db db.Querier, domain types.Domain, policy *form.PasswordPolicy, in io.Reader) (*CSV, error) {
+	reader := csv.NewReader(in)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+	reader.Comment = '#'
+
+	passwordField := form.PasswordField{Required: true, Policy: policy}
+	result := CSV{Domain: domain, Rows: []Row{}}
+	emails := map[string]int{}
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		line, _ := reader.FieldPos(0)
+		for i := range record {
+			record[i] = strings.TrimSpace(record[i])
+		}
+
+		kind := strings.ToLower(record[0])
+		if len(result.Rows) == 0 && (kind == "type" || kind == "kind") {
+			continue
+		}
+
+		row := Row{Line: line, Kind: kind, Active: true}
+		if len(record) < 3 {
+			row.addError("Expected at least 3 columns, found %d.", len(record))
+			result.Rows = append(result.Rows, row)
+			continue
+		}
+		row.Address = record[1]
+
+		if len(record) > 3 {
+			var ok bool
+			if row.Active, ok = parseActive(record[3]); !ok {
+				row.addError("The active column '%s' is not valid.", record[3])
+			}
+		}
+
+		if _, err := emailField.Clean(row.Address); err != nil {
+			row.addError("%s", err)
+		} else if !domain.Contains(row.Address) {
+			row.addError("The address doesn't end with @%s.", domain.Name)
+		}
+
+		switch kind {
+		case KindMailbox:
+			row.password = record[2]
+			if row.password == "" {
+				row.addError("The password cannot be empty.")
+			} else if _, err := passwordField.Clean(row.password); err != nil {
+				row.addError("%s", err)
+			}
+
+			if prev, ok := emails[row.Address]; ok {
+				row.addError("The mailbox is already present at line %d.", prev)
+			} else if _, err := types.GetMailboxByEmail(db, row.Address); err == nil {
+				row.addError("The mailbox already exists.")
+			} else if err != sql.ErrNoRows {
+				return nil, err
+			}
+			emails[row.Address] = row.Line
+
+		case KindAlias:
+			row.Target = record[2]
+			if _, err := emailField.Clean(row.Target); err != nil {
+				row.addError("%s", err)
+			}
+
+		default:
+			row.addError("The type '%s' is neither %s nor %s.", record[0], KindMailbox, KindAlias)
+		}
+
+		result.Rows = append(result.Rows, row)
+	}
+
+	return &result, nil
+}
+
+// Commit creates all the mailboxes and aliases in a single transaction
+// and fails if any of the rows is not valid. The created mailboxes are
+// returned to make their Maildirs.
+func (c *CSV) Commit(database *db.Database) ([]types.Mailbox, error) {
+	if !c.Valid() {
+		return nil, ErrInvalidRows
+	}
+
+	// hash the passwords before starting the transaction
+	mailboxes := []types.Mailbox{}
+	aliases := []types.Alias{}
+	for _, row := range c.Rows {
+		switch row.Kind {
+		case KindMailbox:
+			mailbox := types.Mailbox{
+				Domain: c.Domain.Id,
+				Email:  row.Address,
+				Active: row.Active,
+			}
+			if err := mailbox.SetPassword(row.password); err != nil {
+				return nil, err
+			}
+			mailboxes = append(mailboxes, mailbox)
+
+		case KindAlias:
+			aliases = append(aliases, types.Alias{
+				Domain:      c.Domain.Id,
+				Destination: row.Address,
+				RedirectTo:  row.Target,
+				Active:      row.Active,
+			})
+		}
+	}
+
+	err := database.WithTx(func(tx *db.Tx) error {
+		for i := range mailboxes {
+			if err := mailboxes[i].Create(tx); err != nil {
+				return fmt.Errorf("mailbox %s: %w", mailboxes[i].Email, err)
+			}
+		}
+		for i := range aliases {
+			if err := aliases[i].Create(tx); err != nil {
+				return fmt.Errorf("alias %s: %w", aliases[i].Destination, err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return mailboxes, nil
+}
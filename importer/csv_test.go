@@ -0,0 +1,108 @@
+package importer
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/funnydog/mailadmin/core/db"
+	"github.com/funnydog/mailadmin/core/form"
+	"github.com/funnydog/mailadmin/testutils"
+	"github.com/funnydog/mailadmin/types"
+)
+
+const (
+	databasePath = "/tmp/test-importer.db"
+
+	// a password satisfying the default policy
+	password = "Tulip-Orbit-58-Quay"
+)
+
+func createTestingDatabase(t *testing.T) (*db.Database, types.Domain) {
+	database, domain := testutils.CreateTestingDatabase(t, databasePath)
+
+	mailbox := types.Mailbox{Domain: domain.Id, Email: "taken@example.com", Active: true}
+	if err := mailbox.Create(database); err != nil {
+		t.Fatal(err)
+	}
+	return database, domain
+}
+
+func TestReadCSV(t *testing.T) {
+	database, domain := createTestingDatabase(t)
+
+	input := `type,address,target,active
+mailbox,one@example.com,` + password + `
+mailbox,two@example.com,` + password + `,no
+alias,info@example.com,one@example.com
+`
+	imp, err := ReadCSV(database, domain, form.NewPasswordPolicy(0, 0, 0), strings.NewReader(input))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !imp.Valid() {
+		t.Fatalf("Unexpected errors %v", imp.Rows)
+	}
+	if len(imp.Rows) != 3 {
+		t.Fatalf("Expected 3 rows, found %d", len(imp.Rows))
+	}
+	if imp.Rows[1].Active || imp.Rows[1].Line != 3 {
+		t.Errorf("Row not parsed correctly: %+v", imp.Rows[1])
+	}
+
+	if _, err = imp.Commit(database); err != nil {
+		t.Fatal(err)
+	}
+
+	mailbox, err := types.GetMailboxByEmail(database, "one@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mailbox.Password == password || mailbox.Password == "" {
+		t.Error("The password hasn't been hashed")
+	}
+
+	aliases, err := types.GetAliasList(database, domain.Id.Int64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(aliases) != 1 || aliases[0].RedirectTo != "one@example.com" {
+		t.Errorf("Alias not imported: %v", aliases)
+	}
+}
+
+func TestReadCSVErrors(t *testing.T) {
+	database, domain := createTestingDatabase(t)
+
+	input := `mailbox,new@example.com,` + password + `
+mailbox,new@example.com,` + password + `
+mailbox,taken@example.com,` + password + `
+mailbox,other@example.org,` + password + `
+mailbox,nopass@example.com,
+mailbox,weak@example.com,1
+mailbox,common@example.com,Password123
+alias,info@example.com,notanemail
+forward,info@example.com,one@example.com
+alias,short@example.com
+alias,bad@example.com,one@example.com,maybe
+`
+	imp, err := ReadCSV(database, domain, form.NewPasswordPolicy(0, 0, 0), strings.NewReader(input))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, row := range imp.Rows {
+		if i == 0 && !row.Valid() {
+			t.Errorf("Line %d: unexpected errors %v", row.Line, row.Errors)
+		} else if i > 0 && row.Valid() {
+			t.Errorf("Line %d: expected an error", row.Line)
+		}
+	}
+
+	// nothing must be committed if a row is not valid
+	if _, err = imp.Commit(database); err != ErrInvalidRows {
+		t.Errorf("Expected ErrInvalidRows, got %v", err)
+	}
+	if _, err = types.GetMailboxByEmail(database, "new@example.com"); err == nil {
+		t.Error("The mailbox has been imported")
+	}
+}
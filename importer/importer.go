@@ -0,0 +1,147 @@
+package importer
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/funnydog/mailadmin/backup"
+	"github.com/funnydog/mailadmin/types"
+)
+
+// Report lists the entries of a foreign source which couldn't be
+// mapped to domains, mailboxes and aliases.
+type Report struct {
+	Skipped []string
+}
+
+func (r *Report) skip(format string, args ...interface{}) {
+	r.Skipped = append(r.Skipped, fmt.Sprintf(format, args...))
+}
+
+// builder collects the records read from a foreign source and turns
+// them into a backup document which is then restored by backup.Import.
+type builder struct {
+	domains map[string]*backup.Domain
+	report  Report
+}
+
+func newBuilder() *builder {
+	return &builder{domains: map[string]*backup.Domain{}}
+}
+
+func domainOf(address string) string {
+	at := strings.LastIndex(address, "@")
+	if at < 0 {
+		return ""
+	}
+	return strings.ToLower(address[at+1:])
+}
+
+func (b *builder) domain(name string) *backup.Domain {
+	name = strings.ToLower(name)
+	d, ok := b.domains[name]
+	if !ok {
+		d = &backup.Domain{
+			Name:      name,
+			Active:    true,
+			Mailboxes: []backup.Mailbox{},
+			Aliases:   []backup.Alias{},
+		}
+		b.domains[name] = d
+	}
+	return d
+}
+
+func (b *builder) addMailbox(email, password string, active bool) {
+	email = strings.ToLower(email)
+	d := b.domain(domainOf(email))
+	d.Mailboxes = append(d.Mailboxes, backup.Mailbox{
+		Email:    email,
+		Password: password,
+		Active:   active,
+	})
+}
+
+// addAliases adds an alias for each target of the address. A target
+// equal to the address is kept only if there are other targets, in
+// which case the mail must still be delivered to the mailbox.
+func (b *builder) addAliases(address string, targets []string, active bool) {
+	address = strings.ToLower(address)
+	if domainOf(address) == "" || strings.HasPrefix(address, "@") {
+		b.report.skip("alias %s: catch-all and local addresses are not supported", address)
+		return
+	}
+
+	if len(targets) == 1 && strings.ToLower(targets[0]) == address {
+		return
+	}
+
+	d := b.domain(domainOf(address))
+	for _, target := range targets {
+		if domainOf(target) == "" {
+			b.report.skip("alias %s: the target %s is not an email address", address, target)
+			continue
+		}
+		d.Aliases = append(d.Aliases, backup.Alias{
+			Destination: address,
+			RedirectTo:  target,
+			Active:      active,
+		})
+	}
+}
+
+func (b *builder) document() backup.Document {
+	names := []string{}
+	for name := range b.domains {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	doc := backup.Document{Version: backup.Version, Domains: []backup.Domain{}}
+	for _, name := range names {
+		doc.Domains = append(doc.Domains, *b.domains[name])
+	}
+	return doc
+}
+
+// dovecotHash converts a crypt(3) hash to the dovecot format, the
+// bcrypt hashes are already in the format used by mailadmin.
+func dovecotHash(hash string) (string, bool) {
+	switch {
+	case strings.HasPrefix(hash, "{"):
+		return hash, true
+	case strings.HasPrefix(hash, "$2"):
+		return hash, true
+	case strings.HasPrefix(hash, "$1$"):
+		return "{MD5-CRYPT}" + hash, true
+	case strings.HasPrefix(hash, "$5$"):
+		return "{SHA256-CRYPT}" + hash, true
+	case strings.HasPrefix(hash, "$6$"):
+		return "{SHA512-CRYPT}" + hash, true
+	}
+	return "", false
+}
+
+// randomHash returns the hash of a password nobody knows, used for the
+// mailboxes imported without one.
+func randomHash() (string, error) {
+	buf := make([]byte, 24)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+
+	mailbox := types.Mailbox{}
+	err := mailbox.SetPassword(base64.StdEncoding.EncodeToString(buf))
+	return mailbox.Password, err
+}
+
+// splitTargets splits a list of addresses separated by commas and
+// white space.
+func splitTargets(value string) []string {
+	return strings.FieldsFunc(value, func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\t'
+	})
+}
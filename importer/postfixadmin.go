@@ -0,0 +1,93 @@
+package importer
+
+import (
+	"database/sql"
+
+	"github.com/funnydog/mailadmin/backup"
+)
+
+// ReadPostfixAdmin reads the domain, mailbox and alias tables of a
+// PostfixAdmin database. The aliases PostfixAdmin creates for each
+// mailbox pointing to itself are dropped, the alias domains and the
+// catch-all aliases are reported as skipped.
+func ReadPostfixAdmin(src *sql.DB) (backup.Document, Report, error) {
+	b := newBuilder()
+
+	rows, err := src.Query(`SELECT domain, description, backupmx, active FROM domain WHERE domain <> 'ALL' ORDER BY domain`)
+	if err != nil {
+		return backup.Document{}, b.report, err
+	}
+	for rows.Next() {
+		var name, description string
+		var backupmx, active bool
+		if err = rows.Scan(&name, &description, &backupmx, &active); err != nil {
+			rows.Close()
+			return backup.Document{}, b.report, err
+		}
+
+		d := b.domain(name)
+		d.Description = description
+		d.BackupMX = backupmx
+		d.Active = active
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return backup.Document{}, b.report, err
+	}
+
+	rows, err = src.Query(`SELECT username, password, active FROM mailbox ORDER BY username`)
+	if err != nil {
+		return backup.Document{}, b.report, err
+	}
+	for rows.Next() {
+		var username, password string
+		var active bool
+		if err = rows.Scan(&username, &password, &active); err != nil {
+			rows.Close()
+			return backup.Document{}, b.report, err
+		}
+
+		hash, ok := dovecotHash(password)
+		if !ok {
+			b.report.skip("mailbox %s: the password scheme is not supported", username)
+			continue
+		}
+		b.addMailbox(username, hash, active)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return backup.Document{}, b.report, err
+	}
+
+	rows, err = src.Query(`SELECT address, goto, active FROM alias ORDER BY address`)
+	if err != nil {
+		return backup.Document{}, b.report, err
+	}
+	for rows.Next() {
+		var address, targets string
+		var active bool
+		if err = rows.Scan(&address, &targets, &active); err != nil {
+			rows.Close()
+			return backup.Document{}, b.report, err
+		}
+		b.addAliases(address, splitTargets(targets), active)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return backup.Document{}, b.report, err
+	}
+
+	// the alias_domain table is missing in the old versions
+	rows, err = src.Query(`SELECT alias_domain, target_domain FROM alias_domain`)
+	if err == nil {
+		for rows.Next() {
+			var alias, target string
+			if err = rows.Scan(&alias, &target); err == nil {
+				b.report.skip("alias domain %s -> %s: alias domains are not supported", alias, target)
+			}
+		}
+		rows.Close()
+	}
+
+	return b.document(), b.report, nil
+}
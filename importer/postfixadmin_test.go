@@ -0,0 +1,73 @@
+package importer
+
+import (
+	"database/sql"
+	"os"
+	"testing"
+
+	"github.com/funnydog/mailadmin/backup"
+	"github.com/funnydog/mailadmin/types"
+)
+
+const postfixAdminPath = "/tmp/test-postfixadmin.db"
+
+func TestReadPostfixAdmin(t *testing.T) {
+	database, _ := createTestingDatabase(t)
+
+	src, err := sql.Open("sqlite3", postfixAdminPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(postfixAdminPath)
+	defer src.Close()
+
+	_, err = src.Exec(`
+CREATE TABLE domain (domain TEXT, description TEXT, backupmx INTEGER, active INTEGER);
+CREATE TABLE mailbox (username TEXT, password TEXT, domain TEXT, active INTEGER);
+CREATE TABLE alias (address TEXT, goto TEXT, domain TEXT, active INTEGER);
+INSERT INTO domain VALUES ('ALL', '', 0, 1), ('pfa.org', 'PostfixAdmin', 0, 1);
+INSERT INTO mailbox VALUES
+	('one@pfa.org', '$1$salt$hash', 'pfa.org', 1),
+	('two@pfa.org', '$2y$10$hash', 'pfa.org', 0),
+	('three@pfa.org', 'plaintext', 'pfa.org', 1);
+INSERT INTO alias VALUES
+	('one@pfa.org', 'one@pfa.org', 'pfa.org', 1),
+	('two@pfa.org', 'two@pfa.org,copy@example.net', 'pfa.org', 1),
+	('info@pfa.org', 'one@pfa.org, two@pfa.org', 'pfa.org', 1),
+	('@pfa.org', 'one@pfa.org', 'pfa.org', 1);
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	doc, report, err := ReadPostfixAdmin(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the plaintext password and the catch-all
+	if len(report.Skipped) != 2 {
+		t.Errorf("Expected 2 skipped entries, got %v", report.Skipped)
+	}
+
+	if len(doc.Domains) != 1 || doc.Domains[0].Name != "pfa.org" {
+		t.Fatalf("Unexpected domains %v", doc.Domains)
+	}
+
+	d := doc.Domains[0]
+	if len(d.Mailboxes) != 2 || d.Mailboxes[0].Password != "{MD5-CRYPT}$1$salt$hash" {
+		t.Errorf("Unexpected mailboxes %v", d.Mailboxes)
+	}
+
+	// the self alias of two@ is kept because of the copy
+	if len(d.Aliases) != 4 {
+		t.Errorf("Expected 4 aliases, got %v", d.Aliases)
+	}
+
+	if _, err = backup.Import(database, doc, false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = types.GetMailboxByEmail(database, "two@pfa.org"); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,135 @@
+package importer
+
+import (
+	"bufio"
+	"io"
+	"strings"
+
+	"github.com/funnydog/mailadmin/backup"
+)
+
+// entry is a key and its value read from a postfix lookup table.
+type entry struct {
+	line  int
+	key   string
+	value string
+}
+
+// readTable reads a postfix lookup table in the format accepted by
+// postmap: the comments and the empty lines are skipped and the lines
+// starting with white space continue the previous one.
+func readTable(in io.Reader) ([]entry, error) {
+	entries := []entry{}
+	scanner := bufio.NewScanner(in)
+	for n := 1; scanner.Scan(); n++ {
+		line := scanner.Text()
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+
+		if line[0] == ' ' || line[0] == '\t' {
+			if len(entries) > 0 {
+				last := &entries[len(entries)-1]
+				last.value += " " + trimmed
+			}
+			continue
+		}
+
+		e := entry{line: n, key: trimmed}
+		if i := strings.IndexAny(trimmed, " \t"); i >= 0 {
+			e.key = trimmed[:i]
+			e.value = strings.TrimSpace(trimmed[i:])
+		}
+		entries = append(entries, e)
+	}
+	return entries, scanner.Err()
+}
+
+// ReadPostfixMaps reads the virtual_alias_maps and the
+// virtual_mailbox_maps tables of a postfix installation without a
+// database. The password hashes of the mailboxes are read from a
+// dovecot passwd-file, the mailboxes without one are created inactive
+// with a random password. Any of the readers can be nil.
+func ReadPostfixMaps(virtual, vmailbox, passwd io.Reader) (backup.Document, Report, error) {
+	b := newBuilder()
+
+	hashes := map[string]string{}
+	if passwd != nil {
+		entries, err := readPasswd(passwd)
+		if err != nil {
+			return backup.Document{}, b.report, err
+		}
+		for _, e := range entries {
+			hash, ok := dovecotHash(e.value)
+			if !ok {
+				b.report.skip("passwd line %d: the password scheme of %s is not supported", e.line, e.key)
+				continue
+			}
+			hashes[strings.ToLower(e.key)] = hash
+		}
+	}
+
+	if vmailbox != nil {
+		entries, err := readTable(vmailbox)
+		if err != nil {
+			return backup.Document{}, b.report, err
+		}
+		for _, e := range entries {
+			if domainOf(e.key) == "" || strings.HasPrefix(e.key, "@") {
+				b.report.skip("vmailbox line %d: %s is not a mailbox address", e.line, e.key)
+				continue
+			}
+
+			hash, ok := hashes[strings.ToLower(e.key)]
+			if !ok {
+				if hash, err = randomHash(); err != nil {
+					return backup.Document{}, b.report, err
+				}
+				b.report.skip("vmailbox line %d: %s has no password, created inactive", e.line, e.key)
+			}
+			b.addMailbox(e.key, hash, ok)
+		}
+	}
+
+	if virtual != nil {
+		entries, err := readTable(virtual)
+		if err != nil {
+			return backup.Document{}, b.report, err
+		}
+		for _, e := range entries {
+			if !strings.Contains(e.key, "@") {
+				// a virtual alias domain declaration
+				if strings.Contains(e.key, ".") {
+					b.domain(e.key)
+				} else {
+					b.report.skip("virtual line %d: the local address %s is not supported", e.line, e.key)
+				}
+				continue
+			}
+			b.addAliases(e.key, splitTargets(e.value), true)
+		}
+	}
+
+	return b.document(), b.report, nil
+}
+
+// readPasswd reads the user and the password fields of a dovecot
+// passwd-file.
+func readPasswd(in io.Reader) ([]entry, error) {
+	entries := []entry{}
+	scanner := bufio.NewScanner(in)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.SplitN(line, ":", 3)
+		if len(fields) < 2 {
+			continue
+		}
+		entries = append(entries, entry{line: n, key: fields[0], value: fields[1]})
+	}
+	return entries, scanner.Err()
+}
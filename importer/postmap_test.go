@@ -0,0 +1,62 @@
+package importer
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/funnydog/mailadmin/backup"
+	"github.com/funnydog/mailadmin/types"
+)
+
+func TestReadPostfixMaps(t *testing.T) {
+	database, _ := createTestingDatabase(t)
+
+	virtual := `# virtual alias domains and aliases
+alias.net          anything
+info@maps.org      one@maps.org,
+                   two@maps.org
+postmaster         root
+@maps.org          one@maps.org
+`
+	vmailbox := `one@maps.org   maps.org/one/
+two@maps.org   maps.org/two/
+`
+	passwd := `one@maps.org:{SHA512-CRYPT}$6$salt$hash::::::
+`
+
+	doc, report, err := ReadPostfixMaps(
+		strings.NewReader(virtual),
+		strings.NewReader(vmailbox),
+		strings.NewReader(passwd),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// two@ without password, the local address and the catch-all
+	if len(report.Skipped) != 3 {
+		t.Errorf("Expected 3 skipped entries, got %v", report.Skipped)
+	}
+
+	if len(doc.Domains) != 2 {
+		t.Fatalf("Expected 2 domains, got %v", doc.Domains)
+	}
+
+	maps := doc.Domains[1]
+	if maps.Name != "maps.org" || len(maps.Mailboxes) != 2 || len(maps.Aliases) != 2 {
+		t.Fatalf("Unexpected domain %v", maps)
+	}
+	if !maps.Mailboxes[0].Active || maps.Mailboxes[1].Active {
+		t.Error("Only the mailboxes with a password must be active")
+	}
+	if maps.Aliases[1].RedirectTo != "two@maps.org" {
+		t.Error("The continuation line hasn't been read")
+	}
+
+	if _, err = backup.Import(database, doc, false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = types.GetDomainByName(database, "alias.net"); err != nil {
+		t.Error(err)
+	}
+}
@@ -1,21 +1,40 @@
 package main
 
 import (
+	"database/sql"
 	"embed"
+	"errors"
 	"fmt"
+	"io"
 	"log"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"sort"
 	"strconv"
 	"strings"
 	"syscall"
+	"time"
 
 	"golang.org/x/crypto/bcrypt"
 	"golang.org/x/term"
 
+	"github.com/funnydog/mailadmin/autoconfig"
+	"github.com/funnydog/mailadmin/backup"
 	"github.com/funnydog/mailadmin/core"
 	"github.com/funnydog/mailadmin/core/config"
+	"github.com/funnydog/mailadmin/core/db"
 	"github.com/funnydog/mailadmin/core/form"
+	"github.com/funnydog/mailadmin/core/mailer"
+	"github.com/funnydog/mailadmin/core/scheduler"
+	"github.com/funnydog/mailadmin/dkim"
+	"github.com/funnydog/mailadmin/dnscheck"
+	"github.com/funnydog/mailadmin/importer"
+	"github.com/funnydog/mailadmin/mtasts"
+	"github.com/funnydog/mailadmin/policy"
+	"github.com/funnydog/mailadmin/postfix"
+	"github.com/funnydog/mailadmin/storage"
 	"github.com/funnydog/mailadmin/types"
 	"github.com/gorilla/csrf"
 	"github.com/gorilla/sessions"
@@ -26,11 +45,480 @@ var (
 	//go:embed public
 	resFS        embed.FS
 	helpFlag     = getopt.Bool('h', "display help")
-	createFlag   = getopt.Bool('m', "create a new model")
+	createFlag   = getopt.Bool('m', "create a new model or upgrade the existing one")
 	passwordFlag = getopt.Bool('p', "change the sign-in password")
+	dryRunFlag   = getopt.Bool('n', "validate the input of the import commands without saving it")
 	configPath   = getopt.String('f', "config.json", "path to the configuration")
 )
 
+// command is run from the command line instead of the web server.
+type command struct {
+	args string
+	help string
+	run  func(ctx *core.Context, args []string) error
+}
+
+var commands = map[string]command{
+	"import-csv": {"<domain> <file.csv>", "import the mailboxes and aliases of a CSV file", importCSVCommand},
+	"export":     {"[domain]", "write the JSON backup of a domain or of all the domains", exportCommand},
+	"import":     {"<file.json>", "restore the domains of a JSON backup", importCommand},
+
+	"import-postfixadmin": {"<sqlite3|postgres> <dsn>", "import the domains of a PostfixAdmin database", importPostfixAdminCommand},
+	"import-postfix":      {"<virtual> <vmailbox> [passwd]", "import the domains of the postfix map files, use - to skip one", importPostfixCommand},
+	"postfix-maps":        {"[dir]", "write the postfix lookup tables and run the reload command if they changed", postfixMapsCommand},
+	"dkim-tables":         {"[dir]", "write the OpenDKIM KeyTable, SigningTable and keys and run the reload command if they changed", dkimTablesCommand},
+	"purge-trash":         {"[days]", "delete permanently the records in the trash older than days, 0 empties it", purgeTrashCommand},
+	"policy-server":       {"[address]", "serve the postfix policy delegation requests checking the senders and their quotas", policyServerCommand},
+}
+
+func printCommands() {
+	names := []string{}
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	fmt.Println("\nCommands:")
+	for _, name := range names {
+		c := commands[name]
+		fmt.Printf("  %s %s\n\t%s\n", name, c.args, c.help)
+	}
+}
+
+func runCommand(ctx *core.Context, args []string) error {
+	c, ok := commands[args[0]]
+	if !ok {
+		return fmt.Errorf("Unknown command '%s'", args[0])
+	}
+
+	// the arguments in square brackets are optional
+	max := strings.Fields(c.args)
+	min := 0
+	for _, arg := range max {
+		if !strings.HasPrefix(arg, "[") {
+			min++
+		}
+	}
+	if len(args)-1 < min || len(args)-1 > len(max) {
+		return fmt.Errorf("Usage: %s %s", args[0], c.args)
+	}
+
+	return c.run(ctx, args[1:])
+}
+
+func exportCommand(ctx *core.Context, args []string) error {
+	var doc backup.Document
+	if len(args) == 0 {
+		var err error
+		doc, err = backup.ExportAll(ctx.Database)
+		if err != nil {
+			return err
+		}
+	} else {
+		domain, err := types.GetDomainByName(ctx.Database, args[0])
+		if err != nil {
+			return fmt.Errorf("Domain %s: %w", args[0], err)
+		}
+
+		doc, err = backup.Export(ctx.Database, []types.Domain{domain})
+		if err != nil {
+			return err
+		}
+	}
+
+	return doc.Write(os.Stdout)
+}
+
+func importCommand(ctx *core.Context, args []string) error {
+	file, err := os.Open(args[0])
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	doc, err := backup.Read(file)
+	if err != nil {
+		return err
+	}
+
+	return restore(ctx, doc, importer.Report{})
+}
+
+// restore imports a document read from a foreign source after printing
+// what couldn't be mapped.
+func restore(ctx *core.Context, doc backup.Document, report importer.Report) error {
+	for _, skipped := range report.Skipped {
+		fmt.Printf("skipped %s\n", skipped)
+	}
+
+	stats, err := backup.Import(ctx.Database, doc, *dryRunFlag)
+	if err != nil {
+		return err
+	}
+
+	if *dryRunFlag {
+		fmt.Printf("Dry run: %s\n", stats)
+	} else {
+		fmt.Println(createMaildirs(ctx, "Import completed: "+stats.String(), stats.Mailboxes))
+	}
+	return nil
+}
+
+func importPostfixAdminCommand(ctx *core.Context, args []string) error {
+	if args[0] != "sqlite3" && args[0] != "postgres" {
+		return db.ErrDbTypeNotSupported(args[0])
+	}
+
+	src, err := sql.Open(args[0], args[1])
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	doc, report, err := importer.ReadPostfixAdmin(src)
+	if err != nil {
+		return err
+	}
+	return restore(ctx, doc, report)
+}
+
+func importPostfixCommand(ctx *core.Context, args []string) error {
+	readers := []io.Reader{nil, nil, nil}
+	for i, path := range args {
+		if path == "-" {
+			continue
+		}
+
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		readers[i] = file
+	}
+
+	doc, report, err := importer.ReadPostfixMaps(readers[0], readers[1], readers[2])
+	if err != nil {
+		return err
+	}
+	return restore(ctx, doc, report)
+}
+
+func postfixMapsCommand(ctx *core.Context, args []string) error {
+	dir := ctx.Config.PostfixMapDir
+	if len(args) > 0 {
+		dir = args[0]
+	}
+	if dir == "" {
+		return errors.New("Missing the directory of the postfix lookup tables")
+	}
+
+	changed, err := postfix.WriteMaps(ctx.Database, storage.New(ctx.Config), dir)
+	if err != nil {
+		return err
+	}
+
+	if !changed {
+		fmt.Println("The postfix lookup tables are up to date")
+		return nil
+	}
+
+	fmt.Println("The postfix lookup tables have been updated")
+	if ctx.Config.PostfixReload != "" {
+		return postfix.RunHook(ctx.Config.PostfixReload)
+	}
+	return nil
+}
+
+func dkimTablesCommand(ctx *core.Context, args []string) error {
+	dir := ctx.Config.DKIMDir
+	if len(args) > 0 {
+		dir = args[0]
+	}
+	if dir == "" {
+		return errors.New("Missing the directory of the OpenDKIM tables")
+	}
+
+	changed, err := dkim.WriteTables(ctx.Database, dir)
+	if err != nil {
+		return err
+	}
+
+	if !changed {
+		fmt.Println("The OpenDKIM tables are up to date")
+		return nil
+	}
+
+	fmt.Println("The OpenDKIM tables have been updated")
+	if ctx.Config.DKIMReload != "" {
+		return postfix.RunHook(ctx.Config.DKIMReload)
+	}
+	return nil
+}
+
+func purgeTrashCommand(ctx *core.Context, args []string) error {
+	days := ctx.Config.TrashPurgeDays
+	if len(args) > 0 {
+		var err error
+		if days, err = strconv.Atoi(args[0]); err != nil || days < 0 {
+			return fmt.Errorf("Invalid number of days '%s'", args[0])
+		}
+	} else if days == 0 {
+		return errors.New("The automatic purge of the trash is disabled, pass the number of days")
+	}
+
+	n, err := types.PurgeTrash(ctx.Database, time.Now().AddDate(0, 0, -days))
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%d records purged from the trash\n", n)
+	return nil
+}
+
+// purgeTrash deletes the records which stayed in the trash longer
+// than the configured number of days.
+func purgeTrash(ctx *core.Context) error {
+	days := ctx.Config.TrashPurgeDays
+	n, err := types.PurgeTrash(ctx.Database, time.Now().AddDate(0, 0, -days))
+	if err == nil && n > 0 {
+		log.Printf("%d records purged from the trash\n", n)
+	}
+	return err
+}
+
+// expireAliases moves the expired aliases to the trash, the lookups
+// already ignore them.
+func expireAliases(ctx *core.Context) error {
+	n, err := types.ExpireAliases(ctx.Database, time.Now())
+	if err == nil && n > 0 {
+		log.Printf("%d expired aliases moved to the trash\n", n)
+	}
+	return err
+}
+
+// refreshUsage reads the disk usage of the active mailboxes, so the
+// lists don't wait for the Maildirs to be walked.
+func refreshUsage(ctx *core.Context) error {
+	store := storage.New(ctx.Config)
+	if store == nil {
+		return nil
+	}
+
+	mailboxes, err := types.GetActiveMailboxes(ctx.Database)
+	if err != nil {
+		return err
+	}
+	failed := 0
+	for _, mailbox := range mailboxes {
+		if _, err = usageCache.Refresh(store, mailbox.Email); err != nil {
+			log.Printf("usage of %s: %s\n", mailbox.Email, err)
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("The usage of %d mailboxes couldn't be read", failed)
+	}
+	return nil
+}
+
+// QuotaWarning is the percentage of the quota above which the owner of
+// the mailbox is warned.
+const QuotaWarning = 90
+
+// sendMail sends the mails in the queue.
+func sendMail(ctx *core.Context) error {
+	n, err := ctx.Mailer.Flush()
+	if n > 0 {
+		log.Printf("%d mails sent\n", n)
+	}
+	return err
+}
+
+// warnQuota mails the owners of the active mailboxes which are almost
+// full, every day until they make room.
+func warnQuota(ctx *core.Context) error {
+	store := storage.New(ctx.Config)
+	if store == nil {
+		return nil
+	}
+
+	mailboxes, err := types.GetActiveMailboxes(ctx.Database)
+	if err != nil {
+		return err
+	}
+	for _, mailbox := range mailboxes {
+		usage, err := usageCache.Get(store, mailbox.Email)
+		if err != nil {
+			log.Printf("usage of %s: %s\n", mailbox.Email, err)
+			continue
+		}
+		if usage.Percent() < QuotaWarning {
+			continue
+		}
+		err = ctx.Mailer.Queue(mailbox.Email, "mail_quota.html", map[string]interface{}{
+			"mailbox": mailbox,
+			"usage":   usage,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// queueMail adds a mail to the queue and starts sending it, if the
+// mailer is configured. The body of the private mails is not kept once
+// sent. The errors are logged and appended to the flash message since
+// the record has already been saved.
+func queueMail(ctx *core.Context, flash, to, template string, data map[string]interface{}, private bool) string {
+	if ctx.Mailer == nil {
+		return flash
+	}
+
+	queue := ctx.Mailer.Queue
+	if private {
+		queue = ctx.Mailer.QueuePrivate
+	}
+	if err := queue(to, template, data); err != nil {
+		log.Println("mailer:", err)
+		return fmt.Sprintf("%s, but the mail to %s couldn't be queued: %s", flash, to, err)
+	}
+	if err := ctx.Scheduler.Trigger("send-mail"); err != nil && err != scheduler.ErrJobRunning {
+		log.Println("mailer:", err)
+	}
+	return flash
+}
+
+type job struct {
+	name        string
+	description string
+	spec        string
+	run         func(*core.Context) error
+}
+
+// configureJobs adds the maintenance jobs to the scheduler, the
+// jobschedules field of the configuration replaces their schedules.
+func configureJobs(ctx *core.Context) {
+	jobs := []job{
+		{"expire-aliases", "Move the expired aliases to the trash", "@every 1m", expireAliases},
+	}
+	if ctx.Config.TrashPurgeDays > 0 {
+		jobs = append(jobs, job{"purge-trash", "Delete permanently the old records in the trash", "@hourly", purgeTrash})
+	}
+	if ctx.Config.MailRoot != "" {
+		jobs = append(jobs, job{"refresh-usage", "Read the disk usage of the mailboxes", "@every 5m", refreshUsage})
+	}
+	if ctx.Mailer != nil {
+		jobs = append(jobs, job{"send-mail", "Send the mails in the queue", "@every 1m", sendMail})
+		if ctx.Config.MailRoot != "" {
+			jobs = append(jobs, job{"quota-warnings", "Warn the mailboxes almost full", "0 8 * * *", warnQuota})
+		}
+	}
+
+	for _, j := range jobs {
+		spec := j.spec
+		if custom, ok := ctx.Config.JobSchedules[j.name]; ok {
+			spec = custom
+		}
+		run := j.run
+		err := ctx.Scheduler.Add(j.name, j.description, spec, func() error {
+			return run(ctx)
+		})
+		if err != nil {
+			log.Panicf("job %s: %v", j.name, err)
+		}
+	}
+}
+
+func policyServerCommand(ctx *core.Context, args []string) error {
+	address := ctx.Config.PolicyAddress
+	if len(args) > 0 {
+		address = args[0]
+	} else if address == "" {
+		address = policy.DefaultAddress
+	}
+
+	log.Printf("Serving the policy requests on %s\n", address)
+	server := policy.New(ctx.Database, ctx.Config.PolicyHourly, ctx.Config.PolicyDaily)
+	return server.ListenAndServe(address)
+}
+
+// servePolicy runs the policy server along with the web interface.
+func servePolicy(ctx *core.Context) {
+	server := policy.New(ctx.Database, ctx.Config.PolicyHourly, ctx.Config.PolicyDaily)
+	if err := server.ListenAndServe(ctx.Config.PolicyAddress); err != nil {
+		log.Println("policy server:", err)
+	}
+}
+
+func importCSVCommand(ctx *core.Context, args []string) error {
+	domain, err := types.GetDomainByName(ctx.Database, args[0])
+	if err != nil {
+		return fmt.Errorf("Domain %s: %w", args[0], err)
+	}
+
+	file, err := os.Open(args[1])
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	imp, err := importer.ReadCSV(ctx.Database, domain, ctx.Passwords, file)
+	if err != nil {
+		return err
+	}
+
+	for _, row := range imp.Rows {
+		for _, e := range row.Errors {
+			fmt.Printf("%s:%d: %s %s: %s\n", args[1], row.Line, row.Kind, row.Address, e)
+		}
+	}
+
+	mailboxes, aliases := imp.Count()
+	if !imp.Valid() {
+		return importer.ErrInvalidRows
+	} else if *dryRunFlag {
+		fmt.Printf("%d mailboxes and %d aliases can be imported\n", mailboxes, aliases)
+		return nil
+	}
+
+	created, err := imp.Commit(ctx.Database)
+	if err != nil {
+		return err
+	}
+	fmt.Println(createMaildirs(ctx, fmt.Sprintf("%d mailboxes and %d aliases imported", mailboxes, aliases), created))
+	return nil
+}
+
+// withStorage runs fn on the Maildir storage, if configured, after the
+// database has been changed. The errors are logged and appended to
+// the flash message since the record has already been saved.
+func withStorage(ctx *core.Context, flash string, fn func(s *storage.Storage) error) string {
+	s := storage.New(ctx.Config)
+	if s == nil {
+		return flash
+	}
+
+	if err := fn(s); err != nil {
+		log.Println("storage:", err)
+		return fmt.Sprintf("%s, but the Maildir couldn't be updated: %s", flash, err)
+	}
+	return flash
+}
+
+// createMaildirs makes the Maildirs of the mailboxes, the existing
+// directories are kept. See withStorage.
+func createMaildirs(ctx *core.Context, flash string, mailboxes []types.Mailbox) string {
+	return withStorage(ctx, flash, func(s *storage.Storage) error {
+		for _, mailbox := range mailboxes {
+			if err := s.Create(mailbox); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
 func getFlashes(w http.ResponseWriter, r *http.Request, s sessions.Store) []interface{} {
 	flashes := []interface{}{}
 	session, err := s.Get(r, "session")
@@ -55,10 +543,55 @@ func addFlash(w http.ResponseWriter, r *http.Request, s sessions.Store, text str
 	return nil
 }
 
+// model is a component of the schema: its tables and its migrations.
+type model struct {
+	name    string
+	create  func(*db.Database) error
+	migrate func(*db.Database) (int, error)
+}
+
+var models = []model{
+	{"types", types.CreateModel, types.Migrate},
+	{"scheduler", scheduler.CreateModel, scheduler.Migrate},
+	{"mailer", mailer.CreateModel, mailer.Migrate},
+}
+
+// createModel creates the tables of an empty database.
+func createModel(database *db.Database) error {
+	for _, m := range models {
+		if err := m.create(database); err != nil {
+			return fmt.Errorf("%s: %w", m.name, err)
+		}
+	}
+	return nil
+}
+
+// migrateModel upgrades the tables created by the previous versions,
+// an empty database is left to -m.
+func migrateModel(database *db.Database) error {
+	if !database.HasTable("domain") {
+		return nil
+	}
+	for _, m := range models {
+		if m.migrate == nil {
+			continue
+		}
+		n, err := m.migrate(database)
+		if err != nil {
+			return err
+		} else if n > 0 {
+			log.Printf("%s: %d migrations run\n", m.name, n)
+		}
+	}
+	return nil
+}
+
 func main() {
+	getopt.SetParameters("[command [arguments]]")
 	getopt.Parse()
 	if *helpFlag {
 		getopt.PrintUsage(os.Stdout)
+		printCommands()
 		return
 	}
 
@@ -81,6 +614,11 @@ func main() {
 		if err != nil {
 			log.Panic(err)
 		}
+		if err = ctx.Passwords.Check(string(bytepwd)); err != nil {
+			fmt.Printf("\n%s\n", err)
+			ctx.Close()
+			os.Exit(1)
+		}
 
 		hashpwd, err := bcrypt.GenerateFromPassword(bytepwd, bcrypt.DefaultCost)
 		if err != nil {
@@ -98,17 +636,53 @@ func main() {
 	}
 
 	if *createFlag {
-		fmt.Println("Creating the model")
-		types.CreateModel(ctx.Database)
+		if ctx.Database.HasTable("domain") {
+			fmt.Println("Upgrading the model")
+		} else {
+			fmt.Println("Creating the model")
+			if err = createModel(ctx.Database); err != nil {
+				log.Panic(err)
+			}
+		}
+		if err = migrateModel(ctx.Database); err != nil {
+			log.Panic(err)
+		}
 		return
 	}
 
+	// the databases of the previous versions are upgraded at startup
+	if err = migrateModel(ctx.Database); err != nil {
+		log.Panic(err)
+	}
+
 	configureContext(ctx)
 
 	err = types.PrepareStatements(ctx.Database)
 	if err != nil {
 		log.Panic(err)
 	}
+	err = scheduler.PrepareStatements(ctx.Database)
+	if err != nil {
+		log.Panic(err)
+	}
+	err = mailer.PrepareStatements(ctx.Database)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	if args := getopt.Args(); len(args) > 0 {
+		err = runCommand(ctx, args)
+		if err != nil {
+			log.Println(err)
+			ctx.Close()
+			os.Exit(1)
+		}
+		return
+	}
+
+	if ctx.Config.PolicyAddress != "" {
+		go servePolicy(ctx)
+	}
 
 	err = ctx.ListenAndServe()
 	if err != nil {
@@ -133,6 +707,12 @@ func configureContext(ctx *core.Context) {
 		{"/sign-in/", "GET", signInHandler, "sign-in"},
 		{"/sign-in/", "POST", signInHandler, ""},
 		{"/sign-out/", "GET", signOutHandler, "sign-out"},
+		{"/password/forgot/", "GET", passwordForgot, "password-forgot"},
+		{"/password/forgot/", "POST", passwordForgot, ""},
+		{"/password/reset/", "GET", passwordReset, "password-reset"},
+		{"/password/reset/", "POST", passwordReset, ""},
+
+		{"/search/", "GET", searchHandler, "search"},
 
 		{"/domain/list/", "GET", domainList, "domain-list"},
 		{"/domain/create/", "GET", domainSave, "domain-create"},
@@ -142,6 +722,10 @@ func configureContext(ctx *core.Context) {
 		{"/domain/update/:pk", "POST", domainSave, ""},
 		{"/domain/delete/:pk", "GET", domainDelete, "domain-delete"},
 		{"/domain/delete/:pk", "POST", domainDelete, ""},
+		{"/domain/export/", "GET", domainExport, "domain-export-all"},
+		{"/domain/export/:pk", "GET", domainExport, "domain-export"},
+		{"/domain/import/", "GET", domainImport, "domain-import"},
+		{"/domain/import/", "POST", domainImport, ""},
 
 		{"/mailbox/list/:domain", "GET", mailboxList, "mailbox-list"},
 		{"/mailbox/create/:domain", "GET", mailboxSave, "mailbox-create"},
@@ -150,6 +734,8 @@ func configureContext(ctx *core.Context) {
 		{"/mailbox/update/:domain/:pk", "POST", mailboxSave, ""},
 		{"/mailbox/delete/:domain/:pk", "GET", mailboxDelete, "mailbox-delete"},
 		{"/mailbox/delete/:domain/:pk", "POST", mailboxDelete, ""},
+		{"/mailbox/import/:domain", "GET", csvImport, "csv-import"},
+		{"/mailbox/import/:domain", "POST", csvImport, ""},
 
 		{"/alias/list/:domain", "GET", aliasList, "alias-list"},
 		{"/alias/create/:domain", "GET", aliasSave, "alias-create"},
@@ -158,12 +744,57 @@ func configureContext(ctx *core.Context) {
 		{"/alias/update/:domain/:pk", "POST", aliasSave, ""},
 		{"/alias/delete/:domain/:pk", "GET", aliasDelete, "alias-delete"},
 		{"/alias/delete/:domain/:pk", "POST", aliasDelete, ""},
+
+		{"/dkim/list/:domain", "GET", dkimList, "dkim-list"},
+		{"/dkim/list/:domain", "POST", dkimList, ""},
+		{"/dkim/toggle/:domain/:pk", "POST", dkimToggle, "dkim-toggle"},
+		{"/dkim/promote/:domain/:pk", "POST", dkimPromote, "dkim-promote"},
+		{"/dkim/delete/:domain/:pk", "POST", dkimDelete, "dkim-delete"},
+
+		{"/bcc/list/:domain", "GET", bccList, "bcc-list"},
+		{"/bcc/list/:domain", "POST", bccList, ""},
+		{"/bcc/delete/:domain/:pk", "POST", bccDelete, "bcc-delete"},
+
+		{"/access/list/:domain", "GET", accessList, "access-list"},
+		{"/access/list/:domain", "POST", accessList, ""},
+		{"/access/delete/:domain/:pk", "POST", accessDelete, "access-delete"},
+
+		{"/mta-sts/:domain", "GET", mtastsSave, "mta-sts"},
+		{"/mta-sts/:domain", "POST", mtastsSave, ""},
+
+		{"/jobs/", "GET", jobList, "job-list"},
+		{"/jobs/run/:name", "POST", jobRun, "job-run"},
+
+		{"/trash/", "GET", trashList, "trash"},
+		{"/trash/restore/:kind/:pk", "POST", trashRestore, "trash-restore"},
+		{"/trash/purge/:kind/:pk", "POST", trashPurge, "trash-purge"},
 	}
 
 	for _, r := range routes {
 		ctx.AddRoute(r.name, r.method, r.prefix, r.handler)
 	}
 
+	// the senders fetch the MTA-STS policy from the root of the
+	// mta-sts.<domain> hosts without signing in
+	ctx.AddRootRoute("mta-sts-policy", "GET", mtasts.PolicyPath, mtastsPolicy)
+	ctx.AddAllowedURL(mtasts.PolicyPath)
+
+	// the mail clients configure themselves without signing in,
+	// Thunderbird asks autoconfig.<domain> then the domain itself
+	ctx.AddRootRoute("autoconfig-mozilla", "GET", "/.well-known/autoconfig/mail/config-v1.1.xml", autoconfigMozilla)
+	ctx.AddRootRoute("", "GET", "/mail/config-v1.1.xml", autoconfigMozilla)
+	ctx.AddRootRoute("autoconfig-outlook", "POST", "/autodiscover/autodiscover.xml", autoconfigOutlook)
+	ctx.AddRootRoute("", "GET", "/autodiscover/autodiscover.xml", autoconfigOutlook)
+	ctx.AddRoute("autoconfig-apple", "GET", "/autoconfig/apple.mobileconfig", autoconfigApple)
+	for _, name := range []string{"autoconfig-mozilla", "autoconfig-outlook", "autoconfig-apple"} {
+		ctx.AddAllowedURL(ctx.Reverse(name))
+	}
+	ctx.AddAllowedURL("/mail/config-v1.1.xml")
+
+	// the mailbox owners reset their password without signing in
+	ctx.AddAllowedURL(ctx.Reverse("password-forgot"))
+	ctx.AddAllowedURL(ctx.Reverse("password-reset"))
+
 	// the order is important
 	// from the last executed to the first
 
@@ -192,18 +823,21 @@ func configureContext(ctx *core.Context) {
 			})
 	})
 
-	// skip the CSRF check
-	// ctx.AddMiddleware(func(h http.Handler) http.Handler {
-	// 	return http.HandlerFunc(
-	// 		func(w http.ResponseWriter, r *http.Request) {
-	// 			if r.URL.Path == "/gather/" || r.URL.Path == "/gather" {
-	// 				r = csrf.UnsafeSkipCheck(r)
-	// 			}
-	// 			h.ServeHTTP(w, r)
-	// 		})
-	// })
-}
-
+	// skip the CSRF check of the requests posted by Outlook
+	outlook := ctx.Reverse("autoconfig-outlook")
+	ctx.AddMiddleware(func(h http.Handler) http.Handler {
+		return http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path == outlook {
+					r = csrf.UnsafeSkipCheck(r)
+				}
+				h.ServeHTTP(w, r)
+			})
+	})
+
+	configureJobs(ctx)
+}
+
 func indexHandler(w http.ResponseWriter, r *http.Request, ctx *core.Context) {
 	http.Redirect(
 		w,
@@ -239,7 +873,8 @@ func signInHandler(w http.ResponseWriter, r *http.Request, ctx *core.Context) {
 
 		data["Error"] = "Sign in failed, wrong username/password"
 	}
-	ctx.Render(w, "sign_in.html", &data)
+	data["Title"] = "Sign in"
+	ctx.ExtendAndRender(w, "public", "sign_in.html", &data)
 }
 
 func signOutHandler(w http.ResponseWriter, r *http.Request, ctx *core.Context) {
@@ -256,16 +891,225 @@ func signOutHandler(w http.ResponseWriter, r *http.Request, ctx *core.Context) {
 	)
 }
 
+// passwordResetEnabled tells if the links can be sent: the mailer
+// must be configured and the links must point to the public URL, never
+// to the Host header of the request.
+func passwordResetEnabled(ctx *core.Context) bool {
+	return ctx.Mailer != nil && ctx.Config.PublicURL != ""
+}
+
+// recoverableMailbox tells if the mailbox of the lookup is found outside
+// of the trash, active, of an active domain and with a recovery address.
+func recoverableMailbox(ctx *core.Context, mailbox types.Mailbox, err error) bool {
+	if err == sql.ErrNoRows {
+		return false
+	} else if err != nil {
+		panic(err)
+	}
+
+	domain, err := types.GetDomainById(ctx.Database, mailbox.Domain.Int64)
+	if err != nil {
+		panic(err)
+	}
+	return mailbox.Active && domain.Active && mailbox.Recovery != ""
+}
+
+func passwordForgot(w http.ResponseWriter, r *http.Request, ctx *core.Context) {
+	if !passwordResetEnabled(ctx) {
+		http.NotFound(w, r)
+		return
+	}
+
+	myForm := form.Create()
+	myForm.Add("email", &form.EmailField{Label: "Mailbox", Required: true})
+	data := map[string]interface{}{
+		"form":           myForm,
+		"Title":          "Reset the password",
+		"lifetime":       "1 hour",
+		csrf.TemplateTag: csrf.TemplateField(r),
+	}
+
+	if r.Method == "GET" {
+		// fallthrough
+	} else if r.Method != "POST" {
+		// not supported
+		return
+	} else if myForm.Validate(r) {
+		email := strings.ToLower(strings.TrimSpace(myForm.GetString("email")))
+		mailbox, err := types.GetMailboxByEmail(ctx.Database, email)
+		if recoverableMailbox(ctx, mailbox, err) {
+			var token string
+			err = ctx.Database.WithTx(func(tx *db.Tx) (err error) {
+				token, err = types.NewResetToken(tx, mailbox.Id.Int64, time.Now())
+				return err
+			})
+			if err == nil {
+				link := strings.TrimSuffix(ctx.Config.PublicURL, "/") +
+					ctx.Reverse("password-reset") + "?token=" + url.QueryEscape(token)
+				queueMail(ctx, "", mailbox.Recovery, "mail_reset.html", map[string]interface{}{
+					"mailbox":  mailbox,
+					"link":     link,
+					"lifetime": data["lifetime"],
+				}, true)
+			} else if err != types.ErrResetCooldown {
+				panic(err)
+			}
+		}
+		// the same answer whether the mailbox exists or not
+		data["sent"] = true
+	}
+	ctx.ExtendAndRender(w, "public", "password_forgot.html", &data)
+}
+
+func passwordReset(w http.ResponseWriter, r *http.Request, ctx *core.Context) {
+	if !passwordResetEnabled(ctx) {
+		http.NotFound(w, r)
+		return
+	}
+
+	myForm := form.Create()
+	myForm.Add("password", &form.PasswordField{Label: "Password", Required: true, Policy: ctx.Passwords})
+	myForm.Add("confirm", &form.TextField{Label: "Confirm", Required: true})
+	data := map[string]interface{}{
+		"form":           myForm,
+		"Title":          "Reset the password",
+		csrf.TemplateTag: csrf.TemplateField(r),
+	}
+
+	if r.Method != "GET" && r.Method != "POST" {
+		// not supported
+		return
+	}
+
+	now := time.Now()
+	token := r.FormValue("token")
+	data["token"] = token
+	reset, err := types.GetResetToken(ctx.Database, token, now)
+	if err != nil && err != types.ErrInvalidToken {
+		panic(err)
+	}
+
+	// the mailbox may have been trashed or disabled after the link
+	// was sent
+	mailbox, found := types.Mailbox{}, false
+	if err == nil {
+		mailbox, err = types.GetMailboxById(ctx.Database, reset.Mailbox.Int64)
+		found = recoverableMailbox(ctx, mailbox, err)
+	}
+	if !found {
+		data["Error"] = types.ErrInvalidToken.Error()
+		ctx.ExtendAndRender(w, "public", "password_reset.html", &data)
+		return
+	}
+	data["mailbox"] = mailbox
+
+	if r.Method == "POST" {
+		valid := myForm.Validate(r)
+		if valid && r.FormValue("password") != r.FormValue("confirm") {
+			valid = false
+			myForm.SetError("password", "The passwords don't match")
+		}
+
+		if valid {
+			// the token is used once even if two requests race
+			err = ctx.Database.WithTx(func(tx *db.Tx) error {
+				if err := reset.Use(tx, now); err != nil {
+					return err
+				}
+				if err := mailbox.SetPassword(myForm.GetString("password")); err != nil {
+					return err
+				}
+				return mailbox.Update(tx)
+			})
+			if err == types.ErrInvalidToken {
+				delete(data, "mailbox")
+				data["Error"] = err.Error()
+			} else if err != nil {
+				panic(err)
+			} else {
+				// the owner signs in next, the Maildir of a mailbox
+				// created before the mail root was set may be missing
+				createMaildirs(ctx, "", []types.Mailbox{mailbox})
+				data["done"] = true
+			}
+		}
+	}
+	ctx.ExtendAndRender(w, "public", "password_reset.html", &data)
+}
+
+// maximum number of records of each kind shown by the global search
+const searchLimit = 50
+
+type searchHit struct {
+	Label  string
+	Detail string
+	URL    string
+	Active bool
+}
+
+func searchHandler(w http.ResponseWriter, r *http.Request, ctx *core.Context) {
+	query := strings.TrimSpace(r.FormValue("q"))
+	data := map[string]interface{}{
+		"Title": "Search",
+		"query": query,
+	}
+
+	if query != "" {
+		result, err := types.Search(ctx.Database, query, searchLimit)
+		if err != nil {
+			panic(err)
+		}
+
+		domains := []searchHit{}
+		for _, d := range result.Domains {
+			domains = append(domains, searchHit{
+				Label:  d.Name,
+				Detail: d.Description,
+				URL:    ctx.Reverse("domain-update", d.Id.Int64),
+				Active: d.Active,
+			})
+		}
+
+		mailboxes := []searchHit{}
+		for _, m := range result.Mailboxes {
+			mailboxes = append(mailboxes, searchHit{
+				Label:  m.Email,
+				URL:    ctx.Reverse("mailbox-update", m.Domain.Int64, m.Id.Int64),
+				Active: m.Active,
+			})
+		}
+
+		aliases := []searchHit{}
+		for _, a := range result.Aliases {
+			aliases = append(aliases, searchHit{
+				Label:  a.Destination,
+				Detail: a.RedirectTo,
+				URL:    ctx.Reverse("alias-update", a.Domain.Int64, a.Id.Int64),
+				Active: a.Active,
+			})
+		}
+
+		data["ResultCount"] = result.Count()
+		data["domains"] = domains
+		data["mailboxes"] = mailboxes
+		data["aliases"] = aliases
+	}
+
+	ctx.ExtendAndRender(w, "layout", "search.html", &data)
+}
+
 func domainList(w http.ResponseWriter, r *http.Request, ctx *core.Context) {
-	domains, err := types.GetDomainList(ctx.Database)
+	pager := types.CreatePager(r.URL.Query())
+	domains, err := types.GetDomainPage(ctx.Database, &pager)
 	if err != nil {
 		panic(err)
 	}
 
 	ctx.ExtendAndRender(w, "layout", "domain_list.html", &map[string]interface{}{
-		"DomainCount": len(domains),
+		"DomainCount": pager.Total,
 		"domaintab":   true,
 		"domains":     domains,
+		"pager":       &pager,
 		"flashes":     getFlashes(w, r, ctx.Store),
 	})
 }
@@ -289,6 +1133,37 @@ func domainOverview(w http.ResponseWriter, r *http.Request, ctx *core.Context) {
 		"flashes":     getFlashes(w, r, ctx.Store),
 	}
 
+	if store := storage.New(ctx.Config); store != nil {
+		mailboxes, err := types.GetMailboxList(ctx.Database, domain.Id.Int64)
+		if err != nil {
+			panic(err)
+		}
+
+		total := storage.Usage{}
+		for _, m := range mailboxes {
+			total.Add(mailboxUsage(store, m))
+		}
+		data["usage"] = total
+	}
+
+	// the DNS queries can take a while, run them only on request
+	if r.URL.Query().Get("dnscheck") != "" {
+		keys, err := types.GetDKIMKeys(ctx.Database, domain.Id.Int64)
+		if err != nil {
+			panic(err)
+		}
+
+		var policy *types.MTASTS
+		if p, err := types.GetMTASTS(ctx.Database, domain.Id.Int64); err == nil {
+			policy = &p
+		} else if err != sql.ErrNoRows {
+			panic(err)
+		}
+
+		checker := dnscheck.New(ctx.Config.DNSResolver, ctx.Config.MXHosts)
+		data["dnschecks"] = checker.Run(r.Context(), domain.Name, keys, policy)
+	}
+
 	ctx.ExtendAndRender(w, "layout", "domain_overview.html", &data)
 }
 
@@ -297,10 +1172,23 @@ func domainForm() form.Form {
 	myForm.Add("name", &form.TextField{Label: "Name", Required: true, MaxLength: 50})
 	myForm.Add("description", &form.TextField{Label: "Description"})
 	myForm.Add("backupmx", &form.CheckboxField{Label: "BackupMX"})
+	myForm.Add("transport", &form.TextField{Label: "Transport", MaxLength: 255})
 	myForm.Add("active", &form.CheckboxField{Label: "Active"})
 	return myForm
 }
 
+// validDomainForm validates the form and the syntax of the transport.
+func validDomainForm(form form.Form, r *http.Request) bool {
+	valid := form.Validate(r)
+	if transport := strings.TrimSpace(r.FormValue("transport")); transport != "" {
+		if err := postfix.ValidTransport(transport); err != nil {
+			valid = false
+			form.SetError("transport", err.Error())
+		}
+	}
+	return valid
+}
+
 func domainSave(w http.ResponseWriter, r *http.Request, ctx *core.Context) {
 	parameters := ctx.URLManager.GetParams(r)
 
@@ -331,14 +1219,16 @@ func domainSave(w http.ResponseWriter, r *http.Request, ctx *core.Context) {
 		form.SetString("name", domain.Name)
 		form.SetString("description", domain.Description)
 		form.SetBool("backupmx", domain.BackupMX)
+		form.SetString("transport", domain.Transport)
 		form.SetBool("active", domain.Active)
 	} else if r.Method != "POST" {
 		// not supported
 		return
-	} else if form.Validate(r) {
+	} else if validDomainForm(form, r) {
 		domain.Name = form.GetString("name")
 		domain.Description = form.GetString("description")
 		domain.BackupMX = form.GetBool("backupmx")
+		domain.Transport = strings.TrimSpace(form.GetString("transport"))
 		domain.Active = form.GetBool("active")
 
 		var err error
@@ -386,14 +1276,94 @@ func domainDelete(w http.ResponseWriter, r *http.Request, ctx *core.Context) {
 		ctx.ExtendAndRender(w, "layout", "domain_delete.html", &data)
 	} else if r.Method != "POST" {
 		// method not supported
-	} else if err := domain.Delete(ctx.Database); err != nil {
+	} else if mailboxes, err := types.GetMailboxList(ctx.Database, domain.Id.Int64); err != nil {
+		panic(err)
+	} else if err := ctx.Database.WithTx(func(tx *db.Tx) error { return domain.Delete(tx) }); err != nil {
 		panic(err)
 	} else {
-		_ = addFlash(w, r, ctx.Store, "Domain deleted successfully")
+		flash := withStorage(ctx, "Domain moved to the trash", func(s *storage.Storage) error {
+			for _, mailbox := range mailboxes {
+				if err := s.ArchiveMailbox(mailbox); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		_ = addFlash(w, r, ctx.Store, flash)
 		http.Redirect(w, r, ctx.Reverse("domain-list"), http.StatusFound)
 	}
 }
 
+func domainExport(w http.ResponseWriter, r *http.Request, ctx *core.Context) {
+	parameters := ctx.URLManager.GetParams(r)
+
+	var doc backup.Document
+	filename := "mailadmin"
+	if pk, err := strconv.ParseInt(parameters.ByName("pk"), 10, 64); err != nil {
+		doc, err = backup.ExportAll(ctx.Database)
+		if err != nil {
+			panic(err)
+		}
+	} else {
+		domain, err := types.GetDomainById(ctx.Database, pk)
+		if err != nil {
+			panic(err)
+		}
+
+		doc, err = backup.Export(ctx.Database, []types.Domain{domain})
+		if err != nil {
+			panic(err)
+		}
+		filename += "-" + domain.Name
+	}
+	filename += doc.Exported.Format("-20060102-150405") + ".json"
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	if err := doc.Write(w); err != nil {
+		log.Println(err)
+	}
+}
+
+func domainImport(w http.ResponseWriter, r *http.Request, ctx *core.Context) {
+	data := map[string]interface{}{
+		"Title":          "Import A Backup",
+		"domaintab":      true,
+		"dryrun":         true,
+		csrf.TemplateTag: csrf.TemplateField(r),
+	}
+
+	if r.Method == "GET" {
+		// fallthrough
+	} else if r.Method != "POST" {
+		// not supported
+		return
+	} else if file, _, err := r.FormFile("file"); err != nil {
+		data["Error"] = "Please select a JSON file to upload."
+	} else {
+		defer file.Close()
+
+		dryrun := r.FormValue("dryrun") != ""
+		data["dryrun"] = dryrun
+
+		doc, err := backup.Read(file)
+		if err != nil {
+			data["Error"] = err.Error()
+		} else if stats, err := backup.Import(ctx.Database, doc, dryrun); err != nil {
+			data["Error"] = err.Error()
+		} else if dryrun {
+			data["stats"] = stats
+		} else {
+			flash := createMaildirs(ctx, "Import completed: "+stats.String(), stats.Mailboxes)
+			_ = addFlash(w, r, ctx.Store, flash)
+			http.Redirect(w, r, ctx.Reverse("domain-list"), http.StatusFound)
+			return
+		}
+	}
+
+	ctx.ExtendAndRender(w, "layout", "domain_import.html", &data)
+}
+
 func mailboxList(w http.ResponseWriter, r *http.Request, ctx *core.Context) {
 	parameters := ctx.URLManager.GetParams(r)
 
@@ -407,29 +1377,117 @@ func mailboxList(w http.ResponseWriter, r *http.Request, ctx *core.Context) {
 		panic(err)
 	}
 
-	mailboxes, err := types.GetMailboxList(ctx.Database, domain_id)
-	if err != nil {
-		panic(err)
+	pager := types.CreatePager(r.URL.Query())
+	store := storage.New(ctx.Config)
+
+	var mailboxes []types.Mailbox
+	usage := map[int64]storage.Usage{}
+	if pager.Sort == "usage" && store != nil {
+		// the usage is not in the database, sort all the matches
+		mailboxes, err = types.GetMailboxMatches(ctx.Database, domain_id, pager.Search)
+		if err != nil {
+			panic(err)
+		}
+		for _, m := range mailboxes {
+			usage[m.Id.Int64] = mailboxUsage(store, m)
+		}
+
+		sort.SliceStable(mailboxes, func(i, j int) bool {
+			a, b := usage[mailboxes[i].Id.Int64].Bytes, usage[mailboxes[j].Id.Int64].Bytes
+			if pager.Desc {
+				return a > b
+			}
+			return a < b
+		})
+		start, end := pager.Window(len(mailboxes))
+		mailboxes = mailboxes[start:end]
+	} else {
+		mailboxes, err = types.GetMailboxPage(ctx.Database, domain_id, &pager)
+		if err != nil {
+			panic(err)
+		}
+		if store != nil {
+			for _, m := range mailboxes {
+				usage[m.Id.Int64] = mailboxUsage(store, m)
+			}
+		}
 	}
 
 	ctx.ExtendAndRender(w, "layout", "mailbox_list.html", &map[string]interface{}{
 		"Title":        "Managed Mailboxes",
-		"MailboxCount": len(mailboxes),
+		"MailboxCount": pager.Total,
 		"mailboxtab":   true,
 		"mailboxes":    mailboxes,
+		"usage":        usage,
+		"showusage":    store != nil,
+		"pager":        &pager,
 		"domain":       domain,
 		"flashes":      getFlashes(w, r, ctx.Store),
 	})
 }
 
-func createMailboxForm(pwdRequired bool) form.Form {
+// usageCache keeps the disk usage of the mailboxes shown in the lists.
+var usageCache = storage.NewUsageCache(5 * time.Minute)
+
+// mailboxUsage returns the disk usage of the mailbox, the errors are
+// logged and shown as an empty usage.
+func mailboxUsage(store *storage.Storage, mailbox types.Mailbox) storage.Usage {
+	usage, err := usageCache.Get(store, mailbox.Email)
+	if err != nil {
+		log.Printf("usage of %s: %s\n", mailbox.Email, err)
+	}
+	return usage
+}
+
+func createMailboxForm(pwdRequired bool, policy *form.PasswordPolicy) form.Form {
 	myForm := form.Create()
 	myForm.Add("email", &form.EmailField{Label: "E-Mail", Required: true})
-	myForm.Add("password", &form.TextField{Label: "Password", Required: pwdRequired})
+	myForm.Add("password", &form.PasswordField{Label: "Password", Required: pwdRequired, Policy: policy})
 	myForm.Add("active", &form.CheckboxField{Label: "Active"})
+	myForm.Add("sendas", &form.TextField{Label: "Send as"})
+	myForm.Add("recovery", &form.EmailField{Label: "Recovery address"})
 	return myForm
 }
 
+// parseSendAs returns the addresses, one per line, the mailbox may
+// send as.
+func parseSendAs(ctx *core.Context, text string) ([]string, error) {
+	addresses := []string{}
+	for _, address := range strings.Fields(strings.ToLower(text)) {
+		if err := types.ValidSendAs(ctx.Database, address); err != nil {
+			return nil, err
+		}
+		addresses = append(addresses, address)
+	}
+	return addresses, nil
+}
+
+// historyEntry is a previous version of a record along with the
+// changes made by the version which replaced it.
+type historyEntry struct {
+	Revision types.Revision
+	Changes  []types.Change
+}
+
+func mailboxHistory(ctx *core.Context, mailbox types.Mailbox) ([]historyEntry, error) {
+	revisions, err := types.GetRevisions(ctx.Database, types.RevisionMailbox, mailbox.Id.Int64)
+	if err != nil {
+		return nil, err
+	}
+
+	history := []historyEntry{}
+	newer := mailbox.Version()
+	for _, rev := range revisions {
+		version, err := rev.Mailbox()
+		if err != nil {
+			return nil, err
+		}
+		history = append(history, historyEntry{rev, types.DiffMailbox(version, newer)})
+		newer = version
+	}
+	return history, nil
+}
+
 func mailboxSave(w http.ResponseWriter, r *http.Request, ctx *core.Context) {
 	parameters := ctx.URLManager.GetParams(r)
 
@@ -458,7 +1516,7 @@ func mailboxSave(w http.ResponseWriter, r *http.Request, ctx *core.Context) {
 		title = "Change The Mailbox"
 	}
 
-	form := createMailboxForm(pkerr != nil)
+	form := createMailboxForm(pkerr != nil, ctx.Passwords)
 	data := map[string]interface{}{
 		"form":           form,
 		"mailboxtab":     true,
@@ -467,50 +1525,130 @@ func mailboxSave(w http.ResponseWriter, r *http.Request, ctx *core.Context) {
 		csrf.TemplateTag: csrf.TemplateField(r),
 	}
 
+	sendAs := []string{}
+	if pkerr == nil {
+		if data["history"], err = mailboxHistory(ctx, mailbox); err != nil {
+			panic(err)
+		}
+		if sendAs, err = types.GetSendAs(ctx.Database, mailbox.Id.Int64); err != nil {
+			panic(err)
+		}
+		if ctx.Config.IMAPHost != "" {
+			data["profile"] = ctx.Reverse("autoconfig-apple") + "?emailaddress=" + url.QueryEscape(mailbox.Email)
+		}
+	}
+
 	if r.Method == "GET" {
 		form.SetString("email", mailbox.Email)
 		form.SetBool("active", mailbox.Active)
+		form.SetString("sendas", strings.Join(sendAs, "\n"))
+		form.SetString("recovery", mailbox.Recovery)
 	} else if r.Method != "POST" {
 		// not supported
 		return
 	} else {
+		// a revert submits the values of the revision
+		var revert *types.MailboxVersion
+		if rev, err := strconv.ParseInt(r.PostFormValue("revision"), 10, 64); err == nil && pkerr == nil {
+			revision, err := types.GetRevisionById(ctx.Database, types.RevisionMailbox, pk, rev)
+			if err != nil {
+				panic(err)
+			}
+
+			version, err := revision.Mailbox()
+			if err != nil {
+				panic(err)
+			}
+			revert = &version
+
+			// the history doesn't cover the send as and recovery addresses
+			r.PostForm = url.Values{
+				"email":    {version.Email},
+				"sendas":   {strings.Join(sendAs, "\n")},
+				"recovery": {mailbox.Recovery},
+			}
+			if version.Active {
+				r.PostForm.Set("active", "on")
+			}
+			r.Form = r.PostForm
+		}
+
 		// form validation
 		valid := form.Validate(r)
-		if email := r.FormValue("email"); !strings.HasSuffix(email, "@"+domain.Name) {
+		if email := r.FormValue("email"); !domain.Contains(email) {
 			valid = false
 			form.SetError("email", "The address doesn't end with @"+domain.Name)
 		}
-		if password := r.FormValue("password"); password == "" && pkerr != nil {
+		if r.FormValue("password") == "" && pkerr != nil {
 			valid = false
 			form.SetError("password", "This field cannot be empty")
 		}
+		sendAs, err := parseSendAs(ctx, r.FormValue("sendas"))
+		if err != nil {
+			valid = false
+			form.SetError("sendas", err.Error())
+		}
+		recovery := strings.TrimSpace(r.FormValue("recovery"))
+		if recovery != "" && strings.EqualFold(recovery, strings.TrimSpace(r.FormValue("email"))) {
+			valid = false
+			form.SetError("recovery", "The recovery address must be another mailbox")
+		}
 
 		// submit
 		if valid {
+			oldEmail := mailbox.Email
 			mailbox.Email = form.GetString("email")
 			mailbox.Active = form.GetBool("active")
+			mailbox.Recovery = recovery
 
-			if password := form.GetString("password"); password != "" {
-				// hash the password
-				hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
-				if err != nil {
+			if revert != nil {
+				mailbox.Password = revert.Password
+			} else if password := form.GetString("password"); password != "" {
+				if err := mailbox.SetPassword(password); err != nil {
 					panic(err)
 				}
-				mailbox.Password = string(hash)
 			}
 
 			var flash string
 			if pkerr != nil {
-				err = mailbox.Create(ctx.Database)
 				flash = "Mailbox created successfully"
+			} else if revert != nil {
+				flash = "Mailbox reverted successfully"
 			} else {
-				err = mailbox.Update(ctx.Database)
 				flash = "Mailbox updated successfully"
 			}
+
+			// the mailbox and its send as addresses are saved together
+			err = ctx.Database.WithTx(func(tx *db.Tx) error {
+				var err error
+				if pkerr != nil {
+					err = mailbox.Create(tx)
+				} else {
+					err = mailbox.Update(tx)
+				}
+				if err != nil {
+					return err
+				}
+				return types.SetSendAs(tx, mailbox.Id.Int64, sendAs)
+			})
 			if err != nil {
 				panic(err)
 			}
 
+			if pkerr != nil {
+				flash = createMaildirs(ctx, flash, []types.Mailbox{mailbox})
+				// the settings of the clients are left out if invalid
+				settings, _ := autoconfig.New(ctx.Config)
+				flash = queueMail(ctx, flash, mailbox.Email, "mail_welcome.html", map[string]interface{}{
+					"mailbox":    mailbox,
+					"autoconfig": settings,
+				}, false)
+			} else if oldEmail != mailbox.Email {
+				flash = withStorage(ctx, flash, func(s *storage.Storage) error {
+					return s.Rename(oldEmail, mailbox)
+				})
+			}
+
 			_ = addFlash(w, r, ctx.Store, flash)
 			http.Redirect(w, r, ctx.Reverse("mailbox-list", domain_id), http.StatusFound)
 			return
@@ -557,12 +1695,15 @@ func mailboxDelete(w http.ResponseWriter, r *http.Request, ctx *core.Context) {
 	} else if err := mailbox.Delete(ctx.Database); err != nil {
 		panic(err)
 	} else {
-		_ = addFlash(w, r, ctx.Store, "Mailbox deleted successfully")
+		flash := withStorage(ctx, "Mailbox moved to the trash", func(s *storage.Storage) error {
+			return s.ArchiveMailbox(mailbox)
+		})
+		_ = addFlash(w, r, ctx.Store, flash)
 		http.Redirect(w, r, ctx.Reverse("mailbox-list", mailbox.Domain.Int64), http.StatusFound)
 	}
 }
 
-func aliasList(w http.ResponseWriter, r *http.Request, ctx *core.Context) {
+func csvImport(w http.ResponseWriter, r *http.Request, ctx *core.Context) {
 	parameters := ctx.URLManager.GetParams(r)
 
 	domain_id, err := strconv.ParseInt(parameters.ByName("domain"), 10, 64)
@@ -575,29 +1716,114 @@ func aliasList(w http.ResponseWriter, r *http.Request, ctx *core.Context) {
 		panic(err)
 	}
 
-	aliases, err := types.GetAliasList(ctx.Database, domain_id)
-	if err != nil {
-		panic(err)
+	data := map[string]interface{}{
+		"Title":          "Import Mailboxes And Aliases",
+		"mailboxtab":     true,
+		"domain":         domain,
+		"dryrun":         true,
+		csrf.TemplateTag: csrf.TemplateField(r),
 	}
 
-	ctx.ExtendAndRender(w, "layout", "alias_list.html", &map[string]interface{}{
-		"Title":      "Managed Aliases",
-		"AliasCount": len(aliases),
-		"aliastab":   true,
-		"aliases":    aliases,
-		"domain":     domain,
-		"flashes":    getFlashes(w, r, ctx.Store),
-	})
-}
+	if r.Method == "GET" {
+		// fallthrough
+	} else if r.Method != "POST" {
+		// not supported
+		return
+	} else if file, _, err := r.FormFile("file"); err != nil {
+		data["Error"] = "Please select a CSV file to upload."
+	} else {
+		defer file.Close()
 
-func createAliasForm() form.Form {
-	myForm := form.Create()
-	myForm.Add("destination", &form.EmailField{Label: "Destination", Required: true})
+		dryrun := r.FormValue("dryrun") != ""
+		data["dryrun"] = dryrun
+
+		imp, err := importer.ReadCSV(ctx.Database, domain, ctx.Passwords, file)
+		if err != nil {
+			data["Error"] = err.Error()
+		} else if !imp.Valid() {
+			data["import"] = imp
+			data["Error"] = importer.ErrInvalidRows.Error()
+		} else if dryrun {
+			data["import"] = imp
+		} else if created, err := imp.Commit(ctx.Database); err != nil {
+			panic(err)
+		} else {
+			mailboxes, aliases := imp.Count()
+			flash := fmt.Sprintf("%d mailboxes and %d aliases imported successfully", mailboxes, aliases)
+			flash = createMaildirs(ctx, flash, created)
+			_ = addFlash(w, r, ctx.Store, flash)
+			http.Redirect(w, r, ctx.Reverse("mailbox-list", domain_id), http.StatusFound)
+			return
+		}
+	}
+
+	ctx.ExtendAndRender(w, "layout", "csv_import.html", &data)
+}
+
+func aliasList(w http.ResponseWriter, r *http.Request, ctx *core.Context) {
+	parameters := ctx.URLManager.GetParams(r)
+
+	domain_id, err := strconv.ParseInt(parameters.ByName("domain"), 10, 64)
+	if err != nil {
+		panic(err)
+	}
+
+	domain, err := types.GetDomainById(ctx.Database, domain_id)
+	if err != nil {
+		panic(err)
+	}
+
+	pager := types.CreatePager(r.URL.Query())
+	aliases, err := types.GetAliasPage(ctx.Database, domain_id, &pager)
+	if err != nil {
+		panic(err)
+	}
+
+	ctx.ExtendAndRender(w, "layout", "alias_list.html", &map[string]interface{}{
+		"Title":      "Managed Aliases",
+		"AliasCount": pager.Total,
+		"aliastab":   true,
+		"aliases":    aliases,
+		"pager":      &pager,
+		"domain":     domain,
+		"flashes":    getFlashes(w, r, ctx.Store),
+	})
+}
+
+func createAliasForm() form.Form {
+	myForm := form.Create()
+	myForm.Add("destination", &form.EmailField{Label: "Destination", Required: true})
 	myForm.Add("redirect_to", &form.EmailField{Label: "Redirect to", Required: true})
 	myForm.Add("active", &form.CheckboxField{Label: "Active"})
+	myForm.Add("expires", &form.DateField{Label: "Expires on"})
 	return myForm
 }
 
+// expiryDate returns the midnight, local time, starting the day of the
+// date field.
+func expiryDate(date time.Time) time.Time {
+	return time.Date(date.Year(), date.Month(), date.Day(), 0, 0, 0, 0, time.Local)
+}
+
+func aliasHistory(ctx *core.Context, alias types.Alias) ([]historyEntry, error) {
+	revisions, err := types.GetRevisions(ctx.Database, types.RevisionAlias, alias.Id.Int64)
+	if err != nil {
+		return nil, err
+	}
+
+	history := []historyEntry{}
+	newer := alias.Version()
+	for _, rev := range revisions {
+		version, err := rev.Alias()
+		if err != nil {
+			return nil, err
+		}
+		history = append(history, historyEntry{rev, types.DiffAlias(version, newer)})
+		newer = version
+	}
+	return history, nil
+}
+
 func aliasSave(w http.ResponseWriter, r *http.Request, ctx *core.Context) {
 	parameters := ctx.URLManager.GetParams(r)
 
@@ -635,33 +1861,86 @@ func aliasSave(w http.ResponseWriter, r *http.Request, ctx *core.Context) {
 		csrf.TemplateTag: csrf.TemplateField(r),
 	}
 
+	if pkerr == nil {
+		if data["history"], err = aliasHistory(ctx, alias); err != nil {
+			panic(err)
+		}
+	}
+
 	if r.Method == "GET" {
 		form.SetString("destination", alias.Destination)
 		form.SetString("redirect_to", alias.RedirectTo)
 		form.SetBool("active", alias.Active)
+		if alias.Expires.Valid {
+			form.SetString("expires", alias.Expires.Time.In(time.Local).Format("02/01/2006"))
+		}
 	} else if r.Method != "POST" {
 		// not supported
 		return
 	} else {
+		// a revert submits the values of the revision
+		reverted := false
+		if rev, err := strconv.ParseInt(r.PostFormValue("revision"), 10, 64); err == nil && pkerr == nil {
+			revision, err := types.GetRevisionById(ctx.Database, types.RevisionAlias, pk, rev)
+			if err != nil {
+				panic(err)
+			}
+
+			version, err := revision.Alias()
+			if err != nil {
+				panic(err)
+			}
+			reverted = true
+
+			r.PostForm = url.Values{
+				"destination": {version.Destination},
+				"redirect_to": {version.RedirectTo},
+			}
+			if version.Active {
+				r.PostForm.Set("active", "on")
+			}
+			// the revisions don't keep the expiry
+			if alias.Expires.Valid {
+				r.PostForm.Set("expires", alias.Expires.Time.In(time.Local).Format("02/01/2006"))
+			}
+			r.Form = r.PostForm
+		}
+
 		valid := form.Validate(r)
-		if dest := r.FormValue("destination"); !strings.HasSuffix(dest, "@"+domain.Name) {
+		if dest := r.FormValue("destination"); !domain.Contains(dest) {
 			valid = false
 			form.SetError("destination", "The address doesn't end with @"+domain.Name)
 		}
 
+		var expires sql.NullTime
+		if valid && r.FormValue("expires") != "" {
+			expires = sql.NullTime{Time: expiryDate(form.GetTime("expires")), Valid: true}
+			if !expires.Time.After(time.Now()) {
+				valid = false
+				form.SetError("expires", "The expiry must be a day after today")
+			}
+		}
+
 		if valid {
 			alias.Destination = form.GetString("destination")
 			alias.RedirectTo = form.GetString("redirect_to")
 			alias.Active = form.GetBool("active")
+			alias.Expires = expires
 
-			var flash string
+			flash := "Alias updated successfully"
 			if pkerr != nil {
-				err = alias.Create(ctx.Database)
 				flash = "Alias created successfully"
-			} else {
-				err = alias.Update(ctx.Database)
-				flash = "Alias updated successfully"
+			} else if reverted {
+				flash = "Alias reverted successfully"
 			}
+
+			// the revision is written only along with the update
+			err = ctx.Database.WithTx(func(tx *db.Tx) error {
+				if pkerr != nil {
+					return alias.Create(tx)
+				}
+				return alias.Update(tx)
+			})
 			if err != nil {
 				panic(err)
 			}
@@ -713,7 +1992,729 @@ func aliasDelete(w http.ResponseWriter, r *http.Request, ctx *core.Context) {
 	} else if err := alias.Delete(ctx.Database); err != nil {
 		panic(err)
 	} else {
-		_ = addFlash(w, r, ctx.Store, "Alias deleted successfully")
+		_ = addFlash(w, r, ctx.Store, "Alias moved to the trash")
 		http.Redirect(w, r, ctx.Reverse("alias-list", alias.Domain.Int64), http.StatusFound)
 	}
 }
+
+// dkimRecord is a key along with the DNS record to publish.
+type dkimRecord struct {
+	Key    types.DKIMKey
+	Name   string
+	Record string
+}
+
+func dkimForm() form.Form {
+	myForm := form.Create()
+	myForm.Add("selector", &form.TextField{Label: "Selector", Required: true, MaxLength: 63})
+	myForm.Add("algorithm", &form.ChoiceField{Label: "Algorithm", Required: true, Choices: []form.Choice{
+		{Key: dkim.RSA, Value: fmt.Sprintf("RSA %d bits", dkim.RSABits)},
+		{Key: dkim.Ed25519, Value: "Ed25519"},
+	}})
+	return myForm
+}
+
+func dkimList(w http.ResponseWriter, r *http.Request, ctx *core.Context) {
+	parameters := ctx.URLManager.GetParams(r)
+
+	domain_id, err := strconv.ParseInt(parameters.ByName("domain"), 10, 64)
+	if err != nil {
+		panic(err)
+	}
+
+	domain, err := types.GetDomainById(ctx.Database, domain_id)
+	if err != nil {
+		panic(err)
+	}
+
+	form := dkimForm()
+	data := map[string]interface{}{
+		"Title":          "DKIM Keys",
+		"dkimtab":        true,
+		"domain":         domain,
+		"form":           form,
+		csrf.TemplateTag: csrf.TemplateField(r),
+	}
+
+	if r.Method == "GET" {
+		form.SetString("selector", dkim.DefaultSelector(time.Now()))
+		form.SetString("algorithm", dkim.RSA)
+	} else if r.Method != "POST" {
+		// not supported
+		return
+	} else {
+		valid := form.Validate(r)
+		if err := dkim.ValidSelector(r.FormValue("selector")); err != nil {
+			valid = false
+			form.SetError("selector", err.Error())
+		} else if keys, err := types.GetDKIMKeys(ctx.Database, domain_id); err != nil {
+			panic(err)
+		} else {
+			for _, key := range keys {
+				if key.Selector == r.FormValue("selector") {
+					valid = false
+					form.SetError("selector", "The domain already has a key with this selector.")
+				}
+			}
+		}
+
+		if valid {
+			key, err := dkim.Generate(domain, form.GetString("selector"), form.GetString("algorithm"))
+			if err != nil {
+				panic(err)
+			}
+
+			flash := "DKIM key created successfully"
+			if err = key.Create(ctx.Database); err == types.ErrTooManyDKIMKeys {
+				flash = err.Error() + " Disable one of them first."
+			} else if err != nil {
+				flash = fmt.Sprintf("Cannot create the DKIM key: %s", err)
+			}
+
+			_ = addFlash(w, r, ctx.Store, flash)
+			http.Redirect(w, r, ctx.Reverse("dkim-list", domain_id), http.StatusFound)
+			return
+		}
+	}
+
+	keys, err := types.GetDKIMKeys(ctx.Database, domain_id)
+	if err != nil {
+		panic(err)
+	}
+
+	records := []dkimRecord{}
+	for _, key := range keys {
+		records = append(records, dkimRecord{key, dkim.RecordName(key, domain.Name), dkim.Record(key, domain.Name)})
+	}
+	data["keys"] = records
+	data["flashes"] = getFlashes(w, r, ctx.Store)
+
+	ctx.ExtendAndRender(w, "layout", "dkim_list.html", &data)
+}
+
+// dkimKey returns the key of the URL checking it belongs to the domain.
+func dkimKey(ctx *core.Context, r *http.Request) types.DKIMKey {
+	parameters := ctx.URLManager.GetParams(r)
+
+	domain_id, err := strconv.ParseInt(parameters.ByName("domain"), 10, 64)
+	if err != nil {
+		panic(err)
+	}
+
+	pk, err := strconv.ParseInt(parameters.ByName("pk"), 10, 64)
+	if err != nil {
+		panic(err)
+	}
+
+	key, err := types.GetDKIMKeyById(ctx.Database, pk)
+	if err != nil {
+		panic(err)
+	} else if key.Domain.Int64 != domain_id {
+		panic(sql.ErrNoRows)
+	}
+	return key
+}
+
+func dkimToggle(w http.ResponseWriter, r *http.Request, ctx *core.Context) {
+	key := dkimKey(ctx, r)
+
+	flash := "DKIM key enabled"
+	if key.Active {
+		flash = "DKIM key disabled"
+	}
+	if err := key.SetActive(ctx.Database, !key.Active); err != nil {
+		flash = err.Error()
+	}
+
+	_ = addFlash(w, r, ctx.Store, flash)
+	http.Redirect(w, r, ctx.Reverse("dkim-list", key.Domain.Int64), http.StatusFound)
+}
+
+func dkimPromote(w http.ResponseWriter, r *http.Request, ctx *core.Context) {
+	key := dkimKey(ctx, r)
+
+	flash := "DKIM key signing the mails"
+	if err := ctx.Database.WithTx(func(tx *db.Tx) error { return key.Promote(tx) }); err == types.ErrDKIMKeyInactive {
+		flash = err.Error()
+	} else if err != nil {
+		panic(err)
+	}
+
+	_ = addFlash(w, r, ctx.Store, flash)
+	http.Redirect(w, r, ctx.Reverse("dkim-list", key.Domain.Int64), http.StatusFound)
+}
+
+func dkimDelete(w http.ResponseWriter, r *http.Request, ctx *core.Context) {
+	key := dkimKey(ctx, r)
+
+	flash := "DKIM key deleted"
+	if key.Active {
+		flash = "Disable the DKIM key before deleting it"
+	} else if domain, err := types.GetDomainById(ctx.Database, key.Domain.Int64); err != nil {
+		panic(err)
+	} else if err = key.Delete(ctx.Database); err != nil {
+		panic(err)
+	} else if ctx.Config.DKIMDir != "" {
+		// the tables no longer refer to the key, drop its copy too
+		if err = dkim.RemoveKey(ctx.Config.DKIMDir, key, domain.Name); err != nil {
+			log.Println("dkim:", err)
+			flash = fmt.Sprintf("%s, but its private key couldn't be removed: %s", flash, err)
+		}
+	}
+
+	_ = addFlash(w, r, ctx.Store, flash)
+	http.Redirect(w, r, ctx.Reverse("dkim-list", key.Domain.Int64), http.StatusFound)
+}
+
+// jobState is a job of the scheduler with its latest run.
+type jobState struct {
+	scheduler.Job
+	Last *scheduler.Run
+}
+
+func jobList(w http.ResponseWriter, r *http.Request, ctx *core.Context) {
+	jobs := []jobState{}
+	for _, job := range ctx.Scheduler.Jobs() {
+		state := jobState{Job: job}
+		last, err := scheduler.GetLastRun(ctx.Database, job.Name)
+		if err == nil {
+			state.Last = &last
+		} else if err != sql.ErrNoRows {
+			panic(err)
+		}
+		jobs = append(jobs, state)
+	}
+
+	runs, err := scheduler.GetRuns(ctx.Database, 50)
+	if err != nil {
+		panic(err)
+	}
+
+	data := map[string]interface{}{
+		"Title":          "Jobs",
+		"jobstab":        true,
+		"jobs":           jobs,
+		"runs":           runs,
+		"flashes":        getFlashes(w, r, ctx.Store),
+		csrf.TemplateTag: csrf.TemplateField(r),
+	}
+
+	ctx.ExtendAndRender(w, "layout", "job_list.html", &data)
+}
+
+func jobRun(w http.ResponseWriter, r *http.Request, ctx *core.Context) {
+	name := ctx.URLManager.GetParams(r).ByName("name")
+
+	err := ctx.Scheduler.Trigger(name)
+	if _, ok := err.(scheduler.ErrJobNotFound); ok {
+		panic(err)
+	} else if err != nil {
+		_ = addFlash(w, r, ctx.Store, err.Error())
+	} else {
+		_ = addFlash(w, r, ctx.Store, "The job "+name+" has been started")
+	}
+	http.Redirect(w, r, ctx.Reverse("job-list"), http.StatusFound)
+}
+
+func trashList(w http.ResponseWriter, r *http.Request, ctx *core.Context) {
+	trash, err := types.GetTrash(ctx.Database)
+	if err != nil {
+		panic(err)
+	}
+
+	data := map[string]interface{}{
+		"Title":          "Trash",
+		"trashtab":       true,
+		"trash":          trash,
+		"purgedays":      ctx.Config.TrashPurgeDays,
+		"flashes":        getFlashes(w, r, ctx.Store),
+		csrf.TemplateTag: csrf.TemplateField(r),
+	}
+
+	ctx.ExtendAndRender(w, "layout", "trash.html", &data)
+}
+
+func trashRestore(w http.ResponseWriter, r *http.Request, ctx *core.Context) {
+	parameters := ctx.URLManager.GetParams(r)
+
+	pk, err := strconv.ParseInt(parameters.ByName("pk"), 10, 64)
+	if err != nil {
+		panic(err)
+	}
+
+	kind := parameters.ByName("kind")
+	flash := "Record restored successfully"
+	err = ctx.Database.WithTx(func(tx *db.Tx) error {
+		return types.RestoreFromTrash(tx, kind, pk)
+	})
+	if err != nil {
+		flash = fmt.Sprintf("Cannot restore the record: %s", err)
+	} else if kind != types.TrashAlias {
+		// bring back the Maildirs of the mailboxes
+		mailboxes := []types.Mailbox{}
+		if kind == types.TrashDomain {
+			mailboxes, err = types.GetMailboxList(ctx.Database, pk)
+		} else if mailbox, e := types.GetMailboxById(ctx.Database, pk); e == nil {
+			mailboxes = append(mailboxes, mailbox)
+		} else {
+			err = e
+		}
+		if err != nil {
+			panic(err)
+		}
+
+		flash = withStorage(ctx, flash, func(s *storage.Storage) error {
+			for _, mailbox := range mailboxes {
+				if err := s.RestoreMailbox(mailbox); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	}
+
+	_ = addFlash(w, r, ctx.Store, flash)
+	http.Redirect(w, r, ctx.Reverse("trash"), http.StatusFound)
+}
+
+func trashPurge(w http.ResponseWriter, r *http.Request, ctx *core.Context) {
+	parameters := ctx.URLManager.GetParams(r)
+
+	pk, err := strconv.ParseInt(parameters.ByName("pk"), 10, 64)
+	if err != nil {
+		panic(err)
+	}
+
+	flash := "Record deleted permanently"
+	if err := types.PurgeFromTrash(ctx.Database, parameters.ByName("kind"), pk); err != nil {
+		flash = fmt.Sprintf("Cannot delete the record: %s", err)
+	}
+
+	_ = addFlash(w, r, ctx.Store, flash)
+	http.Redirect(w, r, ctx.Reverse("trash"), http.StatusFound)
+}
+
+func mtastsForm() form.Form {
+	myForm := form.Create()
+	myForm.Add("mode", &form.ChoiceField{Label: "Mode", Required: true, Choices: []form.Choice{
+		{Key: mtasts.None, Value: "None, withdraws the published policy"},
+		{Key: mtasts.Testing, Value: "Testing, the failures are only reported"},
+		{Key: mtasts.Enforce, Value: "Enforce"},
+	}})
+	myForm.Add("mx", &form.TextField{Label: "MX hosts"})
+	myForm.Add("maxage", &form.IntegerField{Label: "Max age", Required: true})
+	myForm.Add("reporturi", &form.TextField{Label: "TLS reports to", MaxLength: 255})
+	return myForm
+}
+
+func mtastsSave(w http.ResponseWriter, r *http.Request, ctx *core.Context) {
+	parameters := ctx.URLManager.GetParams(r)
+
+	domain_id, err := strconv.ParseInt(parameters.ByName("domain"), 10, 64)
+	if err != nil {
+		panic(err)
+	}
+
+	domain, err := types.GetDomainById(ctx.Database, domain_id)
+	if err != nil {
+		panic(err)
+	}
+
+	policy, err := types.GetMTASTS(ctx.Database, domain_id)
+	configured := err == nil
+	if err == sql.ErrNoRows {
+		policy = mtasts.Default(domain, ctx.Config.MXHosts)
+	} else if err != nil {
+		panic(err)
+	}
+
+	form := mtastsForm()
+	data := map[string]interface{}{
+		"Title":          "MTA-STS",
+		"mtaststab":      true,
+		"domain":         domain,
+		"form":           form,
+		"host":           mtasts.HostPrefix + domain.Name,
+		"path":           mtasts.PolicyPath,
+		csrf.TemplateTag: csrf.TemplateField(r),
+	}
+
+	if r.Method == "GET" {
+		form.SetString("mode", policy.Mode)
+		form.SetString("mx", strings.Join(policy.MX, "\n"))
+		form.SetInt64("maxage", policy.MaxAge)
+		form.SetString("reporturi", policy.ReportURI)
+	} else if r.Method != "POST" {
+		// not supported
+		return
+	} else {
+		valid := form.Validate(r)
+		mx, err := mtasts.ParseMX(r.FormValue("mx"))
+		if err != nil {
+			valid = false
+			form.SetError("mx", err.Error())
+		} else if len(mx) == 0 && r.FormValue("mode") != mtasts.None {
+			valid = false
+			form.SetError("mx", "The policy must list at least one MX host.")
+		}
+		if valid && (form.GetInt64("maxage") < mtasts.MinMaxAge || form.GetInt64("maxage") > mtasts.MaxMaxAge) {
+			valid = false
+			form.SetError("maxage", fmt.Sprintf("The max age must be between %d and %d seconds.", mtasts.MinMaxAge, mtasts.MaxMaxAge))
+		}
+		if err := mtasts.ValidReportURI(r.FormValue("reporturi")); err != nil {
+			valid = false
+			form.SetError("reporturi", err.Error())
+		}
+
+		if valid {
+			policy.Mode = form.GetString("mode")
+			policy.MX = mx
+			policy.MaxAge = form.GetInt64("maxage")
+			policy.ReportURI = form.GetString("reporturi")
+			if err = policy.Save(ctx.Database); err != nil {
+				panic(err)
+			}
+
+			_ = addFlash(w, r, ctx.Store, "MTA-STS policy saved successfully")
+			http.Redirect(w, r, ctx.Reverse("mta-sts", domain_id), http.StatusFound)
+			return
+		}
+	}
+
+	if configured {
+		data["policy"] = mtasts.Policy(policy)
+		data["records"] = mtasts.Records(policy, domain.Name)
+	}
+	data["flashes"] = getFlashes(w, r, ctx.Store)
+
+	ctx.ExtendAndRender(w, "layout", "mta_sts.html", &data)
+}
+
+// mtastsPolicy serves the MTA-STS policy of the domain named by the
+// Host header, the requests to other hosts are not found.
+func mtastsPolicy(w http.ResponseWriter, r *http.Request, ctx *core.Context) {
+	name, ok := mtasts.Domain(r.Host)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	domain, err := types.GetDomainByName(ctx.Database, name)
+	if err == sql.ErrNoRows || (err == nil && !domain.Active) {
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
+		panic(err)
+	}
+
+	policy, err := types.GetMTASTS(ctx.Database, domain.Id.Int64)
+	if err == sql.ErrNoRows {
+		// the mode none is served to withdraw a published policy
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
+		panic(err)
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	_, _ = io.WriteString(w, mtasts.Policy(policy))
+}
+
+// autoconfigSettings returns the settings of the mail clients and the
+// address asked for, the requests for addresses outside the active
+// domains are not found.
+func autoconfigSettings(w http.ResponseWriter, r *http.Request, ctx *core.Context, email string) (*autoconfig.Settings, bool) {
+	settings, err := autoconfig.New(ctx.Config)
+	if err != nil {
+		panic(err)
+	} else if settings == nil {
+		http.NotFound(w, r)
+		return nil, false
+	}
+
+	domain, err := types.GetDomainByName(ctx.Database, autoconfig.Domain(email))
+	if err == sql.ErrNoRows || (err == nil && !domain.Active) {
+		http.NotFound(w, r)
+		return nil, false
+	} else if err != nil {
+		panic(err)
+	}
+	return settings, true
+}
+
+func writeXML(w http.ResponseWriter, content []byte, err error) {
+	if err != nil {
+		panic(err)
+	}
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	_, _ = w.Write(content)
+}
+
+func autoconfigMozilla(w http.ResponseWriter, r *http.Request, ctx *core.Context) {
+	// the address is optional, the domain is the host otherwise
+	email := r.URL.Query().Get("emailaddress")
+	if email == "" {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		email = "@" + strings.TrimPrefix(strings.ToLower(host), "autoconfig.")
+	}
+
+	settings, ok := autoconfigSettings(w, r, ctx, email)
+	if ok {
+		content, err := settings.Mozilla(autoconfig.Domain(email))
+		writeXML(w, content, err)
+	}
+}
+
+func autoconfigOutlook(w http.ResponseWriter, r *http.Request, ctx *core.Context) {
+	email := r.URL.Query().Get("emailaddress")
+	if r.Method == "POST" {
+		var err error
+		if email, err = autoconfig.ReadOutlookRequest(r.Body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	settings, ok := autoconfigSettings(w, r, ctx, email)
+	if ok {
+		content, err := settings.Outlook(email)
+		writeXML(w, content, err)
+	}
+}
+
+func autoconfigApple(w http.ResponseWriter, r *http.Request, ctx *core.Context) {
+	email := strings.ToLower(r.URL.Query().Get("emailaddress"))
+
+	settings, ok := autoconfigSettings(w, r, ctx, email)
+	if ok {
+		content, err := settings.Apple(email)
+		if err != nil {
+			panic(err)
+		}
+		w.Header().Set("Content-Type", "application/x-apple-aspen-config")
+		w.Header().Set("Content-Disposition", `attachment; filename="`+autoconfig.Domain(email)+`.mobileconfig"`)
+		_, _ = w.Write(content)
+	}
+}
+
+func bccForm(mailboxes []types.Mailbox) form.Form {
+	targets := []form.Choice{{Key: "0", Value: "All the mailboxes of the domain"}}
+	for _, m := range mailboxes {
+		targets = append(targets, form.Choice{Key: strconv.FormatInt(m.Id.Int64, 10), Value: m.Email})
+	}
+
+	myForm := form.Create()
+	myForm.Add("kind", &form.ChoiceField{Label: "Copy the mails", Required: true, Choices: []form.Choice{
+		{Key: types.BCCRecipient, Value: "received by"},
+		{Key: types.BCCSender, Value: "sent by"},
+	}})
+	myForm.Add("mailbox", &form.ChoiceField{Label: "Mailbox", Required: true, Choices: targets})
+	myForm.Add("address", &form.EmailField{Label: "Copy to", Required: true})
+	return myForm
+}
+
+func bccList(w http.ResponseWriter, r *http.Request, ctx *core.Context) {
+	parameters := ctx.URLManager.GetParams(r)
+
+	domain_id, err := strconv.ParseInt(parameters.ByName("domain"), 10, 64)
+	if err != nil {
+		panic(err)
+	}
+
+	domain, err := types.GetDomainById(ctx.Database, domain_id)
+	if err != nil {
+		panic(err)
+	}
+
+	mailboxes, err := types.GetMailboxList(ctx.Database, domain_id)
+	if err != nil {
+		panic(err)
+	}
+
+	form := bccForm(mailboxes)
+	data := map[string]interface{}{
+		"Title":          "BCC Rules",
+		"bcctab":         true,
+		"domain":         domain,
+		"form":           form,
+		csrf.TemplateTag: csrf.TemplateField(r),
+	}
+
+	if r.Method == "GET" {
+		form.SetString("kind", types.BCCRecipient)
+		form.SetString("mailbox", "0")
+	} else if r.Method == "POST" && form.Validate(r) {
+		bcc := types.BCC{
+			Domain:  domain.Id,
+			Kind:    form.GetString("kind"),
+			Address: strings.ToLower(form.GetString("address")),
+		}
+		if pk, _ := strconv.ParseInt(form.GetString("mailbox"), 10, 64); pk > 0 {
+			bcc.Mailbox = sql.NullInt64{Int64: pk, Valid: true}
+		}
+
+		err = bcc.Create(ctx.Database)
+		if err == types.ErrBCCExists {
+			form.SetError("mailbox", err.Error())
+		} else if err != nil {
+			panic(err)
+		} else {
+			_ = addFlash(w, r, ctx.Store, "BCC rule created successfully")
+			http.Redirect(w, r, ctx.Reverse("bcc-list", domain_id), http.StatusFound)
+			return
+		}
+	}
+
+	rules, err := types.GetBCCs(ctx.Database, domain_id)
+	if err != nil {
+		panic(err)
+	}
+	data["rules"] = rules
+	data["flashes"] = getFlashes(w, r, ctx.Store)
+
+	ctx.ExtendAndRender(w, "layout", "bcc_list.html", &data)
+}
+
+func bccDelete(w http.ResponseWriter, r *http.Request, ctx *core.Context) {
+	parameters := ctx.URLManager.GetParams(r)
+
+	domain_id, err := strconv.ParseInt(parameters.ByName("domain"), 10, 64)
+	if err != nil {
+		panic(err)
+	}
+
+	pk, err := strconv.ParseInt(parameters.ByName("pk"), 10, 64)
+	if err != nil {
+		panic(err)
+	}
+
+	bcc, err := types.GetBCCById(ctx.Database, pk)
+	if err != nil {
+		panic(err)
+	} else if bcc.Domain.Int64 != domain_id {
+		panic(sql.ErrNoRows)
+	}
+
+	if err = bcc.Delete(ctx.Database); err != nil {
+		panic(err)
+	}
+
+	_ = addFlash(w, r, ctx.Store, "BCC rule deleted")
+	http.Redirect(w, r, ctx.Reverse("bcc-list", domain_id), http.StatusFound)
+}
+
+func accessForm() form.Form {
+	myForm := form.Create()
+	myForm.Add("kind", &form.ChoiceField{Label: "Rule of", Required: true, Choices: []form.Choice{
+		{Key: types.AccessSender, Value: "Sender"},
+		{Key: types.AccessRecipient, Value: "Recipient"},
+	}})
+	myForm.Add("pattern", &form.TextField{Label: "Pattern", Required: true, MaxLength: 255})
+	myForm.Add("action", &form.ChoiceField{Label: "Action", Required: true, Choices: []form.Choice{
+		{Key: types.AccessReject, Value: "Reject"},
+		{Key: types.AccessDiscard, Value: "Discard"},
+		{Key: types.AccessOK, Value: "Accept"},
+	}})
+	myForm.Add("message", &form.TextField{Label: "Message", MaxLength: 255})
+	return myForm
+}
+
+func accessList(w http.ResponseWriter, r *http.Request, ctx *core.Context) {
+	parameters := ctx.URLManager.GetParams(r)
+
+	domain_id, err := strconv.ParseInt(parameters.ByName("domain"), 10, 64)
+	if err != nil {
+		panic(err)
+	}
+
+	domain, err := types.GetDomainById(ctx.Database, domain_id)
+	if err != nil {
+		panic(err)
+	}
+
+	form := accessForm()
+	data := map[string]interface{}{
+		"Title":          "Access Rules",
+		"accesstab":      true,
+		"domain":         domain,
+		"form":           form,
+		csrf.TemplateTag: csrf.TemplateField(r),
+	}
+
+	if r.Method == "GET" {
+		form.SetString("kind", types.AccessSender)
+		form.SetString("action", types.AccessReject)
+	} else if r.Method == "POST" {
+		valid := form.Validate(r)
+		pattern := strings.ToLower(strings.TrimSpace(r.FormValue("pattern")))
+		if err := types.ValidAccessPattern(domain, r.FormValue("kind"), pattern); err != nil && pattern != "" {
+			valid = false
+			form.SetError("pattern", err.Error())
+		}
+		if strings.ContainsAny(r.FormValue("message"), "\r\n") {
+			valid = false
+			form.SetError("message", "The message must be a single line.")
+		}
+
+		if valid {
+			rule := types.AccessRule{
+				Domain:  domain.Id,
+				Kind:    form.GetString("kind"),
+				Pattern: pattern,
+				Action:  form.GetString("action"),
+				Message: strings.TrimSpace(form.GetString("message")),
+			}
+
+			err = rule.Create(ctx.Database)
+			if err == types.ErrAccessRuleExists {
+				form.SetError("pattern", err.Error())
+			} else if err != nil {
+				panic(err)
+			} else {
+				_ = addFlash(w, r, ctx.Store, "Access rule created successfully")
+				http.Redirect(w, r, ctx.Reverse("access-list", domain_id), http.StatusFound)
+				return
+			}
+		}
+	}
+
+	rules, err := types.GetAccessRules(ctx.Database, domain_id)
+	if err != nil {
+		panic(err)
+	}
+	data["rules"] = rules
+	data["flashes"] = getFlashes(w, r, ctx.Store)
+
+	ctx.ExtendAndRender(w, "layout", "access_list.html", &data)
+}
+
+func accessDelete(w http.ResponseWriter, r *http.Request, ctx *core.Context) {
+	parameters := ctx.URLManager.GetParams(r)
+
+	domain_id, err := strconv.ParseInt(parameters.ByName("domain"), 10, 64)
+	if err != nil {
+		panic(err)
+	}
+
+	pk, err := strconv.ParseInt(parameters.ByName("pk"), 10, 64)
+	if err != nil {
+		panic(err)
+	}
+
+	rule, err := types.GetAccessRuleById(ctx.Database, pk)
+	if err != nil {
+		panic(err)
+	} else if rule.Domain.Int64 != domain_id {
+		panic(sql.ErrNoRows)
+	}
+
+	if err = rule.Delete(ctx.Database); err != nil {
+		panic(err)
+	}
+
+	_ = addFlash(w, r, ctx.Store, "Access rule deleted")
+	http.Redirect(w, r, ctx.Reverse("access-list", domain_id), http.StatusFound)
+}
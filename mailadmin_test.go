@@ -1,18 +1,34 @@
 package main
 
 import (
+	"bytes"
+	"database/sql"
+	"fmt"
 	"io/ioutil"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
 	"testing"
+	"time"
 
 	"golang.org/x/crypto/bcrypt"
 
 	"github.com/funnydog/mailadmin/core"
 	"github.com/funnydog/mailadmin/core/config"
+	"github.com/funnydog/mailadmin/core/db"
+	"github.com/funnydog/mailadmin/core/form"
+	"github.com/funnydog/mailadmin/core/mailer"
+	"github.com/funnydog/mailadmin/core/scheduler"
+	"github.com/funnydog/mailadmin/dkim"
+	"github.com/funnydog/mailadmin/testutils"
 	"github.com/funnydog/mailadmin/types"
 	"github.com/gorilla/csrf"
 )
@@ -22,6 +38,9 @@ const (
 	databasePath  = "/tmp/testing.db"
 	dummyUsername = "admin"
 	dummyPassword = "pass"
+
+	// a mailbox password satisfying the default policy
+	mailboxPassword = "Tulip-Orbit-58-Quay"
 )
 
 var testingClient = http.Client{
@@ -50,6 +69,25 @@ func testGet(t *testing.T, url string, status int) {
 	}
 }
 
+func testGetBody(t *testing.T, url string, status int) string {
+	res, err := testingClient.Get(url)
+	if err != nil {
+		panic(err)
+	}
+	defer res.Body.Close()
+
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		panic(err)
+	}
+	if res.StatusCode != status {
+		t.Errorf("Actual status: (%d); Expected status: (%d)",
+			res.StatusCode, status)
+		t.Error(string(body))
+	}
+	return string(body)
+}
+
 func testPost(t *testing.T, url, data string, status int) {
 	res, err := testingClient.Post(
 		url,
@@ -66,6 +104,29 @@ func testPost(t *testing.T, url, data string, status int) {
 	}
 }
 
+func testPostBody(t *testing.T, url, data string, status int) string {
+	res, err := testingClient.Post(
+		url,
+		"application/x-www-form-urlencoded",
+		strings.NewReader(data),
+	)
+	if err != nil {
+		panic(err)
+	}
+	defer res.Body.Close()
+
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		panic(err)
+	}
+	if res.StatusCode != status {
+		t.Errorf("Actual status: (%d); Expected status: (%d)",
+			res.StatusCode, status)
+		t.Error(string(body))
+	}
+	return string(body)
+}
+
 func createTestingContext() *core.Context {
 	staticConf := config.Static{
 		StaticDir:   "public/static",
@@ -105,7 +166,7 @@ func createTestingContext() *core.Context {
 	})
 
 	// build the model
-	if err = types.CreateModel(ctx.Database); err != nil {
+	if err = createModel(ctx.Database); err != nil {
 		panic(err)
 	}
 
@@ -113,6 +174,12 @@ func createTestingContext() *core.Context {
 	if err = types.PrepareStatements(ctx.Database); err != nil {
 		panic(err)
 	}
+	if err = scheduler.PrepareStatements(ctx.Database); err != nil {
+		panic(err)
+	}
+	if err = mailer.PrepareStatements(ctx.Database); err != nil {
+		panic(err)
+	}
 
 	// add some dummy db entries
 	domain := types.Domain{
@@ -208,6 +275,81 @@ func TestDomainList(t *testing.T) {
 	testGet(t, ts.URL+ctx.Reverse("domain-list"), http.StatusOK)
 }
 
+func TestDomainListSearch(t *testing.T) {
+	ctx := createTestingContext()
+	defer closeTestingContext(ctx)
+
+	ts := httptest.NewServer(ctx.Router)
+	defer ts.Close()
+
+	for _, name := range []string{"bravo.org", "charlie.net", "delta.it"} {
+		domain := types.Domain{Name: name, Active: true}
+		if err := domain.Create(ctx.Database); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	myURL := ts.URL + ctx.Reverse("domain-list")
+
+	body := testGetBody(t, myURL+"?q=CHAR", http.StatusOK)
+	if !strings.Contains(body, "charlie.net") || strings.Contains(body, "bravo.org") {
+		t.Error("The search didn't filter the domains")
+	}
+
+	// the wildcards typed by the user are matched literally
+	body = testGetBody(t, myURL+"?q=%25", http.StatusOK)
+	if !strings.Contains(body, "No. 0 Managed Domains") {
+		t.Error("The wildcard in the search wasn't escaped")
+	}
+
+	body = testGetBody(t, myURL+"?perpage=2&sort=name&order=desc", http.StatusOK)
+	if !strings.Contains(body, "delta.it") || strings.Contains(body, "bravo.org") {
+		t.Error("The first page doesn't contain the expected domains")
+	}
+	if !strings.Contains(body, "Page 1 of 2") {
+		t.Error("The pager doesn't show the number of pages")
+	}
+
+	body = testGetBody(t, myURL+"?perpage=2&sort=name&order=desc&page=2", http.StatusOK)
+	if !strings.Contains(body, "bravo.org") || strings.Contains(body, "delta.it") {
+		t.Error("The second page doesn't contain the expected domains")
+	}
+
+	// unknown sort keys fall back to the default order
+	testGet(t, myURL+"?sort=password;--&page=-1", http.StatusOK)
+}
+
+func TestSearch(t *testing.T) {
+	ctx := createTestingContext()
+	defer closeTestingContext(ctx)
+
+	ts := httptest.NewServer(ctx.Router)
+	defer ts.Close()
+
+	myURL := ts.URL + ctx.Reverse("search")
+
+	testGet(t, myURL, http.StatusOK)
+
+	// the mailbox and the alias redirecting to it
+	body := testGetBody(t, myURL+"?q=test%40", http.StatusOK)
+	if !strings.Contains(body, ctx.Reverse("mailbox-update", 1, 1)) {
+		t.Error("The search didn't find the mailbox")
+	}
+	if !strings.Contains(body, ctx.Reverse("alias-update", 1, 1)) {
+		t.Error("The search didn't find the alias by redirect_to")
+	}
+
+	body = testGetBody(t, myURL+"?q=EXAMPLE.COM", http.StatusOK)
+	if !strings.Contains(body, ctx.Reverse("domain-update", 1)) {
+		t.Error("The search didn't find the domain")
+	}
+
+	body = testGetBody(t, myURL+"?q=nothing-here", http.StatusOK)
+	if !strings.Contains(body, "Nothing found") {
+		t.Error("The search found unexpected records")
+	}
+}
+
 func TestDomainOverview(t *testing.T) {
 	ctx := createTestingContext()
 	defer closeTestingContext(ctx)
@@ -218,6 +360,31 @@ func TestDomainOverview(t *testing.T) {
 	testGet(t, ts.URL+ctx.Reverse("domain-overview", 1), http.StatusOK)
 }
 
+func TestDomainDNSCheck(t *testing.T) {
+	ctx := createTestingContext()
+	defer closeTestingContext(ctx)
+
+	ts := httptest.NewServer(ctx.Router)
+	defer ts.Close()
+
+	ctx.Config.DNSResolver = testutils.ServeDNS(t, testutils.DNSZone{
+		MX:  map[string][]net.MX{"example.com.": {{Host: "mx.example.com.", Pref: 10}}},
+		TXT: map[string][]string{"example.com.": {"v=spf1 mx -all"}},
+	})
+
+	myURL := ts.URL + ctx.Reverse("domain-overview", 1)
+	if body := testGetBody(t, myURL, http.StatusOK); strings.Contains(body, "10 mx.example.com.") {
+		t.Error("The DNS check has been run without asking")
+	}
+
+	body := testGetBody(t, myURL+"?dnscheck=1", http.StatusOK)
+	for _, expected := range []string{"10 mx.example.com.", "v=spf1 mx -all", "The domain has no DMARC record."} {
+		if !strings.Contains(body, expected) {
+			t.Errorf("The DNS check doesn't show %s", expected)
+		}
+	}
+}
+
 func TestDomainCreate(t *testing.T) {
 	ctx := createTestingContext()
 	defer closeTestingContext(ctx)
@@ -307,6 +474,16 @@ func TestDomainUpdate(t *testing.T) {
 	if domain.BackupMX != true {
 		t.Error("Domain is not BackupMX, Expected BackupMX")
 	}
+
+	data.Set("transport", "smtp:[mx.example.com")
+	testPost(t, myURL, data.Encode(), http.StatusOK)
+
+	data.Set("transport", " smtp:[mx.example.com]:25 ")
+	testPost(t, myURL, data.Encode(), http.StatusFound)
+
+	if domain, _ = types.GetDomainById(ctx.Database, 1); domain.Transport != "smtp:[mx.example.com]:25" {
+		t.Errorf("Domain transport found: %s, Expected smtp:[mx.example.com]:25", domain.Transport)
+	}
 }
 
 func TestDomainDelete(t *testing.T) {
@@ -329,6 +506,109 @@ func TestDomainDelete(t *testing.T) {
 	}
 }
 
+func TestDomainExportImport(t *testing.T) {
+	ctx := createTestingContext()
+	defer closeTestingContext(ctx)
+
+	ts := httptest.NewServer(ctx.Router)
+	defer ts.Close()
+
+	testGet(t, ts.URL+ctx.Reverse("domain-export-all"), http.StatusOK)
+
+	body := testGetBody(t, ts.URL+ctx.Reverse("domain-export", 1), http.StatusOK)
+	if !strings.Contains(body, "test@example.com") {
+		t.Error("The export doesn't contain the mailbox")
+	}
+
+	domain, err := types.GetDomainById(ctx.Database, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = domain.Delete(ctx.Database); err != nil {
+		t.Fatal(err)
+	}
+
+	myURL := ts.URL + ctx.Reverse("domain-import")
+	testGet(t, myURL, http.StatusOK)
+
+	testUpload(t, myURL, "not json", nil, http.StatusOK)
+	testUpload(t, myURL, body, map[string]string{"dryrun": "on"}, http.StatusOK)
+	if _, err = types.GetMailboxByEmail(ctx.Database, "test@example.com"); err == nil {
+		t.Error("The dry run restored the mailbox")
+	}
+
+	root := t.TempDir()
+	ctx.Config.MailRoot = root
+
+	testUpload(t, myURL, body, nil, http.StatusFound)
+	if _, err = types.GetMailboxByEmail(ctx.Database, "test@example.com"); err != nil {
+		t.Error("The mailbox hasn't been restored")
+	}
+	if _, err = os.Stat(filepath.Join(root, "example.com", "test", "cur")); err != nil {
+		t.Error("The Maildir has not been created:", err)
+	}
+}
+
+func TestMailboxList(t *testing.T) {
+	ctx := createTestingContext()
+	defer closeTestingContext(ctx)
+
+	ts := httptest.NewServer(ctx.Router)
+	defer ts.Close()
+
+	myURL := ts.URL + ctx.Reverse("mailbox-list", 1)
+
+	testGet(t, myURL, http.StatusOK)
+
+	body := testGetBody(t, myURL+"?q=test&sort=modified&order=desc", http.StatusOK)
+	if !strings.Contains(body, "test@example.com") {
+		t.Error("The search didn't find the mailbox")
+	}
+
+	body = testGetBody(t, myURL+"?q=nobody", http.StatusOK)
+	if strings.Contains(body, "test@example.com") {
+		t.Error("The search didn't filter the mailboxes")
+	}
+}
+
+func TestMailboxUsage(t *testing.T) {
+	ctx := createTestingContext()
+	defer closeTestingContext(ctx)
+
+	ts := httptest.NewServer(ctx.Router)
+	defer ts.Close()
+
+	root := t.TempDir()
+	ctx.Config.MailRoot = root
+
+	big := types.Mailbox{Domain: sql.NullInt64{Int64: 1, Valid: true}, Email: "big@example.com", Password: "x", Active: true}
+	if err := big.Create(ctx.Database); err != nil {
+		t.Fatal(err)
+	}
+	for email, size := range map[string]string{"big": "1048576S\n7340032 5\n", "test": "0S\n2048 1\n"} {
+		path := filepath.Join(root, "example.com", email)
+		if err := os.MkdirAll(path, 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(path, "maildirsize"), []byte(size), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	body := testGetBody(t, ts.URL+ctx.Reverse("mailbox-list", 1)+"?sort=usage&order=desc", http.StatusOK)
+	if !strings.Contains(body, "7.0 MiB of 1.0 MiB (700%)") {
+		t.Error("The usage and the quota are not shown")
+	}
+	if strings.Index(body, "big@example.com") > strings.Index(body, "test@example.com") {
+		t.Error("The mailboxes are not sorted by usage")
+	}
+
+	body = testGetBody(t, ts.URL+ctx.Reverse("domain-overview", 1), http.StatusOK)
+	if !strings.Contains(body, "7.0 MiB") {
+		t.Error("The total usage is not shown in the overview")
+	}
+}
+
 func TestMailboxCreate(t *testing.T) {
 	ctx := createTestingContext()
 	defer closeTestingContext(ctx)
@@ -342,11 +622,19 @@ func TestMailboxCreate(t *testing.T) {
 
 	data := url.Values{}
 	data.Add("email", "notvalidemail")
-	data.Add("password", dummyPassword)
+	data.Add("password", mailboxPassword)
 	data.Add("active", "on")
 	testPost(t, myURL, data.Encode(), http.StatusOK)
 
+	// the password policy rejects the weak passwords
 	data.Set("email", "valid@example.com")
+	data.Set("password", "12345")
+	body := testPostBody(t, myURL, data.Encode(), http.StatusOK)
+	if !strings.Contains(body, form.ErrPasswordShort(form.DefaultPasswordLength).Error()) {
+		t.Errorf("The weak password has been accepted %s", body)
+	}
+
+	data.Set("password", mailboxPassword)
 	testPost(t, myURL, data.Encode(), http.StatusFound)
 
 	// check if the mailbox was inserted
@@ -372,6 +660,209 @@ func TestMailboxCreate(t *testing.T) {
 	}
 }
 
+// startTestingMailer sets the mailer and its job as if the SMTP server
+// were configured.
+func startTestingMailer(t *testing.T, ctx *core.Context) *testutils.SMTPServer {
+	server := testutils.ServeSMTP(t)
+	host, port, _ := net.SplitHostPort(server.Address)
+	ctx.Config.MailerHost = host
+	ctx.Config.MailerPort, _ = strconv.Atoi(port)
+	ctx.Config.MailerFrom = "admin@example.com"
+	ctx.Config.MailerStartTLS = false
+
+	var err error
+	if ctx.Mailer, err = mailer.New(ctx.Config, ctx.Database, ctx.TemplateManager); err != nil {
+		t.Fatal(err)
+	}
+	err = ctx.Scheduler.Add("send-mail", "", "@every 1m", func() error {
+		return sendMail(ctx)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return server
+}
+
+// waitMails waits for the job started in the background to send n
+// mails.
+func waitMails(server *testutils.SMTPServer, n int) []testutils.SMTPMail {
+	mails := server.Mails()
+	for i := 0; i < 100 && len(mails) < n; i++ {
+		time.Sleep(10 * time.Millisecond)
+		mails = server.Mails()
+	}
+	return mails
+}
+
+func TestMailboxWelcome(t *testing.T) {
+	ctx := createTestingContext()
+	defer closeTestingContext(ctx)
+
+	ts := httptest.NewServer(ctx.Router)
+	defer ts.Close()
+
+	server := startTestingMailer(t, ctx)
+
+	data := url.Values{}
+	data.Add("email", "new@example.com")
+	data.Add("password", mailboxPassword)
+	data.Add("active", "on")
+	testPost(t, ts.URL+ctx.Reverse("mailbox-create", 1), data.Encode(), http.StatusFound)
+
+	mails := waitMails(server, 1)
+	if len(mails) != 1 || mails[0].To[0] != "new@example.com" {
+		t.Fatalf("Unexpected mails %+v", mails)
+	}
+	if !strings.Contains(mails[0].Data, "Subject: Welcome to your new mailbox new@example.com") {
+		t.Errorf("Unexpected mail %s", mails[0].Data)
+	}
+}
+
+func TestPasswordReset(t *testing.T) {
+	ctx := createTestingContext()
+	defer closeTestingContext(ctx)
+
+	ts := httptest.NewServer(ctx.Router)
+	defer ts.Close()
+
+	forgotURL := ts.URL + ctx.Reverse("password-forgot")
+	resetURL := ts.URL + ctx.Reverse("password-reset")
+
+	// disabled without the mailer and the public URL
+	testGet(t, forgotURL, http.StatusNotFound)
+
+	server := startTestingMailer(t, ctx)
+	ctx.Config.PublicURL = "https://mail.example.com/"
+	testGet(t, forgotURL, http.StatusOK)
+
+	// the recovery address is another mailbox
+	mailbox, err := types.GetMailboxById(ctx.Database, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := url.Values{}
+	data.Add("email", mailbox.Email)
+	data.Add("active", "on")
+	data.Add("recovery", mailbox.Email)
+	testPost(t, ts.URL+ctx.Reverse("mailbox-update", 1, 1), data.Encode(), http.StatusOK)
+	data.Set("recovery", "owner@example.net")
+	testPost(t, ts.URL+ctx.Reverse("mailbox-update", 1, 1), data.Encode(), http.StatusFound)
+
+	// the same answer for an unknown mailbox, without mails
+	body := testPostBody(t, forgotURL, url.Values{"email": {"unknown@example.com"}}.Encode(), http.StatusOK)
+	if !strings.Contains(body, "a link to reset its") {
+		t.Errorf("Unexpected page %s", body)
+	}
+	testPost(t, forgotURL, url.Values{"email": {mailbox.Email}}.Encode(), http.StatusOK)
+
+	mails := waitMails(server, 1)
+	if len(mails) != 1 || mails[0].To[0] != "owner@example.net" {
+		t.Fatalf("Unexpected mails %+v", mails)
+	}
+	content, err := ioutil.ReadAll(quotedprintable.NewReader(strings.NewReader(mails[0].Data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	prefix := "https://mail.example.com" + ctx.Reverse("password-reset") + "?token="
+	i := strings.Index(string(content), prefix)
+	if i < 0 {
+		t.Fatalf("The mail doesn't contain the link %s", content)
+	}
+	token := strings.SplitN(string(content[i+len(prefix):]), `"`, 2)[0]
+
+	body = testGetBody(t, resetURL+"?token=wrong", http.StatusOK)
+	if !strings.Contains(body, types.ErrInvalidToken.Error()) {
+		t.Errorf("Unexpected page %s", body)
+	}
+	body = testGetBody(t, resetURL+"?token="+token, http.StatusOK)
+	if !strings.Contains(body, "New password of "+mailbox.Email) {
+		t.Errorf("Unexpected page %s", body)
+	}
+
+	data = url.Values{}
+	data.Add("token", token)
+	data.Add("password", "Password2026")
+	data.Add("confirm", "Password2026")
+	body = testPostBody(t, resetURL, data.Encode(), http.StatusOK)
+	if !strings.Contains(body, form.ErrPasswordWeak.Error()) {
+		t.Errorf("Unexpected page %s", body)
+	}
+
+	data.Set("password", "Quiet-Lantern-31-Fjord")
+	data.Set("confirm", "Quiet-Lantern-31-Fjord!")
+	body = testPostBody(t, resetURL, data.Encode(), http.StatusOK)
+	if !strings.Contains(body, "The passwords don&#39;t match") {
+		t.Errorf("Unexpected page %s", body)
+	}
+
+	data.Set("confirm", "Quiet-Lantern-31-Fjord")
+	body = testPostBody(t, resetURL, data.Encode(), http.StatusOK)
+	if !strings.Contains(body, "The password has been changed") {
+		t.Errorf("Unexpected page %s", body)
+	}
+	if mailbox, err = types.GetMailboxById(ctx.Database, 1); err != nil {
+		t.Fatal(err)
+	} else if bcrypt.CompareHashAndPassword([]byte(mailbox.Password), []byte("Quiet-Lantern-31-Fjord")) != nil {
+		t.Error("The password hasn't been changed")
+	}
+
+	// the link works once
+	data.Set("password", "Amber-Kettle-47-Drift")
+	data.Set("confirm", "Amber-Kettle-47-Drift")
+	body = testPostBody(t, resetURL, data.Encode(), http.StatusOK)
+	if !strings.Contains(body, types.ErrInvalidToken.Error()) {
+		t.Errorf("Unexpected page %s", body)
+	}
+
+	// and expires
+	now := time.Now()
+	if token, err = types.NewResetToken(ctx.Database, 1, now); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = types.GetResetToken(ctx.Database, token, now.Add(types.ResetLifetime/2)); err != nil {
+		t.Error(err)
+	}
+	if _, err = types.GetResetToken(ctx.Database, token, now.Add(types.ResetLifetime+time.Second)); err != types.ErrInvalidToken {
+		t.Errorf("Unexpected error %v", err)
+	}
+
+	// a new link waits for the cooldown, the page answers the same
+	if _, err = types.NewResetToken(ctx.Database, 1, now.Add(time.Minute)); err != types.ErrResetCooldown {
+		t.Errorf("Unexpected error %v", err)
+	}
+	testPost(t, forgotURL, url.Values{"email": {mailbox.Email}}.Encode(), http.StatusOK)
+	if messages, err := mailer.GetMessages(ctx.Database, 10); err != nil {
+		t.Fatal(err)
+	} else if len(messages) != 1 {
+		t.Errorf("Found %d mails in the queue, Expected 1", len(messages))
+	}
+	if _, err = types.GetResetToken(ctx.Database, token, now); err != nil {
+		t.Error("The cooldown revoked the previous link")
+	}
+
+	// the links of the disabled and trashed mailboxes stop working
+	mailbox.Active = false
+	if err = mailbox.Update(ctx.Database); err != nil {
+		t.Fatal(err)
+	}
+	body = testGetBody(t, resetURL+"?token="+token, http.StatusOK)
+	if !strings.Contains(body, types.ErrInvalidToken.Error()) {
+		t.Errorf("Unexpected page %s", body)
+	}
+	mailbox.Active = true
+	if err = mailbox.Update(ctx.Database); err != nil {
+		t.Fatal(err)
+	}
+	if err = mailbox.Delete(ctx.Database); err != nil {
+		t.Fatal(err)
+	}
+	data.Set("token", token)
+	body = testPostBody(t, resetURL, data.Encode(), http.StatusOK)
+	if !strings.Contains(body, types.ErrInvalidToken.Error()) {
+		t.Errorf("Unexpected page %s", body)
+	}
+}
+
 func TestMailboxUpdate(t *testing.T) {
 	ctx := createTestingContext()
 	defer closeTestingContext(ctx)
@@ -415,7 +906,7 @@ func TestMailboxUpdate(t *testing.T) {
 		t.Error("The mailbox is not active")
 	}
 
-	data.Add("password", "12345")
+	data.Add("password", mailboxPassword)
 	testPost(t, myURL, data.Encode(), http.StatusFound)
 
 	mailbox, err = types.GetMailboxById(ctx.Database, 1)
@@ -432,40 +923,724 @@ func TestMailboxUpdate(t *testing.T) {
 	}
 }
 
-func TestMailboxDelete(t *testing.T) {
+func TestMailboxRevert(t *testing.T) {
 	ctx := createTestingContext()
 	defer closeTestingContext(ctx)
 
 	ts := httptest.NewServer(ctx.Router)
 	defer ts.Close()
 
-	myURL := ts.URL + ctx.Reverse("mailbox-delete", 1, 1)
+	myURL := ts.URL + ctx.Reverse("mailbox-update", 1, 1)
 
-	testGet(t, myURL, http.StatusOK)
+	old, err := types.GetMailboxById(ctx.Database, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
 
-	testPost(t, myURL, "", http.StatusFound)
+	data := url.Values{}
+	data.Add("email", "another@example.com")
+	data.Add("password", mailboxPassword)
+	testPost(t, myURL, data.Encode(), http.StatusFound)
 
-	// check if the object is still there
-	_, err := types.GetMailboxById(ctx.Database, 1)
-	if err == nil {
-		t.Error("The Mailbox hasn't been deleted")
+	body := testGetBody(t, myURL, http.StatusOK)
+	if !strings.Contains(body, "Revert to this version") {
+		t.Error("The history of the mailbox is not shown")
+	}
+
+	revisions, err := types.GetRevisions(ctx.Database, types.RevisionMailbox, 1)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(revisions) != 1 {
+		t.Fatalf("Found %d revisions, Expected 1", len(revisions))
+	}
+
+	data = url.Values{}
+	data.Add("revision", strconv.FormatInt(revisions[0].Id.Int64, 10))
+	testPost(t, myURL, data.Encode(), http.StatusFound)
+
+	mailbox, err := types.GetMailboxById(ctx.Database, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mailbox.Version() != old.Version() {
+		t.Errorf("Mailbox %v not reverted to %v", mailbox.Version(), old.Version())
+	}
+
+	// the revert can be reverted too
+	revisions, err = types.GetRevisions(ctx.Database, types.RevisionMailbox, 1)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(revisions) != 2 {
+		t.Errorf("Found %d revisions, Expected 2", len(revisions))
+	}
+
+	// the revisions of the other records are rejected
+	if _, err = types.GetRevisionById(ctx.Database, types.RevisionAlias, 1, revisions[0].Id.Int64); err != sql.ErrNoRows {
+		t.Errorf("Found the revision of a mailbox for an alias: %v", err)
 	}
 }
 
-func TestAliasCreate(t *testing.T) {
+func TestMailboxMaildir(t *testing.T) {
 	ctx := createTestingContext()
 	defer closeTestingContext(ctx)
 
 	ts := httptest.NewServer(ctx.Router)
 	defer ts.Close()
 
-	myURL := ts.URL + ctx.Reverse("alias-create", 1)
-
-	testGet(t, myURL, http.StatusOK)
+	root := t.TempDir()
+	ctx.Config.MailRoot = root
+	ctx.Config.MailArchive = filepath.Join(root, "archive")
 
 	data := url.Values{}
-	data.Add("destination", "original@example.org")
-	data.Add("redirect_to", "redirected@otherdomain.com")
+	data.Add("email", "new@example.com")
+	data.Add("password", mailboxPassword)
+	data.Add("active", "on")
+	testPost(t, ts.URL+ctx.Reverse("mailbox-create", 1), data.Encode(), http.StatusFound)
+
+	if _, err := os.Stat(filepath.Join(root, "example.com", "new", "cur")); err != nil {
+		t.Error("The Maildir has not been created:", err)
+	}
+
+	mailbox, err := types.GetMailboxByEmail(ctx.Database, "new@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data.Set("email", "renamed@example.com")
+	testPost(t, ts.URL+ctx.Reverse("mailbox-update", 1, mailbox.Id.Int64), data.Encode(), http.StatusFound)
+	if _, err := os.Stat(filepath.Join(root, "example.com", "renamed", "cur")); err != nil {
+		t.Error("The Maildir has not been renamed:", err)
+	}
+
+	testPost(t, ts.URL+ctx.Reverse("mailbox-delete", 1, mailbox.Id.Int64), "", http.StatusFound)
+	archived := filepath.Join(root, "archive", "example.com", fmt.Sprintf("renamed-%d", mailbox.Id.Int64))
+	if _, err := os.Stat(archived); err != nil {
+		t.Error("The Maildir has not been archived:", err)
+	}
+
+	testPost(t, ts.URL+ctx.Reverse("trash-restore", "mailbox", mailbox.Id.Int64), "", http.StatusFound)
+	if _, err := os.Stat(filepath.Join(root, "example.com", "renamed", "cur")); err != nil {
+		t.Error("The Maildir has not been restored:", err)
+	}
+}
+
+func TestMailboxSendAs(t *testing.T) {
+	ctx := createTestingContext()
+	defer closeTestingContext(ctx)
+
+	ts := httptest.NewServer(ctx.Router)
+	defer ts.Close()
+
+	myURL := ts.URL + ctx.Reverse("mailbox-update", 1, 1)
+
+	data := url.Values{}
+	data.Add("email", "test@example.com")
+	data.Add("active", "on")
+	data.Add("sendas", "postmaster@example.org")
+	testPost(t, myURL, data.Encode(), http.StatusOK)
+
+	data.Set("email", "another@example.com")
+	data.Set("sendas", "Postmaster@example.com\r\n@example.com")
+	testPost(t, myURL, data.Encode(), http.StatusFound)
+
+	sendAs, err := types.GetSendAs(ctx.Database, 1)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(sendAs) != 2 || sendAs[0] != "@example.com" || sendAs[1] != "postmaster@example.com" {
+		t.Errorf("Unexpected send as addresses %v", sendAs)
+	}
+
+	logins, err := types.GetSenderLogins(ctx.Database)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(logins) != 3 {
+		t.Errorf("Unexpected sender logins %v", logins)
+	}
+
+	// a revert keeps the addresses
+	revisions, err := types.GetRevisions(ctx.Database, types.RevisionMailbox, 1)
+	if err != nil || len(revisions) == 0 {
+		t.Fatal("The update has no revision", err)
+	}
+	testPost(t, myURL, fmt.Sprintf("revision=%d", revisions[0].Id.Int64), http.StatusFound)
+	if sendAs, _ = types.GetSendAs(ctx.Database, 1); len(sendAs) != 2 {
+		t.Errorf("The revert changed the send as addresses to %v", sendAs)
+	}
+}
+
+func TestMailboxDelete(t *testing.T) {
+	ctx := createTestingContext()
+	defer closeTestingContext(ctx)
+
+	ts := httptest.NewServer(ctx.Router)
+	defer ts.Close()
+
+	myURL := ts.URL + ctx.Reverse("mailbox-delete", 1, 1)
+
+	testGet(t, myURL, http.StatusOK)
+
+	testPost(t, myURL, "", http.StatusFound)
+
+	// check if the object is still there
+	_, err := types.GetMailboxById(ctx.Database, 1)
+	if err == nil {
+		t.Error("The Mailbox hasn't been deleted")
+	}
+}
+
+func TestDKIM(t *testing.T) {
+	ctx := createTestingContext()
+	defer closeTestingContext(ctx)
+
+	ts := httptest.NewServer(ctx.Router)
+	defer ts.Close()
+
+	myURL := ts.URL + ctx.Reverse("dkim-list", 1)
+	testGet(t, myURL, http.StatusOK)
+
+	data := url.Values{}
+	data.Add("selector", "Not Valid")
+	data.Add("algorithm", "ed25519")
+	testPost(t, myURL, data.Encode(), http.StatusOK)
+
+	data.Set("selector", "mail")
+	testPost(t, myURL, data.Encode(), http.StatusFound)
+
+	body := testGetBody(t, myURL, http.StatusOK)
+	if !strings.Contains(body, "mail._domainkey.example.com. IN TXT") {
+		t.Error("The DNS record is not shown")
+	}
+
+	// the same selector is rejected
+	testPost(t, myURL, data.Encode(), http.StatusOK)
+
+	// the second key is published without signing
+	data.Set("selector", "next")
+	testPost(t, myURL, data.Encode(), http.StatusFound)
+
+	keys, err := types.GetDKIMKeys(ctx.Database, 1)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(keys) != 2 {
+		t.Fatalf("Found %d keys, Expected 2", len(keys))
+	}
+	next, old := keys[0], keys[1]
+	if next.Signing || !old.Signing {
+		t.Fatal("The new key signs before being promoted")
+	}
+
+	// the signing key cannot be disabled while the other is active
+	testPost(t, ts.URL+ctx.Reverse("dkim-toggle", 1, old.Id.Int64), "", http.StatusFound)
+	if old, _ = types.GetDKIMKeyById(ctx.Database, old.Id.Int64); !old.Active {
+		t.Error("The signing key has been disabled")
+	}
+
+	testPost(t, ts.URL+ctx.Reverse("dkim-promote", 1, next.Id.Int64), "", http.StatusFound)
+	next, _ = types.GetDKIMKeyById(ctx.Database, next.Id.Int64)
+	old, _ = types.GetDKIMKeyById(ctx.Database, old.Id.Int64)
+	if !next.Signing || old.Signing {
+		t.Error("The key hasn't been promoted")
+	}
+
+	dir := t.TempDir()
+	ctx.Config.DKIMDir = dir
+	if _, err = dkim.WriteTables(ctx.Database, dir); err != nil {
+		t.Fatal(err)
+	}
+	keyFile := filepath.Join(dir, "keys", "example.com", "mail.private")
+
+	// an active key cannot be deleted
+	deleteURL := ts.URL + ctx.Reverse("dkim-delete", 1, old.Id.Int64)
+	testPost(t, deleteURL, "", http.StatusFound)
+	if _, err = types.GetDKIMKeyById(ctx.Database, old.Id.Int64); err != nil {
+		t.Error("The active key has been deleted")
+	}
+
+	testPost(t, ts.URL+ctx.Reverse("dkim-toggle", 1, old.Id.Int64), "", http.StatusFound)
+	testPost(t, deleteURL, "", http.StatusFound)
+	if _, err = types.GetDKIMKeyById(ctx.Database, old.Id.Int64); err == nil {
+		t.Error("The key hasn't been deleted")
+	}
+	if _, err = os.Stat(keyFile); !os.IsNotExist(err) {
+		t.Error("The private key of the deleted key is still there")
+	}
+}
+
+func TestMTASTS(t *testing.T) {
+	ctx := createTestingContext()
+	defer closeTestingContext(ctx)
+
+	ts := httptest.NewServer(ctx.Router)
+	defer ts.Close()
+
+	getPolicy := func(host string) (int, string) {
+		req, err := http.NewRequest("GET", ts.URL+ctx.Reverse("mta-sts-policy"), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Host = host
+		res, err := testingClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+
+		body, err := ioutil.ReadAll(res.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res.StatusCode, string(body)
+	}
+
+	// no policy configured yet
+	if status, _ := getPolicy("mta-sts.example.com"); status != http.StatusNotFound {
+		t.Errorf("Actual status: (%d); Expected status: (%d)", status, http.StatusNotFound)
+	}
+
+	myURL := ts.URL + ctx.Reverse("mta-sts", 1)
+	testGet(t, myURL, http.StatusOK)
+
+	data := url.Values{}
+	data.Add("mode", "enforce")
+	data.Add("mx", "not valid")
+	data.Add("maxage", "604800")
+	testPost(t, myURL, data.Encode(), http.StatusOK)
+
+	data.Set("mx", "mx1.example.com\r\n*.example.net")
+	data.Set("maxage", "60")
+	testPost(t, myURL, data.Encode(), http.StatusOK)
+
+	data.Set("maxage", "604800")
+	data.Add("reporturi", "mailto:tls@example.com")
+	testPost(t, myURL, data.Encode(), http.StatusFound)
+
+	body := testGetBody(t, myURL, http.StatusOK)
+	for _, expected := range []string{"_mta-sts.example.com. IN TXT", "v=TLSRPTv1; rua=mailto:tls@example.com"} {
+		if !strings.Contains(body, expected) {
+			t.Errorf("The page doesn't show %s", expected)
+		}
+	}
+
+	status, policy := getPolicy("mta-sts.example.com:443")
+	if status != http.StatusOK {
+		t.Errorf("Actual status: (%d); Expected status: (%d)", status, http.StatusOK)
+	}
+	expected := "version: STSv1\r\nmode: enforce\r\nmx: mx1.example.com\r\nmx: *.example.net\r\nmax_age: 604800\r\n"
+	if policy != expected {
+		t.Errorf("Unexpected policy %q", policy)
+	}
+
+	// the other hosts and domains have no policy
+	for _, host := range []string{"example.com", "mta-sts.example.org"} {
+		if status, _ = getPolicy(host); status != http.StatusNotFound {
+			t.Errorf("The host %s: actual status: (%d); Expected status: (%d)", host, status, http.StatusNotFound)
+		}
+	}
+}
+
+func TestAutoconfig(t *testing.T) {
+	ctx := createTestingContext()
+	defer closeTestingContext(ctx)
+
+	ts := httptest.NewServer(ctx.Router)
+	defer ts.Close()
+
+	mozillaURL := ts.URL + ctx.Reverse("autoconfig-mozilla") + "?emailaddress=test%40example.com"
+	outlookURL := ts.URL + ctx.Reverse("autoconfig-outlook")
+	appleURL := ts.URL + ctx.Reverse("autoconfig-apple") + "?emailaddress=test%40example.com"
+
+	// disabled without the IMAP server
+	testGet(t, mozillaURL, http.StatusNotFound)
+
+	ctx.Config.IMAPHost = "mail.example.com"
+	if body := testGetBody(t, mozillaURL, http.StatusOK); !strings.Contains(body, "<hostname>mail.example.com</hostname>") {
+		t.Error("The Mozilla configuration doesn't show the server")
+	}
+	testGet(t, ts.URL+ctx.Reverse("autoconfig-mozilla")+"?emailaddress=test%40example.org", http.StatusNotFound)
+
+	request := `<Autodiscover><Request><EMailAddress>test@example.com</EMailAddress></Request></Autodiscover>`
+	res, err := testingClient.Post(outlookURL, "text/xml", strings.NewReader(request))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("Actual status: (%d); Expected status: (%d)", res.StatusCode, http.StatusOK)
+	} else if !strings.Contains(string(body), "<LoginName>test@example.com</LoginName>") {
+		t.Error("The Outlook configuration doesn't show the login")
+	}
+
+	if body := testGetBody(t, appleURL, http.StatusOK); !strings.Contains(body, "<string>test@example.com</string>") {
+		t.Error("The Apple profile doesn't show the address")
+	}
+	if body := testGetBody(t, ts.URL+ctx.Reverse("mailbox-update", 1, 1), http.StatusOK); !strings.Contains(body, "configuration profile") {
+		t.Error("The mailbox page doesn't link the Apple profile")
+	}
+}
+
+func TestBCC(t *testing.T) {
+	ctx := createTestingContext()
+	defer closeTestingContext(ctx)
+
+	ts := httptest.NewServer(ctx.Router)
+	defer ts.Close()
+
+	myURL := ts.URL + ctx.Reverse("bcc-list", 1)
+	testGet(t, myURL, http.StatusOK)
+
+	data := url.Values{}
+	data.Add("kind", "recipient")
+	data.Add("mailbox", "0")
+	data.Add("address", "not an address")
+	testPost(t, myURL, data.Encode(), http.StatusOK)
+
+	data.Set("address", "archive@example.net")
+	testPost(t, myURL, data.Encode(), http.StatusFound)
+
+	// one rule of each kind for the domain
+	testPost(t, myURL, data.Encode(), http.StatusOK)
+
+	data.Set("kind", "sender")
+	data.Set("mailbox", "1")
+	testPost(t, myURL, data.Encode(), http.StatusFound)
+
+	rules, err := types.GetBCCs(ctx.Database, 1)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(rules) != 2 {
+		t.Fatalf("Found %d rules, Expected 2", len(rules))
+	}
+
+	entries, err := types.GetBCCMap(ctx.Database, types.BCCSender)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(entries) != 1 || entries[0].Address != "test@example.com" {
+		t.Errorf("Unexpected sender BCC map %v", entries)
+	}
+
+	testPost(t, ts.URL+ctx.Reverse("bcc-delete", 1, rules[0].Id.Int64), "", http.StatusFound)
+	if _, err = types.GetBCCById(ctx.Database, rules[0].Id.Int64); err == nil {
+		t.Error("The rule hasn't been deleted")
+	}
+}
+
+func TestAccessRules(t *testing.T) {
+	ctx := createTestingContext()
+	defer closeTestingContext(ctx)
+
+	ts := httptest.NewServer(ctx.Router)
+	defer ts.Close()
+
+	myURL := ts.URL + ctx.Reverse("access-list", 1)
+	testGet(t, myURL, http.StatusOK)
+
+	data := url.Values{}
+	data.Add("kind", "sender")
+	data.Add("pattern", "not a pattern")
+	data.Add("action", "REJECT")
+	data.Add("message", "No spam please")
+	testPost(t, myURL, data.Encode(), http.StatusOK)
+
+	data.Set("pattern", "Spam.Example.org")
+	testPost(t, myURL, data.Encode(), http.StatusFound)
+	testPost(t, myURL, data.Encode(), http.StatusOK)
+
+	// the recipient rules are limited to the addresses of the domain
+	data.Set("kind", "recipient")
+	data.Set("pattern", "noreply@example.org")
+	testPost(t, myURL, data.Encode(), http.StatusOK)
+
+	data.Set("pattern", "noreply@example.com")
+	testPost(t, myURL, data.Encode(), http.StatusFound)
+
+	entries, err := types.GetRecipientAccess(ctx.Database)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(entries) != 1 || entries[0].Result != "REJECT No spam please" {
+		t.Errorf("Unexpected recipient access %v", entries)
+	}
+
+	rules, err := types.GetAccessRules(ctx.Database, 1)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(rules) != 2 || rules[1].Pattern != "spam.example.org" {
+		t.Fatalf("Unexpected rules %v", rules)
+	}
+
+	testPost(t, ts.URL+ctx.Reverse("access-delete", 1, rules[0].Id.Int64), "", http.StatusFound)
+	if _, err = types.GetAccessRuleById(ctx.Database, rules[0].Id.Int64); err == nil {
+		t.Error("The rule hasn't been deleted")
+	}
+}
+
+func TestJobs(t *testing.T) {
+	ctx := createTestingContext()
+	defer closeTestingContext(ctx)
+
+	ts := httptest.NewServer(ctx.Router)
+	defer ts.Close()
+
+	body := testGetBody(t, ts.URL+ctx.Reverse("job-list"), http.StatusOK)
+	if !strings.Contains(body, "expire-aliases") {
+		t.Error("The job list doesn't show the expiry of the aliases")
+	}
+
+	testPost(t, ts.URL+ctx.Reverse("job-run", "expire-aliases"), "", http.StatusFound)
+
+	// wait for the run started in the background
+	var run scheduler.Run
+	for i := 0; i < 100; i++ {
+		var err error
+		run, err = scheduler.GetLastRun(ctx.Database, "expire-aliases")
+		if err == nil && run.Finished.Valid {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if run.Status() != "ok" || !run.Manual {
+		t.Errorf("Unexpected run %+v", run)
+	}
+}
+
+func TestTrash(t *testing.T) {
+	ctx := createTestingContext()
+	defer closeTestingContext(ctx)
+
+	ts := httptest.NewServer(ctx.Router)
+	defer ts.Close()
+
+	testPost(t, ts.URL+ctx.Reverse("mailbox-delete", 1, 1), "", http.StatusFound)
+
+	body := testGetBody(t, ts.URL+ctx.Reverse("trash"), http.StatusOK)
+	if !strings.Contains(body, "test@example.com") {
+		t.Error("The deleted mailbox is not in the trash")
+	}
+
+	testPost(t, ts.URL+ctx.Reverse("trash-restore", "mailbox", 1), "", http.StatusFound)
+	if _, err := types.GetMailboxById(ctx.Database, 1); err != nil {
+		t.Error("The Mailbox hasn't been restored")
+	}
+
+	// a new domain with the same name prevents the restore
+	testPost(t, ts.URL+ctx.Reverse("domain-delete", 1), "", http.StatusFound)
+	domain := types.Domain{Name: "example.com", Active: true}
+	if err := domain.Create(ctx.Database); err != nil {
+		t.Fatal(err)
+	}
+	if err := types.RestoreFromTrash(ctx.Database, types.TrashDomain, 1); err == nil {
+		t.Error("The Domain has been restored over the new one")
+	}
+
+	// the mailboxes and aliases are purged with the domain
+	testPost(t, ts.URL+ctx.Reverse("trash-purge", "domain", 1), "", http.StatusFound)
+	if _, err := types.GetMailboxByEmail(ctx.Database, "test@example.com"); err == nil {
+		t.Error("The Mailbox hasn't been purged with the domain")
+	}
+}
+
+func TestTrashDomain(t *testing.T) {
+	ctx := createTestingContext()
+	defer closeTestingContext(ctx)
+
+	ts := httptest.NewServer(ctx.Router)
+	defer ts.Close()
+
+	// a mailbox deleted before the domain stays in the trash
+	other := types.Mailbox{Domain: sql.NullInt64{Int64: 1, Valid: true}, Email: "other@example.com", Password: "hash", Active: true}
+	if err := other.Create(ctx.Database); err != nil {
+		t.Fatal(err)
+	}
+	if err := other.Delete(ctx.Database); err != nil {
+		t.Fatal(err)
+	}
+
+	// the addresses of the domain are released with it
+	testPost(t, ts.URL+ctx.Reverse("domain-delete", 1), "", http.StatusFound)
+	if _, err := types.GetMailboxByEmail(ctx.Database, "test@example.com"); err != sql.ErrNoRows {
+		t.Errorf("The mailbox of the deleted domain is still found: %v", err)
+	}
+
+	domain := types.Domain{Name: "example.com", Active: true}
+	if err := domain.Create(ctx.Database); err != nil {
+		t.Fatal(err)
+	}
+	data := url.Values{}
+	data.Add("email", "test@example.com")
+	data.Add("password", mailboxPassword)
+	data.Add("active", "on")
+	testPost(t, ts.URL+ctx.Reverse("mailbox-create", domain.Id.Int64), data.Encode(), http.StatusFound)
+
+	// the old domain comes back with its records once the new one is
+	// deleted
+	testPost(t, ts.URL+ctx.Reverse("domain-delete", domain.Id.Int64), "", http.StatusFound)
+	testPost(t, ts.URL+ctx.Reverse("trash-restore", "domain", 1), "", http.StatusFound)
+	if mailbox, err := types.GetMailboxByEmail(ctx.Database, "test@example.com"); err != nil || mailbox.Id.Int64 != 1 {
+		t.Errorf("The mailbox hasn't been restored with the domain: %v %v", mailbox.Id, err)
+	}
+	if _, err := types.GetAliasById(ctx.Database, 1); err != nil {
+		t.Errorf("The alias hasn't been restored with the domain: %v", err)
+	}
+	if _, err := types.GetMailboxByEmail(ctx.Database, "other@example.com"); err != sql.ErrNoRows {
+		t.Errorf("The mailbox deleted before the domain has been restored: %v", err)
+	}
+}
+
+func TestPurgeTrash(t *testing.T) {
+	ctx := createTestingContext()
+	defer closeTestingContext(ctx)
+
+	alias, err := types.GetAliasById(ctx.Database, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = alias.Delete(ctx.Database); err != nil {
+		t.Fatal(err)
+	}
+
+	n, err := types.PurgeTrash(ctx.Database, time.Now().AddDate(0, 0, -1))
+	if err != nil {
+		t.Fatal(err)
+	} else if n != 0 {
+		t.Errorf("%d records purged, Expected 0", n)
+	}
+
+	n, err = types.PurgeTrash(ctx.Database, time.Now().Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	} else if n != 1 {
+		t.Errorf("%d records purged, Expected 1", n)
+	}
+
+	if err = types.RestoreFromTrash(ctx.Database, types.TrashAlias, 1); err != sql.ErrNoRows {
+		t.Errorf("Restore returned %v, Expected sql.ErrNoRows", err)
+	}
+}
+
+func testUpload(t *testing.T, url, data string, fields map[string]string, status int) {
+	testUploadBody(t, url, data, fields, status)
+}
+
+func testUploadBody(t *testing.T, url, data string, fields map[string]string, status int) string {
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	for key, value := range fields {
+		writer.WriteField(key, value)
+	}
+	part, err := writer.CreateFormFile("file", "upload.csv")
+	if err != nil {
+		panic(err)
+	}
+	part.Write([]byte(data))
+	writer.Close()
+
+	res, err := testingClient.Post(url, writer.FormDataContentType(), &body)
+	if err != nil {
+		panic(err)
+	}
+	defer res.Body.Close()
+
+	content, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		panic(err)
+	}
+	if res.StatusCode != status {
+		t.Errorf("Actual status: (%d); Expected status: (%d)",
+			res.StatusCode, status)
+		t.Error(string(content))
+	}
+	return string(content)
+}
+
+func TestCSVImport(t *testing.T) {
+	ctx := createTestingContext()
+	defer closeTestingContext(ctx)
+
+	ts := httptest.NewServer(ctx.Router)
+	defer ts.Close()
+
+	myURL := ts.URL + ctx.Reverse("csv-import", 1)
+
+	testGet(t, myURL, http.StatusOK)
+
+	// missing file
+	testPost(t, myURL, "", http.StatusOK)
+
+	// rows with errors are never imported
+	data := "mailbox,one@example.com," + mailboxPassword + "\nmailbox,two@example.org," + mailboxPassword + "\n"
+	testUpload(t, myURL, data, nil, http.StatusOK)
+	if _, err := types.GetMailboxByEmail(ctx.Database, "one@example.com"); err == nil {
+		t.Error("The mailbox has been imported with errors in the file")
+	}
+
+	// the passwords follow the policy of the mailbox form
+	body := testUploadBody(t, myURL, "mailbox,weak@example.com,1\n", nil, http.StatusOK)
+	if !strings.Contains(body, form.ErrPasswordShort(form.DefaultPasswordLength).Error()) {
+		t.Errorf("Unexpected page %s", body)
+	}
+
+	// dry run
+	data = "mailbox,one@example.com," + mailboxPassword + "\nalias,info@example.com,one@example.com\n"
+	testUpload(t, myURL, data, map[string]string{"dryrun": "on"}, http.StatusOK)
+	if _, err := types.GetMailboxByEmail(ctx.Database, "one@example.com"); err == nil {
+		t.Error("The mailbox has been imported by a dry run")
+	}
+
+	// the Maildirs of the imported mailboxes are made
+	root := t.TempDir()
+	ctx.Config.MailRoot = root
+
+	testUpload(t, myURL, data, nil, http.StatusFound)
+	mailbox, err := types.GetMailboxByEmail(ctx.Database, "one@example.com")
+	if err != nil {
+		t.Fatal("The mailbox hasn't been imported")
+	}
+	err = bcrypt.CompareHashAndPassword([]byte(mailbox.Password), []byte(mailboxPassword))
+	if err != nil {
+		t.Error(err)
+	}
+	if _, err = os.Stat(filepath.Join(root, "example.com", "one", "cur")); err != nil {
+		t.Error("The Maildir has not been created:", err)
+	}
+}
+
+func TestAliasList(t *testing.T) {
+	ctx := createTestingContext()
+	defer closeTestingContext(ctx)
+
+	ts := httptest.NewServer(ctx.Router)
+	defer ts.Close()
+
+	myURL := ts.URL + ctx.Reverse("alias-list", 1)
+
+	testGet(t, myURL, http.StatusOK)
+
+	// the search matches the redirect_to address too
+	body := testGetBody(t, myURL+"?q=test@&sort=redirect_to", http.StatusOK)
+	if !strings.Contains(body, "postmaster@example.com") {
+		t.Error("The search didn't find the alias")
+	}
+
+	body = testGetBody(t, myURL+"?q=nobody", http.StatusOK)
+	if strings.Contains(body, "postmaster@example.com") {
+		t.Error("The search didn't filter the aliases")
+	}
+}
+
+func TestAliasCreate(t *testing.T) {
+	ctx := createTestingContext()
+	defer closeTestingContext(ctx)
+
+	ts := httptest.NewServer(ctx.Router)
+	defer ts.Close()
+
+	myURL := ts.URL + ctx.Reverse("alias-create", 1)
+
+	testGet(t, myURL, http.StatusOK)
+
+	data := url.Values{}
+	data.Add("destination", "original@example.org")
+	data.Add("redirect_to", "redirected@otherdomain.com")
 	data.Add("active", "on")
 	testPost(t, myURL, data.Encode(), http.StatusOK)
 
@@ -532,6 +1707,97 @@ func TestAliasUpdate(t *testing.T) {
 	}
 }
 
+func TestAliasRevert(t *testing.T) {
+	ctx := createTestingContext()
+	defer closeTestingContext(ctx)
+
+	ts := httptest.NewServer(ctx.Router)
+	defer ts.Close()
+
+	myURL := ts.URL + ctx.Reverse("alias-update", 1, 1)
+
+	data := url.Values{}
+	data.Add("destination", "abuse@example.com")
+	data.Add("redirect_to", "test@example.com")
+	testPost(t, myURL, data.Encode(), http.StatusFound)
+
+	data = url.Values{}
+	data.Add("revision", "1")
+	testPost(t, myURL, data.Encode(), http.StatusFound)
+
+	alias, err := types.GetAliasById(ctx.Database, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if alias.Destination != "postmaster@example.com" || !alias.Active {
+		t.Errorf("Alias %v not reverted", alias.Version())
+	}
+}
+
+func TestAliasExpiry(t *testing.T) {
+	ctx := createTestingContext()
+	defer closeTestingContext(ctx)
+
+	ts := httptest.NewServer(ctx.Router)
+	defer ts.Close()
+
+	myURL := ts.URL + ctx.Reverse("alias-update", 1, 1)
+
+	data := url.Values{}
+	data.Add("destination", "postmaster@example.com")
+	data.Add("redirect_to", "test@example.com")
+	data.Add("active", "on")
+	data.Add("expires", time.Now().Format("02/01/2006"))
+	testPost(t, myURL, data.Encode(), http.StatusOK)
+
+	data.Set("expires", time.Now().AddDate(0, 0, 3).Format("02/01/2006"))
+	testPost(t, myURL, data.Encode(), http.StatusFound)
+
+	alias, err := types.GetAliasById(ctx.Database, 1)
+	if err != nil {
+		t.Fatal(err)
+	} else if !alias.Expires.Valid || alias.Countdown() != "2 days" {
+		t.Errorf("Unexpected expiry %v, %s", alias.Expires, alias.Countdown())
+	}
+
+	body := testGetBody(t, ts.URL+ctx.Reverse("alias-list", 1), http.StatusOK)
+	if !strings.Contains(body, "2 days") {
+		t.Error("The alias list doesn't show the countdown")
+	}
+
+	// an expired alias leaves the lookups before the job runs
+	alias.Expires.Time = time.Now().Add(-time.Minute)
+	if err = alias.Update(ctx.Database); err != nil {
+		t.Fatal(err)
+	}
+	aliases, err := types.GetActiveAliases(ctx.Database)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(aliases) != 0 {
+		t.Errorf("The expired alias is still active: %v", aliases)
+	}
+
+	n, err := types.ExpireAliases(ctx.Database, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	} else if n != 1 {
+		t.Errorf("%d aliases expired, expected 1", n)
+	}
+	if _, err = types.GetAliasById(ctx.Database, 1); err != sql.ErrNoRows {
+		t.Errorf("The expired alias is not in the trash: %v", err)
+	}
+
+	// the restored alias doesn't expire anymore
+	if err = types.RestoreFromTrash(ctx.Database, types.TrashAlias, 1); err != nil {
+		t.Fatal(err)
+	}
+	if alias, err = types.GetAliasById(ctx.Database, 1); err != nil {
+		t.Fatal(err)
+	} else if alias.Expires.Valid {
+		t.Errorf("The restored alias still expires on %v", alias.Expires.Time)
+	}
+}
+
 func TestAliasDelete(t *testing.T) {
 	ctx := createTestingContext()
 	defer closeTestingContext(ctx)
@@ -550,3 +1816,156 @@ func TestAliasDelete(t *testing.T) {
 		t.Error("The Alias hasn't been deleted")
 	}
 }
+
+// the schema of the first version, before the migrations
+const baselineSchema = `
+CREATE TABLE domain (
+	id INTEGER PRIMARY KEY,
+	name VARCHAR(50) NOT NULL,
+	description TEXT NOT NULL DEFAULT '',
+	backupmx TINYINT(1) NOT NULL DEFAULT '0',
+	active TINYINT(1) NOT NULL DEFAULT '1',
+	created DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	modified DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	CONSTRAINT unique_name UNIQUE (name)
+);
+CREATE TABLE mailbox (
+	id INTEGER PRIMARY KEY,
+	domain_id INTEGER NOT NULL,
+	email VARCHAR(100) NOT NULL,
+	password VARCHAR(256) NOT NULL,
+	created DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	modified DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	active TINYINT(1) NOT NULL DEFAULT '1',
+	CONSTRAINT unique_email UNIQUE (email),
+	FOREIGN KEY (domain_id) REFERENCES domain(id) ON DELETE CASCADE
+);
+CREATE TABLE alias (
+	id INTEGER PRIMARY KEY,
+	domain_id INTEGER NOT NULL,
+	destination VARCHAR(100) NOT NULL,
+	redirect_to VARCHAR(100) NOT NULL,
+	created DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	modified DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	active TINYINT(1) NOT NULL DEFAULT '1',
+	FOREIGN KEY (domain_id) REFERENCES domain(id) ON DELETE CASCADE
+);
+INSERT INTO domain(id, name) VALUES (1, 'example.com');
+INSERT INTO mailbox(domain_id, email, password) VALUES (1, 'test@example.com', 'hash');
+INSERT INTO alias(domain_id, destination, redirect_to) VALUES (1, 'info@example.com', 'test@example.com');
+`
+
+// schemaOf returns the sorted columns of the tables and views of the
+// database, and the names of its indexes.
+func schemaOf(t *testing.T, database *db.Database) map[string][]string {
+	rows, err := database.Db.Query(`SELECT type, name FROM sqlite_master WHERE name NOT LIKE 'sqlite_%'`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	objects := [][2]string{}
+	for rows.Next() {
+		var kind, name string
+		if err = rows.Scan(&kind, &name); err != nil {
+			t.Fatal(err)
+		}
+		objects = append(objects, [2]string{kind, name})
+	}
+	rows.Close()
+
+	schema := map[string][]string{}
+	for _, o := range objects {
+		columns := []string{}
+		if o[0] == "table" || o[0] == "view" {
+			rows, err := database.Db.Query(`SELECT name FROM pragma_table_info($1)`, o[1])
+			if err != nil {
+				t.Fatal(err)
+			}
+			for rows.Next() {
+				var name string
+				if err = rows.Scan(&name); err != nil {
+					t.Fatal(err)
+				}
+				columns = append(columns, name)
+			}
+			rows.Close()
+			sort.Strings(columns)
+		}
+		schema[o[0]+" "+o[1]] = columns
+	}
+	return schema
+}
+
+func TestMigrateModel(t *testing.T) {
+	fresh := testutils.ConnectTestingDatabase(t, "/tmp/test-fresh.db")
+	if err := createModel(fresh); err != nil {
+		t.Fatal(err)
+	}
+
+	old := testutils.ConnectTestingDatabase(t, "/tmp/test-baseline.db")
+	if _, err := old.Db.Exec(baselineSchema); err != nil {
+		t.Fatal(err)
+	}
+	if err := migrateModel(old); err != nil {
+		t.Fatal(err)
+	}
+
+	// the migrated database matches the new one
+	expected, actual := schemaOf(t, fresh), schemaOf(t, old)
+	for name, columns := range expected {
+		if strings.Join(actual[name], ",") != strings.Join(columns, ",") {
+			t.Errorf("%s has %v, Expected %v", name, actual[name], columns)
+		}
+	}
+	for name := range actual {
+		if _, ok := expected[name]; !ok {
+			t.Errorf("Unexpected %s", name)
+		}
+	}
+	for _, m := range models {
+		v1, _ := fresh.SchemaVersion(m.name)
+		v2, _ := old.SchemaVersion(m.name)
+		if v1 == 0 || v1 != v2 {
+			t.Errorf("%s at version %d, Expected %d", m.name, v2, v1)
+		}
+	}
+
+	// the migrations are run once and the empty databases are left
+	// to -m
+	if err := migrateModel(old); err != nil {
+		t.Error(err)
+	}
+	empty := testutils.ConnectTestingDatabase(t, "/tmp/test-empty.db")
+	if err := migrateModel(empty); err != nil || empty.HasTable("schema_version") {
+		t.Errorf("The empty database has been migrated: %v", err)
+	}
+
+	// the records are kept and the statements work
+	if err := types.PrepareStatements(old); err != nil {
+		t.Fatal(err)
+	}
+	if err := scheduler.PrepareStatements(old); err != nil {
+		t.Fatal(err)
+	}
+	if err := mailer.PrepareStatements(old); err != nil {
+		t.Fatal(err)
+	}
+	if mailboxes, err := types.GetActiveMailboxes(old); err != nil || len(mailboxes) != 1 {
+		t.Errorf("Unexpected active mailboxes %v, %v", mailboxes, err)
+	}
+	if aliases, err := types.GetActiveAliases(old); err != nil || len(aliases) != 1 {
+		t.Errorf("Unexpected active aliases %v, %v", aliases, err)
+	}
+
+	// the names are unique only outside of the trash
+	domain, err := types.GetDomainByName(old, "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = old.WithTx(func(tx *db.Tx) error { return domain.Delete(tx) }); err != nil {
+		t.Fatal(err)
+	}
+	again := types.Domain{Name: "example.com", Active: true}
+	if err = again.Create(old); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,126 @@
+package mtasts
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+
+	"github.com/funnydog/mailadmin/types"
+)
+
+// modes of the policy, RFC 8461 section 5
+const (
+	Enforce = "enforce"
+	Testing = "testing"
+	None    = "none"
+)
+
+// bounds of max_age in seconds, the RFC allows up to one year and
+// suggests weeks, a day is the least that makes sense to cache.
+const (
+	DefaultMaxAge = 604800
+	MinMaxAge     = 86400
+	MaxMaxAge     = 31557600
+)
+
+// HostPrefix is the label of the host serving the policy of a domain.
+const HostPrefix = "mta-sts."
+
+// PolicyPath is the well-known path of the policy.
+const PolicyPath = "/.well-known/mta-sts.txt"
+
+var mxRe = regexp.MustCompile(`^(\*\.)?([a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?\.)+[a-z]{2,63}$`)
+
+type ErrInvalidMX string
+
+func (im ErrInvalidMX) Error() string {
+	return fmt.Sprintf("'%s' is not a valid MX host name", string(im))
+}
+
+type ErrInvalidReportURI string
+
+func (ir ErrInvalidReportURI) Error() string {
+	return fmt.Sprintf("The report address '%s' must start with mailto: or https:", string(ir))
+}
+
+// Default returns the policy of a domain not configured yet, the MX
+// list is filled with the mail servers of the configuration.
+func Default(domain types.Domain, mxHosts []string) types.MTASTS {
+	mx := []string{}
+	for _, host := range mxHosts {
+		mx = append(mx, strings.TrimSuffix(strings.ToLower(host), "."))
+	}
+	return types.MTASTS{
+		Domain: domain.Id,
+		Mode:   None,
+		MX:     mx,
+		MaxAge: DefaultMaxAge,
+	}
+}
+
+// ParseMX splits the text in host names, one per line or separated by
+// spaces, and validates them.
+func ParseMX(text string) ([]string, error) {
+	mx := []string{}
+	for _, host := range strings.Fields(strings.ToLower(text)) {
+		host = strings.TrimSuffix(host, ".")
+		if !mxRe.MatchString(host) {
+			return nil, ErrInvalidMX(host)
+		}
+		mx = append(mx, host)
+	}
+	return mx, nil
+}
+
+// ValidReportURI checks the rua of the TLS-RPT record, empty disables
+// the reports.
+func ValidReportURI(uri string) error {
+	if uri != "" && !strings.HasPrefix(uri, "mailto:") && !strings.HasPrefix(uri, "https:") {
+		return ErrInvalidReportURI(uri)
+	}
+	return nil
+}
+
+// Domain returns the domain whose policy is requested from host, the
+// Host header of the request, or false if it isn't an MTA-STS host.
+func Domain(host string) (string, bool) {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	if !strings.HasPrefix(host, HostPrefix) || len(host) == len(HostPrefix) {
+		return "", false
+	}
+	return strings.TrimPrefix(host, HostPrefix), true
+}
+
+// Policy returns the policy file served to the senders.
+func Policy(p types.MTASTS) string {
+	var b strings.Builder
+	b.WriteString("version: STSv1\r\n")
+	fmt.Fprintf(&b, "mode: %s\r\n", p.Mode)
+	for _, host := range p.MX {
+		fmt.Fprintf(&b, "mx: %s\r\n", host)
+	}
+	fmt.Fprintf(&b, "max_age: %d\r\n", p.MaxAge)
+	return b.String()
+}
+
+// PolicyID returns the id of the policy, it changes every time the
+// policy is saved so the senders fetch it again.
+func PolicyID(p types.MTASTS) string {
+	return p.Modified.UTC().Format("20060102150405")
+}
+
+// Records returns the TXT records to publish in the zone of the domain,
+// the TLS-RPT one only if the report address is set.
+func Records(p types.MTASTS, domain string) []string {
+	records := []string{
+		fmt.Sprintf(`_mta-sts.%s. IN TXT "v=STSv1; id=%s"`, domain, PolicyID(p)),
+	}
+	if p.ReportURI != "" {
+		records = append(records, fmt.Sprintf(`_smtp._tls.%s. IN TXT "v=TLSRPTv1; rua=%s"`, domain, p.ReportURI))
+	}
+	return records
+}
@@ -0,0 +1,102 @@
+package mtasts
+
+import (
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/funnydog/mailadmin/testutils"
+	"github.com/funnydog/mailadmin/types"
+)
+
+const databasePath = "/tmp/test-mtasts.db"
+
+func TestParseMX(t *testing.T) {
+	mx, err := ParseMX("MX1.example.com.\n *.example.net\r\n")
+	if err != nil {
+		t.Fatal(err)
+	} else if len(mx) != 2 || mx[0] != "mx1.example.com" || mx[1] != "*.example.net" {
+		t.Errorf("Unexpected MX list %v", mx)
+	}
+
+	for _, host := range []string{"mx", "mx.*.example.com", "-mx.example.com", "mx_1.example.com"} {
+		if _, err = ParseMX(host); err == nil {
+			t.Errorf("The host %s has been accepted", host)
+		}
+	}
+}
+
+func TestDomain(t *testing.T) {
+	tests := []struct {
+		host   string
+		domain string
+		ok     bool
+	}{
+		{"mta-sts.example.com", "example.com", true},
+		{"MTA-STS.Example.com.:8443", "example.com", true},
+		{"mta-sts.", "", false},
+		{"www.example.com", "", false},
+		{"example.com:443", "", false},
+	}
+	for _, test := range tests {
+		domain, ok := Domain(test.host)
+		if domain != test.domain || ok != test.ok {
+			t.Errorf("Domain(%s) = %s, %v; Expected %s, %v", test.host, domain, ok, test.domain, test.ok)
+		}
+	}
+}
+
+func TestPolicy(t *testing.T) {
+	p := types.MTASTS{
+		Mode:      Enforce,
+		MX:        []string{"mx1.example.com", "*.example.net"},
+		MaxAge:    DefaultMaxAge,
+		ReportURI: "mailto:tls@example.com",
+		Modified:  time.Date(2026, 10, 19, 12, 30, 0, 0, time.UTC),
+	}
+
+	expected := "version: STSv1\r\nmode: enforce\r\nmx: mx1.example.com\r\nmx: *.example.net\r\nmax_age: 604800\r\n"
+	if policy := Policy(p); policy != expected {
+		t.Errorf("Unexpected policy %q", policy)
+	}
+
+	records := Records(p, "example.com")
+	if len(records) != 2 ||
+		records[0] != `_mta-sts.example.com. IN TXT "v=STSv1; id=20261019123000"` ||
+		records[1] != `_smtp._tls.example.com. IN TXT "v=TLSRPTv1; rua=mailto:tls@example.com"` {
+		t.Errorf("Unexpected records %v", records)
+	}
+
+	p.ReportURI = ""
+	if records = Records(p, "example.com"); len(records) != 1 {
+		t.Errorf("Unexpected records %v", records)
+	}
+}
+
+func TestSave(t *testing.T) {
+	database, domain := testutils.CreateTestingDatabase(t, databasePath)
+
+	if _, err := types.GetMTASTS(database, domain.Id.Int64); err != sql.ErrNoRows {
+		t.Fatalf("Unexpected error %v", err)
+	}
+
+	p := Default(domain, []string{"MX.example.com."})
+	p.Mode = Testing
+	if err := p.Save(database); err != nil {
+		t.Fatal(err)
+	}
+
+	p.Mode = Enforce
+	p.MX = append(p.MX, "mx2.example.com")
+	if err := p.Save(database); err != nil {
+		t.Fatal(err)
+	}
+
+	saved, err := types.GetMTASTS(database, domain.Id.Int64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved.Mode != Enforce || len(saved.MX) != 2 || saved.MX[0] != "mx.example.com" || saved.MaxAge != DefaultMaxAge {
+		t.Errorf("Unexpected policy %+v", saved)
+	}
+}
@@ -0,0 +1,269 @@
+package policy
+
+import (
+	"bufio"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/funnydog/mailadmin/core/db"
+	"github.com/funnydog/mailadmin/types"
+)
+
+// actions returned to postfix, see access(5)
+const (
+	Dunno  = "DUNNO"
+	Reject = "REJECT"
+	Defer  = "DEFER"
+)
+
+// DefaultAddress is where the server listens when the configuration
+// doesn't set an address.
+const DefaultAddress = "127.0.0.1:10031"
+
+// maxRequest bounds the size of a request, postfix sends less than
+// 2 KB of attributes.
+const maxRequest = 64 * 1024
+
+var ErrRequestTooLarge = errors.New("The policy request is too large")
+
+// Request holds the attributes sent by postfix, name=value.
+type Request map[string]string
+
+// ReadRequest reads the attributes up to the empty line ending the
+// request, io.EOF if the connection has been closed before it.
+func ReadRequest(r *bufio.Reader) (Request, error) {
+	req := Request{}
+	size := 0
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			if err == io.EOF && (line != "" || len(req) > 0) {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+
+		size += len(line)
+		if size > maxRequest {
+			return nil, ErrRequestTooLarge
+		}
+
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
+			return req, nil
+		}
+		if kv := strings.SplitN(line, "=", 2); len(kv) == 2 {
+			req[kv[0]] = kv[1]
+		}
+	}
+}
+
+// Server decides whether the mailboxes signed in with SASL can send,
+// the mailboxes and domains must be active and within the quotas of
+// recipients per hour and per day, 0 means no limit. It applies the
+// sender access rules of the domains too.
+type Server struct {
+	DB     db.Querier
+	Hourly int64
+	Daily  int64
+	Now    func() time.Time
+
+	// the check and the update of the counters are not atomic
+	mutex sync.Mutex
+}
+
+// New returns a server with the given quotas.
+func New(db db.Querier, hourly, daily int64) *Server {
+	return &Server{
+		DB:     db,
+		Hourly: hourly,
+		Daily:  daily,
+		Now:    time.Now,
+	}
+}
+
+// recipients returns the number of recipients counted by the request,
+// known from the DATA state on, one per request before.
+func recipients(req Request) int64 {
+	if n, err := strconv.ParseInt(req["recipient_count"], 10, 64); err == nil && n > 0 {
+		return n
+	}
+	return 1
+}
+
+// senderRule returns the sender rule of the domain matching the
+// address, looked up like postfix: the address, the domain and its
+// parents, then user@.
+func senderRule(rules []types.AccessRule, address string) *types.AccessRule {
+	patterns := map[string]*types.AccessRule{}
+	for i := range rules {
+		patterns[rules[i].Pattern] = &rules[i]
+	}
+
+	address = strings.ToLower(address)
+	at := strings.LastIndex(address, "@")
+	if at < 0 {
+		return nil
+	}
+
+	keys := []string{address}
+	for domain := address[at+1:]; domain != ""; {
+		keys = append(keys, domain)
+		i := strings.Index(domain, ".")
+		if i < 0 {
+			break
+		}
+		domain = domain[i+1:]
+	}
+	keys = append(keys, address[:at+1])
+
+	for _, key := range keys {
+		if rule, ok := patterns[key]; ok {
+			return rule
+		}
+	}
+	return nil
+}
+
+// checkAccess applies the sender rules of the domain of the recipient.
+func (s *Server) checkAccess(req Request) (string, error) {
+	sender, recipient := req["sender"], strings.ToLower(req["recipient"])
+	at := strings.LastIndex(recipient, "@")
+	if sender == "" || at < 0 {
+		return Dunno, nil
+	}
+
+	domain, err := types.GetDomainByName(s.DB, recipient[at+1:])
+	if err == sql.ErrNoRows || (err == nil && !domain.Active) {
+		return Dunno, nil
+	} else if err != nil {
+		return "", err
+	}
+
+	rules, err := types.GetAccessRulesByKind(s.DB, domain.Id.Int64, types.AccessSender)
+	if err != nil {
+		return "", err
+	}
+	if rule := senderRule(rules, sender); rule != nil {
+		return rule.Result(), nil
+	}
+	return Dunno, nil
+}
+
+// Decide returns the action for the request. In the RCPT state the
+// sender rules of the domain of the recipient are applied, in the
+// later ones the senders signed in are checked against their quotas,
+// the mails of the clients not signed in are left to the other
+// restrictions.
+func (s *Server) Decide(req Request) (string, error) {
+	if req["protocol_state"] == "RCPT" {
+		return s.checkAccess(req)
+	}
+
+	user := strings.ToLower(req["sasl_username"])
+	if user == "" {
+		return Dunno, nil
+	}
+
+	mailbox, err := types.GetMailboxByEmail(s.DB, user)
+	if err == sql.ErrNoRows {
+		return Reject + " The sender is not a known mailbox", nil
+	} else if err != nil {
+		return "", err
+	}
+
+	domain, err := types.GetDomainById(s.DB, mailbox.Domain.Int64)
+	if err != nil {
+		return "", err
+	}
+	if !mailbox.Active || !domain.Active {
+		return Reject + " The mailbox of the sender is disabled", nil
+	}
+
+	now := s.Now()
+	hour := now.Truncate(time.Hour)
+	day := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	n := recipients(req)
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	hourly, err := types.GetSendCount(s.DB, mailbox.Id.Int64, types.Hourly, hour)
+	if err != nil {
+		return "", err
+	}
+	daily, err := types.GetSendCount(s.DB, mailbox.Id.Int64, types.Daily, day)
+	if err != nil {
+		return "", err
+	}
+
+	if s.Hourly > 0 && hourly.Count+n > s.Hourly {
+		return fmt.Sprintf("%s The sender exceeded the quota of %d recipients per hour", Defer, s.Hourly), nil
+	}
+	if s.Daily > 0 && daily.Count+n > s.Daily {
+		return fmt.Sprintf("%s The sender exceeded the quota of %d recipients per day", Defer, s.Daily), nil
+	}
+
+	if err = hourly.Add(s.DB, n); err != nil {
+		return "", err
+	}
+	if err = daily.Add(s.DB, n); err != nil {
+		return "", err
+	}
+	return Dunno, nil
+}
+
+// handle answers the requests of a connection until postfix closes
+// it, the errors of the database defer the mail.
+func (s *Server) handle(conn net.Conn) {
+	defer conn.Close()
+
+	r := bufio.NewReader(conn)
+	for {
+		req, err := ReadRequest(r)
+		if err != nil {
+			if err != io.EOF {
+				log.Println("policy request:", err)
+			}
+			return
+		}
+
+		action, err := s.Decide(req)
+		if err != nil {
+			log.Println("policy of", req["sasl_username"], ":", err)
+			action = Defer + " Temporary failure of the policy service"
+		}
+		if _, err = fmt.Fprintf(conn, "action=%s\n\n", action); err != nil {
+			return
+		}
+	}
+}
+
+// Serve accepts the connections of postfix on the listener.
+func (s *Server) Serve(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go s.handle(conn)
+	}
+}
+
+// ListenAndServe listens on the TCP address and serves the requests.
+func (s *Server) ListenAndServe(address string) error {
+	l, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+	return s.Serve(l)
+}
@@ -0,0 +1,174 @@
+package policy
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/funnydog/mailadmin/core/db"
+	"github.com/funnydog/mailadmin/testutils"
+	"github.com/funnydog/mailadmin/types"
+)
+
+const databasePath = "/tmp/test-policy.db"
+
+func createTestingDatabase(t *testing.T) *db.Database {
+	database, domain := testutils.CreateTestingDatabase(t, databasePath)
+	for _, m := range []types.Mailbox{
+		{Domain: domain.Id, Email: "test@example.com", Active: true},
+		{Domain: domain.Id, Email: "disabled@example.com"},
+	} {
+		if err := m.Create(database); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, r := range []types.AccessRule{
+		{Domain: domain.Id, Kind: types.AccessSender, Pattern: "example.org", Action: types.AccessReject, Message: "Go away"},
+		{Domain: domain.Id, Kind: types.AccessSender, Pattern: "friend@news.example.org", Action: types.AccessOK},
+		{Domain: domain.Id, Kind: types.AccessSender, Pattern: "spam@", Action: types.AccessDiscard},
+	} {
+		if err := r.Create(database); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return database
+}
+
+func TestReadRequest(t *testing.T) {
+	r := bufio.NewReader(strings.NewReader("request=smtpd_access_policy\nprotocol_state=RCPT\nsasl_username=test@example.com\n\nrequest=smtpd"))
+
+	req, err := ReadRequest(r)
+	if err != nil {
+		t.Fatal(err)
+	} else if req["protocol_state"] != "RCPT" || req["sasl_username"] != "test@example.com" {
+		t.Errorf("Unexpected request %v", req)
+	}
+
+	if _, err = ReadRequest(r); err != io.ErrUnexpectedEOF {
+		t.Errorf("Unexpected error %v", err)
+	}
+	if _, err = ReadRequest(r); err != io.EOF {
+		t.Errorf("Unexpected error %v", err)
+	}
+}
+
+func TestDecide(t *testing.T) {
+	database := createTestingDatabase(t)
+
+	now := time.Date(2026, 10, 19, 10, 30, 0, 0, time.UTC)
+	s := New(database, 3, 5)
+	s.Now = func() time.Time { return now }
+
+	tests := []struct {
+		req    Request
+		action string
+	}{
+		{Request{}, Dunno},
+		{Request{"sasl_username": "unknown@example.com"}, Reject},
+		{Request{"sasl_username": "disabled@example.com"}, Reject},
+		{Request{"sasl_username": "Test@example.com", "recipient_count": "2"}, Dunno},
+		{Request{"sasl_username": "test@example.com"}, Dunno},
+		{Request{"sasl_username": "test@example.com"}, Defer},
+	}
+	for i, test := range tests {
+		action, err := s.Decide(test.req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(action, test.action) {
+			t.Errorf("Request %d: action %s, Expected %s", i, action, test.action)
+		}
+	}
+
+	// the hourly counter restarts, the daily one doesn't
+	now = now.Add(time.Hour)
+	for i, expected := range []string{Dunno, Dunno, Defer} {
+		action, err := s.Decide(Request{"sasl_username": "test@example.com"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(action, expected) {
+			t.Errorf("Request %d: action %s, Expected %s", i, action, expected)
+		}
+	}
+
+	// a new day
+	now = now.AddDate(0, 0, 1)
+	if action, _ := s.Decide(Request{"sasl_username": "test@example.com", "recipient_count": "3"}); action != Dunno {
+		t.Errorf("Unexpected action %s", action)
+	}
+}
+
+func TestAccessRules(t *testing.T) {
+	database := createTestingDatabase(t)
+
+	s := New(database, 1, 1)
+	tests := []struct {
+		sender    string
+		recipient string
+		action    string
+	}{
+		{"someone@example.org", "test@example.com", "REJECT Go away"},
+		{"someone@news.example.org", "test@example.com", "REJECT Go away"},
+		{"friend@news.example.org", "Test@Example.com", "OK"},
+		{"spam@example.net", "test@example.com", "DISCARD"},
+		{"someone@example.net", "test@example.com", "DUNNO"},
+		{"someone@example.org", "test@example.net", "DUNNO"},
+		{"", "test@example.com", "DUNNO"},
+	}
+	for _, test := range tests {
+		req := Request{"protocol_state": "RCPT", "sender": test.sender, "recipient": test.recipient, "sasl_username": "test@example.com"}
+		action, err := s.Decide(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if action != test.action {
+			t.Errorf("%s to %s: action %s, Expected %s", test.sender, test.recipient, action, test.action)
+		}
+	}
+
+	// the RCPT state doesn't count the recipients
+	if action, _ := s.Decide(Request{"sasl_username": "test@example.com"}); action != Dunno {
+		t.Errorf("Unexpected action %s", action)
+	}
+}
+
+func TestServe(t *testing.T) {
+	database := createTestingDatabase(t)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go New(database, 0, 0).Serve(l)
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	r := bufio.NewReader(conn)
+	for _, test := range []struct{ user, action string }{
+		{"test@example.com", "action=DUNNO"},
+		{"disabled@example.com", "action=REJECT"},
+	} {
+		if _, err = io.WriteString(conn, "request=smtpd_access_policy\nsasl_username="+test.user+"\n\n"); err != nil {
+			t.Fatal(err)
+		}
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if empty, _ := r.ReadString('\n'); empty != "\n" {
+			t.Error("The response doesn't end with an empty line")
+		}
+		if !strings.HasPrefix(line, test.action) {
+			t.Errorf("Unexpected response %s", line)
+		}
+	}
+}
@@ -0,0 +1,259 @@
+package postfix
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/funnydog/mailadmin/core/db"
+	"github.com/funnydog/mailadmin/storage"
+	"github.com/funnydog/mailadmin/types"
+)
+
+// names of the files written by WriteMaps
+const (
+	VirtualMailboxDomains = "virtual_mailbox_domains"
+	VirtualMailboxMaps    = "virtual_mailbox_maps"
+	VirtualAliasMaps      = "virtual_alias_maps"
+	SenderLoginMaps       = "sender_login_maps"
+	TransportMaps         = "transport_maps"
+	RelayDomains          = "relay_domains"
+	RelayRecipientMaps    = "relay_recipient_maps"
+	SenderBCCMaps         = "sender_bcc_maps"
+	RecipientBCCMaps      = "recipient_bcc_maps"
+	RecipientAccess       = "recipient_access"
+)
+
+const header = "# Generated by mailadmin, do not edit.\n"
+
+// maildir returns the path of the mailbox relative to
+// virtual_mailbox_base, the trailing slash selects the Maildir format.
+func maildir(s *storage.Storage, email string) (string, error) {
+	path, err := s.Relative(email)
+	if err != nil {
+		return "", err
+	}
+	return filepath.ToSlash(path) + "/", nil
+}
+
+// RenderMaps returns the content of the lookup tables built from the
+// active records, keyed by file name. The files are in the format
+// read by postmap. The paths of the mailboxes follow the layout of the
+// storage, the default one if nil.
+func RenderMaps(db db.Querier, s *storage.Storage) (map[string][]byte, error) {
+	if s == nil {
+		s = &storage.Storage{Layout: storage.DefaultLayout}
+	}
+
+	domains, err := types.GetActiveDomains(db)
+	if err != nil {
+		return nil, err
+	}
+
+	mailboxes, err := types.GetActiveMailboxes(db)
+	if err != nil {
+		return nil, err
+	}
+
+	aliases, err := types.GetActiveAliases(db)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString(header)
+	for _, d := range domains {
+		if !d.BackupMX {
+			fmt.Fprintf(&buf, "%s\tOK\n", d.Name)
+		}
+	}
+	files := map[string][]byte{VirtualMailboxDomains: buf.Bytes()}
+
+	// the backup MX domains are relayed to the primary servers
+	backup := map[int64]bool{}
+	buf = bytes.Buffer{}
+	buf.WriteString(header)
+	for _, d := range domains {
+		if d.BackupMX {
+			backup[d.Id.Int64] = true
+			fmt.Fprintf(&buf, "%s\tOK\n", d.Name)
+		}
+	}
+	files[RelayDomains] = buf.Bytes()
+
+	buf = bytes.Buffer{}
+	buf.WriteString(header)
+	for _, d := range domains {
+		if d.Transport != "" {
+			fmt.Fprintf(&buf, "%s\t%s\n", d.Name, d.Transport)
+		}
+	}
+	files[TransportMaps] = buf.Bytes()
+
+	buf = bytes.Buffer{}
+	buf.WriteString(header)
+	for _, m := range mailboxes {
+		path, err := maildir(s, m.Email)
+		if err != nil {
+			return nil, err
+		}
+		fmt.Fprintf(&buf, "%s\t%s\n", m.Email, path)
+	}
+	files[VirtualMailboxMaps] = buf.Bytes()
+
+	// the aliases are sorted by destination, a line for each one
+	targets := map[string][]string{}
+	destinations := []string{}
+	for _, a := range aliases {
+		if _, ok := targets[a.Destination]; !ok {
+			destinations = append(destinations, a.Destination)
+		}
+		targets[a.Destination] = append(targets[a.Destination], a.RedirectTo)
+	}
+	sort.Strings(destinations)
+
+	buf = bytes.Buffer{}
+	buf.WriteString(header)
+	for _, d := range destinations {
+		fmt.Fprintf(&buf, "%s\t%s\n", d, strings.Join(targets[d], ", "))
+	}
+	files[VirtualAliasMaps] = buf.Bytes()
+
+	// the relays accept only the known recipients of the backup MX
+	// domains
+	recipients := []string{}
+	for _, m := range mailboxes {
+		if backup[m.Domain.Int64] {
+			recipients = append(recipients, m.Email)
+		}
+	}
+	for _, a := range aliases {
+		if backup[a.Domain.Int64] {
+			recipients = append(recipients, a.Destination)
+		}
+	}
+	sort.Strings(recipients)
+
+	buf = bytes.Buffer{}
+	buf.WriteString(header)
+	for i, r := range recipients {
+		if i == 0 || recipients[i-1] != r {
+			fmt.Fprintf(&buf, "%s\tOK\n", r)
+		}
+	}
+	files[RelayRecipientMaps] = buf.Bytes()
+
+	logins, err := types.GetSenderLogins(db)
+	if err != nil {
+		return nil, err
+	}
+
+	// the logins of an address on the same line, sorted by address
+	buf = bytes.Buffer{}
+	buf.WriteString(header)
+	for i := 0; i < len(logins); {
+		j := i
+		owners := []string{}
+		for ; j < len(logins) && logins[j].Address == logins[i].Address; j++ {
+			owners = append(owners, logins[j].Login)
+		}
+		fmt.Fprintf(&buf, "%s\t%s\n", logins[i].Address, strings.Join(owners, ", "))
+		i = j
+	}
+	files[SenderLoginMaps] = buf.Bytes()
+
+	access, err := types.GetRecipientAccess(db)
+	if err != nil {
+		return nil, err
+	}
+
+	buf = bytes.Buffer{}
+	buf.WriteString(header)
+	for _, e := range access {
+		fmt.Fprintf(&buf, "%s\t%s\n", e.Pattern, e.Result)
+	}
+	files[RecipientAccess] = buf.Bytes()
+
+	for kind, name := range map[string]string{types.BCCSender: SenderBCCMaps, types.BCCRecipient: RecipientBCCMaps} {
+		entries, err := types.GetBCCMap(db, kind)
+		if err != nil {
+			return nil, err
+		}
+
+		buf = bytes.Buffer{}
+		buf.WriteString(header)
+		for _, e := range entries {
+			fmt.Fprintf(&buf, "%s\t%s\n", e.Address, e.BCC)
+		}
+		files[name] = buf.Bytes()
+	}
+
+	return files, nil
+}
+
+// writeFile replaces the file atomically with a rename and reports if
+// the content changed.
+func writeFile(path string, content []byte) (bool, error) {
+	old, err := os.ReadFile(path)
+	if err == nil && bytes.Equal(old, content) {
+		return false, nil
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return false, err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err = tmp.Write(content); err != nil {
+		tmp.Close()
+		return false, err
+	}
+	if err = tmp.Chmod(0644); err != nil {
+		tmp.Close()
+		return false, err
+	}
+	if err = tmp.Close(); err != nil {
+		return false, err
+	}
+	return true, os.Rename(tmp.Name(), path)
+}
+
+// WriteMaps writes the lookup tables in dir and reports if any of them
+// changed.
+func WriteMaps(db db.Querier, s *storage.Storage, dir string) (bool, error) {
+	files, err := RenderMaps(db, s)
+	if err != nil {
+		return false, err
+	}
+
+	names := []string{}
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	changed := false
+	for _, name := range names {
+		c, err := writeFile(filepath.Join(dir, name), files[name])
+		if err != nil {
+			return changed, err
+		}
+		changed = changed || c
+	}
+	return changed, nil
+}
+
+// RunHook runs the command with the shell, usually to postmap the
+// files and reload postfix. The output is returned with the error.
+func RunHook(command string) error {
+	out, err := exec.Command("/bin/sh", "-c", command).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s: %w: %s", command, err, bytes.TrimSpace(out))
+	}
+	return nil
+}
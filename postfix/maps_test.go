@@ -0,0 +1,180 @@
+package postfix
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/funnydog/mailadmin/core/db"
+	"github.com/funnydog/mailadmin/storage"
+	"github.com/funnydog/mailadmin/testutils"
+	"github.com/funnydog/mailadmin/types"
+)
+
+const databasePath = "/tmp/test-postfix.db"
+
+func createTestingDatabase(t *testing.T) *db.Database {
+	database, domain := testutils.CreateTestingDatabase(t, databasePath)
+	inactive := types.Domain{Name: "inactive.org", Active: false}
+	if err := inactive.Create(database); err != nil {
+		t.Fatal(err)
+	}
+	relayed := types.Domain{Name: "relayed.net", BackupMX: true, Transport: "smtp:[mx.relayed.net]:25", Active: true}
+	if err := relayed.Create(database); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, m := range []types.Mailbox{
+		{Domain: domain.Id, Email: "one@example.com", Password: "x", Active: true},
+		{Domain: domain.Id, Email: "off@example.com", Password: "x", Active: false},
+		{Domain: inactive.Id, Email: "one@inactive.org", Password: "x", Active: true},
+		{Domain: relayed.Id, Email: "two@relayed.net", Password: "x", Active: true},
+	} {
+		if err := m.Create(database); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, a := range []types.Alias{
+		{Domain: domain.Id, Destination: "info@example.com", RedirectTo: "one@example.com", Active: true},
+		{Domain: domain.Id, Destination: "info@example.com", RedirectTo: "other@example.net", Active: true},
+		{Domain: relayed.Id, Destination: "info@relayed.net", RedirectTo: "two@relayed.net", Active: true},
+	} {
+		if err := a.Create(database); err != nil {
+			t.Fatal(err)
+		}
+	}
+	one, err := types.GetMailboxByEmail(database, "one@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, b := range []types.BCC{
+		{Domain: domain.Id, Kind: types.BCCRecipient, Address: "archive@example.net"},
+		{Domain: domain.Id, Mailbox: one.Id, Kind: types.BCCSender, Address: "sent@example.net"},
+		{Domain: inactive.Id, Kind: types.BCCSender, Address: "archive@example.net"},
+	} {
+		if err := b.Create(database); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, r := range []types.AccessRule{
+		{Domain: domain.Id, Kind: types.AccessRecipient, Pattern: "noreply@example.com", Action: types.AccessReject, Message: "Nobody reads this mailbox"},
+		{Domain: domain.Id, Kind: types.AccessSender, Pattern: "spam.example.org", Action: types.AccessDiscard},
+		{Domain: inactive.Id, Kind: types.AccessRecipient, Pattern: "one@inactive.org", Action: types.AccessOK},
+	} {
+		if err := r.Create(database); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := types.SetSendAs(database, one.Id.Int64, []string{"info@example.com", "@inactive.org"}); err != nil {
+		t.Fatal(err)
+	}
+	return database
+}
+
+func TestRenderMaps(t *testing.T) {
+	database := createTestingDatabase(t)
+
+	files, err := RenderMaps(database, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]string{
+		VirtualMailboxDomains: header + "example.com\tOK\n",
+		VirtualMailboxMaps:    header + "one@example.com\texample.com/one/\ntwo@relayed.net\trelayed.net/two/\n",
+		VirtualAliasMaps:      header + "info@example.com\tone@example.com, other@example.net\ninfo@relayed.net\ttwo@relayed.net\n",
+		SenderLoginMaps:       header + "@inactive.org\tone@example.com\ninfo@example.com\tone@example.com\none@example.com\tone@example.com\ntwo@relayed.net\ttwo@relayed.net\n",
+		TransportMaps:         header + "relayed.net\tsmtp:[mx.relayed.net]:25\n",
+		RelayDomains:          header + "relayed.net\tOK\n",
+		RelayRecipientMaps:    header + "info@relayed.net\tOK\ntwo@relayed.net\tOK\n",
+		SenderBCCMaps:         header + "one@example.com\tsent@example.net\n",
+		RecipientBCCMaps:      header + "@example.com\tarchive@example.net\n",
+		RecipientAccess:       header + "noreply@example.com\tREJECT Nobody reads this mailbox\n",
+	}
+	for name, content := range expected {
+		if string(files[name]) != content {
+			t.Errorf("%s: expected %q, got %q", name, content, files[name])
+		}
+	}
+
+	// the paths follow the layout of the storage
+	files, err = RenderMaps(database, &storage.Storage{Root: "/var/mail", Layout: "%d/users/%u"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := header + "one@example.com\texample.com/users/one@example.com/\ntwo@relayed.net\trelayed.net/users/two@relayed.net/\n"
+	if string(files[VirtualMailboxMaps]) != content {
+		t.Errorf("%s: expected %q, got %q", VirtualMailboxMaps, content, files[VirtualMailboxMaps])
+	}
+}
+
+func TestWriteMaps(t *testing.T) {
+	database := createTestingDatabase(t)
+
+	dir := t.TempDir()
+	changed, err := WriteMaps(database, nil, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !changed {
+		t.Error("The first write must change the files")
+	}
+
+	changed, err = WriteMaps(database, nil, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if changed {
+		t.Error("The files changed without changes in the database")
+	}
+
+	// no temporary files are left behind
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 10 {
+		t.Errorf("Expected 10 files, found %d", len(entries))
+	}
+
+	mailbox, err := types.GetMailboxByEmail(database, "off@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mailbox.Active = true
+	if err = mailbox.Update(database); err != nil {
+		t.Fatal(err)
+	}
+
+	changed, err = WriteMaps(database, nil, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !changed {
+		t.Error("The files didn't change after the update")
+	}
+
+	content, err := os.ReadFile(filepath.Join(dir, VirtualMailboxMaps))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(content), "off@example.com") {
+		t.Error("The activated mailbox is missing")
+	}
+}
+
+func TestRunHook(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "reloaded")
+	if err := RunHook("touch " + path); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Error("The hook hasn't been run")
+	}
+
+	if err := RunHook("exit 1"); err == nil {
+		t.Error("Expected error but got no error instead")
+	}
+}
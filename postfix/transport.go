@@ -0,0 +1,84 @@
+package postfix
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+type ErrInvalidTransport string
+
+func (it ErrInvalidTransport) Error() string {
+	return fmt.Sprintf("'%s' is not a valid transport, use transport:nexthop like smtp:[mx.example.com]:25", string(it))
+}
+
+var (
+	transportRe = regexp.MustCompile(`^[a-z][a-z0-9_-]*$`)
+	hostRe      = regexp.MustCompile(`^([a-z0-9]([a-z0-9-]*[a-z0-9])?\.)*[a-z0-9]([a-z0-9-]*[a-z0-9])?$`)
+	socketRe    = regexp.MustCompile(`^[A-Za-z0-9_./-]+$`)
+)
+
+// validPort checks the optional :port or :service of a next hop.
+func validPort(port string) bool {
+	if n, err := strconv.Atoi(port); err == nil {
+		return n > 0 && n < 65536
+	}
+	return transportRe.MatchString(port)
+}
+
+// validHost checks host, host:port, [host] and [host]:port, the
+// brackets skip the MX lookup.
+func validHost(nexthop string) bool {
+	host, port := nexthop, ""
+	if strings.HasPrefix(host, "[") {
+		end := strings.Index(host, "]")
+		if end < 0 {
+			return false
+		}
+		host, port = host[1:end], host[end+1:]
+		if port != "" && !strings.HasPrefix(port, ":") {
+			return false
+		}
+		port = strings.TrimPrefix(port, ":")
+	} else if i := strings.LastIndex(host, ":"); i >= 0 {
+		host, port = host[:i], host[i+1:]
+		if port == "" {
+			return false
+		}
+	}
+	return hostRe.MatchString(host) && (port == "" || validPort(port))
+}
+
+// ValidTransport checks the syntax of a transport(5) result: the name
+// of a master.cf service and an optional next hop, which for the LMTP
+// and SMTP clients can be unix:/path or inet:host:port. The error and
+// discard transports take a free text.
+func ValidTransport(transport string) error {
+	i := strings.Index(transport, ":")
+	if i < 0 || !transportRe.MatchString(transport[:i]) {
+		return ErrInvalidTransport(transport)
+	}
+	name, nexthop := transport[:i], transport[i+1:]
+
+	switch {
+	case nexthop == "":
+		return nil
+	case name == "error" || name == "discard":
+		if strings.ContainsAny(nexthop, "\r\n") {
+			return ErrInvalidTransport(transport)
+		}
+		return nil
+	case strings.HasPrefix(nexthop, "unix:"):
+		if socketRe.MatchString(strings.TrimPrefix(nexthop, "unix:")) {
+			return nil
+		}
+	case strings.HasPrefix(nexthop, "inet:"):
+		if validHost(strings.TrimPrefix(nexthop, "inet:")) {
+			return nil
+		}
+	case validHost(nexthop):
+		return nil
+	}
+	return ErrInvalidTransport(transport)
+}
@@ -0,0 +1,38 @@
+package postfix
+
+import "testing"
+
+func TestValidTransport(t *testing.T) {
+	valid := []string{
+		"smtp:[mx.example.com]:25",
+		"smtp:[mx.example.com]",
+		"smtp:mx.example.com:submission",
+		"relay:",
+		"lmtp:unix:private/dovecot-lmtp",
+		"lmtp:inet:127.0.0.1:24",
+		"error:5.1.1 Mailbox unavailable",
+	}
+	for _, transport := range valid {
+		if err := ValidTransport(transport); err != nil {
+			t.Errorf("%s: %s", transport, err)
+		}
+	}
+
+	invalid := []string{
+		"",
+		"smtp",
+		"SMTP:mx.example.com",
+		"smtp:[mx.example.com",
+		"smtp:[mx.example.com]25",
+		"smtp:mx.example.com:",
+		"smtp:mx.example.com:70000",
+		"smtp:mx example.com",
+		"lmtp:unix:",
+		"error:line\nbreak",
+	}
+	for _, transport := range invalid {
+		if err := ValidTransport(transport); err == nil {
+			t.Errorf("The transport %q has been accepted", transport)
+		}
+	}
+}
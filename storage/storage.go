@@ -0,0 +1,207 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/funnydog/mailadmin/core/config"
+	"github.com/funnydog/mailadmin/types"
+)
+
+// DefaultLayout is the path of the mailboxes relative to the mail
+// root when the configuration doesn't set one.
+const DefaultLayout = "%d/%n"
+
+var ErrExists = errors.New("The Maildir already exists")
+
+type ErrInvalidAddress string
+
+func (ia ErrInvalidAddress) Error() string {
+	return fmt.Sprintf("The address '%s' cannot be used as a path", string(ia))
+}
+
+// Storage manages the Maildir of the mailboxes under Root. The Layout
+// expands %d to the domain, %n to the local part and %u to the whole
+// address, like the mail_location of dovecot.
+type Storage struct {
+	Root    string
+	Layout  string
+	Archive string
+	UID     int
+	GID     int
+}
+
+// New returns the storage of the configuration or nil if the mail root
+// is not set, in which case the Maildirs are left to dovecot.
+func New(conf *config.Configuration) *Storage {
+	if conf.MailRoot == "" {
+		return nil
+	}
+
+	s := Storage{
+		Root:    conf.MailRoot,
+		Layout:  conf.MailLayout,
+		Archive: conf.MailArchive,
+		UID:     conf.MailUID,
+		GID:     conf.MailGID,
+	}
+	if s.Layout == "" {
+		s.Layout = DefaultLayout
+	}
+	if s.Archive == "" {
+		s.Archive = filepath.Join(s.Root, ".archive")
+	}
+	return &s
+}
+
+// Relative returns the path of the mailbox relative to the root, the
+// virtual_mailbox_base of postfix.
+func (s *Storage) Relative(email string) (string, error) {
+	at := strings.LastIndex(email, "@")
+	if at < 1 {
+		return "", ErrInvalidAddress(email)
+	}
+
+	local, domain := strings.ToLower(email[:at]), strings.ToLower(email[at+1:])
+	for _, part := range []string{local, domain} {
+		if part == "" || part == "." || part == ".." || strings.ContainsAny(part, "/\\\x00") {
+			return "", ErrInvalidAddress(email)
+		}
+	}
+
+	path := strings.NewReplacer(
+		"%d", domain,
+		"%n", local,
+		"%u", local+"@"+domain,
+	).Replace(s.Layout)
+	return filepath.Clean(path), nil
+}
+
+// Path returns the path of the Maildir of the address.
+func (s *Storage) Path(email string) (string, error) {
+	path, err := s.Relative(email)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(s.Root, path), nil
+}
+
+// archivePath returns where the Maildir of the mailbox is kept after
+// the mailbox is deleted, the id tells apart the mailboxes with the
+// same address.
+func (s *Storage) archivePath(mailbox types.Mailbox) (string, error) {
+	path, err := s.Relative(mailbox.Email)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(s.Archive, fmt.Sprintf("%s-%d", path, mailbox.Id.Int64)), nil
+}
+
+// mkdir creates the directory with the parents owned by the mail user.
+func (s *Storage) mkdir(path string) error {
+	if _, err := os.Stat(path); err == nil {
+		return nil
+	}
+
+	if err := s.mkdir(filepath.Dir(path)); err != nil {
+		return err
+	}
+
+	if err := os.Mkdir(path, 0700); err != nil && !os.IsExist(err) {
+		return err
+	}
+	if s.UID > 0 {
+		return os.Chown(path, s.UID, s.GID)
+	}
+	return nil
+}
+
+// Create makes the Maildir of the mailbox with the cur, new and tmp
+// subdirectories, the existing directories are kept.
+func (s *Storage) Create(mailbox types.Mailbox) error {
+	path, err := s.Path(mailbox.Email)
+	if err != nil {
+		return err
+	}
+
+	for _, sub := range []string{"cur", "new", "tmp"} {
+		if err = s.mkdir(filepath.Join(path, sub)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// move renames from to to, creating the parents of to. Nothing is done
+// if from doesn't exist.
+func (s *Storage) move(from, to string) error {
+	if _, err := os.Stat(from); os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if _, err := os.Stat(to); err == nil {
+		return ErrExists
+	}
+
+	if err := s.mkdir(filepath.Dir(to)); err != nil {
+		return err
+	}
+	return os.Rename(from, to)
+}
+
+// Rename moves the Maildir after the address of the mailbox changed
+// from old.
+func (s *Storage) Rename(old string, mailbox types.Mailbox) error {
+	from, err := s.Path(old)
+	if err != nil {
+		return err
+	}
+
+	to, err := s.Path(mailbox.Email)
+	if err != nil {
+		return err
+	}
+
+	if from == to {
+		return nil
+	}
+	return s.move(from, to)
+}
+
+// ArchiveMailbox moves the Maildir of a deleted mailbox to the archive.
+func (s *Storage) ArchiveMailbox(mailbox types.Mailbox) error {
+	from, err := s.Path(mailbox.Email)
+	if err != nil {
+		return err
+	}
+
+	to, err := s.archivePath(mailbox)
+	if err != nil {
+		return err
+	}
+	return s.move(from, to)
+}
+
+// RestoreMailbox moves the Maildir of a restored mailbox back from the
+// archive, or creates it if it has never been archived.
+func (s *Storage) RestoreMailbox(mailbox types.Mailbox) error {
+	from, err := s.archivePath(mailbox)
+	if err != nil {
+		return err
+	}
+
+	to, err := s.Path(mailbox.Email)
+	if err != nil {
+		return err
+	}
+
+	if err = s.move(from, to); err != nil {
+		return err
+	}
+	return s.Create(mailbox)
+}
@@ -0,0 +1,111 @@
+package storage
+
+import (
+	"database/sql"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/funnydog/mailadmin/core/config"
+	"github.com/funnydog/mailadmin/types"
+)
+
+func isDir(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && info.IsDir()
+}
+
+func TestPath(t *testing.T) {
+	s := Storage{Root: "/var/vmail", Layout: "%d/%n"}
+
+	path, err := s.Path("Test@Example.com")
+	if err != nil {
+		t.Fatal(err)
+	} else if path != "/var/vmail/example.com/test" {
+		t.Errorf("Path %s, Expected /var/vmail/example.com/test", path)
+	}
+
+	s.Layout = "%u/Maildir"
+	if path, _ = s.Path("test@example.com"); path != "/var/vmail/test@example.com/Maildir" {
+		t.Errorf("Path %s, Expected /var/vmail/test@example.com/Maildir", path)
+	}
+
+	for _, email := range []string{"test", "@example.com", "../x@example.com", "test@..", "a/b@example.com"} {
+		if _, err = s.Path(email); err == nil {
+			t.Errorf("The address %s has been accepted", email)
+		}
+	}
+}
+
+func TestNew(t *testing.T) {
+	if New(&config.Configuration{}) != nil {
+		t.Error("Storage configured without a mail root")
+	}
+
+	s := New(&config.Configuration{MailRoot: "/var/vmail"})
+	if s.Layout != DefaultLayout {
+		t.Errorf("Layout %s, Expected %s", s.Layout, DefaultLayout)
+	}
+	if s.Archive != "/var/vmail/.archive" {
+		t.Errorf("Archive %s, Expected /var/vmail/.archive", s.Archive)
+	}
+}
+
+func TestLifecycle(t *testing.T) {
+	root := t.TempDir()
+	s := Storage{Root: root, Layout: DefaultLayout, Archive: filepath.Join(root, "archive")}
+
+	mailbox := types.Mailbox{
+		Id:    sql.NullInt64{Int64: 7, Valid: true},
+		Email: "test@example.com",
+	}
+	if err := s.Create(mailbox); err != nil {
+		t.Fatal(err)
+	}
+	for _, sub := range []string{"cur", "new", "tmp"} {
+		path := filepath.Join(root, "example.com", "test", sub)
+		if info, err := os.Stat(path); err != nil {
+			t.Error(err)
+		} else if info.Mode().Perm() != 0700 {
+			t.Errorf("%s has mode %v, Expected 0700", path, info.Mode().Perm())
+		}
+	}
+
+	// a mail to check that the content follows the directory
+	mail := filepath.Join(root, "example.com", "test", "new", "1.mail")
+	if err := os.WriteFile(mail, []byte("hello"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	mailbox.Email = "renamed@example.com"
+	if err := s.Rename("test@example.com", mailbox); err != nil {
+		t.Fatal(err)
+	}
+	if !isDir(filepath.Join(root, "example.com", "renamed", "new")) || isDir(filepath.Join(root, "example.com", "test")) {
+		t.Error("The Maildir has not been renamed")
+	}
+
+	// the rename doesn't overwrite another Maildir
+	other := types.Mailbox{Email: "other@example.com"}
+	if err := s.Create(other); err != nil {
+		t.Fatal(err)
+	}
+	other.Email = "renamed@example.com"
+	if err := s.Rename("other@example.com", other); err != ErrExists {
+		t.Errorf("Rename returned %v, Expected ErrExists", err)
+	}
+
+	if err := s.ArchiveMailbox(mailbox); err != nil {
+		t.Fatal(err)
+	}
+	if !isDir(filepath.Join(root, "archive", "example.com", "renamed-7", "new")) {
+		t.Error("The Maildir has not been archived")
+	}
+
+	if err := s.RestoreMailbox(mailbox); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(root, "example.com", "renamed", "new", "1.mail")); err != nil {
+		t.Error("The Maildir has not been restored:", err)
+	}
+}
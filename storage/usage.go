@@ -0,0 +1,254 @@
+package storage
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// names of the files written by the quota plugins in the Maildir
+const (
+	MaildirSize  = "maildirsize"
+	DovecotQuota = "dovecot-quota"
+)
+
+// Usage is the space taken by a Maildir and its quota, zero if not
+// set. Found is false if the Maildir doesn't exist.
+type Usage struct {
+	Bytes         int64
+	Messages      int64
+	QuotaBytes    int64
+	QuotaMessages int64
+	Found         bool
+}
+
+func formatSize(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+
+	div, exp := int64(unit), 0
+	for n := size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(size)/float64(div), "KMGTPE"[exp])
+}
+
+func (u Usage) Size() string {
+	return formatSize(u.Bytes)
+}
+
+func (u Usage) QuotaSize() string {
+	return formatSize(u.QuotaBytes)
+}
+
+// Percent returns the used fraction of the quota.
+func (u Usage) Percent() int64 {
+	if u.QuotaBytes <= 0 {
+		return 0
+	}
+	return u.Bytes * 100 / u.QuotaBytes
+}
+
+func (u *Usage) Add(other Usage) {
+	u.Bytes += other.Bytes
+	u.Messages += other.Messages
+	u.QuotaBytes += other.QuotaBytes
+	u.QuotaMessages += other.QuotaMessages
+	u.Found = u.Found || other.Found
+}
+
+// ReadMaildirSize parses a maildirsize file of the Maildir++ quota: the
+// first line has the quota as "<bytes>S,<count>C", the following ones
+// the size and count deltas to sum.
+func ReadMaildirSize(in io.Reader) (Usage, error) {
+	usage := Usage{Found: true}
+
+	scanner := bufio.NewScanner(in)
+	if scanner.Scan() {
+		for _, def := range strings.Split(scanner.Text(), ",") {
+			def = strings.TrimSpace(def)
+			if def == "" {
+				continue
+			}
+
+			value, err := strconv.ParseInt(def[:len(def)-1], 10, 64)
+			if err != nil {
+				return usage, fmt.Errorf("maildirsize: invalid quota '%s'", def)
+			}
+			switch def[len(def)-1] {
+			case 'S':
+				usage.QuotaBytes = value
+			case 'C':
+				usage.QuotaMessages = value
+			}
+		}
+	}
+
+	for line := 2; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		} else if len(fields) != 2 {
+			return usage, fmt.Errorf("maildirsize:%d: expected the size and the count", line)
+		}
+
+		size, err := strconv.ParseInt(fields[0], 10, 64)
+		if err != nil {
+			return usage, fmt.Errorf("maildirsize:%d: %w", line, err)
+		}
+		count, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return usage, fmt.Errorf("maildirsize:%d: %w", line, err)
+		}
+		usage.Bytes += size
+		usage.Messages += count
+	}
+	return usage, scanner.Err()
+}
+
+// ReadDovecotQuota parses the file of the dovecot dict quota backend,
+// made of key and value lines.
+func ReadDovecotQuota(in io.Reader) (Usage, error) {
+	usage := Usage{Found: true}
+
+	scanner := bufio.NewScanner(in)
+	for scanner.Scan() {
+		key := strings.TrimSpace(scanner.Text())
+		if !scanner.Scan() {
+			return usage, fmt.Errorf("%s: missing the value of %s", DovecotQuota, key)
+		}
+
+		value, err := strconv.ParseInt(strings.TrimSpace(scanner.Text()), 10, 64)
+		if err != nil {
+			return usage, fmt.Errorf("%s: %s: %w", DovecotQuota, key, err)
+		}
+		switch key {
+		case "priv/quota/storage":
+			usage.Bytes = value
+		case "priv/quota/messages":
+			usage.Messages = value
+		}
+	}
+	return usage, scanner.Err()
+}
+
+// walkMaildir sums the size of the messages in the cur and new
+// directories of the Maildir and of its folders.
+func walkMaildir(path string) (Usage, error) {
+	usage := Usage{Found: true}
+	err := filepath.WalkDir(path, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		parent := filepath.Base(filepath.Dir(p))
+		if d.Type().IsRegular() && (parent == "cur" || parent == "new") {
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			usage.Bytes += info.Size()
+			usage.Messages++
+		}
+		return nil
+	})
+	return usage, err
+}
+
+func readFile(path string, read func(io.Reader) (Usage, error)) (Usage, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return Usage{}, err
+	}
+	defer file.Close()
+	return read(file)
+}
+
+// Usage returns the space taken by the Maildir of the address, read
+// from the quota files if present or by walking the directory.
+func (s *Storage) Usage(email string) (Usage, error) {
+	path, err := s.Path(email)
+	if err != nil {
+		return Usage{}, err
+	}
+
+	if _, err = os.Stat(path); os.IsNotExist(err) {
+		return Usage{}, nil
+	} else if err != nil {
+		return Usage{}, err
+	}
+
+	usage, err := readFile(filepath.Join(path, MaildirSize), ReadMaildirSize)
+	if !os.IsNotExist(err) {
+		return usage, err
+	}
+
+	usage, err = readFile(filepath.Join(path, DovecotQuota), ReadDovecotQuota)
+	if !os.IsNotExist(err) {
+		return usage, err
+	}
+
+	return walkMaildir(path)
+}
+
+type cacheEntry struct {
+	usage   Usage
+	expires time.Time
+}
+
+// UsageCache keeps the usage of the Maildirs for a while, walking the
+// large ones on every page view would be too slow.
+type UsageCache struct {
+	ttl     time.Duration
+	mutex   sync.Mutex
+	entries map[string]cacheEntry
+}
+
+func NewUsageCache(ttl time.Duration) *UsageCache {
+	return &UsageCache{ttl: ttl, entries: map[string]cacheEntry{}}
+}
+
+func (c *UsageCache) Get(s *Storage, email string) (Usage, error) {
+	path, err := s.Path(email)
+	if err != nil {
+		return Usage{}, err
+	}
+
+	c.mutex.Lock()
+	entry, ok := c.entries[path]
+	c.mutex.Unlock()
+	if ok && time.Now().Before(entry.expires) {
+		return entry.usage, nil
+	}
+	return c.Refresh(s, email)
+}
+
+// Refresh reads the usage of the Maildir even if cached and keeps it
+// for the time to live of the cache.
+func (c *UsageCache) Refresh(s *Storage, email string) (Usage, error) {
+	path, err := s.Path(email)
+	if err != nil {
+		return Usage{}, err
+	}
+
+	now := time.Now()
+	usage, err := s.Usage(email)
+	if err != nil {
+		return usage, err
+	}
+
+	c.mutex.Lock()
+	c.entries[path] = cacheEntry{usage, now.Add(c.ttl)}
+	c.mutex.Unlock()
+	return usage, nil
+}
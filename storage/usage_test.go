@@ -0,0 +1,84 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadMaildirSize(t *testing.T) {
+	usage, err := ReadMaildirSize(strings.NewReader("1048576S,100C\n1000 2\n500 1\n-200 -1\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := Usage{Bytes: 1300, Messages: 2, QuotaBytes: 1048576, QuotaMessages: 100, Found: true}
+	if usage != expected {
+		t.Errorf("Usage %+v, Expected %+v", usage, expected)
+	}
+	if usage.Size() != "1.3 KiB" || usage.QuotaSize() != "1.0 MiB" {
+		t.Errorf("Sizes %s and %s, Expected 1.3 KiB and 1.0 MiB", usage.Size(), usage.QuotaSize())
+	}
+
+	if _, err = ReadMaildirSize(strings.NewReader("xS\n")); err == nil {
+		t.Error("Invalid quota accepted")
+	}
+	if _, err = ReadMaildirSize(strings.NewReader("\n10\n")); err == nil {
+		t.Error("Invalid line accepted")
+	}
+}
+
+func TestReadDovecotQuota(t *testing.T) {
+	usage, err := ReadDovecotQuota(strings.NewReader("priv/quota/storage\n4096\npriv/quota/messages\n3\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if usage.Bytes != 4096 || usage.Messages != 3 {
+		t.Errorf("Usage %+v, Expected 4096 bytes and 3 messages", usage)
+	}
+}
+
+func TestUsage(t *testing.T) {
+	s := Storage{Root: t.TempDir(), Layout: DefaultLayout}
+
+	usage, err := s.Usage("test@example.com")
+	if err != nil {
+		t.Fatal(err)
+	} else if usage.Found {
+		t.Error("Found the usage of a missing Maildir")
+	}
+
+	// without the quota files the Maildir is walked
+	path, _ := s.Path("test@example.com")
+	for _, dir := range []string{"cur", "new", "tmp", ".Sent/cur"} {
+		if err = os.MkdirAll(filepath.Join(path, dir), 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name, size := range map[string]int{"cur/1": 10, "new/2": 20, "tmp/3": 40, ".Sent/cur/4": 80} {
+		if err = os.WriteFile(filepath.Join(path, name), make([]byte, size), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cache := NewUsageCache(time.Hour)
+	usage, err = cache.Get(&s, "test@example.com")
+	if err != nil {
+		t.Fatal(err)
+	} else if usage.Bytes != 110 || usage.Messages != 3 {
+		t.Errorf("Usage %+v, Expected 110 bytes and 3 messages", usage)
+	}
+
+	// the quota file is preferred but the cache is still valid
+	if err = os.WriteFile(filepath.Join(path, MaildirSize), []byte("0S\n5000 1\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if usage, _ = cache.Get(&s, "test@example.com"); usage.Bytes != 110 {
+		t.Errorf("Usage %+v not cached", usage)
+	}
+	if usage, _ = s.Usage("test@example.com"); usage.Bytes != 5000 {
+		t.Errorf("Usage %+v, Expected 5000 bytes from %s", usage, MaildirSize)
+	}
+}
@@ -0,0 +1,44 @@
+package testutils
+
+import (
+	"os"
+	"testing"
+
+	"github.com/funnydog/mailadmin/core/config"
+	"github.com/funnydog/mailadmin/core/db"
+	"github.com/funnydog/mailadmin/types"
+)
+
+// ConnectTestingDatabase opens a new sqlite3 database at path, the
+// database is closed and removed at the end of the test.
+func ConnectTestingDatabase(t *testing.T, path string) *db.Database {
+	os.Remove(path)
+	database, err := db.Connect(&config.Configuration{DBType: "sqlite3", DBName: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		database.Close()
+		os.Remove(path)
+	})
+	return database
+}
+
+// CreateTestingDatabase opens a new database at path with the tables
+// and the statements of the types, and creates the active domain
+// example.com.
+func CreateTestingDatabase(t *testing.T, path string) (*db.Database, types.Domain) {
+	database := ConnectTestingDatabase(t, path)
+	if err := types.CreateModel(database); err != nil {
+		t.Fatal(err)
+	}
+	if err := types.PrepareStatements(database); err != nil {
+		t.Fatal(err)
+	}
+
+	domain := types.Domain{Name: "example.com", Active: true}
+	if err := domain.Create(database); err != nil {
+		t.Fatal(err)
+	}
+	return database, domain
+}
@@ -0,0 +1,130 @@
+package testutils
+
+import (
+	"encoding/binary"
+	"net"
+	"strings"
+	"testing"
+)
+
+// DNS record types answered by ServeDNS
+const (
+	dnsTypeMX  = 15
+	dnsTypeTXT = 16
+)
+
+// DNSZone holds the records served by ServeDNS, the names are lower
+// case with the trailing dot.
+type DNSZone struct {
+	MX  map[string][]net.MX
+	TXT map[string][]string
+}
+
+// ServeDNS starts a stub DNS server on a local UDP port answering the
+// MX and TXT queries of the zone and returns its address. The server
+// is stopped at the end of the test.
+func ServeDNS(t *testing.T, zone DNSZone) string {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if reply := zone.answer(buf[:n]); reply != nil {
+				_, _ = conn.WriteTo(reply, addr)
+			}
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+func appendUint16(b []byte, v uint16) []byte {
+	return append(b, byte(v>>8), byte(v))
+}
+
+func appendUint32(b []byte, v uint32) []byte {
+	return append(appendUint16(b, uint16(v>>16)), byte(v>>8), byte(v))
+}
+
+func encodeName(name string) []byte {
+	out := []byte{}
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		out = append(out, byte(len(label)))
+		out = append(out, label...)
+	}
+	return append(out, 0)
+}
+
+// answer builds the reply to the query, nil if it cannot be parsed.
+func (zone *DNSZone) answer(query []byte) []byte {
+	if len(query) < 12 {
+		return nil
+	}
+
+	// the question: the labels, the type and the class
+	labels := []string{}
+	pos := 12
+	for pos < len(query) && query[pos] != 0 {
+		size := int(query[pos])
+		if pos+1+size > len(query) {
+			return nil
+		}
+		labels = append(labels, string(query[pos+1:pos+1+size]))
+		pos += 1 + size
+	}
+	if pos+5 > len(query) {
+		return nil
+	}
+	qtype := binary.BigEndian.Uint16(query[pos+1:])
+	question := query[12 : pos+5]
+	name := strings.ToLower(strings.Join(labels, ".")) + "."
+
+	answers := [][]byte{}
+	switch qtype {
+	case dnsTypeMX:
+		for _, mx := range zone.MX[name] {
+			rdata := appendUint16(nil, mx.Pref)
+			answers = append(answers, append(rdata, encodeName(mx.Host)...))
+		}
+	case dnsTypeTXT:
+		for _, txt := range zone.TXT[name] {
+			rdata := []byte{}
+			for len(txt) > 255 {
+				rdata = append(append(rdata, 255), txt[:255]...)
+				txt = txt[255:]
+			}
+			answers = append(answers, append(append(rdata, byte(len(txt))), txt...))
+		}
+	}
+
+	// NXDOMAIN if the name has no records at all
+	rcode := uint16(0)
+	if len(zone.MX[name]) == 0 && len(zone.TXT[name]) == 0 {
+		rcode = 3
+	}
+
+	reply := append([]byte{}, query[:2]...)
+	reply = appendUint16(reply, 0x8180|rcode)
+	reply = appendUint16(reply, 1)
+	reply = appendUint16(reply, uint16(len(answers)))
+	reply = appendUint16(reply, 0)
+	reply = appendUint16(reply, 0)
+	reply = append(reply, question...)
+	for _, rdata := range answers {
+		// the name is a pointer to the question
+		reply = append(reply, 0xc0, 12)
+		reply = appendUint16(reply, qtype)
+		reply = appendUint16(reply, 1)
+		reply = appendUint32(reply, 60)
+		reply = appendUint16(reply, uint16(len(rdata)))
+		reply = append(reply, rdata...)
+	}
+	return reply
+}
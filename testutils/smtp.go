@@ -0,0 +1,126 @@
+package testutils
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// SMTPMail is a mail received by ServeSMTP.
+type SMTPMail struct {
+	From string
+	To   []string
+	Data string
+}
+
+// SMTPServer is a stand-in SMTP server keeping the mails it receives.
+type SMTPServer struct {
+	Address string
+
+	mutex  sync.Mutex
+	mails  []SMTPMail
+	reject bool
+}
+
+// Mails returns the mails received so far.
+func (s *SMTPServer) Mails() []SMTPMail {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]SMTPMail{}, s.mails...)
+}
+
+// Reject makes the server refuse the recipients with a temporary error.
+func (s *SMTPServer) Reject(reject bool) {
+	s.mutex.Lock()
+	s.reject = reject
+	s.mutex.Unlock()
+}
+
+// ServeSMTP starts a stand-in SMTP server on a local TCP port, without
+// TLS nor authentication. The server is stopped at the end of the
+// test.
+func ServeSMTP(t *testing.T) *SMTPServer {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	s := &SMTPServer{Address: l.Addr().String()}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.handle(conn)
+		}
+	}()
+	return s
+}
+
+func (s *SMTPServer) handle(conn net.Conn) {
+	defer conn.Close()
+
+	r := bufio.NewReader(conn)
+	reply := func(format string, args ...interface{}) {
+		fmt.Fprintf(conn, format+"\r\n", args...)
+	}
+
+	reply("220 localhost ESMTP")
+	mail := SMTPMail{}
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		command := strings.ToUpper(line)
+
+		switch {
+		case strings.HasPrefix(command, "EHLO"), strings.HasPrefix(command, "HELO"):
+			reply("250 localhost")
+		case strings.HasPrefix(command, "MAIL FROM:"):
+			mail = SMTPMail{From: strings.Trim(line[len("MAIL FROM:"):], "<> ")}
+			reply("250 OK")
+		case strings.HasPrefix(command, "RCPT TO:"):
+			s.mutex.Lock()
+			reject := s.reject
+			s.mutex.Unlock()
+			if reject {
+				reply("451 Try again later")
+				continue
+			}
+			mail.To = append(mail.To, strings.Trim(line[len("RCPT TO:"):], "<> "))
+			reply("250 OK")
+		case command == "DATA":
+			reply("354 End data with <CR><LF>.<CR><LF>")
+			var data strings.Builder
+			for {
+				line, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if line == ".\r\n" {
+					break
+				}
+				data.WriteString(strings.TrimPrefix(line, "."))
+			}
+			mail.Data = data.String()
+			s.mutex.Lock()
+			s.mails = append(s.mails, mail)
+			s.mutex.Unlock()
+			reply("250 OK")
+		case command == "RSET", command == "NOOP":
+			reply("250 OK")
+		case command == "QUIT":
+			reply("221 Bye")
+			return
+		default:
+			reply("502 Command not implemented")
+		}
+	}
+}
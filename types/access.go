@@ -0,0 +1,225 @@
+package types
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"regexp"
+	"time"
+
+	"github.com/funnydog/mailadmin/core/db"
+)
+
+// kinds of the access rules: the senders the domain accepts mail from
+// and its addresses accepting mail
+const (
+	AccessSender    = "sender"
+	AccessRecipient = "recipient"
+)
+
+// actions of the access rules, see access(5)
+const (
+	AccessOK      = "OK"
+	AccessReject  = "REJECT"
+	AccessDiscard = "DISCARD"
+)
+
+var ErrAccessRuleExists = errors.New("The domain already has a rule for this pattern.")
+
+type ErrInvalidPattern string
+
+func (ip ErrInvalidPattern) Error() string {
+	return fmt.Sprintf("'%s' must be an address, a domain or user@", string(ip))
+}
+
+var (
+	accessAddressRe = regexp.MustCompile(`^[^@\s]+@([a-z0-9-]+\.)+[a-z]{2,63}$`)
+	accessDomainRe  = regexp.MustCompile(`^([a-z0-9-]+\.)+[a-z]{2,63}$`)
+	accessUserRe    = regexp.MustCompile(`^[^@\s]+@$`)
+)
+
+// AccessRule allows, rejects or discards the mails of the senders or
+// to the recipients matching Pattern, the message is returned to the
+// client by the reject and discard actions.
+type AccessRule struct {
+	Id      sql.NullInt64
+	Domain  sql.NullInt64
+	Kind    string
+	Pattern string
+	Action  string
+	Message string
+	Created time.Time
+}
+
+// AccessEntry is an entry of a postfix access table.
+type AccessEntry struct {
+	Pattern string
+	Result  string
+}
+
+const accessColumns = `id, domain_id, kind, pattern, action, message, created`
+
+func (rule *AccessRule) scan(s scanner) error {
+	return s.Scan(
+		&rule.Id,
+		&rule.Domain,
+		&rule.Kind,
+		&rule.Pattern,
+		&rule.Action,
+		&rule.Message,
+		&rule.Created,
+	)
+}
+
+func scanAccessRules(rows *sql.Rows) ([]AccessRule, error) {
+	rules := []AccessRule{}
+	for rows.Next() {
+		r := AccessRule{}
+		if err := r.scan(rows); err != nil {
+			return rules, err
+		}
+		rules = append(rules, r)
+	}
+	return rules, rows.Err()
+}
+
+func accessStatements(stmts map[string]string) {
+	stmts["accessList"] = `SELECT ` + accessColumns + ` FROM access_rule WHERE domain_id=$1 ORDER BY kind, pattern`
+	stmts["accessListByKind"] = `SELECT ` + accessColumns + ` FROM access_rule WHERE domain_id=$1 AND kind=$2 ORDER BY pattern`
+	stmts["accessFind"] = `SELECT ` + accessColumns + ` FROM access_rule WHERE id=$1`
+	stmts["accessCount"] = `SELECT COUNT(*) FROM access_rule WHERE domain_id=$1 AND kind=$2 AND pattern=$3`
+	stmts["accessCreate"] = `INSERT INTO access_rule(domain_id, kind, pattern, action, message, created) VALUES ($1, $2, $3, $4, $5, $6)`
+	stmts["accessDelete"] = `DELETE FROM access_rule WHERE id=$1`
+	stmts["recipientAccessList"] = `SELECT pattern, result FROM recipient_access ORDER BY pattern`
+}
+
+// ValidAccessPattern checks the pattern of a rule of the domain. The
+// sender patterns are an address, a domain, which matches its
+// subdomains too, or user@. The recipient ones are addresses of the
+// domain.
+func ValidAccessPattern(domain Domain, kind, pattern string) error {
+	switch kind {
+	case AccessSender:
+		if accessAddressRe.MatchString(pattern) || accessDomainRe.MatchString(pattern) || accessUserRe.MatchString(pattern) {
+			return nil
+		}
+	case AccessRecipient:
+		if accessAddressRe.MatchString(pattern) && domain.Contains(pattern) {
+			return nil
+		}
+		return fmt.Errorf("'%s' must be an address ending with @%s", pattern, domain.Name)
+	}
+	return ErrInvalidPattern(pattern)
+}
+
+// Result returns the action in the format of the access tables.
+func (rule *AccessRule) Result() string {
+	if rule.Message != "" && rule.Action != AccessOK {
+		return rule.Action + " " + rule.Message
+	}
+	return rule.Action
+}
+
+func (rule *AccessRule) Create(db db.Querier) error {
+	stmt, err := db.FindStatement("accessCount")
+	if err != nil {
+		return err
+	}
+
+	var count int64
+	if err = stmt.QueryRow(rule.Domain.Int64, rule.Kind, rule.Pattern).Scan(&count); err != nil {
+		return err
+	} else if count > 0 {
+		return ErrAccessRuleExists
+	}
+
+	if stmt, err = db.FindStatement("accessCreate"); err != nil {
+		return err
+	}
+
+	rule.Created = time.Now()
+	res, err := stmt.Exec(rule.Domain, rule.Kind, rule.Pattern, rule.Action, rule.Message, rule.Created)
+	if err != nil {
+		return err
+	}
+
+	rule.Id.Int64, err = res.LastInsertId()
+	if err != nil {
+		return err
+	}
+	rule.Id.Valid = true
+	return nil
+}
+
+func (rule *AccessRule) Delete(db db.Querier) error {
+	stmt, err := db.FindStatement("accessDelete")
+	if err != nil {
+		return err
+	}
+
+	_, err = stmt.Exec(rule.Id.Int64)
+	return err
+}
+
+func queryAccessRules(db db.Querier, name string, args ...interface{}) ([]AccessRule, error) {
+	stmt, err := db.FindStatement(name)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := stmt.Query(args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return scanAccessRules(rows)
+}
+
+// GetAccessRules returns the rules of the domain.
+func GetAccessRules(db db.Querier, domain_id int64) ([]AccessRule, error) {
+	return queryAccessRules(db, "accessList", domain_id)
+}
+
+// GetAccessRulesByKind returns the sender or recipient rules of the
+// domain.
+func GetAccessRulesByKind(db db.Querier, domain_id int64, kind string) ([]AccessRule, error) {
+	return queryAccessRules(db, "accessListByKind", domain_id, kind)
+}
+
+func GetAccessRuleById(db db.Querier, PK int64) (AccessRule, error) {
+	rule := AccessRule{}
+
+	stmt, err := db.FindStatement("accessFind")
+	if err != nil {
+		return rule, err
+	}
+
+	err = rule.scan(stmt.QueryRow(PK))
+	return rule, err
+}
+
+// GetRecipientAccess returns the recipient rules of the active
+// domains in the format of check_recipient_access.
+func GetRecipientAccess(db db.Querier) ([]AccessEntry, error) {
+	stmt, err := db.FindStatement("recipientAccessList")
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := stmt.Query()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := []AccessEntry{}
+	for rows.Next() {
+		e := AccessEntry{}
+		if err = rows.Scan(&e.Pattern, &e.Result); err != nil {
+			return entries, err
+		}
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
@@ -0,0 +1,165 @@
+package types
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/funnydog/mailadmin/core/db"
+)
+
+// kinds of the BCC rules, named after the postfix maps
+const (
+	BCCSender    = "sender"
+	BCCRecipient = "recipient"
+)
+
+var ErrBCCExists = errors.New("A rule of the same kind already exists, postfix supports a single BCC address for each sender and recipient.")
+
+// BCC copies the mails sent or received by a whole domain, or by one
+// of its mailboxes when Mailbox is set, to Address. Email is the
+// address of the mailbox, empty for the domain rules.
+type BCC struct {
+	Id      sql.NullInt64
+	Domain  sql.NullInt64
+	Mailbox sql.NullInt64
+	Kind    string
+	Address string
+	Created time.Time
+	Email   string
+}
+
+// BCCEntry is an entry of the postfix sender_bcc_maps and
+// recipient_bcc_maps, Address is an email or @domain.
+type BCCEntry struct {
+	Address string
+	BCC     string
+}
+
+const bccColumns = `b.id, b.domain_id, b.mailbox_id, b.kind, b.address, b.created, COALESCE(m.email, '')`
+
+func (bcc *BCC) scan(s scanner) error {
+	return s.Scan(
+		&bcc.Id,
+		&bcc.Domain,
+		&bcc.Mailbox,
+		&bcc.Kind,
+		&bcc.Address,
+		&bcc.Created,
+		&bcc.Email,
+	)
+}
+
+func bccStatements(stmts map[string]string) {
+	from := ` FROM bcc b LEFT JOIN mailbox m ON m.id=b.mailbox_id`
+	stmts["bccList"] = `SELECT ` + bccColumns + from + ` WHERE b.domain_id=$1 ORDER BY b.kind, COALESCE(m.email, ''), b.id`
+	stmts["bccFind"] = `SELECT ` + bccColumns + from + ` WHERE b.id=$1`
+	stmts["bccCount"] = `SELECT COUNT(*) FROM bcc WHERE kind=$1 AND domain_id=$2 AND COALESCE(mailbox_id, 0)=$3`
+	stmts["bccCreate"] = `INSERT INTO bcc(domain_id, mailbox_id, kind, address, created) VALUES ($1, $2, $3, $4, $5)`
+	stmts["bccDelete"] = `DELETE FROM bcc WHERE id=$1`
+	for _, kind := range []string{BCCSender, BCCRecipient} {
+		stmts[kind+"BCCMap"] = `SELECT address, bcc FROM ` + kind + `_bcc ORDER BY address`
+	}
+}
+
+func (bcc *BCC) Create(db db.Querier) error {
+	stmt, err := db.FindStatement("bccCount")
+	if err != nil {
+		return err
+	}
+
+	var count int64
+	if err = stmt.QueryRow(bcc.Kind, bcc.Domain.Int64, bcc.Mailbox.Int64).Scan(&count); err != nil {
+		return err
+	} else if count > 0 {
+		return ErrBCCExists
+	}
+
+	if stmt, err = db.FindStatement("bccCreate"); err != nil {
+		return err
+	}
+
+	bcc.Created = time.Now()
+	res, err := stmt.Exec(bcc.Domain, bcc.Mailbox, bcc.Kind, bcc.Address, bcc.Created)
+	if err != nil {
+		return err
+	}
+
+	bcc.Id.Int64, err = res.LastInsertId()
+	if err != nil {
+		return err
+	}
+	bcc.Id.Valid = true
+	return nil
+}
+
+func (bcc *BCC) Delete(db db.Querier) error {
+	stmt, err := db.FindStatement("bccDelete")
+	if err != nil {
+		return err
+	}
+
+	_, err = stmt.Exec(bcc.Id.Int64)
+	return err
+}
+
+// GetBCCs returns the rules of the domain and of its mailboxes.
+func GetBCCs(db db.Querier, domain_id int64) ([]BCC, error) {
+	stmt, err := db.FindStatement("bccList")
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := stmt.Query(domain_id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	rules := []BCC{}
+	for rows.Next() {
+		b := BCC{}
+		if err = b.scan(rows); err != nil {
+			return rules, err
+		}
+		rules = append(rules, b)
+	}
+	return rules, rows.Err()
+}
+
+func GetBCCById(db db.Querier, PK int64) (BCC, error) {
+	bcc := BCC{}
+
+	stmt, err := db.FindStatement("bccFind")
+	if err != nil {
+		return bcc, err
+	}
+
+	err = bcc.scan(stmt.QueryRow(PK))
+	return bcc, err
+}
+
+// GetBCCMap returns the entries of the postfix map of the kind for the
+// active domains and mailboxes, sorted by address.
+func GetBCCMap(db db.Querier, kind string) ([]BCCEntry, error) {
+	stmt, err := db.FindStatement(kind + "BCCMap")
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := stmt.Query()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := []BCCEntry{}
+	for rows.Next() {
+		e := BCCEntry{}
+		if err = rows.Scan(&e.Address, &e.BCC); err != nil {
+			return entries, err
+		}
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
@@ -0,0 +1,265 @@
+package types
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/funnydog/mailadmin/core/db"
+)
+
+// MaxActiveDKIMKeys is the number of keys of a domain published at the
+// same time, two allow to rotate the key without invalidating the
+// signatures of the mails still in transit.
+const MaxActiveDKIMKeys = 2
+
+var (
+	ErrTooManyDKIMKeys = errors.New("A domain cannot have more than 2 active DKIM keys.")
+	ErrDKIMKeyInactive = errors.New("Enable the DKIM key before signing with it.")
+	ErrDKIMKeySigning  = errors.New("Sign with the other active DKIM key before disabling this one.")
+)
+
+// DKIMKey is a signing key of a domain. The private key is PEM encoded,
+// the public key is the base64 value of the p= tag of the DNS record.
+// Among the active keys of a domain only the signing one signs the
+// mails, the others are just published.
+type DKIMKey struct {
+	Id         sql.NullInt64
+	Domain     sql.NullInt64
+	Selector   string
+	Algorithm  string
+	PrivateKey string
+	PublicKey  string
+	Active     bool
+	Signing    bool
+	Created    time.Time
+}
+
+const dkimColumns = `id, domain_id, selector, algorithm, private_key, public_key, active, signing, created`
+
+func (key *DKIMKey) scan(s scanner) error {
+	return s.Scan(
+		&key.Id,
+		&key.Domain,
+		&key.Selector,
+		&key.Algorithm,
+		&key.PrivateKey,
+		&key.PublicKey,
+		&key.Active,
+		&key.Signing,
+		&key.Created,
+	)
+}
+
+func scanDKIMKeys(rows *sql.Rows) ([]DKIMKey, error) {
+	keys := []DKIMKey{}
+	for rows.Next() {
+		k := DKIMKey{}
+		if err := k.scan(rows); err != nil {
+			return keys, err
+		}
+		keys = append(keys, k)
+	}
+	return keys, rows.Err()
+}
+
+func dkimStatements(stmts map[string]string) {
+	stmts["dkimList"] = `SELECT ` + dkimColumns + ` FROM dkim_key WHERE domain_id=$1 ORDER BY created DESC, id DESC`
+	stmts["dkimFind"] = `SELECT ` + dkimColumns + ` FROM dkim_key WHERE id=$1`
+	stmts["dkimCreate"] = `INSERT INTO dkim_key(domain_id, selector, algorithm, private_key, public_key, active, signing, created) VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`
+	stmts["dkimSetActive"] = `UPDATE dkim_key SET active=$1, signing=$2 WHERE id=$3`
+	stmts["dkimSetSigning"] = `UPDATE dkim_key SET signing=$1 WHERE id=$2`
+	stmts["dkimClearSigning"] = `UPDATE dkim_key SET signing=$1 WHERE domain_id=$2`
+	stmts["dkimDelete"] = `DELETE FROM dkim_key WHERE id=$1`
+	stmts["dkimActiveCount"] = `SELECT COUNT(*) FROM dkim_key WHERE domain_id=$1 AND active`
+	stmts["dkimSigningCount"] = `SELECT COUNT(*) FROM dkim_key WHERE domain_id=$1 AND active AND signing`
+
+	// the keys of the domains seen by postfix, newest first
+	stmts["dkimActiveList"] = `SELECT ` + prefixColumns("k", dkimColumns) + ` FROM dkim_key k JOIN active_domain d ON d.id=k.domain_id WHERE k.active ORDER BY d.name, k.created DESC, k.id DESC`
+}
+
+func countDKIMKeys(db db.Querier, name string, domain_id int64) (int64, error) {
+	stmt, err := db.FindStatement(name)
+	if err != nil {
+		return 0, err
+	}
+
+	var count int64
+	err = stmt.QueryRow(domain_id).Scan(&count)
+	return count, err
+}
+
+func countActiveDKIMKeys(db db.Querier, domain_id int64) (int64, error) {
+	return countDKIMKeys(db, "dkimActiveCount", domain_id)
+}
+
+// hasSigningDKIMKey reports if an active key of the domain signs the
+// mails, the first key enabled signs them until another one is promoted.
+func hasSigningDKIMKey(db db.Querier, domain_id int64) (bool, error) {
+	n, err := countDKIMKeys(db, "dkimSigningCount", domain_id)
+	return n > 0, err
+}
+
+func (key *DKIMKey) Create(db db.Querier) error {
+	key.Signing = false
+	if key.Active {
+		if n, err := countActiveDKIMKeys(db, key.Domain.Int64); err != nil {
+			return err
+		} else if n >= MaxActiveDKIMKeys {
+			return ErrTooManyDKIMKeys
+		}
+		signing, err := hasSigningDKIMKey(db, key.Domain.Int64)
+		if err != nil {
+			return err
+		}
+		key.Signing = !signing
+	}
+
+	stmt, err := db.FindStatement("dkimCreate")
+	if err != nil {
+		return err
+	}
+
+	key.Created = time.Now()
+	res, err := stmt.Exec(
+		key.Domain,
+		key.Selector,
+		key.Algorithm,
+		key.PrivateKey,
+		key.PublicKey,
+		key.Active,
+		key.Signing,
+		key.Created,
+	)
+	if err != nil {
+		return err
+	}
+
+	key.Id.Int64, err = res.LastInsertId()
+	if err != nil {
+		return err
+	}
+	key.Id.Valid = true
+	return nil
+}
+
+// SetActive publishes or retires the key, at most MaxActiveDKIMKeys
+// keys of a domain can be active. The key enabled signs the mails if
+// no other one does, the signing key can be disabled only if it is the
+// last active one.
+func (key *DKIMKey) SetActive(db db.Querier, active bool) error {
+	signing := false
+	if active && !key.Active {
+		if n, err := countActiveDKIMKeys(db, key.Domain.Int64); err != nil {
+			return err
+		} else if n >= MaxActiveDKIMKeys {
+			return ErrTooManyDKIMKeys
+		}
+		other, err := hasSigningDKIMKey(db, key.Domain.Int64)
+		if err != nil {
+			return err
+		}
+		signing = !other
+	} else if active {
+		signing = key.Signing
+	} else if key.Active && key.Signing {
+		if n, err := countActiveDKIMKeys(db, key.Domain.Int64); err != nil {
+			return err
+		} else if n > 1 {
+			return ErrDKIMKeySigning
+		}
+	}
+
+	stmt, err := db.FindStatement("dkimSetActive")
+	if err != nil {
+		return err
+	}
+
+	if _, err = stmt.Exec(active, signing, key.Id.Int64); err != nil {
+		return err
+	}
+	key.Active = active
+	key.Signing = signing
+	return nil
+}
+
+// Promote makes the active key sign the mails of its domain in place of
+// the previous one, run it in a transaction.
+func (key *DKIMKey) Promote(db db.Querier) error {
+	if !key.Active {
+		return ErrDKIMKeyInactive
+	}
+
+	stmt, err := db.FindStatement("dkimClearSigning")
+	if err != nil {
+		return err
+	}
+	if _, err = stmt.Exec(false, key.Domain.Int64); err != nil {
+		return err
+	}
+
+	stmt, err = db.FindStatement("dkimSetSigning")
+	if err != nil {
+		return err
+	}
+	if _, err = stmt.Exec(true, key.Id.Int64); err != nil {
+		return err
+	}
+	key.Signing = true
+	return nil
+}
+
+func (key *DKIMKey) Delete(db db.Querier) error {
+	stmt, err := db.FindStatement("dkimDelete")
+	if err != nil {
+		return err
+	}
+
+	_, err = stmt.Exec(key.Id.Int64)
+	return err
+}
+
+// GetDKIMKeys returns the keys of the domain, newest first.
+func GetDKIMKeys(db db.Querier, domain_id int64) ([]DKIMKey, error) {
+	stmt, err := db.FindStatement("dkimList")
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := stmt.Query(domain_id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return scanDKIMKeys(rows)
+}
+
+// GetActiveDKIMKeys returns the active keys of the active domains
+// sorted by domain name, the newest key of each domain first.
+func GetActiveDKIMKeys(db db.Querier) ([]DKIMKey, error) {
+	stmt, err := db.FindStatement("dkimActiveList")
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := stmt.Query()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return scanDKIMKeys(rows)
+}
+
+func GetDKIMKeyById(db db.Querier, PK int64) (DKIMKey, error) {
+	key := DKIMKey{}
+
+	stmt, err := db.FindStatement("dkimFind")
+	if err != nil {
+		return key, err
+	}
+
+	err = key.scan(stmt.QueryRow(PK))
+	return key, err
+}
@@ -0,0 +1,213 @@
+package types
+
+import (
+	"github.com/funnydog/mailadmin/core/db"
+)
+
+// migrations upgrade the databases created by the previous versions,
+// CreateModel makes the last schema at once. The statements are the
+// schema of their time: change the model with a new migration, never
+// by editing the old ones.
+var migrations = []db.Migration{
+	// the trash: the unique names hold only outside of it, SQLite
+	// cannot drop the constraints and rebuilds the tables
+	{Description: "trash", Statements: []string{
+		`CREATE TABLE domain_new (
+	id INTEGER PRIMARY KEY,
+	name VARCHAR(50) NOT NULL,
+	description TEXT NOT NULL DEFAULT '',
+	backupmx TINYINT(1) NOT NULL DEFAULT '0',
+	active TINYINT(1) NOT NULL DEFAULT '1',
+	created DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	modified DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	deleted DATETIME NULL DEFAULT NULL
+)`,
+		`INSERT INTO domain_new(id, name, description, backupmx, active, created, modified)
+	SELECT id, name, description, backupmx, active, created, modified FROM domain`,
+		`DROP TABLE domain`,
+		`ALTER TABLE domain_new RENAME TO domain`,
+		`CREATE UNIQUE INDEX unique_name ON domain(name) WHERE deleted IS NULL`,
+
+		`CREATE TABLE mailbox_new (
+	id INTEGER PRIMARY KEY,
+	domain_id INTEGER NOT NULL,
+	email VARCHAR(100) NOT NULL,
+	password VARCHAR(256) NOT NULL,
+	created DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	modified DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	active TINYINT(1) NOT NULL DEFAULT '1',
+	deleted DATETIME NULL DEFAULT NULL,
+	FOREIGN KEY (domain_id) REFERENCES domain(id) ON DELETE CASCADE
+)`,
+		`INSERT INTO mailbox_new(id, domain_id, email, password, created, modified, active)
+	SELECT id, domain_id, email, password, created, modified, active FROM mailbox`,
+		`DROP TABLE mailbox`,
+		`ALTER TABLE mailbox_new RENAME TO mailbox`,
+		`CREATE UNIQUE INDEX unique_email ON mailbox(email) WHERE deleted IS NULL`,
+
+		`ALTER TABLE alias ADD COLUMN deleted DATETIME NULL DEFAULT NULL`,
+
+		`CREATE VIEW active_domain AS
+	SELECT * FROM domain WHERE active AND deleted IS NULL`,
+		`CREATE VIEW active_mailbox AS
+	SELECT m.* FROM mailbox m JOIN active_domain d ON d.id=m.domain_id
+	WHERE m.active AND m.deleted IS NULL`,
+		`CREATE VIEW active_alias AS
+	SELECT a.* FROM alias a JOIN active_domain d ON d.id=a.domain_id
+	WHERE a.active AND a.deleted IS NULL`,
+	}},
+
+	// the previous versions of the mailboxes and aliases
+	{Description: "revisions", Statements: []string{
+		`CREATE TABLE IF NOT EXISTS revision (
+	id INTEGER PRIMARY KEY,
+	kind VARCHAR(20) NOT NULL,
+	record_id INTEGER NOT NULL,
+	data TEXT NOT NULL,
+	created DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+)`,
+		`CREATE INDEX IF NOT EXISTS revision_record ON revision(kind, record_id)`,
+	}},
+
+	// the DKIM keys of the domains
+	{Description: "dkim", Statements: []string{
+		`CREATE TABLE IF NOT EXISTS dkim_key (
+	id INTEGER PRIMARY KEY,
+	domain_id INTEGER NOT NULL,
+	selector VARCHAR(63) NOT NULL,
+	algorithm VARCHAR(20) NOT NULL,
+	private_key TEXT NOT NULL,
+	public_key TEXT NOT NULL,
+	active TINYINT(1) NOT NULL DEFAULT '1',
+	signing TINYINT(1) NOT NULL DEFAULT '0',
+	created DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	UNIQUE(domain_id, selector),
+	FOREIGN KEY (domain_id) REFERENCES domain(id) ON DELETE CASCADE
+)`,
+	}},
+
+	// the MTA-STS policies of the domains
+	{Description: "mta-sts", Statements: []string{
+		`CREATE TABLE IF NOT EXISTS mta_sts (
+	domain_id INTEGER PRIMARY KEY,
+	mode VARCHAR(10) NOT NULL DEFAULT 'none',
+	mx TEXT NOT NULL DEFAULT '',
+	max_age INTEGER NOT NULL DEFAULT '604800',
+	report_uri VARCHAR(255) NOT NULL DEFAULT '',
+	modified DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	FOREIGN KEY (domain_id) REFERENCES domain(id) ON DELETE CASCADE
+)`,
+	}},
+
+	// the recipients of the mails sent by the mailboxes
+	{Description: "send count", Statements: []string{
+		`CREATE TABLE IF NOT EXISTS send_count (
+	mailbox_id INTEGER NOT NULL,
+	period VARCHAR(4) NOT NULL,
+	start BIGINT NOT NULL,
+	count INTEGER NOT NULL DEFAULT '0',
+	PRIMARY KEY (mailbox_id, period),
+	FOREIGN KEY (mailbox_id) REFERENCES mailbox(id) ON DELETE CASCADE
+)`,
+	}},
+
+	// the addresses the mailboxes may send as
+	{Description: "send as", Statements: []string{
+		`CREATE TABLE IF NOT EXISTS send_as (
+	id INTEGER PRIMARY KEY,
+	mailbox_id INTEGER NOT NULL,
+	address VARCHAR(255) NOT NULL,
+	UNIQUE(mailbox_id, address),
+	FOREIGN KEY (mailbox_id) REFERENCES mailbox(id) ON DELETE CASCADE
+)`,
+		`DROP VIEW IF EXISTS sender_login`,
+		`CREATE VIEW sender_login AS
+	SELECT email AS address, email AS login FROM active_mailbox
+	UNION
+	SELECT s.address, m.email AS login FROM send_as s JOIN active_mailbox m ON m.id=s.mailbox_id`,
+	}},
+
+	// the postfix transport of the domains
+	{Description: "transport", Statements: []string{
+		`ALTER TABLE domain ADD COLUMN transport VARCHAR(255) NOT NULL DEFAULT ''`,
+		`DROP VIEW IF EXISTS active_transport`,
+		`CREATE VIEW active_transport AS
+	SELECT name AS domain, transport FROM active_domain WHERE transport <> ''`,
+	}},
+
+	// the BCC rules of the domains and of the mailboxes
+	{Description: "bcc", Statements: []string{
+		`CREATE TABLE IF NOT EXISTS bcc (
+	id INTEGER PRIMARY KEY,
+	domain_id INTEGER NOT NULL,
+	mailbox_id INTEGER NULL DEFAULT NULL,
+	kind VARCHAR(10) NOT NULL,
+	address VARCHAR(255) NOT NULL,
+	created DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	FOREIGN KEY (domain_id) REFERENCES domain(id) ON DELETE CASCADE,
+	FOREIGN KEY (mailbox_id) REFERENCES mailbox(id) ON DELETE CASCADE
+)`,
+		`DROP VIEW IF EXISTS sender_bcc`,
+		`CREATE VIEW sender_bcc AS
+	SELECT '@' || d.name AS address, b.address AS bcc FROM bcc b JOIN active_domain d ON d.id=b.domain_id
+	WHERE b.kind='sender' AND b.mailbox_id IS NULL
+	UNION
+	SELECT m.email AS address, b.address AS bcc FROM bcc b JOIN active_mailbox m ON m.id=b.mailbox_id
+	WHERE b.kind='sender'`,
+		`DROP VIEW IF EXISTS recipient_bcc`,
+		`CREATE VIEW recipient_bcc AS
+	SELECT '@' || d.name AS address, b.address AS bcc FROM bcc b JOIN active_domain d ON d.id=b.domain_id
+	WHERE b.kind='recipient' AND b.mailbox_id IS NULL
+	UNION
+	SELECT m.email AS address, b.address AS bcc FROM bcc b JOIN active_mailbox m ON m.id=b.mailbox_id
+	WHERE b.kind='recipient'`,
+	}},
+
+	// the access rules of the domains
+	{Description: "access rules", Statements: []string{
+		`CREATE TABLE IF NOT EXISTS access_rule (
+	id INTEGER PRIMARY KEY,
+	domain_id INTEGER NOT NULL,
+	kind VARCHAR(10) NOT NULL,
+	pattern VARCHAR(255) NOT NULL,
+	action VARCHAR(10) NOT NULL,
+	message VARCHAR(255) NOT NULL DEFAULT '',
+	created DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	UNIQUE(domain_id, kind, pattern),
+	FOREIGN KEY (domain_id) REFERENCES domain(id) ON DELETE CASCADE
+)`,
+		`DROP VIEW IF EXISTS recipient_access`,
+		`CREATE VIEW recipient_access AS
+	SELECT r.pattern, CASE WHEN r.message <> '' AND r.action <> 'OK' THEN r.action || ' ' || r.message ELSE r.action END AS result
+	FROM access_rule r JOIN active_domain d ON d.id=r.domain_id WHERE r.kind='recipient'`,
+	}},
+
+	// the expiry of the aliases, the expired ones leave the view
+	{Description: "alias expiry", Statements: []string{
+		`ALTER TABLE alias ADD COLUMN expires DATETIME NULL DEFAULT NULL`,
+		`DROP VIEW IF EXISTS active_alias`,
+		`CREATE VIEW active_alias AS
+	SELECT a.* FROM alias a JOIN active_domain d ON d.id=a.domain_id
+	WHERE a.active AND a.deleted IS NULL
+	AND (a.expires IS NULL OR a.expires > CURRENT_TIMESTAMP)`,
+	}},
+
+	// the password reset through a recovery address
+	{Description: "password reset", Statements: []string{
+		`ALTER TABLE mailbox ADD COLUMN recovery VARCHAR(255) NOT NULL DEFAULT ''`,
+		`CREATE TABLE IF NOT EXISTS reset_token (
+	id INTEGER PRIMARY KEY,
+	mailbox_id INTEGER NOT NULL,
+	hash VARCHAR(64) NOT NULL UNIQUE,
+	created DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	expires DATETIME NOT NULL,
+	used DATETIME NULL DEFAULT NULL,
+	FOREIGN KEY (mailbox_id) REFERENCES mailbox(id) ON DELETE CASCADE
+)`,
+	}},
+}
+
+// Migrate upgrades the tables to the last schema.
+func Migrate(database *db.Database) (int, error) {
+	return database.Migrate("types", migrations)
+}
@@ -0,0 +1,83 @@
+package types
+
+import (
+	"database/sql"
+	"strings"
+	"time"
+
+	"github.com/funnydog/mailadmin/core/db"
+)
+
+// MTASTS holds the MTA-STS policy of a domain and the address where
+// the senders send their TLS reports. MX lists the names the policy
+// allows, wildcards like *.example.com included.
+type MTASTS struct {
+	Domain    sql.NullInt64
+	Mode      string
+	MX        []string
+	MaxAge    int64
+	ReportURI string
+	Modified  time.Time
+}
+
+const mtastsColumns = `domain_id, mode, mx, max_age, report_uri, modified`
+
+func (p *MTASTS) scan(s scanner) error {
+	var mx string
+	err := s.Scan(
+		&p.Domain,
+		&p.Mode,
+		&mx,
+		&p.MaxAge,
+		&p.ReportURI,
+		&p.Modified,
+	)
+	p.MX = strings.Fields(mx)
+	return err
+}
+
+func mtastsStatements(stmts map[string]string) {
+	stmts["mtastsFind"] = `SELECT ` + mtastsColumns + ` FROM mta_sts WHERE domain_id=$1`
+	stmts["mtastsSave"] = `INSERT INTO mta_sts(` + mtastsColumns + `) VALUES ($1, $2, $3, $4, $5, $6)
+ON CONFLICT(domain_id) DO UPDATE SET mode=excluded.mode, mx=excluded.mx, max_age=excluded.max_age, report_uri=excluded.report_uri, modified=excluded.modified`
+}
+
+// Save creates or replaces the policy of the domain, the modification
+// time is the id of the policy published in the DNS.
+func (p *MTASTS) Save(db db.Querier) error {
+	p.Modified = time.Now()
+	return p.Restore(db)
+}
+
+// Restore saves the policy keeping its modification time, so that the
+// id published in the DNS stays valid.
+func (p *MTASTS) Restore(db db.Querier) error {
+	stmt, err := db.FindStatement("mtastsSave")
+	if err != nil {
+		return err
+	}
+
+	_, err = stmt.Exec(
+		p.Domain,
+		p.Mode,
+		strings.Join(p.MX, "\n"),
+		p.MaxAge,
+		p.ReportURI,
+		p.Modified,
+	)
+	return err
+}
+
+// GetMTASTS returns the policy of the domain, sql.ErrNoRows if it has
+// never been configured.
+func GetMTASTS(db db.Querier, domain_id int64) (MTASTS, error) {
+	p := MTASTS{}
+
+	stmt, err := db.FindStatement("mtastsFind")
+	if err != nil {
+		return p, err
+	}
+
+	err = p.scan(stmt.QueryRow(domain_id))
+	return p, err
+}
@@ -0,0 +1,185 @@
+package types
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+const (
+	DefaultPerPage = 25
+	MaxPerPage     = 200
+)
+
+// Pager holds the search, sort and pagination parameters of a list
+// page. Total is filled by the Get*Page functions.
+type Pager struct {
+	Search  string
+	Sort    string
+	Desc    bool
+	Page    int
+	PerPage int
+	Total   int64
+}
+
+// sortColumns maps the sort keys accepted from the query string to the
+// column names of each table, the first one is the default.
+var sortColumns = map[string][]string{
+	"domain":  {"name", "active", "backupmx", "modified"},
+	"mailbox": {"email", "active", "modified"},
+	"alias":   {"destination", "redirect_to", "active", "modified"},
+}
+
+// CreatePager reads the pager parameters from the query string.
+func CreatePager(values url.Values) Pager {
+	p := Pager{
+		Search: strings.TrimSpace(values.Get("q")),
+		Sort:   values.Get("sort"),
+		Desc:   values.Get("order") == "desc",
+	}
+	p.Page, _ = strconv.Atoi(values.Get("page"))
+	p.PerPage, _ = strconv.Atoi(values.Get("perpage"))
+	return p
+}
+
+func (p *Pager) normalizeRange() {
+	if p.Page < 1 {
+		p.Page = 1
+	}
+	if p.PerPage < 1 {
+		p.PerPage = DefaultPerPage
+	} else if p.PerPage > MaxPerPage {
+		p.PerPage = MaxPerPage
+	}
+}
+
+// normalize fixes the out of range values and replaces an unknown sort
+// key with the default one of the table.
+func (p *Pager) normalize(table string) {
+	p.normalizeRange()
+
+	columns := sortColumns[table]
+	for _, c := range columns {
+		if c == p.Sort {
+			return
+		}
+	}
+	p.Sort = columns[0]
+}
+
+func (p *Pager) statement(table string) string {
+	order := "asc"
+	if p.Desc {
+		order = "desc"
+	}
+	return fmt.Sprintf("%sPage:%s:%s", table, p.Sort, order)
+}
+
+// Window sets the Total to n and returns the bounds of the current
+// page in a list of n items sorted outside the database.
+func (p *Pager) Window(n int) (int, int) {
+	p.normalizeRange()
+	p.Total = int64(n)
+
+	start := p.offset()
+	if start > n {
+		start = n
+	}
+	end := start + p.PerPage
+	if end > n {
+		end = n
+	}
+	return start, end
+}
+
+func (p *Pager) offset() int {
+	return (p.Page - 1) * p.PerPage
+}
+
+func (p *Pager) pattern() string {
+	return likePattern(p.Search)
+}
+
+// likePattern returns the search string as a case insensitive LIKE
+// pattern escaping the wildcards typed by the user.
+func likePattern(search string) string {
+	s := strings.ToLower(search)
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	s = strings.ReplaceAll(s, "%", `\%`)
+	s = strings.ReplaceAll(s, "_", `\_`)
+	return "%" + s + "%"
+}
+
+func (p *Pager) Pages() int {
+	if p.Total == 0 || p.PerPage == 0 {
+		return 1
+	}
+	return int((p.Total + int64(p.PerPage) - 1) / int64(p.PerPage))
+}
+
+func (p *Pager) HasPrev() bool {
+	return p.Page > 1
+}
+
+func (p *Pager) HasNext() bool {
+	return p.Page < p.Pages()
+}
+
+func (p *Pager) PrevPage() int {
+	return p.Page - 1
+}
+
+func (p *Pager) NextPage() int {
+	return p.Page + 1
+}
+
+func (p *Pager) values(page int, sort string, desc bool) string {
+	v := url.Values{}
+	if p.Search != "" {
+		v.Set("q", p.Search)
+	}
+	v.Set("sort", sort)
+	if desc {
+		v.Set("order", "desc")
+	}
+	if p.PerPage != DefaultPerPage {
+		v.Set("perpage", strconv.Itoa(p.PerPage))
+	}
+	if page > 1 {
+		v.Set("page", strconv.Itoa(page))
+	}
+	return "?" + v.Encode()
+}
+
+// PageQuery returns the query string for another page of the list.
+func (p *Pager) PageQuery(page int) string {
+	return p.values(page, p.Sort, p.Desc)
+}
+
+// SortQuery returns the query string to sort the list by column,
+// toggling the direction if the list is already sorted by it.
+func (p *Pager) SortQuery(column string) string {
+	return p.values(1, column, column == p.Sort && !p.Desc)
+}
+
+// SortMark returns an arrow if the list is sorted by column.
+func (p *Pager) SortMark(column string) string {
+	if column != p.Sort {
+		return ""
+	} else if p.Desc {
+		return "▼"
+	}
+	return "▲"
+}
+
+// pageStatements builds the paginated select for every sort column and
+// direction of the table.
+func pageStatements(stmts map[string]string, table, query, tiebreak string) {
+	for _, column := range sortColumns[table] {
+		for _, order := range []string{"asc", "desc"} {
+			p := Pager{Sort: column, Desc: order == "desc"}
+			stmts[p.statement(table)] = fmt.Sprintf(query, column+" "+order+", "+tiebreak)
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package types
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"time"
+
+	"github.com/funnydog/mailadmin/core/db"
+)
+
+// ResetLifetime is how long a password reset link works.
+const ResetLifetime = time.Hour
+
+// ResetCooldown is how long a mailbox waits before a new link, so the
+// public form can't flood the recovery address.
+const ResetCooldown = 5 * time.Minute
+
+var (
+	ErrInvalidToken  = errors.New("The link is invalid, expired or has already been used")
+	ErrResetCooldown = errors.New("A link has already been sent in the last minutes")
+)
+
+// ResetToken allows to change the password of a mailbox once before it
+// expires. The token itself is only in the link sent to the recovery
+// address, the database keeps its SHA-256 hash.
+type ResetToken struct {
+	Id      sql.NullInt64
+	Mailbox sql.NullInt64
+	Created time.Time
+	Expires time.Time
+	Used    sql.NullTime
+}
+
+func resetStatements(stmts map[string]string) {
+	stmts["resetCreate"] = `INSERT INTO reset_token(mailbox_id, hash, created, expires) VALUES ($1, $2, $3, $4)`
+	stmts["resetFind"] = `SELECT id, mailbox_id, created, expires, used FROM reset_token WHERE hash=$1 AND used IS NULL AND expires > $2`
+	stmts["resetUse"] = `UPDATE reset_token SET used=$1 WHERE id=$2 AND used IS NULL`
+	stmts["resetRecent"] = `SELECT COUNT(*) FROM reset_token WHERE mailbox_id=$1 AND used IS NULL AND expires > $2 AND created > $3`
+
+	// a new link replaces the ones sent before
+	stmts["resetRevoke"] = `DELETE FROM reset_token WHERE mailbox_id=$1 AND used IS NULL`
+	stmts["resetPurge"] = `DELETE FROM reset_token WHERE expires < $1`
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// NewResetToken returns a new token of the mailbox revoking the unused
+// ones, the expired tokens of every mailbox are deleted. It returns
+// ErrResetCooldown if a valid token is younger than ResetCooldown. Run
+// it in a transaction.
+func NewResetToken(db db.Querier, mailbox_id int64, now time.Time) (string, error) {
+	now = now.UTC()
+	stmt, err := db.FindStatement("resetRecent")
+	if err != nil {
+		return "", err
+	}
+	var recent int64
+	if err = stmt.QueryRow(mailbox_id, now, now.Add(-ResetCooldown)).Scan(&recent); err != nil {
+		return "", err
+	} else if recent > 0 {
+		return "", ErrResetCooldown
+	}
+
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(b)
+
+	for _, exec := range []struct {
+		key  string
+		args []interface{}
+	}{
+		{"resetPurge", []interface{}{now}},
+		{"resetRevoke", []interface{}{mailbox_id}},
+		{"resetCreate", []interface{}{mailbox_id, hashToken(token), now, now.Add(ResetLifetime)}},
+	} {
+		stmt, err := db.FindStatement(exec.key)
+		if err != nil {
+			return "", err
+		}
+		if _, err = stmt.Exec(exec.args...); err != nil {
+			return "", err
+		}
+	}
+	return token, nil
+}
+
+// GetResetToken returns the token if it is valid at the given time,
+// ErrInvalidToken otherwise.
+func GetResetToken(db db.Querier, token string, now time.Time) (ResetToken, error) {
+	t := ResetToken{}
+
+	stmt, err := db.FindStatement("resetFind")
+	if err != nil {
+		return t, err
+	}
+
+	err = stmt.QueryRow(hashToken(token), now.UTC()).Scan(&t.Id, &t.Mailbox, &t.Created, &t.Expires, &t.Used)
+	if err == sql.ErrNoRows {
+		err = ErrInvalidToken
+	}
+	return t, err
+}
+
+// Use marks the token as used, ErrInvalidToken if it already was.
+func (t *ResetToken) Use(db db.Querier, now time.Time) error {
+	stmt, err := db.FindStatement("resetUse")
+	if err != nil {
+		return err
+	}
+
+	t.Used = sql.NullTime{Time: now.UTC(), Valid: true}
+	result, err := stmt.Exec(t.Used, t.Id)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrInvalidToken
+	}
+	return nil
+}
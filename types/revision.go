@@ -0,0 +1,218 @@
+package types
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/funnydog/mailadmin/core/db"
+)
+
+// kinds of the records with a history
+const (
+	RevisionMailbox = "mailbox"
+	RevisionAlias   = "alias"
+)
+
+// Revision is a previous version of a record, stored as JSON by the
+// Update methods before changing it.
+type Revision struct {
+	Id      sql.NullInt64
+	Kind    string
+	Record  int64
+	Data    string
+	Created time.Time
+}
+
+// MailboxVersion holds the fields of a mailbox kept in its history.
+type MailboxVersion struct {
+	Email    string `json:"email"`
+	Password string `json:"password"`
+	Active   bool   `json:"active"`
+}
+
+// AliasVersion holds the fields of an alias kept in its history.
+type AliasVersion struct {
+	Destination string `json:"destination"`
+	RedirectTo  string `json:"redirect_to"`
+	Active      bool   `json:"active"`
+}
+
+// Change is a field which differs between two versions.
+type Change struct {
+	Field string
+	Old   string
+	New   string
+}
+
+func (mailbox *Mailbox) Version() MailboxVersion {
+	return MailboxVersion{
+		Email:    mailbox.Email,
+		Password: mailbox.Password,
+		Active:   mailbox.Active,
+	}
+}
+
+func (alias *Alias) Version() AliasVersion {
+	return AliasVersion{
+		Destination: alias.Destination,
+		RedirectTo:  alias.RedirectTo,
+		Active:      alias.Active,
+	}
+}
+
+func (rev *Revision) scan(s scanner) error {
+	return s.Scan(
+		&rev.Id,
+		&rev.Kind,
+		&rev.Record,
+		&rev.Data,
+		&rev.Created,
+	)
+}
+
+func (rev *Revision) Mailbox() (MailboxVersion, error) {
+	version := MailboxVersion{}
+	if rev.Kind != RevisionMailbox {
+		return version, fmt.Errorf("The revision %d is not of a mailbox", rev.Id.Int64)
+	}
+	err := json.Unmarshal([]byte(rev.Data), &version)
+	return version, err
+}
+
+func (rev *Revision) Alias() (AliasVersion, error) {
+	version := AliasVersion{}
+	if rev.Kind != RevisionAlias {
+		return version, fmt.Errorf("The revision %d is not of an alias", rev.Id.Int64)
+	}
+	err := json.Unmarshal([]byte(rev.Data), &version)
+	return version, err
+}
+
+func yesNo(value bool) string {
+	if value {
+		return "Yes"
+	}
+	return "No"
+}
+
+// DiffMailbox lists the fields changed from old to new, the password
+// hashes are not shown.
+func DiffMailbox(old, new MailboxVersion) []Change {
+	changes := []Change{}
+	if old.Email != new.Email {
+		changes = append(changes, Change{"Address", old.Email, new.Email})
+	}
+	if old.Password != new.Password {
+		changes = append(changes, Change{"Password", "", "changed"})
+	}
+	if old.Active != new.Active {
+		changes = append(changes, Change{"Active", yesNo(old.Active), yesNo(new.Active)})
+	}
+	return changes
+}
+
+// DiffAlias lists the fields changed from old to new.
+func DiffAlias(old, new AliasVersion) []Change {
+	changes := []Change{}
+	if old.Destination != new.Destination {
+		changes = append(changes, Change{"Destination", old.Destination, new.Destination})
+	}
+	if old.RedirectTo != new.RedirectTo {
+		changes = append(changes, Change{"Redirect to", old.RedirectTo, new.RedirectTo})
+	}
+	if old.Active != new.Active {
+		changes = append(changes, Change{"Active", yesNo(old.Active), yesNo(new.Active)})
+	}
+	return changes
+}
+
+func revisionStatements(stmts map[string]string) {
+	stmts["revisionCreate"] = `INSERT INTO revision(kind, record_id, data, created) VALUES ($1, $2, $3, $4)`
+	stmts["revisionList"] = `SELECT id, kind, record_id, data, created FROM revision WHERE kind=$1 AND record_id=$2 ORDER BY id DESC`
+	stmts["revisionFind"] = `SELECT id, kind, record_id, data, created FROM revision WHERE id=$1`
+
+	// the history of the purged records
+	stmts["revisionPurge"] = `DELETE FROM revision WHERE
+(kind='mailbox' AND record_id NOT IN (SELECT id FROM mailbox)) OR
+(kind='alias' AND record_id NOT IN (SELECT id FROM alias))`
+}
+
+// saveRevision stores version as a revision of the record unless it's
+// equal to current.
+func saveRevision(db db.Querier, kind string, record int64, version, current interface{}) error {
+	data, err := json.Marshal(version)
+	if err != nil {
+		return err
+	}
+
+	if same, err := json.Marshal(current); err != nil {
+		return err
+	} else if string(same) == string(data) {
+		return nil
+	}
+
+	stmt, err := db.FindStatement("revisionCreate")
+	if err != nil {
+		return err
+	}
+
+	_, err = stmt.Exec(kind, record, string(data), time.Now())
+	return err
+}
+
+// GetRevisions returns the history of a record, the newest first.
+func GetRevisions(db db.Querier, kind string, record int64) ([]Revision, error) {
+	revisions := []Revision{}
+
+	stmt, err := db.FindStatement("revisionList")
+	if err != nil {
+		return revisions, err
+	}
+
+	rows, err := stmt.Query(kind, record)
+	if err != nil {
+		return revisions, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		rev := Revision{}
+		if err := rev.scan(rows); err != nil {
+			return revisions, err
+		}
+		revisions = append(revisions, rev)
+	}
+	return revisions, rows.Err()
+}
+
+// GetRevisionById returns the revision PK of the given record.
+func GetRevisionById(db db.Querier, kind string, record, PK int64) (Revision, error) {
+	rev := Revision{}
+
+	stmt, err := db.FindStatement("revisionFind")
+	if err != nil {
+		return rev, err
+	}
+
+	if err = rev.scan(stmt.QueryRow(PK)); err != nil {
+		return rev, err
+	}
+
+	if rev.Kind != kind || rev.Record != record {
+		return rev, sql.ErrNoRows
+	}
+	return rev, nil
+}
+
+// purgeRevisions deletes the history of the records no longer present.
+func purgeRevisions(db db.Querier) error {
+	stmt, err := db.FindStatement("revisionPurge")
+	if err != nil {
+		return err
+	}
+
+	_, err = stmt.Exec()
+	return err
+}
@@ -0,0 +1,69 @@
+package types
+
+import "github.com/funnydog/mailadmin/core/db"
+
+// SearchResult holds the records of every domain matching a global
+// search.
+type SearchResult struct {
+	Domains   []Domain
+	Mailboxes []Mailbox
+	Aliases   []Alias
+}
+
+func (r *SearchResult) Count() int {
+	return len(r.Domains) + len(r.Mailboxes) + len(r.Aliases)
+}
+
+// Search looks for the domains, mailboxes and aliases containing the
+// search string, returning at most limit records for each kind.
+func Search(db db.Querier, search string, limit int) (SearchResult, error) {
+	result := SearchResult{
+		Domains:   []Domain{},
+		Mailboxes: []Mailbox{},
+		Aliases:   []Alias{},
+	}
+	pattern := likePattern(search)
+
+	stmt, err := db.FindStatement("domainSearch")
+	if err != nil {
+		return result, err
+	}
+
+	rows, err := stmt.Query(pattern, limit)
+	if err != nil {
+		return result, err
+	}
+	result.Domains, err = scanDomains(rows)
+	rows.Close()
+	if err != nil {
+		return result, err
+	}
+
+	stmt, err = db.FindStatement("mailboxSearch")
+	if err != nil {
+		return result, err
+	}
+
+	rows, err = stmt.Query(pattern, limit)
+	if err != nil {
+		return result, err
+	}
+	result.Mailboxes, err = scanMailboxes(rows)
+	rows.Close()
+	if err != nil {
+		return result, err
+	}
+
+	stmt, err = db.FindStatement("aliasSearch")
+	if err != nil {
+		return result, err
+	}
+
+	rows, err = stmt.Query(pattern, limit)
+	if err != nil {
+		return result, err
+	}
+	result.Aliases, err = scanAliases(rows)
+	rows.Close()
+	return result, err
+}
@@ -0,0 +1,131 @@
+package types
+
+import (
+	"database/sql"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/funnydog/mailadmin/core/db"
+)
+
+var sendAsRe = regexp.MustCompile(`^([^@\s]+)?@[a-z0-9.-]+\.[a-z]{2,63}$`)
+
+type ErrInvalidSendAs string
+
+func (is ErrInvalidSendAs) Error() string {
+	return fmt.Sprintf("'%s' is neither an address nor @domain", string(is))
+}
+
+type ErrSendAsNotHosted string
+
+func (nh ErrSendAsNotHosted) Error() string {
+	return fmt.Sprintf("The domain of '%s' is not managed here", string(nh))
+}
+
+// SenderLogin is an entry of the postfix smtpd_sender_login_maps: the
+// mailbox signed in as Login may send as Address.
+type SenderLogin struct {
+	Address string
+	Login   string
+}
+
+func sendAsStatements(stmts map[string]string) {
+	stmts["sendAsList"] = `SELECT address FROM send_as WHERE mailbox_id=$1 ORDER BY address`
+	stmts["sendAsCreate"] = `INSERT INTO send_as(mailbox_id, address) VALUES ($1, $2)`
+	stmts["sendAsClear"] = `DELETE FROM send_as WHERE mailbox_id=$1`
+	stmts["senderLoginList"] = `SELECT address, login FROM sender_login ORDER BY address, login`
+}
+
+// ValidSendAs checks that the mailboxes may be granted the address, an
+// email or @domain for the whole domain, of one of the domains.
+func ValidSendAs(db db.Querier, address string) error {
+	if !sendAsRe.MatchString(address) {
+		return ErrInvalidSendAs(address)
+	}
+
+	_, err := GetDomainByName(db, address[strings.LastIndex(address, "@")+1:])
+	if err == sql.ErrNoRows {
+		return ErrSendAsNotHosted(address)
+	}
+	return err
+}
+
+// GetSendAs returns the addresses the mailbox may send as besides its
+// own, sorted.
+func GetSendAs(db db.Querier, mailbox_id int64) ([]string, error) {
+	stmt, err := db.FindStatement("sendAsList")
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := stmt.Query(mailbox_id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	addresses := []string{}
+	for rows.Next() {
+		var address string
+		if err = rows.Scan(&address); err != nil {
+			return addresses, err
+		}
+		addresses = append(addresses, address)
+	}
+	return addresses, rows.Err()
+}
+
+// SetSendAs replaces the addresses the mailbox may send as, run it in
+// a transaction.
+func SetSendAs(db db.Querier, mailbox_id int64, addresses []string) error {
+	stmt, err := db.FindStatement("sendAsClear")
+	if err != nil {
+		return err
+	}
+	if _, err = stmt.Exec(mailbox_id); err != nil {
+		return err
+	}
+
+	stmt, err = db.FindStatement("sendAsCreate")
+	if err != nil {
+		return err
+	}
+	seen := map[string]bool{}
+	for _, address := range addresses {
+		if seen[address] {
+			continue
+		}
+		seen[address] = true
+		if _, err = stmt.Exec(mailbox_id, address); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetSenderLogins returns the sender login map of the active
+// mailboxes, each one can send as its own address and as the ones it
+// has been granted.
+func GetSenderLogins(db db.Querier) ([]SenderLogin, error) {
+	stmt, err := db.FindStatement("senderLoginList")
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := stmt.Query()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	logins := []SenderLogin{}
+	for rows.Next() {
+		l := SenderLogin{}
+		if err = rows.Scan(&l.Address, &l.Login); err != nil {
+			return logins, err
+		}
+		logins = append(logins, l)
+	}
+	return logins, rows.Err()
+}
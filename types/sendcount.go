@@ -0,0 +1,70 @@
+package types
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/funnydog/mailadmin/core/db"
+)
+
+// periods of the send counters
+const (
+	Hourly = "hour"
+	Daily  = "day"
+)
+
+// SendCount is the number of recipients a mailbox sent mail to since
+// Start, the beginning of the current hour or day.
+type SendCount struct {
+	Mailbox sql.NullInt64
+	Period  string
+	Start   time.Time
+	Count   int64
+}
+
+func sendCountStatements(stmts map[string]string) {
+	stmts["sendCountFind"] = `SELECT start, count FROM send_count WHERE mailbox_id=$1 AND period=$2`
+
+	// the counter restarts from zero when a new period begins
+	stmts["sendCountAdd"] = `INSERT INTO send_count(mailbox_id, period, start, count) VALUES ($1, $2, $3, $4)
+ON CONFLICT(mailbox_id, period) DO UPDATE SET
+	count=CASE WHEN send_count.start=excluded.start THEN send_count.count+excluded.count ELSE excluded.count END,
+	start=excluded.start`
+}
+
+// GetSendCount returns the counter of the mailbox for the period
+// beginning at start, zero if nothing has been sent since.
+func GetSendCount(db db.Querier, mailbox_id int64, period string, start time.Time) (SendCount, error) {
+	count := SendCount{
+		Mailbox: sql.NullInt64{Int64: mailbox_id, Valid: true},
+		Period:  period,
+		Start:   start,
+	}
+
+	stmt, err := db.FindStatement("sendCountFind")
+	if err != nil {
+		return count, err
+	}
+
+	var saved int64
+	err = stmt.QueryRow(mailbox_id, period).Scan(&saved, &count.Count)
+	if err == sql.ErrNoRows || (err == nil && saved != start.Unix()) {
+		count.Count = 0
+		return count, nil
+	}
+	return count, err
+}
+
+// Add increments the counter by n saving it.
+func (count *SendCount) Add(db db.Querier, n int64) error {
+	stmt, err := db.FindStatement("sendCountAdd")
+	if err != nil {
+		return err
+	}
+
+	if _, err = stmt.Exec(count.Mailbox, count.Period, count.Start.Unix(), n); err != nil {
+		return err
+	}
+	count.Count += n
+	return nil
+}
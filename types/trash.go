@@ -0,0 +1,223 @@
+package types
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/funnydog/mailadmin/core/db"
+)
+
+// kinds of the records in the trash
+const (
+	TrashDomain  = "domain"
+	TrashMailbox = "mailbox"
+	TrashAlias   = "alias"
+)
+
+type ErrTrashKind string
+
+func (kind ErrTrashKind) Error() string {
+	return fmt.Sprintf("Unknown kind of record '%s'", string(kind))
+}
+
+// Trash holds the deleted records. The mailboxes and aliases of a
+// deleted domain are not listed, they come back with the domain.
+type Trash struct {
+	Domains   []Domain
+	Mailboxes []Mailbox
+	Aliases   []Alias
+}
+
+func (trash Trash) Count() int {
+	return len(trash.Domains) + len(trash.Mailboxes) + len(trash.Aliases)
+}
+
+func trashStatements(stmts map[string]string) {
+	for _, kind := range []string{TrashDomain, TrashMailbox, TrashAlias} {
+		stmts[kind+"Restore"] = `UPDATE ` + kind + ` SET deleted=NULL WHERE id=$1 AND deleted IS NOT NULL`
+		stmts[kind+"Purge"] = `DELETE FROM ` + kind + ` WHERE id=$1 AND deleted IS NOT NULL`
+		stmts[kind+"PurgeBefore"] = `DELETE FROM ` + kind + ` WHERE deleted < $1`
+	}
+	// an expired alias comes back without its expiry, or it would go
+	// back to the trash at once
+	stmts["aliasRestore"] = `UPDATE alias SET deleted=NULL, expires=CASE WHEN expires > CURRENT_TIMESTAMP THEN expires END WHERE id=$1 AND deleted IS NOT NULL`
+
+	// the mailboxes and aliases deleted with the domain have its marker
+	stmts["domainRestoreMailboxes"] = `UPDATE mailbox SET deleted=NULL WHERE domain_id=$1 AND deleted=(SELECT deleted FROM domain WHERE id=$1 AND deleted IS NOT NULL)`
+	stmts["domainRestoreAliases"] = `UPDATE alias SET deleted=NULL WHERE domain_id=$1 AND deleted=(SELECT deleted FROM domain WHERE id=$1 AND deleted IS NOT NULL)`
+
+	stmts["domainTrashList"] = `SELECT ` + domainColumns + ` FROM domain WHERE deleted IS NOT NULL ORDER BY deleted DESC`
+	stmts["mailboxTrashList"] = `SELECT ` + prefixColumns("m", mailboxColumns) + ` FROM mailbox m JOIN domain d ON d.id=m.domain_id WHERE m.deleted IS NOT NULL AND d.deleted IS NULL ORDER BY m.deleted DESC`
+	stmts["aliasTrashList"] = `SELECT ` + prefixColumns("a", aliasColumns) + ` FROM alias a JOIN domain d ON d.id=a.domain_id WHERE a.deleted IS NOT NULL AND d.deleted IS NULL ORDER BY a.deleted DESC`
+
+	stmts["domainTrashFind"] = `SELECT ` + domainColumns + ` FROM domain WHERE id=$1 AND deleted IS NOT NULL`
+	stmts["mailboxTrashFind"] = `SELECT ` + mailboxColumns + ` FROM mailbox WHERE id=$1 AND deleted IS NOT NULL`
+}
+
+// trashQuery runs the list statement key and passes the rows to scan.
+func trashQuery(db db.Querier, key string, scan func(rows *sql.Rows) error) error {
+	stmt, err := db.FindStatement(key)
+	if err != nil {
+		return err
+	}
+
+	rows, err := stmt.Query()
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	return scan(rows)
+}
+
+func GetTrash(db db.Querier) (Trash, error) {
+	trash := Trash{}
+
+	err := trashQuery(db, "domainTrashList", func(rows *sql.Rows) (err error) {
+		trash.Domains, err = scanDomains(rows)
+		return err
+	})
+	if err != nil {
+		return trash, err
+	}
+
+	err = trashQuery(db, "mailboxTrashList", func(rows *sql.Rows) (err error) {
+		trash.Mailboxes, err = scanMailboxes(rows)
+		return err
+	})
+	if err != nil {
+		return trash, err
+	}
+
+	err = trashQuery(db, "aliasTrashList", func(rows *sql.Rows) (err error) {
+		trash.Aliases, err = scanAliases(rows)
+		return err
+	})
+	return trash, err
+}
+
+func checkTrashKind(kind string) error {
+	switch kind {
+	case TrashDomain, TrashMailbox, TrashAlias:
+		return nil
+	}
+	return ErrTrashKind(kind)
+}
+
+// checkRestore fails if a record with the same name or email was
+// created after the one in the trash had been deleted.
+func checkRestore(db db.Querier, kind string, pk int64) error {
+	switch kind {
+	case TrashDomain:
+		stmt, err := db.FindStatement("domainTrashFind")
+		if err != nil {
+			return err
+		}
+		domain := Domain{}
+		if err = domain.scan(stmt.QueryRow(pk)); err != nil {
+			return err
+		}
+		if _, err = GetDomainByName(db, domain.Name); err == nil {
+			return fmt.Errorf("The domain %s already exists", domain.Name)
+		} else if err != sql.ErrNoRows {
+			return err
+		}
+
+	case TrashMailbox:
+		stmt, err := db.FindStatement("mailboxTrashFind")
+		if err != nil {
+			return err
+		}
+		mailbox := Mailbox{}
+		if err = mailbox.scan(stmt.QueryRow(pk)); err != nil {
+			return err
+		}
+		if _, err = GetMailboxByEmail(db, mailbox.Email); err == nil {
+			return fmt.Errorf("The mailbox %s already exists", mailbox.Email)
+		} else if err != sql.ErrNoRows {
+			return err
+		}
+	}
+	return nil
+}
+
+// execTrash runs the statement of kind on the record pk and returns
+// sql.ErrNoRows if the record is not in the trash.
+func execTrash(db db.Querier, key string, pk int64) error {
+	stmt, err := db.FindStatement(key)
+	if err != nil {
+		return err
+	}
+
+	result, err := stmt.Exec(pk)
+	if err != nil {
+		return err
+	}
+
+	if n, err := result.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// RestoreFromTrash clears the deleted marker of the record of the
+// given kind.
+func RestoreFromTrash(db db.Querier, kind string, pk int64) error {
+	if err := checkTrashKind(kind); err != nil {
+		return err
+	}
+	if err := checkRestore(db, kind, pk); err != nil {
+		return err
+	}
+	if kind == TrashDomain {
+		for _, key := range []string{"domainRestoreMailboxes", "domainRestoreAliases"} {
+			stmt, err := db.FindStatement(key)
+			if err != nil {
+				return err
+			}
+			if _, err = stmt.Exec(pk); err != nil {
+				return err
+			}
+		}
+	}
+	return execTrash(db, kind+"Restore", pk)
+}
+
+// PurgeFromTrash deletes permanently the record of the given kind,
+// the mailboxes and aliases of a domain are deleted with it.
+func PurgeFromTrash(db db.Querier, kind string, pk int64) error {
+	if err := checkTrashKind(kind); err != nil {
+		return err
+	}
+	if err := execTrash(db, kind+"Purge", pk); err != nil {
+		return err
+	}
+	return purgeRevisions(db)
+}
+
+// PurgeTrash deletes permanently the records moved to the trash before
+// the given time and returns how many were deleted.
+func PurgeTrash(db db.Querier, before time.Time) (int64, error) {
+	total := int64(0)
+	for _, kind := range []string{TrashAlias, TrashMailbox, TrashDomain} {
+		stmt, err := db.FindStatement(kind + "PurgeBefore")
+		if err != nil {
+			return total, err
+		}
+
+		result, err := stmt.Exec(before)
+		if err != nil {
+			return total, err
+		}
+
+		n, err := result.RowsAffected()
+		if err != nil {
+			return total, err
+		}
+		total += n
+	}
+	return total, purgeRevisions(db)
+}
@@ -2,22 +2,65 @@ package types
 
 import (
 	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
 	"time"
 
+	"golang.org/x/crypto/bcrypt"
+
 	"github.com/funnydog/mailadmin/core/db"
 )
 
+// bcrypt ignores the bytes after the 72nd one
+const MaxPasswordLength = 72
+
+var ErrPasswordTooLong = errors.New("The password is longer than 72 bytes.")
+
+// scanner is implemented by both *sql.Row and *sql.Rows.
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
 type Domain struct {
 	Id          sql.NullInt64
 	Name        string
 	Description string
 	BackupMX    bool
+	Transport   string
 	Active      bool
 	Created     time.Time
 	Modified    time.Time
+	Deleted     sql.NullTime
 }
 
-func (domain *Domain) Create(db *db.Database) error {
+func (domain *Domain) scan(s scanner) error {
+	return s.Scan(
+		&domain.Id,
+		&domain.Name,
+		&domain.Description,
+		&domain.BackupMX,
+		&domain.Transport,
+		&domain.Active,
+		&domain.Created,
+		&domain.Modified,
+		&domain.Deleted,
+	)
+}
+
+func scanDomains(rows *sql.Rows) ([]Domain, error) {
+	domains := []Domain{}
+	for rows.Next() {
+		t := Domain{}
+		if err := t.scan(rows); err != nil {
+			return domains, err
+		}
+		domains = append(domains, t)
+	}
+	return domains, rows.Err()
+}
+
+func (domain *Domain) Create(db db.Querier) error {
 	stmt, err := db.FindStatement("domainCreate")
 	if err != nil {
 		return err
@@ -30,6 +73,7 @@ func (domain *Domain) Create(db *db.Database) error {
 		domain.Name,
 		domain.Description,
 		domain.BackupMX,
+		domain.Transport,
 		domain.Active,
 		domain.Created,
 		domain.Modified,
@@ -46,7 +90,7 @@ func (domain *Domain) Create(db *db.Database) error {
 	return nil
 }
 
-func (domain *Domain) Update(db *db.Database) error {
+func (domain *Domain) Update(db db.Querier) error {
 	stmt, err := db.FindStatement("domainUpdate")
 	if err != nil {
 		return err
@@ -58,6 +102,7 @@ func (domain *Domain) Update(db *db.Database) error {
 		domain.Name,
 		domain.Description,
 		domain.BackupMX,
+		domain.Transport,
 		domain.Active,
 		domain.Modified,
 		domain.Id,
@@ -66,17 +111,24 @@ func (domain *Domain) Update(db *db.Database) error {
 	return err
 }
 
-func (domain *Domain) Delete(db *db.Database) error {
-	stmt, err := db.FindStatement("domainDelete")
-	if err != nil {
-		return err
+// Delete moves the domain to the trash along with its mailboxes and
+// aliases, which take the same deleted marker to come back with the
+// domain. See PurgeFromTrash to delete it permanently.
+func (domain *Domain) Delete(db db.Querier) error {
+	domain.Deleted = sql.NullTime{Time: time.Now(), Valid: true}
+	for _, key := range []string{"domainDeleteAliases", "domainDeleteMailboxes", "domainDelete"} {
+		stmt, err := db.FindStatement(key)
+		if err != nil {
+			return err
+		}
+		if _, err = stmt.Exec(domain.Deleted, domain.Id.Int64); err != nil {
+			return err
+		}
 	}
-
-	_, err = stmt.Exec(domain.Id.Int64)
-	return err
+	return nil
 }
 
-func GetDomainList(db *db.Database) ([]Domain, error) {
+func GetDomainList(db db.Querier) ([]Domain, error) {
 	domains := []Domain{}
 
 	stmt, err := db.FindStatement("domainList")
@@ -90,27 +142,73 @@ func GetDomainList(db *db.Database) ([]Domain, error) {
 	}
 	defer rows.Close()
 
-	for rows.Next() {
-		t := Domain{}
-		err := rows.Scan(
-			&t.Id,
-			&t.Name,
-			&t.Description,
-			&t.BackupMX,
-			&t.Active,
-			&t.Created,
-			&t.Modified,
-		)
-		if err != nil {
-			return domains, err
-		}
+	return scanDomains(rows)
+}
 
-		domains = append(domains, t)
+// GetDomainPage returns the domains matching the search of the pager
+// and sets its Total to the number of matches.
+func GetDomainPage(db db.Querier, pager *Pager) ([]Domain, error) {
+	domains := []Domain{}
+	pager.normalize("domain")
+
+	stmt, err := db.FindStatement("domainCount")
+	if err != nil {
+		return domains, err
 	}
-	return domains, rows.Err()
+
+	err = stmt.QueryRow(pager.pattern()).Scan(&pager.Total)
+	if err != nil {
+		return domains, err
+	}
+
+	stmt, err = db.FindStatement(pager.statement("domain"))
+	if err != nil {
+		return domains, err
+	}
+
+	rows, err := stmt.Query(pager.pattern(), pager.PerPage, pager.offset())
+	if err != nil {
+		return domains, err
+	}
+	defer rows.Close()
+
+	return scanDomains(rows)
 }
 
-func GetDomainById(db *db.Database, PK int64) (Domain, error) {
+// Contains reports whether the address belongs to the domain.
+func (domain *Domain) Contains(address string) bool {
+	return strings.HasSuffix(address, "@"+domain.Name)
+}
+
+func GetDomainByName(db db.Querier, name string) (Domain, error) {
+	t := Domain{}
+
+	stmt, err := db.FindStatement("domainFindByName")
+	if err != nil {
+		return t, err
+	}
+
+	err = t.scan(stmt.QueryRow(name))
+	return t, err
+}
+
+// GetActiveDomains returns the active domains.
+func GetActiveDomains(db db.Querier) ([]Domain, error) {
+	stmt, err := db.FindStatement("domainActiveList")
+	if err != nil {
+		return []Domain{}, err
+	}
+
+	rows, err := stmt.Query()
+	if err != nil {
+		return []Domain{}, err
+	}
+	defer rows.Close()
+
+	return scanDomains(rows)
+}
+
+func GetDomainById(db db.Querier, PK int64) (Domain, error) {
 	t := Domain{}
 
 	stmt, err := db.FindStatement("domainFind")
@@ -118,15 +216,7 @@ func GetDomainById(db *db.Database, PK int64) (Domain, error) {
 		return t, err
 	}
 
-	err = stmt.QueryRow(PK).Scan(
-		&t.Id,
-		&t.Name,
-		&t.Description,
-		&t.BackupMX,
-		&t.Active,
-		&t.Created,
-		&t.Modified,
-	)
+	err = t.scan(stmt.QueryRow(PK))
 	return t, err
 }
 
@@ -135,12 +225,54 @@ type Mailbox struct {
 	Domain   sql.NullInt64
 	Email    string
 	Password string
+	Recovery string
 	Created  time.Time
 	Modified time.Time
 	Active   bool
+	Deleted  sql.NullTime
+}
+
+func (mailbox *Mailbox) scan(s scanner) error {
+	return s.Scan(
+		&mailbox.Id,
+		&mailbox.Domain,
+		&mailbox.Email,
+		&mailbox.Password,
+		&mailbox.Recovery,
+		&mailbox.Active,
+		&mailbox.Created,
+		&mailbox.Modified,
+		&mailbox.Deleted,
+	)
 }
 
-func (mailbox *Mailbox) Create(db *db.Database) error {
+func scanMailboxes(rows *sql.Rows) ([]Mailbox, error) {
+	mailboxes := []Mailbox{}
+	for rows.Next() {
+		t := Mailbox{}
+		if err := t.scan(rows); err != nil {
+			return mailboxes, err
+		}
+		mailboxes = append(mailboxes, t)
+	}
+	return mailboxes, rows.Err()
+}
+
+// SetPassword stores the bcrypt hash of the password.
+func (mailbox *Mailbox) SetPassword(password string) error {
+	if len(password) > MaxPasswordLength {
+		return ErrPasswordTooLong
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	mailbox.Password = string(hash)
+	return nil
+}
+
+func (mailbox *Mailbox) Create(db db.Querier) error {
 	stmt, err := db.FindStatement("mailboxCreate")
 	if err != nil {
 		return err
@@ -153,6 +285,7 @@ func (mailbox *Mailbox) Create(db *db.Database) error {
 		mailbox.Domain,
 		mailbox.Email,
 		mailbox.Password,
+		mailbox.Recovery,
 		mailbox.Active,
 		mailbox.Created,
 		mailbox.Modified,
@@ -169,18 +302,30 @@ func (mailbox *Mailbox) Create(db *db.Database) error {
 	return nil
 }
 
-func (mailbox *Mailbox) Update(db *db.Database) error {
+// Update stores the previous version of the mailbox in its history before
+// changing it.
+func (mailbox *Mailbox) Update(db db.Querier) error {
 	stmt, err := db.FindStatement("mailboxUpdate")
 	if err != nil {
 		return err
 	}
 
+	if old, err := GetMailboxById(db, mailbox.Id.Int64); err == nil {
+		err = saveRevision(db, RevisionMailbox, mailbox.Id.Int64, old.Version(), mailbox.Version())
+		if err != nil {
+			return err
+		}
+	} else if err != sql.ErrNoRows {
+		return err
+	}
+
 	mailbox.Modified = time.Now()
 
 	_, err = stmt.Exec(
 		mailbox.Domain,
 		mailbox.Email,
 		mailbox.Password,
+		mailbox.Recovery,
 		mailbox.Active,
 		mailbox.Modified,
 		mailbox.Id,
@@ -189,17 +334,20 @@ func (mailbox *Mailbox) Update(db *db.Database) error {
 	return err
 }
 
-func (mailbox Mailbox) Delete(db *db.Database) error {
+// Delete moves the mailbox to the trash, see PurgeFromTrash to delete
+// it permanently.
+func (mailbox *Mailbox) Delete(db db.Querier) error {
 	stmt, err := db.FindStatement("mailboxDelete")
 	if err != nil {
 		return err
 	}
 
-	_, err = stmt.Exec(mailbox.Id.Int64)
+	mailbox.Deleted = sql.NullTime{Time: time.Now(), Valid: true}
+	_, err = stmt.Exec(mailbox.Deleted, mailbox.Id.Int64)
 	return err
 }
 
-func GetMailboxList(db *db.Database, domain_id int64) ([]Mailbox, error) {
+func GetMailboxList(db db.Querier, domain_id int64) ([]Mailbox, error) {
 	mailboxes := []Mailbox{}
 
 	stmt, err := db.FindStatement("mailboxList")
@@ -213,27 +361,86 @@ func GetMailboxList(db *db.Database, domain_id int64) ([]Mailbox, error) {
 	}
 	defer rows.Close()
 
-	for rows.Next() {
-		t := Mailbox{}
-		err := rows.Scan(
-			&t.Id,
-			&t.Domain,
-			&t.Email,
-			&t.Password,
-			&t.Active,
-			&t.Created,
-			&t.Modified,
-		)
-		if err != nil {
-			return mailboxes, err
-		}
+	return scanMailboxes(rows)
+}
 
-		mailboxes = append(mailboxes, t)
+// GetMailboxPage returns the mailboxes matching the search of the pager
+// and sets its Total to the number of matches.
+func GetMailboxPage(db db.Querier, domain_id int64, pager *Pager) ([]Mailbox, error) {
+	mailboxes := []Mailbox{}
+	pager.normalize("mailbox")
+
+	stmt, err := db.FindStatement("mailboxCount")
+	if err != nil {
+		return mailboxes, err
 	}
-	return mailboxes, rows.Err()
+
+	err = stmt.QueryRow(domain_id, pager.pattern()).Scan(&pager.Total)
+	if err != nil {
+		return mailboxes, err
+	}
+
+	stmt, err = db.FindStatement(pager.statement("mailbox"))
+	if err != nil {
+		return mailboxes, err
+	}
+
+	rows, err := stmt.Query(domain_id, pager.pattern(), pager.PerPage, pager.offset())
+	if err != nil {
+		return mailboxes, err
+	}
+	defer rows.Close()
+
+	return scanMailboxes(rows)
+}
+
+// GetMailboxMatches returns all the mailboxes of the domain matching
+// the search, for the lists sorted outside the database.
+func GetMailboxMatches(db db.Querier, domain_id int64, search string) ([]Mailbox, error) {
+	stmt, err := db.FindStatement("mailboxMatches")
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := stmt.Query(domain_id, likePattern(search))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return scanMailboxes(rows)
+}
+
+// GetActiveMailboxes returns the active mailboxes of the active
+// domains.
+func GetActiveMailboxes(db db.Querier) ([]Mailbox, error) {
+	stmt, err := db.FindStatement("mailboxActiveList")
+	if err != nil {
+		return []Mailbox{}, err
+	}
+
+	rows, err := stmt.Query()
+	if err != nil {
+		return []Mailbox{}, err
+	}
+	defer rows.Close()
+
+	return scanMailboxes(rows)
+}
+
+func GetMailboxByEmail(db db.Querier, email string) (Mailbox, error) {
+	var t Mailbox
+
+	stmt, err := db.FindStatement("mailboxFindByEmail")
+	if err != nil {
+		return t, err
+	}
+
+	err = t.scan(stmt.QueryRow(email))
+	return t, err
 }
 
-func GetMailboxById(db *db.Database, PK int64) (Mailbox, error) {
+func GetMailboxById(db db.Querier, PK int64) (Mailbox, error) {
 	var t Mailbox
 
 	stmt, err := db.FindStatement("mailboxFind")
@@ -241,15 +448,7 @@ func GetMailboxById(db *db.Database, PK int64) (Mailbox, error) {
 		return t, err
 	}
 
-	err = stmt.QueryRow(PK).Scan(
-		&t.Id,
-		&t.Domain,
-		&t.Email,
-		&t.Password,
-		&t.Active,
-		&t.Created,
-		&t.Modified,
-	)
+	err = t.scan(stmt.QueryRow(PK))
 	return t, err
 }
 
@@ -261,9 +460,37 @@ type Alias struct {
 	Created     time.Time
 	Modified    time.Time
 	Active      bool
+	Expires     sql.NullTime
+	Deleted     sql.NullTime
+}
+
+func (alias *Alias) scan(s scanner) error {
+	return s.Scan(
+		&alias.Id,
+		&alias.Domain,
+		&alias.Destination,
+		&alias.RedirectTo,
+		&alias.Active,
+		&alias.Expires,
+		&alias.Created,
+		&alias.Modified,
+		&alias.Deleted,
+	)
+}
+
+func scanAliases(rows *sql.Rows) ([]Alias, error) {
+	aliases := []Alias{}
+	for rows.Next() {
+		t := Alias{}
+		if err := t.scan(rows); err != nil {
+			return aliases, err
+		}
+		aliases = append(aliases, t)
+	}
+	return aliases, rows.Err()
 }
 
-func (alias *Alias) Create(db *db.Database) error {
+func (alias *Alias) Create(db db.Querier) error {
 	stmt, err := db.FindStatement("aliasCreate")
 	if err != nil {
 		return err
@@ -277,6 +504,7 @@ func (alias *Alias) Create(db *db.Database) error {
 		alias.Destination,
 		alias.RedirectTo,
 		alias.Active,
+		alias.expires(),
 		alias.Created,
 		alias.Modified,
 	)
@@ -292,12 +520,23 @@ func (alias *Alias) Create(db *db.Database) error {
 	return nil
 }
 
-func (alias *Alias) Update(db *db.Database) error {
+// Update stores the previous version of the alias in its history before
+// changing it.
+func (alias *Alias) Update(db db.Querier) error {
 	stmt, err := db.FindStatement("aliasUpdate")
 	if err != nil {
 		return err
 	}
 
+	if old, err := GetAliasById(db, alias.Id.Int64); err == nil {
+		err = saveRevision(db, RevisionAlias, alias.Id.Int64, old.Version(), alias.Version())
+		if err != nil {
+			return err
+		}
+	} else if err != sql.ErrNoRows {
+		return err
+	}
+
 	alias.Modified = time.Now()
 
 	_, err = stmt.Exec(
@@ -305,23 +544,82 @@ func (alias *Alias) Update(db *db.Database) error {
 		alias.Destination,
 		alias.RedirectTo,
 		alias.Active,
+		alias.expires(),
 		alias.Modified,
 		alias.Id,
 	)
 	return err
 }
 
-func (alias Alias) Delete(db *db.Database) error {
+// expires returns the expiry in UTC, the views compare it with
+// CURRENT_TIMESTAMP as text.
+func (alias *Alias) expires() sql.NullTime {
+	if !alias.Expires.Valid {
+		return alias.Expires
+	}
+	return sql.NullTime{Time: alias.Expires.Time.UTC(), Valid: true}
+}
+
+// Expired reports whether the expiry of the alias has passed.
+func (alias *Alias) Expired(now time.Time) bool {
+	return alias.Expires.Valid && !alias.Expires.Time.After(now)
+}
+
+// Countdown returns the time left before the alias expires, empty if
+// it never does.
+func (alias *Alias) Countdown() string {
+	if !alias.Expires.Valid {
+		return ""
+	}
+
+	left := time.Until(alias.Expires.Time)
+	plural := func(n int64, unit string) string {
+		if n == 1 {
+			return fmt.Sprintf("1 %s", unit)
+		}
+		return fmt.Sprintf("%d %ss", n, unit)
+	}
+	switch {
+	case left <= 0:
+		return "expired"
+	case left >= 48*time.Hour:
+		return plural(int64(left/(24*time.Hour)), "day")
+	case left >= 2*time.Hour:
+		return plural(int64(left/time.Hour), "hour")
+	default:
+		return plural(int64(left/time.Minute)+1, "minute")
+	}
+}
+
+// ExpireAliases moves to the trash the aliases expired at the given
+// time and returns how many they were.
+func ExpireAliases(db db.Querier, now time.Time) (int64, error) {
+	stmt, err := db.FindStatement("aliasExpire")
+	if err != nil {
+		return 0, err
+	}
+
+	result, err := stmt.Exec(now.UTC())
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// Delete moves the alias to the trash, see PurgeFromTrash to delete
+// it permanently.
+func (alias *Alias) Delete(db db.Querier) error {
 	stmt, err := db.FindStatement("aliasDelete")
 	if err != nil {
 		return err
 	}
 
-	_, err = stmt.Exec(alias.Id.Int64)
+	alias.Deleted = sql.NullTime{Time: time.Now(), Valid: true}
+	_, err = stmt.Exec(alias.Deleted, alias.Id.Int64)
 	return err
 }
 
-func GetAliasList(db *db.Database, domain_id int64) ([]Alias, error) {
+func GetAliasList(db db.Querier, domain_id int64) ([]Alias, error) {
 	aliases := []Alias{}
 
 	stmt, err := db.FindStatement("aliasList")
@@ -335,27 +633,70 @@ func GetAliasList(db *db.Database, domain_id int64) ([]Alias, error) {
 	}
 	defer rows.Close()
 
-	for rows.Next() {
-		t := Alias{}
-		err := rows.Scan(
-			&t.Id,
-			&t.Domain,
-			&t.Destination,
-			&t.RedirectTo,
-			&t.Active,
-			&t.Created,
-			&t.Modified,
-		)
-		if err != nil {
-			return aliases, err
-		}
+	return scanAliases(rows)
+}
 
-		aliases = append(aliases, t)
+// GetAliasPage returns the aliases matching the search of the pager
+// and sets its Total to the number of matches.
+func GetAliasPage(db db.Querier, domain_id int64, pager *Pager) ([]Alias, error) {
+	aliases := []Alias{}
+	pager.normalize("alias")
+
+	stmt, err := db.FindStatement("aliasCount")
+	if err != nil {
+		return aliases, err
 	}
-	return aliases, rows.Err()
+
+	err = stmt.QueryRow(domain_id, pager.pattern()).Scan(&pager.Total)
+	if err != nil {
+		return aliases, err
+	}
+
+	stmt, err = db.FindStatement(pager.statement("alias"))
+	if err != nil {
+		return aliases, err
+	}
+
+	rows, err := stmt.Query(domain_id, pager.pattern(), pager.PerPage, pager.offset())
+	if err != nil {
+		return aliases, err
+	}
+	defer rows.Close()
+
+	return scanAliases(rows)
 }
 
-func GetAliasById(db *db.Database, PK int64) (Alias, error) {
+// GetActiveAliases returns the active aliases of the active domains.
+func GetActiveAliases(db db.Querier) ([]Alias, error) {
+	stmt, err := db.FindStatement("aliasActiveList")
+	if err != nil {
+		return []Alias{}, err
+	}
+
+	rows, err := stmt.Query()
+	if err != nil {
+		return []Alias{}, err
+	}
+	defer rows.Close()
+
+	return scanAliases(rows)
+}
+
+// GetAliasByAddress returns the alias of the domain redirecting the
+// destination to redirectTo.
+func GetAliasByAddress(db db.Querier, domain_id int64, destination, redirectTo string) (Alias, error) {
+	t := Alias{}
+
+	stmt, err := db.FindStatement("aliasFindByAddress")
+	if err != nil {
+		return t, err
+	}
+
+	err = t.scan(stmt.QueryRow(domain_id, destination, redirectTo))
+	return t, err
+}
+
+func GetAliasById(db db.Querier, PK int64) (Alias, error) {
 	t := Alias{}
 
 	stmt, err := db.FindStatement("aliasFind")
@@ -363,42 +704,97 @@ func GetAliasById(db *db.Database, PK int64) (Alias, error) {
 		return t, err
 	}
 
-	err = stmt.QueryRow(PK).Scan(
-		&t.Id,
-		&t.Domain,
-		&t.Destination,
-		&t.RedirectTo,
-		&t.Active,
-		&t.Created,
-		&t.Modified,
-	)
+	err = t.scan(stmt.QueryRow(PK))
 	return t, err
 }
 
+// columns read by the scan method of each type
+const (
+	domainColumns  = `id, name, description, backupmx, transport, active, created, modified, deleted`
+	mailboxColumns = `id, domain_id, email, password, recovery, active, created, modified, deleted`
+	aliasColumns   = `id, domain_id, destination, redirect_to, active, expires, created, modified, deleted`
+)
+
+// prefixColumns qualifies the columns with the table alias, used in
+// the joins.
+func prefixColumns(alias, columns string) string {
+	names := strings.Split(columns, ", ")
+	for i := range names {
+		names[i] = alias + "." + names[i]
+	}
+	return strings.Join(names, ", ")
+}
+
 func PrepareStatements(db *db.Database) error {
+	// the records in the trash have the deleted column set and are
+	// hidden by all the statements except the ones in trash.go
 	stmts := map[string]string{
 		// domains
-		"domainList":   `SELECT id, name, description, backupmx, active, created, modified FROM domain ORDER BY name`,
-		"domainFind":   `SELECT id, name, description, backupmx, active, created, modified FROM domain WHERE id=$1`,
-		"domainCreate": `INSERT INTO domain(name, description, backupmx, active, created, modified) VALUES ($1, $2, $3, $4, $5, $6)`,
-		"domainUpdate": `UPDATE domain SET name=$1, description=$2, backupmx=$3, active=$4, modified=$5 WHERE id=$7`,
-		"domainDelete": `DELETE FROM domain WHERE id=$1`,
+		"domainList":       `SELECT ` + domainColumns + ` FROM domain WHERE deleted IS NULL ORDER BY name`,
+		"domainFind":       `SELECT ` + domainColumns + ` FROM domain WHERE id=$1 AND deleted IS NULL`,
+		"domainFindByName": `SELECT ` + domainColumns + ` FROM domain WHERE name=$1 AND deleted IS NULL`,
+		"domainCreate":     `INSERT INTO domain(name, description, backupmx, transport, active, created, modified) VALUES ($1, $2, $3, $4, $5, $6, $7)`,
+		"domainUpdate":     `UPDATE domain SET name=$1, description=$2, backupmx=$3, transport=$4, active=$5, modified=$6 WHERE id=$7`,
+		"domainDelete":     `UPDATE domain SET deleted=$1 WHERE id=$2`,
+
+		// the records already in the trash keep their own marker
+		"domainDeleteMailboxes": `UPDATE mailbox SET deleted=$1 WHERE domain_id=$2 AND deleted IS NULL`,
+		"domainDeleteAliases":   `UPDATE alias SET deleted=$1 WHERE domain_id=$2 AND deleted IS NULL`,
 
 		// mailboxes
-		"mailboxList":   `SELECT id, domain_id, email, password, active, created, modified FROM mailbox WHERE domain_id=$1 ORDER BY email`,
-		"mailboxFind":   `SELECT id, domain_id, email, password, active, created, modified FROM mailbox WHERE id=$1`,
-		"mailboxCreate": `INSERT INTO mailbox(domain_id, email, password, active, created, modified) VALUES ($1, $2, $3, $4, $5, $6)`,
-		"mailboxUpdate": `UPDATE mailbox SET domain_id=$1, email=$2, password=$3, active=$4, modified=$5 WHERE id=$6`,
-		"mailboxDelete": `DELETE FROM mailbox WHERE id=$1`,
+		"mailboxList":        `SELECT ` + mailboxColumns + ` FROM mailbox WHERE domain_id=$1 AND deleted IS NULL ORDER BY email`,
+		"mailboxFind":        `SELECT ` + mailboxColumns + ` FROM mailbox WHERE id=$1 AND deleted IS NULL`,
+		"mailboxMatches":     `SELECT ` + mailboxColumns + ` FROM mailbox WHERE domain_id=$1 AND deleted IS NULL AND LOWER(email) LIKE $2 ESCAPE '\' ORDER BY email`,
+		"mailboxFindByEmail": `SELECT ` + mailboxColumns + ` FROM mailbox WHERE email=$1 AND deleted IS NULL`,
+		"mailboxCreate":      `INSERT INTO mailbox(domain_id, email, password, recovery, active, created, modified) VALUES ($1, $2, $3, $4, $5, $6, $7)`,
+		"mailboxUpdate":      `UPDATE mailbox SET domain_id=$1, email=$2, password=$3, recovery=$4, active=$5, modified=$6 WHERE id=$7`,
+		"mailboxDelete":      `UPDATE mailbox SET deleted=$1 WHERE id=$2`,
 
 		// aliases
-		"aliasList":   `SELECT id, domain_id, destination, redirect_to, active, created, modified FROM alias WHERE domain_id=$1 ORDER BY destination, redirect_to`,
-		"aliasFind":   `SELECT id, domain_id, destination, redirect_to, active, created, modified FROM alias WHERE id=$1`,
-		"aliasCreate": `INSERT INTO alias(domain_id, destination, redirect_to, active, created, modified) VALUES ($1, $2, $3, $4, $5, $6)`,
-		"aliasUpdate": `UPDATE alias SET domain_id=$1, destination=$2, redirect_to=$3, active=$4, modified=$5 WHERE id=$6`,
-		"aliasDelete": `DELETE FROM alias WHERE id=$1`,
+		"aliasList":          `SELECT ` + aliasColumns + ` FROM alias WHERE domain_id=$1 AND deleted IS NULL ORDER BY destination, redirect_to`,
+		"aliasFind":          `SELECT ` + aliasColumns + ` FROM alias WHERE id=$1 AND deleted IS NULL`,
+		"aliasFindByAddress": `SELECT ` + aliasColumns + ` FROM alias WHERE domain_id=$1 AND destination=$2 AND redirect_to=$3 AND deleted IS NULL`,
+		"aliasCreate":        `INSERT INTO alias(domain_id, destination, redirect_to, active, expires, created, modified) VALUES ($1, $2, $3, $4, $5, $6, $7)`,
+		"aliasUpdate":        `UPDATE alias SET domain_id=$1, destination=$2, redirect_to=$3, active=$4, expires=$5, modified=$6 WHERE id=$7`,
+		"aliasDelete":        `UPDATE alias SET deleted=$1 WHERE id=$2`,
+		"aliasExpire":        `UPDATE alias SET deleted=$1 WHERE expires IS NOT NULL AND expires <= $1 AND deleted IS NULL`,
+
+		// active records used by the lookup tables
+		"domainActiveList":  `SELECT ` + domainColumns + ` FROM active_domain ORDER BY name`,
+		"mailboxActiveList": `SELECT ` + mailboxColumns + ` FROM active_mailbox ORDER BY email`,
+		"aliasActiveList":   `SELECT ` + aliasColumns + ` FROM active_alias ORDER BY destination, redirect_to`,
+
+		// search counters for the paginated lists
+		"domainCount":  `SELECT COUNT(*) FROM domain WHERE deleted IS NULL AND LOWER(name) LIKE $1 ESCAPE '\'`,
+		"mailboxCount": `SELECT COUNT(*) FROM mailbox WHERE domain_id=$1 AND deleted IS NULL AND LOWER(email) LIKE $2 ESCAPE '\'`,
+		"aliasCount":   `SELECT COUNT(*) FROM alias WHERE domain_id=$1 AND deleted IS NULL AND (LOWER(destination) LIKE $2 ESCAPE '\' OR LOWER(redirect_to) LIKE $2 ESCAPE '\')`,
+
+		// global search
+		"domainSearch":  `SELECT ` + domainColumns + ` FROM domain WHERE deleted IS NULL AND (LOWER(name) LIKE $1 ESCAPE '\' OR LOWER(description) LIKE $1 ESCAPE '\') ORDER BY name LIMIT $2`,
+		"mailboxSearch": `SELECT ` + prefixColumns("m", mailboxColumns) + ` FROM mailbox m JOIN domain d ON d.id=m.domain_id WHERE m.deleted IS NULL AND d.deleted IS NULL AND LOWER(m.email) LIKE $1 ESCAPE '\' ORDER BY m.email LIMIT $2`,
+		"aliasSearch":   `SELECT ` + prefixColumns("a", aliasColumns) + ` FROM alias a JOIN domain d ON d.id=a.domain_id WHERE a.deleted IS NULL AND d.deleted IS NULL AND (LOWER(a.destination) LIKE $1 ESCAPE '\' OR LOWER(a.redirect_to) LIKE $1 ESCAPE '\') ORDER BY a.destination, a.redirect_to LIMIT $2`,
 	}
 
+	// paginated lists, one statement for each sort order
+	pageStatements(stmts, "domain",
+		`SELECT `+domainColumns+` FROM domain WHERE deleted IS NULL AND LOWER(name) LIKE $1 ESCAPE '\' ORDER BY %s LIMIT $2 OFFSET $3`,
+		"name")
+	pageStatements(stmts, "mailbox",
+		`SELECT `+mailboxColumns+` FROM mailbox WHERE domain_id=$1 AND deleted IS NULL AND LOWER(email) LIKE $2 ESCAPE '\' ORDER BY %s LIMIT $3 OFFSET $4`,
+		"email")
+	pageStatements(stmts, "alias",
+		`SELECT `+aliasColumns+` FROM alias WHERE domain_id=$1 AND deleted IS NULL AND (LOWER(destination) LIKE $2 ESCAPE '\' OR LOWER(redirect_to) LIKE $2 ESCAPE '\') ORDER BY %s LIMIT $3 OFFSET $4`,
+		"destination, redirect_to")
+	trashStatements(stmts)
+	revisionStatements(stmts)
+	dkimStatements(stmts)
+	mtastsStatements(stmts)
+	sendCountStatements(stmts)
+	sendAsStatements(stmts)
+	bccStatements(stmts)
+	accessStatements(stmts)
+	resetStatements(stmts)
+
 	for key, sql := range stmts {
 		err := db.PrepareStatement(key, sql)
 		if err != nil {
@@ -408,6 +804,8 @@ func PrepareStatements(db *db.Database) error {
 	return nil
 }
 
+// CreateModel creates the last schema, see Migrate for the databases
+// created by the previous versions.
 func CreateModel(db *db.Database) error {
 	// domain table
 	_, err := db.Db.Exec(`
@@ -416,11 +814,13 @@ CREATE TABLE domain (
 	name VARCHAR(50) NOT NULL,
 	description TEXT NOT NULL DEFAULT '',
 	backupmx TINYINT(1) NOT NULL DEFAULT '0',
+	transport VARCHAR(255) NOT NULL DEFAULT '',
 	active TINYINT(1) NOT NULL DEFAULT '1',
 	created DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
 	modified DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
-	CONSTRAINT unique_name UNIQUE (name)
+	deleted DATETIME NULL DEFAULT NULL
 );
+CREATE UNIQUE INDEX unique_name ON domain(name) WHERE deleted IS NULL;
 `)
 	if err != nil {
 		return err
@@ -433,12 +833,15 @@ CREATE TABLE mailbox (
 	domain_id INTEGER NOT NULL,
 	email VARCHAR(100) NOT NULL,
 	password VARCHAR(256) NOT NULL,
+	recovery VARCHAR(255) NOT NULL DEFAULT '',
 	created DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
 	modified DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
 	active TINYINT(1) NOT NULL DEFAULT '1',
-	CONSTRAINT unique_email UNIQUE (email),
+	deleted DATETIME NULL DEFAULT NULL,
 	FOREIGN KEY (domain_id) REFERENCES domain(id) ON DELETE CASCADE
-);`)
+);
+CREATE UNIQUE INDEX unique_email ON mailbox(email) WHERE deleted IS NULL;
+`)
 	if err != nil {
 		return err
 	}
@@ -453,11 +856,176 @@ CREATE TABLE alias (
 	created DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
 	modified DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
 	active TINYINT(1) NOT NULL DEFAULT '1',
+	expires DATETIME NULL DEFAULT NULL,
+	deleted DATETIME NULL DEFAULT NULL,
 	FOREIGN KEY (domain_id) REFERENCES domain(id) ON DELETE CASCADE
 );`)
 	if err != nil {
 		return err
 	}
 
-	return nil
+	// previous versions of the mailboxes and aliases
+	_, err = db.Db.Exec(`
+CREATE TABLE revision (
+	id INTEGER PRIMARY KEY,
+	kind VARCHAR(20) NOT NULL,
+	record_id INTEGER NOT NULL,
+	data TEXT NOT NULL,
+	created DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX revision_record ON revision(kind, record_id);
+`)
+	if err != nil {
+		return err
+	}
+
+	// DKIM keys of the domains
+	_, err = db.Db.Exec(`
+CREATE TABLE dkim_key (
+	id INTEGER PRIMARY KEY,
+	domain_id INTEGER NOT NULL,
+	selector VARCHAR(63) NOT NULL,
+	algorithm VARCHAR(20) NOT NULL,
+	private_key TEXT NOT NULL,
+	public_key TEXT NOT NULL,
+	active TINYINT(1) NOT NULL DEFAULT '1',
+	signing TINYINT(1) NOT NULL DEFAULT '0',
+	created DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	UNIQUE(domain_id, selector),
+	FOREIGN KEY (domain_id) REFERENCES domain(id) ON DELETE CASCADE
+);`)
+	if err != nil {
+		return err
+	}
+
+	// MTA-STS policies of the domains
+	_, err = db.Db.Exec(`
+CREATE TABLE mta_sts (
+	domain_id INTEGER PRIMARY KEY,
+	mode VARCHAR(10) NOT NULL DEFAULT 'none',
+	mx TEXT NOT NULL DEFAULT '',
+	max_age INTEGER NOT NULL DEFAULT '604800',
+	report_uri VARCHAR(255) NOT NULL DEFAULT '',
+	modified DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	FOREIGN KEY (domain_id) REFERENCES domain(id) ON DELETE CASCADE
+);`)
+	if err != nil {
+		return err
+	}
+
+	// recipients of the mails sent by the mailboxes, start is the unix
+	// time of the beginning of the period
+	_, err = db.Db.Exec(`
+CREATE TABLE send_count (
+	mailbox_id INTEGER NOT NULL,
+	period VARCHAR(4) NOT NULL,
+	start BIGINT NOT NULL,
+	count INTEGER NOT NULL DEFAULT '0',
+	PRIMARY KEY (mailbox_id, period),
+	FOREIGN KEY (mailbox_id) REFERENCES mailbox(id) ON DELETE CASCADE
+);`)
+	if err != nil {
+		return err
+	}
+
+	// addresses the mailboxes may send as besides their own
+	_, err = db.Db.Exec(`
+CREATE TABLE send_as (
+	id INTEGER PRIMARY KEY,
+	mailbox_id INTEGER NOT NULL,
+	address VARCHAR(255) NOT NULL,
+	UNIQUE(mailbox_id, address),
+	FOREIGN KEY (mailbox_id) REFERENCES mailbox(id) ON DELETE CASCADE
+);`)
+	if err != nil {
+		return err
+	}
+
+	// BCC rules of the domains and of the mailboxes
+	_, err = db.Db.Exec(`
+CREATE TABLE bcc (
+	id INTEGER PRIMARY KEY,
+	domain_id INTEGER NOT NULL,
+	mailbox_id INTEGER NULL DEFAULT NULL,
+	kind VARCHAR(10) NOT NULL,
+	address VARCHAR(255) NOT NULL,
+	created DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	FOREIGN KEY (domain_id) REFERENCES domain(id) ON DELETE CASCADE,
+	FOREIGN KEY (mailbox_id) REFERENCES mailbox(id) ON DELETE CASCADE
+);`)
+	if err != nil {
+		return err
+	}
+
+	// access rules of the domains
+	_, err = db.Db.Exec(`
+CREATE TABLE access_rule (
+	id INTEGER PRIMARY KEY,
+	domain_id INTEGER NOT NULL,
+	kind VARCHAR(10) NOT NULL,
+	pattern VARCHAR(255) NOT NULL,
+	action VARCHAR(10) NOT NULL,
+	message VARCHAR(255) NOT NULL DEFAULT '',
+	created DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	UNIQUE(domain_id, kind, pattern),
+	FOREIGN KEY (domain_id) REFERENCES domain(id) ON DELETE CASCADE
+);`)
+	if err != nil {
+		return err
+	}
+
+	// password reset tokens of the mailboxes, only the hash is kept
+	_, err = db.Db.Exec(`
+CREATE TABLE reset_token (
+	id INTEGER PRIMARY KEY,
+	mailbox_id INTEGER NOT NULL,
+	hash VARCHAR(64) NOT NULL UNIQUE,
+	created DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	expires DATETIME NOT NULL,
+	used DATETIME NULL DEFAULT NULL,
+	FOREIGN KEY (mailbox_id) REFERENCES mailbox(id) ON DELETE CASCADE
+);`)
+	if err != nil {
+		return err
+	}
+
+	// views of the records postfix and dovecot must see: active, not
+	// in the trash and belonging to an active domain
+	_, err = db.Db.Exec(`
+CREATE VIEW active_domain AS
+	SELECT * FROM domain WHERE active AND deleted IS NULL;
+CREATE VIEW active_mailbox AS
+	SELECT m.* FROM mailbox m JOIN active_domain d ON d.id=m.domain_id
+	WHERE m.active AND m.deleted IS NULL;
+CREATE VIEW active_alias AS
+	SELECT a.* FROM alias a JOIN active_domain d ON d.id=a.domain_id
+	WHERE a.active AND a.deleted IS NULL
+	AND (a.expires IS NULL OR a.expires > CURRENT_TIMESTAMP);
+CREATE VIEW active_transport AS
+	SELECT name AS domain, transport FROM active_domain WHERE transport <> '';
+CREATE VIEW sender_bcc AS
+	SELECT '@' || d.name AS address, b.address AS bcc FROM bcc b JOIN active_domain d ON d.id=b.domain_id
+	WHERE b.kind='sender' AND b.mailbox_id IS NULL
+	UNION
+	SELECT m.email AS address, b.address AS bcc FROM bcc b JOIN active_mailbox m ON m.id=b.mailbox_id
+	WHERE b.kind='sender';
+CREATE VIEW recipient_bcc AS
+	SELECT '@' || d.name AS address, b.address AS bcc FROM bcc b JOIN active_domain d ON d.id=b.domain_id
+	WHERE b.kind='recipient' AND b.mailbox_id IS NULL
+	UNION
+	SELECT m.email AS address, b.address AS bcc FROM bcc b JOIN active_mailbox m ON m.id=b.mailbox_id
+	WHERE b.kind='recipient';
+CREATE VIEW recipient_access AS
+	SELECT r.pattern, CASE WHEN r.message <> '' AND r.action <> 'OK' THEN r.action || ' ' || r.message ELSE r.action END AS result
+	FROM access_rule r JOIN active_domain d ON d.id=r.domain_id WHERE r.kind='recipient';
+CREATE VIEW sender_login AS
+	SELECT email AS address, email AS login FROM active_mailbox
+	UNION
+	SELECT s.address, m.email AS login FROM send_as s JOIN active_mailbox m ON m.id=s.mailbox_id;
+`)
+	if err != nil {
+		return err
+	}
+
+	return db.SetSchemaVersion("types", len(migrations))
 }